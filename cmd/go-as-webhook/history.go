@@ -0,0 +1,175 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/yamatt/matrix-as-webhook/internal/args"
+	"github.com/yamatt/matrix-as-webhook/internal/config"
+	"github.com/yamatt/matrix-as-webhook/internal/history"
+	"github.com/yamatt/matrix-as-webhook/internal/server"
+)
+
+// runHistory queries the delivery history of a running server through the
+// admin API and prints it.
+func runHistory(rawArgs []string) error {
+	cliArgs, err := args.ParseHistory(rawArgs)
+	if err != nil {
+		return err
+	}
+	return queryHistory(cliArgs)
+}
+
+// runDeadLetterList lists the events whose last delivery to a route failed.
+func runDeadLetterList(rawArgs []string) error {
+	cliArgs, err := args.ParseDeadLetters("deadletter list", rawArgs)
+	if err != nil {
+		return err
+	}
+	var result struct {
+		DeadLetters []history.Record `json:"deadletters"`
+	}
+	if err := callAdmin(cliArgs, "GET", "/admin/v1/deadletters", 30*time.Second, &result); err != nil {
+		return err
+	}
+	return printRecords(cliArgs, result.DeadLetters)
+}
+
+// runDeadLetterReplay sends the selected dead letters to their routes again
+// and prints the outcome of each.
+func runDeadLetterReplay(rawArgs []string) error {
+	cliArgs, err := args.ParseDeadLetters("deadletter replay", rawArgs)
+	if err != nil {
+		return err
+	}
+	var result struct {
+		Replayed []server.ReplayResult `json:"replayed"`
+	}
+	// Each replay may wait for a slow receiver
+	if err := callAdmin(cliArgs, "POST", "/admin/v1/deadletters/replay", 10*time.Minute, &result); err != nil {
+		return err
+	}
+
+	if cliArgs.JSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(result.Replayed)
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "EVENT\tROUTE\tATTEMPT\tRESULT\tSTATUS\tERROR")
+	failed := 0
+	for _, r := range result.Replayed {
+		outcome, status := "skipped", "-"
+		switch {
+		case r.Success:
+			outcome = "delivered"
+		case r.Sent:
+			outcome = "failed"
+		}
+		if !r.Success {
+			failed++
+		}
+		if r.Status != 0 {
+			status = strconv.Itoa(r.Status)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%s\t%s\t%s\n", r.EventID, r.Route, r.Attempt, outcome, status, r.Error)
+	}
+	tw.Flush()
+	if failed > 0 {
+		return fmt.Errorf("%d of %d dead letters were not delivered", failed, len(result.Replayed))
+	}
+	return nil
+}
+
+// queryHistory queries the delivery history and prints it.
+func queryHistory(cliArgs args.HistoryArgs) error {
+	var result struct {
+		Deliveries []history.Record `json:"deliveries"`
+	}
+	if err := callAdmin(cliArgs, "GET", "/admin/v1/deliveries", 30*time.Second, &result); err != nil {
+		return err
+	}
+	return printRecords(cliArgs, result.Deliveries)
+}
+
+// callAdmin sends a request with the history filters to the admin API of a
+// running server and decodes the response into out.
+func callAdmin(cliArgs args.HistoryArgs, method, path string, timeout time.Duration, out interface{}) error {
+	token := cliArgs.AdminToken
+	if token == "" {
+		if cfg, err := config.Load(cliArgs.ConfigPath); err == nil {
+			token = cfg.Admin.Token.Value()
+		}
+	}
+	if token == "" {
+		return fmt.Errorf("no admin token: pass -admin-token or set [admin] token in %s", cliArgs.ConfigPath)
+	}
+
+	query := url.Values{}
+	for key, value := range map[string]string{
+		"event_id": cliArgs.EventID,
+		"room_id":  cliArgs.RoomID,
+		"route":    cliArgs.Route,
+		"status":   cliArgs.Status,
+		"since":    cliArgs.Since,
+		"until":    cliArgs.Until,
+	} {
+		if value != "" {
+			query.Set(key, value)
+		}
+	}
+	query.Set("limit", strconv.Itoa(cliArgs.Limit))
+
+	req, err := http.NewRequest(method, strings.TrimSuffix(cliArgs.Server, "/")+path+"?"+query.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := (&http.Client{Timeout: timeout}).Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("admin API returned %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	return json.Unmarshal(body, out)
+}
+
+// printRecords prints delivery records as JSON or a table.
+func printRecords(cliArgs args.HistoryArgs, records []history.Record) error {
+	if cliArgs.JSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(records)
+	}
+	printDeliveries(os.Stdout, records)
+	return nil
+}
+
+// printDeliveries writes deliveries as a table.
+func printDeliveries(w io.Writer, deliveries []history.Record) {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "TIME\tEVENT\tROUTE\tATTEMPT\tSTATUS\tLATENCY\tERROR")
+	for _, d := range deliveries {
+		status := "-"
+		if d.Status != 0 {
+			status = strconv.Itoa(d.Status)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%d\t%s\t%.0fms\t%s\n",
+			d.Time.Local().Format(time.DateTime), d.EventID, d.Route, d.Attempt, status, d.LatencyMS, d.Error)
+	}
+	tw.Flush()
+}
@@ -1,69 +1,253 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"net/http"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/yamatt/matrix-as-webhook/internal/args"
 	"github.com/yamatt/matrix-as-webhook/internal/config"
-	"github.com/yamatt/matrix-as-webhook/internal/registration"
+	"github.com/yamatt/matrix-as-webhook/internal/listen"
+	"github.com/yamatt/matrix-as-webhook/internal/logging"
 	"github.com/yamatt/matrix-as-webhook/internal/server"
+	"github.com/yamatt/matrix-as-webhook/internal/tracing"
 )
 
 func main() {
-	cliArgs, err := args.Parse(os.Args[1:])
-	if err != nil {
-		log.Fatalf("Failed to parse arguments: %v", err)
+	command, rawArgs, err := args.Split(os.Args[1:])
+	if err == nil {
+		err = run(command, rawArgs)
+	}
+	switch {
+	case args.IsHelp(err):
+	case err != nil:
+		fmt.Fprintln(os.Stderr, "error:", err)
+		os.Exit(1)
 	}
+}
 
-	// Handle generate-registration flag
-	if cliArgs.GenerateRegistration != "" {
-		if err := generateRegistrationFile(cliArgs); err != nil {
-			log.Fatalf("Failed to generate registration: %v", err)
+// run runs a subcommand. The command "" is the flag-only form of earlier
+// versions.
+func run(command string, rawArgs []string) error {
+	switch command {
+	case "":
+		cliArgs, err := args.Parse(rawArgs)
+		if err != nil {
+			return err
+		}
+		if cliArgs.GenerateRegistration != "" {
+			return runRegistrationGenerate(args.RegistrationArgs{
+				ConfigPath: cliArgs.ConfigPath,
+				File:       cliArgs.GenerateRegistration,
+				Server:     cliArgs.Server,
+				AsToken:    cliArgs.AsToken,
+			})
+		}
+		serve(cliArgs)
+	case "serve":
+		cliArgs, err := args.ParseServe(rawArgs)
+		if err != nil {
+			return err
+		}
+		serve(cliArgs)
+	case "validate":
+		return runValidate(rawArgs)
+	case "registration generate":
+		cliArgs, err := args.ParseRegistration(command, rawArgs)
+		if err != nil {
+			return err
 		}
-		return
+		return runRegistrationGenerate(cliArgs)
+	case "registration show":
+		return runRegistrationShow(rawArgs)
+	case "registration check":
+		return runRegistrationCheck(rawArgs)
+	case "route test":
+		return runRouteTest(rawArgs)
+	case "history":
+		return runHistory(rawArgs)
+	case "deadletter list":
+		return runDeadLetterList(rawArgs)
+	case "deadletter replay":
+		return runDeadLetterReplay(rawArgs)
+	case "version":
+		fmt.Println(args.Program, versionString())
+	case "help":
+		args.Usage(os.Stdout)
 	}
+	return nil
+}
 
+// serve runs the application service until SIGINT or SIGTERM.
+func serve(cliArgs args.Args) {
 	cfg, err := config.Load(cliArgs.ConfigPath)
+	configLoaded := err == nil
 	if err != nil {
-		log.Printf("Warning: Could not load config file: %v. Using defaults.", err)
-		cfg = config.NewDefault()
+		if !cliArgs.InsecureDev {
+			fatal("could not load config file; pass -insecure-dev to run on defaults", fmt.Errorf("%s: %w", cliArgs.ConfigPath, err))
+		}
+		slog.Warn("could not load config file, using defaults", "path", cliArgs.ConfigPath, "error", err)
+		if cfg, err = config.NewDefault(); err != nil {
+			fatal("could not resolve the tokens", err)
+		}
+	}
+	if err := logging.Setup(os.Stderr, cfg.Logging); err != nil {
+		fatal("invalid logging configuration", err)
+	}
+	if cfg.ASToken == "" && !cliArgs.InsecureDev {
+		fatal("no AS token configured; set AS_TOKEN, or pass -insecure-dev", errors.New("missing AS token"))
+	}
+	if cfg.HSToken == "" && !cliArgs.InsecureDev {
+		fatal("no HS token configured; set HS_TOKEN to the registration's hs_token, or pass -insecure-dev", errors.New("missing HS token"))
+	}
+	if cliArgs.InsecureDev {
+		insecureBanner(configLoaded, cfg.HSToken != "")
 	}
 
-	// print found config routes
 	for _, route := range cfg.Routes {
-		log.Printf("Loaded route: Name=%s", route.Name)
+		slog.Info("loaded route", logging.KeyRoute, route.Name)
+	}
+
+	shutdownTracing, err := tracing.Setup(context.Background(), cfg.Tracing)
+	if err != nil {
+		fatal("failed to set up tracing", err)
+	}
+	defer shutdownTracing(context.Background())
+	if cfg.Tracing.Exporter != "" {
+		slog.Info("tracing enabled", "exporter", cfg.Tracing.Exporter)
 	}
 
+	// The first SIGINT or SIGTERM starts a graceful shutdown; a second one
+	// kills the process.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
 	srv := server.NewAppServer(cfg)
+	srv.SetInsecureDev(cliArgs.InsecureDev)
+	if configLoaded {
+		srv.SetConfigPath(cliArgs.ConfigPath)
+	}
+	if err := srv.Start(ctx); err != nil {
+		fatal("failed to start", err)
+	}
 
-	addr := fmt.Sprintf(":%d", cliArgs.Port)
-	log.Printf("Starting Matrix Application Server on %s", addr)
+	serveErr := make(chan error, 3)
+	var httpServers []*http.Server
+	for _, e := range endpoints(cfg, cliArgs, srv) {
+		l, err := listen.Open(e.conf)
+		if err != nil {
+			fatal("failed to listen", fmt.Errorf("%s listener: %w", e.name, err))
+		}
+		httpServer := &http.Server{
+			Handler:      e.handler,
+			ReadTimeout:  cfg.Server.ReadTimeout,
+			WriteTimeout: cfg.Server.WriteTimeout,
+			IdleTimeout:  cfg.Server.IdleTimeout,
+		}
+		httpServers = append(httpServers, httpServer)
+		slog.Info("listening", "listener", e.name, "addr", l.Addr().String(), "tls", e.conf.CertFile != "")
+		go func() {
+			serveErr <- httpServer.Serve(l)
+		}()
+	}
+	slog.Info("started Matrix Application Server")
 
-	if err := http.ListenAndServe(addr, srv.Router()); err != nil {
-		log.Fatalf("Server failed to start: %v", err)
+	select {
+	case err := <-serveErr:
+		fatal("server failed", err)
+	case <-ctx.Done():
 	}
+	stop()
+
+	shutdown(srv, httpServers, cfg.Server.ShutdownTimeout)
 }
 
-// generateRegistrationFile creates and writes a registration file
-func generateRegistrationFile(cliArgs args.Args) error {
-	reg, err := registration.Generate(cliArgs.Server, cliArgs.AsToken)
-	if err != nil {
-		return err
+// endpoint is a listener and what it serves.
+type endpoint struct {
+	name    string
+	conf    config.ListenerConfig
+	handler http.Handler
+}
+
+// endpoints returns the listeners to open, the homeserver-facing one first.
+func endpoints(cfg *config.Config, cliArgs args.Args, srv *server.AppServer) []endpoint {
+	primary := config.ListenerConfig{Listen: cfg.Server.Listen, CertFile: cfg.Server.CertFile, KeyFile: cfg.Server.KeyFile}
+	if cliArgs.Listen != "" {
+		primary.Listen = cliArgs.Listen
+	}
+	if primary.Listen == "" {
+		primary.Listen = fmt.Sprintf(":%d", cliArgs.Port)
 	}
+	list := []endpoint{{"main", primary, srv.Router()}}
 
-	if err := reg.WriteToFile(cliArgs.GenerateRegistration); err != nil {
-		return err
+	switch {
+	case cfg.Server.Admin.Listen == "":
+	case cfg.Admin.Token == "":
+		slog.Warn("not opening the admin listener: the admin API is only served with an [admin] token")
+	default:
+		list = append(list, endpoint{"admin", cfg.Server.Admin, srv.AdminRouter()})
+	}
+	if cfg.Server.Metrics.Listen != "" {
+		list = append(list, endpoint{"metrics", cfg.Server.Metrics, srv.MetricsRouter()})
 	}
+	return list
+}
 
-	fmt.Printf("Registration file generated at: %s\n", cliArgs.GenerateRegistration)
-	fmt.Printf("Configuration:\n")
-	fmt.Printf("  - Server URL: %s\n", reg.Url)
-	fmt.Printf("  - AS Token: %s\n", reg.AsToken)
-	fmt.Printf("  - HS Token: %s\n", reg.HsToken)
-	// Namespaces are omitted unless configured separately
+// shutdown refuses new transactions, waits up to timeout for the ones in
+// flight to finish sending their webhooks and then closes the servers. The
+// homeserver-facing server comes first in httpServers.
+//
+// Nothing is persisted for transactions still in flight at the timeout:
+// their connections are closed without a response, so the homeserver, which
+// keeps every transaction until it is acknowledged, sends them again after
+// the restart.
+func shutdown(srv *server.AppServer, httpServers []*http.Server, timeout time.Duration) {
+	slog.Info("shutting down", "timeout", timeout, "in_flight", srv.InFlight())
+	srv.BeginShutdown()
 
-	return nil
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := httpServers[0].Shutdown(ctx); err != nil {
+		slog.Warn("transactions did not finish before the shutdown timeout", "in_flight", srv.InFlight(), "error", err)
+		// Close the connections so that a transaction finishing later is
+		// not acknowledged after all.
+		httpServers[0].Close()
+	} else {
+		slog.Info("drained in-flight transactions")
+	}
+	for _, httpServer := range httpServers[1:] {
+		if err := httpServer.Shutdown(ctx); err != nil {
+			httpServer.Close()
+		}
+	}
+	if err := srv.Close(); err != nil {
+		slog.Error("failed to close the delivery history", "error", err)
+	}
+}
+
+// fatal logs err and exits.
+func fatal(msg string, err error) {
+	slog.Error(msg, "error", err)
+	os.Exit(1)
+}
+
+// insecureBanner warns that the server runs in insecure development mode.
+func insecureBanner(configLoaded, hasToken bool) {
+	fmt.Fprintln(os.Stderr, strings.Repeat("!", 72))
+	fmt.Fprintln(os.Stderr, "!! INSECURE DEVELOPMENT MODE (-insecure-dev). Do not use in production.")
+	if !configLoaded {
+		fmt.Fprintln(os.Stderr, "!! The config file did not load: running on defaults with no routes.")
+	}
+	if !hasToken {
+		fmt.Fprintln(os.Stderr, "!! No HS token: anyone can send transactions to this server.")
+	}
+	fmt.Fprintln(os.Stderr, strings.Repeat("!", 72))
+	slog.Warn("running in insecure development mode", "config_loaded", configLoaded, "hs_token", hasToken)
 }
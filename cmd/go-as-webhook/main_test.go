@@ -0,0 +1,76 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/yamatt/matrix-as-webhook/internal/config"
+	"github.com/yamatt/matrix-as-webhook/internal/server"
+)
+
+// TestShutdownLeavesCutOffTransactionsUnacknowledged checks the shutdown
+// design: a transaction still sending its webhooks at the timeout is not
+// persisted but left unacknowledged, so that the homeserver sends it again.
+func TestShutdownLeavesCutOffTransactionsUnacknowledged(t *testing.T) {
+	received := make(chan struct{}, 1)
+	release := make(chan struct{})
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- struct{}{}
+		<-release
+	}))
+	defer receiver.Close()
+	defer close(release)
+
+	cfg, err := config.NewDefault()
+	if err != nil {
+		t.Fatalf("NewDefault failed: %v", err)
+	}
+	cfg.HSToken = "hs-token"
+	cfg.Egress.AllowCIDRs = []string{"127.0.0.0/8"}
+	cfg.Routes = []config.RouteConfig{{Name: "slow", Selector: "true", WebhookURL: receiver.URL}}
+	config.ApplyDefaults(cfg)
+	srv := server.NewAppServer(cfg)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	httpServer := &http.Server{Handler: srv.Router()}
+	go func() { _ = httpServer.Serve(l) }()
+
+	txn := `{"events": [{"type": "m.room.message", "event_id": "$cut", "room_id": "!room:example.org",
+		"sender": "@alice:example.org", "content": {"body": "hi"}}]}`
+	// The response status, or 0 if the connection closed without one
+	status := make(chan int, 1)
+	go func() {
+		req, _ := http.NewRequest("PUT", "http://"+l.Addr().String()+"/_matrix/app/v1/transactions/cut", strings.NewReader(txn))
+		req.Header.Set("Authorization", "Bearer hs-token")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			status <- 0
+			return
+		}
+		resp.Body.Close()
+		status <- resp.StatusCode
+	}()
+
+	select {
+	case <-received:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the webhook to be sent")
+	}
+	shutdown(srv, []*http.Server{httpServer}, 50*time.Millisecond)
+
+	select {
+	case code := <-status:
+		if code != 0 {
+			t.Errorf("Expected the cut-off transaction to get no response, got %d", code)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the connection to be closed at the shutdown timeout")
+	}
+}
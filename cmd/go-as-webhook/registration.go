@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+
+	"github.com/yamatt/matrix-as-webhook/internal/args"
+	"github.com/yamatt/matrix-as-webhook/internal/config"
+	"github.com/yamatt/matrix-as-webhook/internal/registration"
+	"gopkg.in/yaml.v3"
+)
+
+// runRegistrationGenerate creates and writes a registration file.
+func runRegistrationGenerate(cliArgs args.RegistrationArgs) error {
+	// Namespaces, the bot localpart and the AS token come from the config
+	// file when present
+	cfg, err := config.Load(cliArgs.ConfigPath)
+	if err != nil {
+		slog.Warn("could not load config file, namespaces will be empty", "path", cliArgs.ConfigPath, "error", err)
+		if cfg, err = config.NewDefault(); err != nil {
+			return err
+		}
+	}
+
+	asToken, err := config.ResolveSecret(cliArgs.AsToken)
+	if err != nil {
+		return err
+	}
+	if asToken == "" {
+		asToken = cfg.ASToken.Value()
+	}
+	reg, err := registration.Generate(cliArgs.Server, asToken, cfg.HSToken.Value())
+	if err != nil {
+		return err
+	}
+	reg.ApplyConfig(cfg)
+
+	if err := reg.WriteToFile(cliArgs.File); err != nil {
+		return err
+	}
+
+	fmt.Printf("Registration file generated at: %s\n", cliArgs.File)
+	fmt.Printf("Configuration:\n")
+	fmt.Printf("  - Server URL: %s\n", reg.Url)
+	// The tokens are only written to the registration file, never to stdout
+	fmt.Printf("  - AS Token: %s\n", config.Secret(reg.AsToken))
+	fmt.Printf("  - HS Token: %s\n", config.Secret(reg.HsToken))
+	fmt.Printf("  - Sender localpart: %s\n", reg.SenderLocalpart)
+	fmt.Printf("  - Namespaces: %d users, %d aliases, %d rooms\n",
+		len(reg.Namespaces.Users), len(reg.Namespaces.Aliases), len(reg.Namespaces.Rooms))
+	if cfg.HSToken == "" {
+		fmt.Printf("Set HS_TOKEN to the hs_token in %s before starting the server.\n", cliArgs.File)
+	}
+
+	return nil
+}
+
+// runRegistrationShow prints a registration file with its tokens masked.
+func runRegistrationShow(rawArgs []string) error {
+	cliArgs, err := args.ParseRegistration("registration show", rawArgs)
+	if err != nil {
+		return err
+	}
+	reg, err := registration.Load(cliArgs.File)
+	if err != nil {
+		return err
+	}
+	reg.AsToken = config.Secret(reg.AsToken).String()
+	reg.HsToken = config.Secret(reg.HsToken).String()
+
+	enc := yaml.NewEncoder(os.Stdout)
+	enc.SetIndent(2)
+	defer enc.Close()
+	return enc.Encode(reg)
+}
+
+// runRegistrationCheck reports where a registration file and the config
+// disagree.
+func runRegistrationCheck(rawArgs []string) error {
+	cliArgs, err := args.ParseRegistration("registration check", rawArgs)
+	if err != nil {
+		return err
+	}
+	reg, err := registration.Load(cliArgs.File)
+	if err != nil {
+		return err
+	}
+	cfg, err := config.Load(cliArgs.ConfigPath)
+	if err != nil {
+		return fmt.Errorf("%s: %w", cliArgs.ConfigPath, err)
+	}
+
+	problems := reg.Check(cfg)
+	for _, p := range problems {
+		fmt.Printf("%s: %s\n", cliArgs.File, p)
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("%s does not match %s", cliArgs.File, cliArgs.ConfigPath)
+	}
+	fmt.Printf("%s matches %s\n", cliArgs.File, cliArgs.ConfigPath)
+	return nil
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+
+	"github.com/yamatt/matrix-as-webhook/internal/args"
+	"github.com/yamatt/matrix-as-webhook/internal/config"
+	"github.com/yamatt/matrix-as-webhook/internal/server"
+)
+
+// runRouteTest runs an event through the routes of a config file, like the
+// admin API's dry run but without a running server, and prints the outcome.
+func runRouteTest(rawArgs []string) error {
+	cliArgs, err := args.ParseRouteTest(rawArgs)
+	if err != nil {
+		return err
+	}
+	cfg, err := config.Load(cliArgs.ConfigPath)
+	if err != nil {
+		return fmt.Errorf("%s: %w", cliArgs.ConfigPath, err)
+	}
+
+	in := os.Stdin
+	if cliArgs.EventFile != "-" {
+		f, err := os.Open(cliArgs.EventFile)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		in = f
+	}
+	var event server.MatrixEvent
+	if err := json.NewDecoder(in).Decode(&event); err != nil {
+		return fmt.Errorf("invalid event: %w", err)
+	}
+
+	result, err := server.NewAppServer(cfg).DryRun(context.Background(), event, cliArgs.Ephemeral)
+	if err != nil {
+		return err
+	}
+	if cliArgs.JSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(result)
+	}
+	printTestResult(os.Stdout, result)
+	return nil
+}
+
+// printTestResult writes the outcome of a dry run as a table.
+func printTestResult(w io.Writer, result server.TestResult) {
+	switch {
+	case result.Skipped != "":
+		fmt.Fprintln(w, "skipped:", result.Skipped)
+		return
+	case result.Denied != "":
+		fmt.Fprintln(w, "denied by the access policy:", result.Denied)
+		return
+	}
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ROUTE\tOUTCOME\tDETAIL")
+	for _, r := range result.Routes {
+		detail := r.Reason
+		if r.Error != "" {
+			detail = r.Error
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", r.Route, r.Outcome, detail)
+	}
+	tw.Flush()
+}
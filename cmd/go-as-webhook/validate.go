@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/yamatt/matrix-as-webhook/internal/args"
+	"github.com/yamatt/matrix-as-webhook/internal/config"
+	"github.com/yamatt/matrix-as-webhook/internal/inbound"
+	"github.com/yamatt/matrix-as-webhook/internal/logging"
+	"github.com/yamatt/matrix-as-webhook/internal/router"
+	"github.com/yamatt/matrix-as-webhook/internal/webhook"
+)
+
+// runValidate loads a config file and checks what the server would refuse
+// or fail on at startup, without starting it.
+func runValidate(rawArgs []string) error {
+	cliArgs, err := args.ParseValidate(rawArgs)
+	if err != nil {
+		return err
+	}
+	cfg, err := config.Load(cliArgs.ConfigPath)
+	if err != nil {
+		return fmt.Errorf("%s: %w", cliArgs.ConfigPath, err)
+	}
+
+	problems := validateConfig(cfg)
+	for _, p := range problems {
+		fmt.Printf("%s: %s\n", cliArgs.ConfigPath, p)
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("%s is not valid", cliArgs.ConfigPath)
+	}
+	fmt.Printf("%s is valid: %d routes, %d hooks\n", cliArgs.ConfigPath, len(cfg.Routes), len(cfg.Hooks))
+	return nil
+}
+
+// validateConfig returns the problems of a loaded config.
+func validateConfig(cfg *config.Config) []string {
+	var problems []string
+	if cfg.ASToken == "" {
+		problems = append(problems, "no AS token: set the AS_TOKEN environment variable")
+	}
+	if cfg.HSToken == "" {
+		problems = append(problems, "no HS token: set the HS_TOKEN environment variable to the registration's hs_token")
+	}
+	if err := logging.Setup(io.Discard, cfg.Logging); err != nil {
+		problems = append(problems, err.Error())
+	}
+
+	names := make(map[string]bool)
+	for _, rc := range cfg.Routes {
+		if names[rc.Name] {
+			problems = append(problems, fmt.Sprintf("route %q: the name is used by another route", rc.Name))
+		}
+		names[rc.Name] = true
+		if err := router.CheckSelector(rc.Selector); err != nil {
+			problems = append(problems, fmt.Sprintf("route %q: %v", rc.Name, err))
+		}
+	}
+
+	ids := make(map[string]bool)
+	for _, hc := range cfg.Hooks {
+		if ids[hc.ID] {
+			problems = append(problems, fmt.Sprintf("hook %s: the ID is used by another hook", hc.ID))
+		}
+		ids[hc.ID] = true
+		if _, err := inbound.NewHook(hc); err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+
+	for _, l := range []struct {
+		section string
+		conf    config.ListenerConfig
+	}{
+		{"[server]", config.ListenerConfig{Listen: cfg.Server.Listen, CertFile: cfg.Server.CertFile, KeyFile: cfg.Server.KeyFile}},
+		{"[server.admin]", cfg.Server.Admin},
+		{"[server.metrics]", cfg.Server.Metrics},
+	} {
+		if (l.conf.CertFile == "") != (l.conf.KeyFile == "") {
+			problems = append(problems, l.section+": cert_file and key_file must be set together")
+		}
+	}
+	if cfg.Egress.Proxy != "" {
+		if _, err := webhook.ParseProxy(cfg.Egress.Proxy); err != nil {
+			problems = append(problems, "[egress] "+err.Error())
+		}
+	}
+	if cfg.Server.Admin.Listen != "" && cfg.Admin.Token == "" {
+		problems = append(problems, "[server.admin] listen is set, but the admin API is only served with an [admin] token")
+	}
+	return problems
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"runtime"
+	"runtime/debug"
+	"strings"
+)
+
+// version is set at build time with -ldflags "-X main.version=v1.2.3". If
+// it is not, the module version and VCS revision Go recorded are used.
+var version string
+
+// versionString returns the version, the revision it was built from if
+// known, and the Go version.
+func versionString() string {
+	v, revision := version, ""
+	if info, ok := debug.ReadBuildInfo(); ok {
+		if v == "" {
+			v = info.Main.Version
+		}
+		for _, setting := range info.Settings {
+			if setting.Key == "vcs.revision" && len(setting.Value) >= 12 {
+				revision = setting.Value[:12]
+			}
+		}
+	}
+	if v == "" {
+		v = "(devel)"
+	}
+	if revision != "" && !strings.Contains(v, revision) {
+		v += " " + revision
+	}
+	return v + " " + runtime.Version()
+}
@@ -0,0 +1,331 @@
+// Package access decides which rooms and senders the appservice acts on.
+package access
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/yamatt/matrix-as-webhook/internal/config"
+	"github.com/yamatt/matrix-as-webhook/internal/logging"
+	"github.com/yamatt/matrix-as-webhook/internal/matrix"
+	"github.com/yamatt/matrix-as-webhook/internal/metrics"
+)
+
+const (
+	// aliasTTL is how long a room's aliases are cached.
+	aliasTTL = 5 * time.Minute
+	// aliasErrorTTL is how long a failed alias lookup is cached, so that a
+	// homeserver outage does not cost a request per event.
+	aliasErrorTTL = 30 * time.Second
+)
+
+// Reasons an event or invite is denied, used as counter keys.
+const (
+	ReasonRoomDenied       = "room_denied"
+	ReasonRoomNotAllowed   = "room_not_allowed"
+	ReasonSenderDenied     = "sender_denied"
+	ReasonSenderNotAllowed = "sender_not_allowed"
+	// ReasonAliasesUnknown denies rooms whose aliases could not be looked
+	// up while deny_aliases rules apply.
+	ReasonAliasesUnknown = "aliases_unknown"
+)
+
+// DeniedError is returned for events and invites the policy does not allow.
+type DeniedError struct {
+	Reason string
+	// Route is the route whose policy denied the event, or "" for the
+	// global policy.
+	Route string
+}
+
+func (e *DeniedError) Error() string {
+	if e.Route != "" {
+		return fmt.Sprintf("access: %s for route '%s'", e.Reason, e.Route)
+	}
+	return "access: " + e.Reason
+}
+
+// StateFetcher reads room state; *matrix.Client implements it.
+type StateFetcher interface {
+	GetStateEvent(ctx context.Context, roomID, eventType, stateKey string) (map[string]interface{}, error)
+}
+
+// rules is a compiled AccessConfig.
+type rules struct {
+	allowRooms, denyRooms     map[string]bool
+	allowAliases, denyAliases []*regexp.Regexp
+	allowSenders, denySenders []*regexp.Regexp
+	allowServers, denyServers map[string]bool
+}
+
+type cachedAliases struct {
+	aliases []string
+	err     error // the lookup failed
+	expires time.Time
+}
+
+// Policy applies the global access policy and the per-route policies.
+type Policy struct {
+	global    rules
+	routes    []rules // indexed like the configured routes
+	logDenied bool
+	autoJoin  bool
+	fetcher   StateFetcher
+	now       func() time.Time
+
+	mu      sync.Mutex
+	aliases map[string]cachedAliases
+	denied  map[string]uint64
+}
+
+// NewPolicy compiles the global and per-route policies of cfg. Invalid
+// patterns are logged and ignored.
+func NewPolicy(cfg *config.Config, fetcher StateFetcher) *Policy {
+	p := &Policy{
+		global:    compile(cfg.Access.AccessConfig),
+		logDenied: cfg.Access.LogDenied,
+		autoJoin:  cfg.Access.AutoJoin,
+		fetcher:   fetcher,
+		now:       time.Now,
+		aliases:   make(map[string]cachedAliases),
+		denied:    make(map[string]uint64),
+	}
+	for _, r := range cfg.Routes {
+		p.routes = append(p.routes, compile(r.Access))
+	}
+	return p
+}
+
+func compile(conf config.AccessConfig) rules {
+	return rules{
+		allowRooms:   set(conf.AllowRooms),
+		denyRooms:    set(conf.DenyRooms),
+		allowAliases: patterns(conf.AllowAliases),
+		denyAliases:  patterns(conf.DenyAliases),
+		allowSenders: patterns(conf.AllowSenders),
+		denySenders:  patterns(conf.DenySenders),
+		allowServers: set(conf.AllowServers),
+		denyServers:  set(conf.DenyServers),
+	}
+}
+
+func set(values []string) map[string]bool {
+	m := make(map[string]bool, len(values))
+	for _, v := range values {
+		m[v] = true
+	}
+	return m
+}
+
+// patterns compiles regexes anchored to the whole ID.
+func patterns(exprs []string) []*regexp.Regexp {
+	var out []*regexp.Regexp
+	for _, expr := range exprs {
+		re, err := regexp.Compile("^(?:" + expr + ")$")
+		if err != nil {
+			slog.Warn("ignoring invalid access pattern", "pattern", expr, "error", err)
+			continue
+		}
+		out = append(out, re)
+	}
+	return out
+}
+
+func (r *rules) usesAliases() bool {
+	return len(r.allowAliases) > 0 || len(r.denyAliases) > 0
+}
+
+// check returns the reason an event is denied, or "". An empty roomID or
+// sender skips the room or sender checks, for ephemeral events that have
+// only one of them.
+func (r *rules) check(roomID, sender string, aliases []string) string {
+	if roomID != "" {
+		if r.denyRooms[roomID] || matchAny(r.denyAliases, aliases...) {
+			return ReasonRoomDenied
+		}
+	}
+	if sender != "" {
+		if matchAny(r.denySenders, sender) || r.denyServers[serverName(sender)] {
+			return ReasonSenderDenied
+		}
+	}
+	if roomID != "" && (len(r.allowRooms) > 0 || len(r.allowAliases) > 0) {
+		if !r.allowRooms[roomID] && !matchAny(r.allowAliases, aliases...) {
+			return ReasonRoomNotAllowed
+		}
+	}
+	if sender != "" && (len(r.allowSenders) > 0 || len(r.allowServers) > 0) {
+		if !matchAny(r.allowSenders, sender) && !r.allowServers[serverName(sender)] {
+			return ReasonSenderNotAllowed
+		}
+	}
+	return ""
+}
+
+func matchAny(res []*regexp.Regexp, values ...string) bool {
+	for _, re := range res {
+		for _, v := range values {
+			if re.MatchString(v) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// serverName returns the server part of a user ID, including any port.
+func serverName(userID string) string {
+	_, server, _ := strings.Cut(userID, ":")
+	return server
+}
+
+// Check applies the global policy to an event sent by sender in roomID.
+func (p *Policy) Check(ctx context.Context, roomID, sender string) error {
+	return p.apply(ctx, &p.global, "", roomID, sender)
+}
+
+// CheckRoute applies the policy of the route at index i of the configured
+// routes.
+func (p *Policy) CheckRoute(ctx context.Context, i int, route, roomID, sender string) error {
+	if i < 0 || i >= len(p.routes) {
+		return nil
+	}
+	return p.apply(ctx, &p.routes[i], route, roomID, sender)
+}
+
+// CheckInvite applies the global policy to an invite of the bot. The bot is
+// not in the room yet, so the aliases come from the invite's stripped state.
+func (p *Policy) CheckInvite(ctx context.Context, roomID, inviter string, aliases []string) error {
+	return p.deny(ctx, p.global.check(roomID, inviter, aliases), "", roomID, inviter)
+}
+
+// AutoJoin reports whether allowed invites should be accepted.
+func (p *Policy) AutoJoin() bool {
+	return p.autoJoin
+}
+
+func (p *Policy) apply(ctx context.Context, r *rules, route, roomID, sender string) error {
+	var aliases []string
+	if roomID != "" && r.usesAliases() {
+		var err error
+		if aliases, err = p.roomAliases(ctx, roomID); err != nil && len(r.denyAliases) > 0 {
+			// The room might match a deny rule, so fail closed
+			return p.deny(ctx, ReasonAliasesUnknown, route, roomID, sender)
+		}
+	}
+	return p.deny(ctx, r.check(roomID, sender, aliases), route, roomID, sender)
+}
+
+type dryRunKey struct{}
+
+// DryRun returns a context whose denials are neither counted nor logged,
+// for trying out events.
+func DryRun(ctx context.Context) context.Context {
+	return context.WithValue(ctx, dryRunKey{}, true)
+}
+
+// deny counts and optionally logs a denial, returning nil if reason is "".
+func (p *Policy) deny(ctx context.Context, reason, route, roomID, sender string) error {
+	if reason == "" {
+		return nil
+	}
+	if ctx.Value(dryRunKey{}) != nil {
+		return &DeniedError{Reason: reason, Route: route}
+	}
+	p.mu.Lock()
+	p.denied[reason]++
+	p.mu.Unlock()
+	metrics.AccessDenied.WithLabelValues(reason).Inc()
+
+	err := &DeniedError{Reason: reason, Route: route}
+	if p.logDenied {
+		logging.FromContext(ctx).Info("access denied", logging.KeyRoomID, roomID, "sender", sender, logging.KeyRoute, route, "reason", reason)
+	}
+	return err
+}
+
+// Denied returns how many events and invites were denied, by reason.
+func (p *Policy) Denied() map[string]uint64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	out := make(map[string]uint64, len(p.denied))
+	for reason, n := range p.denied {
+		out[reason] = n
+	}
+	return out
+}
+
+// Observe updates the alias cache from an m.room.canonical_alias state
+// event seen in a transaction.
+func (p *Policy) Observe(roomID, eventType string, content map[string]interface{}) {
+	if eventType != "m.room.canonical_alias" {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.aliases[roomID] = cachedAliases{aliases: aliasesOf(content), expires: p.now().Add(aliasTTL)}
+}
+
+// roomAliases returns the canonical and alternative aliases of a room.
+// Lookup errors are logged and cached for aliasErrorTTL; the room then has
+// no aliases, so it matches no allow_aliases rule.
+func (p *Policy) roomAliases(ctx context.Context, roomID string) ([]string, error) {
+	p.mu.Lock()
+	cached, ok := p.aliases[roomID]
+	p.mu.Unlock()
+	if ok && p.now().Before(cached.expires) {
+		return cached.aliases, cached.err
+	}
+
+	content, err := p.fetcher.GetStateEvent(ctx, roomID, "m.room.canonical_alias", "")
+	var mErr *matrix.Error
+	if errors.As(err, &mErr) && mErr.ErrCode == "M_NOT_FOUND" {
+		content, err = nil, nil
+	}
+	if err != nil {
+		logging.FromContext(ctx).Warn("error fetching room aliases", logging.KeyRoomID, roomID, "error", err)
+		p.mu.Lock()
+		p.aliases[roomID] = cachedAliases{err: err, expires: p.now().Add(aliasErrorTTL)}
+		p.mu.Unlock()
+		return nil, err
+	}
+	p.Observe(roomID, "m.room.canonical_alias", content)
+	return aliasesOf(content), nil
+}
+
+// aliasesOf returns the aliases in m.room.canonical_alias content.
+func aliasesOf(content map[string]interface{}) []string {
+	var aliases []string
+	if alias, ok := content["alias"].(string); ok && alias != "" {
+		aliases = append(aliases, alias)
+	}
+	if alt, ok := content["alt_aliases"].([]interface{}); ok {
+		for _, a := range alt {
+			if alias, ok := a.(string); ok {
+				aliases = append(aliases, alias)
+			}
+		}
+	}
+	return aliases
+}
+
+// InviteAliases returns the aliases in the stripped state of an invite's
+// unsigned.invite_room_state.
+func InviteAliases(unsigned map[string]interface{}) []string {
+	state, _ := unsigned["invite_room_state"].([]interface{})
+	for _, s := range state {
+		ev, ok := s.(map[string]interface{})
+		if !ok || ev["type"] != "m.room.canonical_alias" {
+			continue
+		}
+		content, _ := ev["content"].(map[string]interface{})
+		return aliasesOf(content)
+	}
+	return nil
+}
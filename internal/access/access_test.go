@@ -0,0 +1,205 @@
+package access
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/yamatt/matrix-as-webhook/internal/config"
+	"github.com/yamatt/matrix-as-webhook/internal/matrix"
+)
+
+// fakeFetcher serves m.room.canonical_alias content by room and counts
+// lookups. A non-nil err fails every lookup.
+type fakeFetcher struct {
+	aliases map[string]map[string]interface{}
+	err     error
+	calls   int
+}
+
+func (f *fakeFetcher) GetStateEvent(_ context.Context, roomID, eventType, _ string) (map[string]interface{}, error) {
+	f.calls++
+	if f.err != nil {
+		return nil, f.err
+	}
+	content, ok := f.aliases[roomID]
+	if !ok || eventType != "m.room.canonical_alias" {
+		return nil, &matrix.Error{StatusCode: http.StatusNotFound, ErrCode: "M_NOT_FOUND"}
+	}
+	return content, nil
+}
+
+func reason(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.(*DeniedError).Reason
+}
+
+func TestCheck(t *testing.T) {
+	fetcher := &fakeFetcher{aliases: map[string]map[string]interface{}{
+		"!ops:example.org":   {"alias": "#ops-alerts:example.org"},
+		"!other:example.org": {"alias": "#random:example.org", "alt_aliases": []interface{}{"#ops-old:example.org"}},
+	}}
+	cfg := &config.Config{Access: config.GlobalAccessConfig{AccessConfig: config.AccessConfig{
+		AllowRooms:   []string{"!direct:example.org"},
+		AllowAliases: []string{`#ops-.*:example\.org`},
+		DenyRooms:    []string{"!other:example.org"},
+		AllowServers: []string{"example.org"},
+		DenySenders:  []string{`@spam.*:example\.org`},
+	}}}
+	p := NewPolicy(cfg, fetcher)
+	ctx := context.Background()
+
+	tests := []struct {
+		room, sender, want string
+	}{
+		{"!ops:example.org", "@alice:example.org", ""},
+		{"!direct:example.org", "@alice:example.org", ""},
+		{"!other:example.org", "@alice:example.org", ReasonRoomDenied},
+		{"!unknown:example.org", "@alice:example.org", ReasonRoomNotAllowed},
+		{"!ops:example.org", "@spammer:example.org", ReasonSenderDenied},
+		{"!ops:example.org", "@alice:evil.org", ReasonSenderNotAllowed},
+		// Presence has no room, typing and receipts no sender.
+		{"", "@alice:example.org", ""},
+		{"!ops:example.org", "", ""},
+	}
+	for _, tt := range tests {
+		if got := reason(p.Check(ctx, tt.room, tt.sender)); got != tt.want {
+			t.Errorf("Check(%s, %s): expected %q, got %q", tt.room, tt.sender, tt.want, got)
+		}
+	}
+
+	denied := p.Denied()
+	if denied[ReasonRoomDenied] != 1 || denied[ReasonRoomNotAllowed] != 1 || denied[ReasonSenderDenied] != 1 || denied[ReasonSenderNotAllowed] != 1 {
+		t.Errorf("Unexpected denied counts: %v", denied)
+	}
+	if fetcher.calls != 4 {
+		t.Errorf("Expected aliases to be fetched once per room, got %d lookups", fetcher.calls)
+	}
+}
+
+func TestCheckDenyAliasWins(t *testing.T) {
+	fetcher := &fakeFetcher{aliases: map[string]map[string]interface{}{
+		"!room:example.org": {"alias": "#ops-private:example.org"},
+	}}
+	cfg := &config.Config{Access: config.GlobalAccessConfig{AccessConfig: config.AccessConfig{
+		AllowRooms:  []string{"!room:example.org"},
+		DenyAliases: []string{`#.*-private:.*`},
+	}}}
+	p := NewPolicy(cfg, fetcher)
+
+	if got := reason(p.Check(context.Background(), "!room:example.org", "@alice:example.org")); got != ReasonRoomDenied {
+		t.Errorf("Expected %q, got %q", ReasonRoomDenied, got)
+	}
+}
+
+func TestCheckObservedAliases(t *testing.T) {
+	fetcher := &fakeFetcher{}
+	cfg := &config.Config{Access: config.GlobalAccessConfig{AccessConfig: config.AccessConfig{
+		AllowAliases: []string{`#ops:example\.org`},
+	}}}
+	p := NewPolicy(cfg, fetcher)
+	p.Observe("!room:example.org", "m.room.canonical_alias", map[string]interface{}{"alias": "#ops:example.org"})
+
+	if err := p.Check(context.Background(), "!room:example.org", "@alice:example.org"); err != nil {
+		t.Errorf("Expected observed alias to be allowed, got %v", err)
+	}
+	if fetcher.calls != 0 {
+		t.Errorf("Expected no lookups, got %d", fetcher.calls)
+	}
+}
+
+func TestCheckAliasLookupFails(t *testing.T) {
+	fetcher := &fakeFetcher{err: errors.New("connection refused")}
+	cfg := &config.Config{Access: config.GlobalAccessConfig{AccessConfig: config.AccessConfig{
+		AllowRooms:  []string{"!room:example.org"},
+		DenyAliases: []string{"#.*-private:example\\.org"},
+	}}}
+	p := NewPolicy(cfg, fetcher)
+	now := time.Now()
+	p.now = func() time.Time { return now }
+
+	// The room might be private, so it is denied rather than let through
+	if got := reason(p.Check(context.Background(), "!room:example.org", "@alice:example.org")); got != ReasonAliasesUnknown {
+		t.Errorf("Expected %q when the aliases cannot be looked up, got %q", ReasonAliasesUnknown, got)
+	}
+	_ = p.Check(context.Background(), "!room:example.org", "@alice:example.org")
+	if fetcher.calls != 1 {
+		t.Errorf("Expected the failed lookup to be cached, got %d lookups", fetcher.calls)
+	}
+
+	fetcher.err = nil
+	now = now.Add(aliasErrorTTL + time.Second)
+	if err := p.Check(context.Background(), "!room:example.org", "@alice:example.org"); err != nil {
+		t.Errorf("Expected the room to be allowed once its aliases are known, got %v", err)
+	}
+	if fetcher.calls != 2 {
+		t.Errorf("Expected a new lookup after the error expired, got %d lookups", fetcher.calls)
+	}
+
+	// Without deny_aliases, a failed lookup only means no alias matches
+	fetcher.err = errors.New("connection refused")
+	p = NewPolicy(&config.Config{Access: config.GlobalAccessConfig{AccessConfig: config.AccessConfig{
+		AllowRooms:   []string{"!room:example.org"},
+		AllowAliases: []string{"#ops:example\\.org"},
+	}}}, fetcher)
+	if err := p.Check(context.Background(), "!room:example.org", "@alice:example.org"); err != nil {
+		t.Errorf("Expected an allowed room ID to be allowed, got %v", err)
+	}
+}
+
+func TestCheckRoute(t *testing.T) {
+	cfg := &config.Config{Routes: []config.RouteConfig{
+		{Name: "open"},
+		{Name: "ops", Access: config.AccessConfig{AllowRooms: []string{"!ops:example.org"}}},
+	}}
+	p := NewPolicy(cfg, &fakeFetcher{})
+	ctx := context.Background()
+
+	if err := p.CheckRoute(ctx, 0, "open", "!room:example.org", "@alice:example.org"); err != nil {
+		t.Errorf("Expected route without policy to allow, got %v", err)
+	}
+	err := p.CheckRoute(ctx, 1, "ops", "!room:example.org", "@alice:example.org")
+	if err == nil || err.Error() != "access: room_not_allowed for route 'ops'" {
+		t.Errorf("Expected route policy to deny, got %v", err)
+	}
+	if err := p.CheckRoute(ctx, 1, "ops", "!ops:example.org", "@alice:example.org"); err != nil {
+		t.Errorf("Expected allowed room, got %v", err)
+	}
+}
+
+func TestCheckInvite(t *testing.T) {
+	cfg := &config.Config{Access: config.GlobalAccessConfig{AccessConfig: config.AccessConfig{
+		AllowAliases: []string{`#ops:example\.org`},
+	}}}
+	p := NewPolicy(cfg, &fakeFetcher{})
+
+	unsigned := map[string]interface{}{"invite_room_state": []interface{}{
+		map[string]interface{}{"type": "m.room.name", "content": map[string]interface{}{"name": "Ops"}},
+		map[string]interface{}{"type": "m.room.canonical_alias", "content": map[string]interface{}{"alias": "#ops:example.org"}},
+	}}
+	if err := p.CheckInvite(context.Background(), "!room:example.org", "@alice:example.org", InviteAliases(unsigned)); err != nil {
+		t.Errorf("Expected invite to be allowed, got %v", err)
+	}
+	if got := reason(p.CheckInvite(context.Background(), "!room:example.org", "@alice:example.org", nil)); got != ReasonRoomNotAllowed {
+		t.Errorf("Expected %q without aliases, got %q", ReasonRoomNotAllowed, got)
+	}
+}
+
+func TestDryRunNotCounted(t *testing.T) {
+	cfg := &config.Config{Access: config.GlobalAccessConfig{AccessConfig: config.AccessConfig{
+		DenyRooms: []string{"!denied:example.org"},
+	}}}
+	p := NewPolicy(cfg, &fakeFetcher{})
+
+	err := p.Check(DryRun(context.Background()), "!denied:example.org", "@alice:example.org")
+	if reason(err) != ReasonRoomDenied {
+		t.Errorf("Expected %s in a dry run, got %v", ReasonRoomDenied, err)
+	}
+	if denied := p.Denied(); len(denied) != 0 {
+		t.Errorf("Expected dry runs not to be counted, got %v", denied)
+	}
+}
@@ -1,9 +1,129 @@
 package args
 
 import (
+	"errors"
 	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
 )
 
+// Program is the name the usage messages give the binary.
+const Program = "as-webhook"
+
+// EnvPrefix starts the environment variables flags can be set with: a flag
+// such as -admin-token is read from MAS_ADMIN_TOKEN. Flags on the command
+// line take precedence.
+const EnvPrefix = "MAS_"
+
+// Command is a subcommand.
+type Command struct {
+	Name    string
+	Summary string
+}
+
+// Commands lists the subcommands in the order the usage shows them.
+var Commands = []Command{
+	{"serve", "Run the application service (the default)"},
+	{"validate", "Check a config file without starting the server"},
+	{"registration generate", "Write a registration file for the homeserver"},
+	{"registration show", "Print a registration file with its tokens hidden"},
+	{"registration check", "Check a registration file against the config"},
+	{"route test", "Show what the routes would do with an event, without sending it"},
+	{"history", "Query the delivery history of a running server"},
+	{"deadletter list", "List failed deliveries of a running server"},
+	{"deadletter replay", "Send failed deliveries of a running server again"},
+	{"version", "Print the version"},
+	{"help", "Show this help"},
+}
+
+// Split separates the subcommand at the start of rawArgs from the
+// arguments following it. Without a subcommand, as in the flag-only form of
+// earlier versions, the command is "" and all arguments are returned.
+func Split(rawArgs []string) (string, []string, error) {
+	if len(rawArgs) == 0 {
+		return "", rawArgs, nil
+	}
+	first := rawArgs[0]
+	var subcommands []string
+	for _, c := range Commands {
+		if c.Name == first {
+			return first, rawArgs[1:], nil
+		}
+		if group, sub, ok := strings.Cut(c.Name, " "); ok && group == first {
+			if len(rawArgs) > 1 && rawArgs[1] == sub {
+				return c.Name, rawArgs[2:], nil
+			}
+			subcommands = append(subcommands, sub)
+		}
+	}
+	if len(subcommands) > 0 {
+		return "", nil, fmt.Errorf("%s needs a subcommand: %s", first, strings.Join(subcommands, ", "))
+	}
+	return "", rawArgs, nil
+}
+
+// Usage writes the list of subcommands.
+func Usage(w io.Writer) {
+	fmt.Fprintf(w, "Usage: %s <command> [flags]\n\nCommands:\n", Program)
+	for _, c := range Commands {
+		fmt.Fprintf(w, "  %-23s %s\n", c.Name, c.Summary)
+	}
+	fmt.Fprintf(w, "\nRun %s <command> -h for the flags of a command. Every flag can also be set\n", Program)
+	fmt.Fprintf(w, "with an environment variable: %sCONFIG for -config, %sADMIN_TOKEN for -admin-token.\n", EnvPrefix, EnvPrefix)
+	fmt.Fprintf(w, "Without a command, %s serves, accepting the flags of earlier versions.\n", Program)
+}
+
+// EnvName returns the environment variable a flag can be set with.
+func EnvName(flagName string) string {
+	return EnvPrefix + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+// newFlagSet returns a flag set for a command.
+func newFlagSet(command string) *flag.FlagSet {
+	return flag.NewFlagSet(Program+" "+command, flag.ContinueOnError)
+}
+
+// parse sets the flags of fs from their environment variables, then
+// parses rawArgs over them.
+func parse(fs *flag.FlagSet, rawArgs []string) error {
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		name := EnvName(f.Name)
+		value, ok := os.LookupEnv(name)
+		if !ok || err != nil {
+			return
+		}
+		if setErr := fs.Set(f.Name, value); setErr != nil {
+			err = fmt.Errorf("invalid value %q for %s: %w", value, name, setErr)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return fs.Parse(rawArgs)
+}
+
+// parseWithConfig is parse for commands that take the config file as an
+// optional positional argument, before or after the flags.
+func parseWithConfig(fs *flag.FlagSet, rawArgs []string, configPath *string) error {
+	if err := parse(fs, rawArgs); err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		return nil
+	}
+	*configPath = fs.Arg(0)
+	if err := fs.Parse(fs.Args()[1:]); err != nil {
+		return err
+	}
+	if fs.NArg() > 0 {
+		return fmt.Errorf("unexpected arguments: %s", strings.Join(fs.Args(), " "))
+	}
+	return nil
+}
+
 // Args represents parsed command-line arguments.
 type Args struct {
 	ConfigPath           string
@@ -11,22 +131,205 @@ type Args struct {
 	GenerateRegistration string
 	Server               string
 	AsToken              string
+	// Listen overrides [server] listen
+	Listen string
+	// InsecureDev runs on defaults when the config does not load and without
+	// an AS token, instead of refusing to start
+	InsecureDev bool
+}
+
+// serveFlags defines the flags of the serve command.
+func serveFlags(fs *flag.FlagSet, parsed *Args) {
+	fs.StringVar(&parsed.ConfigPath, "config", "config.toml", "Path to configuration file")
+	fs.IntVar(&parsed.Port, "port", 8080, "Port to listen on when no listen address is set")
+	fs.StringVar(&parsed.Listen, "listen", "", "Address to listen on: host:port, unix:/path/to.sock or systemd (default: [server] listen)")
+	fs.BoolVar(&parsed.InsecureDev, "insecure-dev", false, "Start without a config file or AS token; for local development only")
 }
 
-// Parse parses the provided arguments slice.
+// Parse parses the arguments of the flag-only form of earlier versions,
+// where -generate-registration writes a registration file instead of
+// serving.
 func Parse(rawArgs []string) (Args, error) {
-	fs := flag.NewFlagSet("matrix-as-webhook", flag.ContinueOnError)
+	fs := newFlagSet("")
+	fs.Usage = func() {
+		Usage(fs.Output())
+		fmt.Fprintln(fs.Output(), "\nFlags:")
+		fs.PrintDefaults()
+	}
 
 	var parsed Args
-	fs.StringVar(&parsed.ConfigPath, "config", "config.toml", "Path to configuration file")
-	fs.IntVar(&parsed.Port, "port", 8080, "Port to listen on")
+	serveFlags(fs, &parsed)
 	fs.StringVar(&parsed.GenerateRegistration, "generate-registration", "", "Generate registration.yaml file at this path and exit")
 	fs.StringVar(&parsed.Server, "server", "http://localhost:8080", "Server address (e.g., http://localhost:8080 or https://app.example.com)")
 	fs.StringVar(&parsed.AsToken, "as-token", "", "Application Service token for registration (if empty, generated)")
 
-	if err := fs.Parse(rawArgs); err != nil {
+	if err := parseWithConfig(fs, rawArgs, &parsed.ConfigPath); err != nil {
+		return Args{}, err
+	}
+
+	return parsed, nil
+}
+
+// ParseServe parses the arguments following "serve".
+func ParseServe(rawArgs []string) (Args, error) {
+	fs := newFlagSet("serve")
+
+	var parsed Args
+	serveFlags(fs, &parsed)
+
+	if err := parseWithConfig(fs, rawArgs, &parsed.ConfigPath); err != nil {
 		return Args{}, err
 	}
 
 	return parsed, nil
 }
+
+// ValidateArgs represents the arguments of the validate subcommand.
+type ValidateArgs struct {
+	ConfigPath string
+}
+
+// ParseValidate parses the arguments following "validate".
+func ParseValidate(rawArgs []string) (ValidateArgs, error) {
+	fs := newFlagSet("validate")
+
+	var parsed ValidateArgs
+	fs.StringVar(&parsed.ConfigPath, "config", "config.toml", "Path to configuration file")
+
+	if err := parseWithConfig(fs, rawArgs, &parsed.ConfigPath); err != nil {
+		return ValidateArgs{}, err
+	}
+
+	return parsed, nil
+}
+
+// RegistrationArgs represents the arguments of the registration
+// subcommands.
+type RegistrationArgs struct {
+	ConfigPath string
+	File       string
+	Server     string
+	AsToken    string
+}
+
+// ParseRegistration parses the arguments following "registration generate",
+// "registration show" or "registration check".
+func ParseRegistration(command string, rawArgs []string) (RegistrationArgs, error) {
+	fs := newFlagSet(command)
+
+	var parsed RegistrationArgs
+	fs.StringVar(&parsed.File, "file", "registration.yaml", "Path of the registration file")
+	if command != "registration show" {
+		fs.StringVar(&parsed.ConfigPath, "config", "config.toml", "Path to configuration file")
+	}
+	if command == "registration generate" {
+		fs.StringVar(&parsed.Server, "server", "http://localhost:8080", "URL the homeserver reaches this server on")
+		fs.StringVar(&parsed.AsToken, "as-token", "", "Application Service token (if empty, generated). Accepts a secret reference")
+	}
+
+	if err := parse(fs, rawArgs); err != nil {
+		return RegistrationArgs{}, err
+	}
+	if fs.NArg() > 0 {
+		return RegistrationArgs{}, fmt.Errorf("unexpected arguments: %s", strings.Join(fs.Args(), " "))
+	}
+
+	return parsed, nil
+}
+
+// RouteTestArgs represents the arguments of the route test subcommand.
+type RouteTestArgs struct {
+	ConfigPath string
+	// EventFile holds the event as JSON; "-" reads it from stdin
+	EventFile string
+	Ephemeral bool
+	JSON      bool
+}
+
+// ParseRouteTest parses the arguments following "route test".
+func ParseRouteTest(rawArgs []string) (RouteTestArgs, error) {
+	fs := newFlagSet("route test")
+
+	var parsed RouteTestArgs
+	fs.StringVar(&parsed.ConfigPath, "config", "config.toml", "Path to configuration file")
+	fs.StringVar(&parsed.EventFile, "event", "-", "File with the Matrix event as JSON, or - for stdin")
+	fs.BoolVar(&parsed.Ephemeral, "ephemeral", false, "Route the event as a receipt, typing or presence event")
+	fs.BoolVar(&parsed.JSON, "json", false, "Print the outcome as JSON, with the payloads")
+
+	if err := parse(fs, rawArgs); err != nil {
+		return RouteTestArgs{}, err
+	}
+	if fs.NArg() > 0 {
+		return RouteTestArgs{}, fmt.Errorf("unexpected arguments: %s", strings.Join(fs.Args(), " "))
+	}
+
+	return parsed, nil
+}
+
+// HistoryArgs represents the arguments of the history subcommand.
+type HistoryArgs struct {
+	ConfigPath string
+	Server     string
+	AdminToken string
+	EventID    string
+	RoomID     string
+	Route      string
+	Status     string
+	Since      string
+	Until      string
+	Limit      int
+	JSON       bool
+}
+
+// historyFlags defines the flags of the commands that query the delivery
+// history, with -status if withStatus is set.
+func historyFlags(fs *flag.FlagSet, parsed *HistoryArgs, withStatus bool) {
+	fs.StringVar(&parsed.ConfigPath, "config", "config.toml", "Path to configuration file, read for the admin token")
+	fs.StringVar(&parsed.Server, "server", "http://localhost:8080", "Address of the running server")
+	fs.StringVar(&parsed.AdminToken, "admin-token", "", "Admin API token (default: [admin] token from the config)")
+	fs.StringVar(&parsed.EventID, "event-id", "", "Only show deliveries of this event")
+	fs.StringVar(&parsed.RoomID, "room", "", "Only show deliveries of events in this room")
+	fs.StringVar(&parsed.Route, "route", "", "Only show deliveries to this route")
+	if withStatus {
+		fs.StringVar(&parsed.Status, "status", "", "Only show deliveries with this outcome: success, failure, a status code or a class such as 5xx")
+	}
+	fs.StringVar(&parsed.Since, "since", "", "Only show deliveries after this time (RFC 3339, or a duration ago such as 1h)")
+	fs.StringVar(&parsed.Until, "until", "", "Only show deliveries before this time (RFC 3339, or a duration ago such as 1h)")
+	fs.IntVar(&parsed.Limit, "limit", 100, "Maximum number of deliveries shown")
+	fs.BoolVar(&parsed.JSON, "json", false, "Print the deliveries as JSON")
+}
+
+// ParseHistory parses the arguments following "history".
+func ParseHistory(rawArgs []string) (HistoryArgs, error) {
+	fs := newFlagSet("history")
+
+	var parsed HistoryArgs
+	historyFlags(fs, &parsed, true)
+
+	if err := parse(fs, rawArgs); err != nil {
+		return HistoryArgs{}, err
+	}
+
+	return parsed, nil
+}
+
+// ParseDeadLetters parses the arguments following "deadletter list" or
+// "deadletter replay". They select failed deliveries from the history.
+func ParseDeadLetters(command string, rawArgs []string) (HistoryArgs, error) {
+	fs := newFlagSet(command)
+
+	var parsed HistoryArgs
+	historyFlags(fs, &parsed, false)
+
+	if err := parse(fs, rawArgs); err != nil {
+		return HistoryArgs{}, err
+	}
+	parsed.Status = "failure"
+
+	return parsed, nil
+}
+
+// IsHelp reports whether err is the result of asking for a command's help.
+func IsHelp(err error) bool {
+	return errors.Is(err, flag.ErrHelp)
+}
@@ -27,10 +27,25 @@ func TestParseDefaults(t *testing.T) {
 	if parsed.AsToken != "" {
 		t.Errorf("expected empty AsToken, got %q", parsed.AsToken)
 	}
+
+	if parsed.InsecureDev {
+		t.Error("expected strict mode by default")
+	}
+}
+
+func TestParseInsecureDev(t *testing.T) {
+	parsed, err := Parse([]string{"-insecure-dev"})
+	if err != nil {
+		t.Fatalf("Parse returned error: %v", err)
+	}
+
+	if !parsed.InsecureDev {
+		t.Error("expected InsecureDev to be set")
+	}
 }
 
 func TestParseOverride(t *testing.T) {
-	parsed, err := Parse([]string{"-config", "custom.json", "-port", "9000"})
+	parsed, err := Parse([]string{"-config", "custom.json", "-port", "9000", "-listen", "unix:/run/as.sock"})
 	if err != nil {
 		t.Fatalf("Parse returned error: %v", err)
 	}
@@ -42,6 +57,10 @@ func TestParseOverride(t *testing.T) {
 	if parsed.Port != 9000 {
 		t.Errorf("expected port 9000, got %d", parsed.Port)
 	}
+
+	if parsed.Listen != "unix:/run/as.sock" {
+		t.Errorf("expected listen 'unix:/run/as.sock', got %q", parsed.Listen)
+	}
 }
 
 func TestParseGenerateRegistration(t *testing.T) {
@@ -111,3 +130,111 @@ func TestParseAllGenerationFlags(t *testing.T) {
 		t.Errorf("expected ConfigPath 'config.toml', got %q", parsed.ConfigPath)
 	}
 }
+
+func TestParseHistory(t *testing.T) {
+	parsed, err := ParseHistory([]string{"-event-id", "$abc", "-status", "5xx", "-since", "1h", "-json"})
+	if err != nil {
+		t.Fatalf("ParseHistory returned error: %v", err)
+	}
+
+	if parsed.EventID != "$abc" || parsed.Status != "5xx" || parsed.Since != "1h" || !parsed.JSON {
+		t.Errorf("expected the filter flags to be set, got %+v", parsed)
+	}
+
+	if parsed.Server != "http://localhost:8080" || parsed.Limit != 100 {
+		t.Errorf("expected default server and limit, got %q and %d", parsed.Server, parsed.Limit)
+	}
+}
+
+func TestSplit(t *testing.T) {
+	tests := []struct {
+		rawArgs []string
+		command string
+		rest    int
+	}{
+		{nil, "", 0},
+		{[]string{"-port", "9000"}, "", 2},
+		{[]string{"config.toml"}, "", 1},
+		{[]string{"serve", "-port", "9000"}, "serve", 2},
+		{[]string{"registration", "check", "-file", "r.yaml"}, "registration check", 2},
+		{[]string{"route", "test"}, "route test", 0},
+	}
+	for _, tt := range tests {
+		command, rest, err := Split(tt.rawArgs)
+		if err != nil {
+			t.Fatalf("Split(%v) returned error: %v", tt.rawArgs, err)
+		}
+		if command != tt.command || len(rest) != tt.rest {
+			t.Errorf("expected %q with %d arguments for %v, got %q with %v", tt.command, tt.rest, tt.rawArgs, command, rest)
+		}
+	}
+
+	if _, _, err := Split([]string{"deadletter", "purge"}); err == nil {
+		t.Error("expected an error for an unknown subcommand")
+	}
+}
+
+func TestParsePositionalConfig(t *testing.T) {
+	parsed, err := Parse([]string{"custom.toml", "-port", "9000"})
+	if err != nil {
+		t.Fatalf("Parse returned error: %v", err)
+	}
+
+	if parsed.ConfigPath != "custom.toml" || parsed.Port != 9000 {
+		t.Errorf("expected config custom.toml on port 9000, got %q on %d", parsed.ConfigPath, parsed.Port)
+	}
+
+	if _, err := ParseServe([]string{"a.toml", "b.toml"}); err == nil {
+		t.Error("expected an error for two config files")
+	}
+}
+
+func TestParseEnv(t *testing.T) {
+	t.Setenv("MAS_CONFIG", "/etc/as-webhook/config.toml")
+	t.Setenv("MAS_PORT", "9000")
+	t.Setenv("MAS_INSECURE_DEV", "true")
+
+	parsed, err := ParseServe([]string{"-port", "9100"})
+	if err != nil {
+		t.Fatalf("ParseServe returned error: %v", err)
+	}
+
+	if parsed.ConfigPath != "/etc/as-webhook/config.toml" || !parsed.InsecureDev {
+		t.Errorf("expected the config path and insecure mode from the environment, got %+v", parsed)
+	}
+
+	if parsed.Port != 9100 {
+		t.Errorf("expected the -port flag to override MAS_PORT, got %d", parsed.Port)
+	}
+
+	t.Setenv("MAS_PORT", "http")
+	if _, err := ParseServe(nil); err == nil {
+		t.Error("expected an error for an invalid MAS_PORT")
+	}
+}
+
+func TestParseRegistration(t *testing.T) {
+	parsed, err := ParseRegistration("registration generate", []string{"-file", "out.yaml", "-server", "https://as.example.org"})
+	if err != nil {
+		t.Fatalf("ParseRegistration returned error: %v", err)
+	}
+
+	if parsed.File != "out.yaml" || parsed.Server != "https://as.example.org" || parsed.ConfigPath != "config.toml" {
+		t.Errorf("expected the generate flags to be set, got %+v", parsed)
+	}
+
+	if _, err := ParseRegistration("registration show", []string{"-server", "https://as.example.org"}); err == nil {
+		t.Error("expected show to have no -server flag")
+	}
+}
+
+func TestParseDeadLetters(t *testing.T) {
+	parsed, err := ParseDeadLetters("deadletter list", []string{"-route", "alerts"})
+	if err != nil {
+		t.Fatalf("ParseDeadLetters returned error: %v", err)
+	}
+
+	if parsed.Route != "alerts" || parsed.Status != "failure" {
+		t.Errorf("expected failed deliveries to alerts, got %+v", parsed)
+	}
+}
@@ -1,23 +1,255 @@
 package config
 
 import (
+	"errors"
+	"fmt"
+	"net/url"
 	"os"
+	"time"
 
 	"github.com/BurntSushi/toml"
 )
 
-const defaultHTTPMethod = "POST"
+const (
+	defaultHTTPMethod      = "POST"
+	defaultSenderLocalpart = "webhook"
+	defaultHookMsgType     = "m.notice"
+	defaultHookFormat      = "generic"
+	defaultRoomPreset      = "public_chat"
+	defaultMediaMode       = "none"
+	defaultMediaMaxBytes   = 10 * 1024 * 1024
+	defaultMediaProxyTTL   = 15 * time.Minute
+	defaultCryptoStorePath = "crypto-store.json"
+	defaultDeviceName      = "matrix-as-webhook"
+	defaultSigning         = "legacy"
+	defaultAPIKeyHeader    = "X-API-Key"
+	defaultServiceName     = "matrix-as-webhook"
+	defaultSampleRatio     = 1.0
+	defaultLogLevel        = "info"
+	defaultLogFormat       = "text"
+	defaultHistoryEntries  = 10000
+	defaultHistoryMaxAge   = 7 * 24 * time.Hour
+	defaultReadTimeout     = 30 * time.Second
+	defaultWriteTimeout    = 2 * time.Minute
+	defaultIdleTimeout     = 2 * time.Minute
+	defaultShutdownTimeout = 25 * time.Second
+)
+
+// DefaultMaxRedirects is how many redirects a webhook request follows when
+// [egress] max_redirects is not set.
+const DefaultMaxRedirects = 3
 
 // Config represents the application configuration.
 type Config struct {
-	// ASToken is the Application Service token from the AS_TOKEN environment variable
-	ASToken string
-	Routes  []RouteConfig `toml:"routes"`
+	// ASToken is the Application Service token from the AS_TOKEN environment
+	// variable, which may itself be a secret reference. It cannot be set in
+	// the config file.
+	ASToken Secret `toml:"-"`
+	// HSToken is the token the homeserver authenticates its requests with,
+	// the hs_token of the registration file, from the HS_TOKEN environment
+	// variable. It cannot be set in the config file either.
+	HSToken     Secret             `toml:"-"`
+	Server      ServerConfig       `toml:"server"`
+	Homeserver  HomeserverConfig   `toml:"homeserver"`
+	Namespaces  NamespacesConfig   `toml:"namespaces"`
+	Ghosts      []GhostConfig      `toml:"ghosts"`
+	RoomAliases []RoomAliasConfig  `toml:"room_aliases"`
+	Routes      []RouteConfig      `toml:"routes"`
+	Hooks       []HookConfig       `toml:"hooks"`
+	Enrichment  EnrichmentConfig   `toml:"enrichment"`
+	Media       MediaConfig        `toml:"media"`
+	Encryption  EncryptionConfig   `toml:"encryption"`
+	Signing     SigningConfig      `toml:"signing"`
+	Egress      EgressConfig       `toml:"egress"`
+	Access      GlobalAccessConfig `toml:"access"`
+	Tracing     TracingConfig      `toml:"tracing"`
+	Logging     LoggingConfig      `toml:"logging"`
+	History     HistoryConfig      `toml:"history"`
+	Admin       AdminConfig        `toml:"admin"`
+}
+
+// ServerConfig controls the HTTP server.
+type ServerConfig struct {
+	// Listen is where the homeserver-facing server listens: host:port,
+	// unix:/path/to.sock, or systemd or systemd:name for a socket passed by
+	// systemd (default: all interfaces on -port)
+	Listen string `toml:"listen,omitempty"`
+	// CertFile and KeyFile are a PEM certificate and key to serve HTTPS
+	// with; they are reloaded when the files change
+	CertFile string `toml:"cert_file,omitempty"`
+	KeyFile  string `toml:"key_file,omitempty"`
+	// Admin and Metrics move the admin API and /metrics to their own
+	// listeners; they are served on the main one if their listen is empty
+	Admin   ListenerConfig `toml:"admin"`
+	Metrics ListenerConfig `toml:"metrics"`
+	// ReadTimeout bounds reading a request, including its body (default: 30s)
+	ReadTimeout time.Duration `toml:"read_timeout,omitempty"`
+	// WriteTimeout bounds handling a request and writing the response.
+	// Transactions are answered once their webhooks are sent, so it must
+	// allow for the slowest routes (default: 2m)
+	WriteTimeout time.Duration `toml:"write_timeout,omitempty"`
+	// IdleTimeout is how long a keep-alive connection waits for the next request (default: 2m)
+	IdleTimeout time.Duration `toml:"idle_timeout,omitempty"`
+	// ShutdownTimeout is how long requests in flight may finish after
+	// SIGINT or SIGTERM (default: 25s)
+	ShutdownTimeout time.Duration `toml:"shutdown_timeout,omitempty"`
+}
+
+// ListenerConfig is an extra listener. Listen, CertFile and KeyFile work
+// like those of ServerConfig.
+type ListenerConfig struct {
+	Listen   string `toml:"listen,omitempty"`
+	CertFile string `toml:"cert_file,omitempty"`
+	KeyFile  string `toml:"key_file,omitempty"`
+}
+
+// HistoryConfig controls the record of webhook delivery attempts.
+type HistoryConfig struct {
+	// Path is a JSON Lines file the history is kept in across restarts;
+	// empty keeps it in memory only
+	Path string `toml:"path,omitempty"`
+	// MaxEntries is how many attempts are kept; -1 disables the history (default: 10000)
+	MaxEntries int `toml:"max_entries,omitempty"`
+	// MaxAge is how long attempts are kept (default: 168h)
+	MaxAge time.Duration `toml:"max_age,omitempty"`
+}
+
+// AdminConfig protects the admin API under /admin/v1.
+type AdminConfig struct {
+	// Token must be sent as a bearer token; the admin API is disabled without one
+	Token Secret `toml:"token,omitempty"`
+}
+
+// LoggingConfig controls the structured log output.
+type LoggingConfig struct {
+	// Level is debug, info, warn or error (default: info)
+	Level string `toml:"level,omitempty"`
+	// Format is text or json (default: text)
+	Format string `toml:"format,omitempty"`
+	// LogContent logs message bodies at debug level instead of redacting
+	// them; they may contain private conversations (default: false)
+	LogContent bool `toml:"log_content,omitempty"`
+}
+
+// TracingConfig configures OpenTelemetry tracing of transactions, routing
+// and webhook deliveries.
+type TracingConfig struct {
+	// Exporter is otlp-http, otlp-grpc or stdout; empty disables tracing
+	Exporter string `toml:"exporter,omitempty"`
+	// Endpoint is the collector URL (default: the OTEL_EXPORTER_OTLP_* variables
+	// or the exporter's default, e.g. http://localhost:4318)
+	Endpoint string `toml:"endpoint,omitempty"`
+	// Insecure sends spans without TLS
+	Insecure bool `toml:"insecure,omitempty"`
+	// Headers are sent with every export request, e.g. an API key
+	Headers map[string]Secret `toml:"headers,omitempty"`
+	// ServiceName is the service.name resource attribute (default: matrix-as-webhook)
+	ServiceName string `toml:"service_name,omitempty"`
+	// SampleRatio is the fraction of new traces recorded; incoming sampled
+	// traces are always recorded (default: 1)
+	SampleRatio float64 `toml:"sample_ratio,omitempty"`
+}
+
+// GlobalAccessConfig is the access policy applied to every event before
+// routing and to invites of the bot.
+type GlobalAccessConfig struct {
+	AccessConfig
+	// LogDenied logs every event and invite the policy denies (default: false)
+	LogDenied bool `toml:"log_denied,omitempty"`
+	// AutoJoin makes the bot accept invites to rooms the policy allows;
+	// invites to denied rooms are rejected either way (default: false)
+	AutoJoin bool `toml:"auto_join,omitempty"`
+}
+
+// AccessConfig lists the rooms and senders events are accepted from. Deny
+// entries win over allow entries. Once a room or sender allow list is set,
+// anything it does not match is denied. Patterns are regular expressions
+// matched against the whole ID.
+type AccessConfig struct {
+	// AllowRooms and DenyRooms are room IDs (e.g. !abc:example.org)
+	AllowRooms []string `toml:"allow_rooms,omitempty"`
+	DenyRooms  []string `toml:"deny_rooms,omitempty"`
+	// AllowAliases and DenyAliases are patterns for the room's canonical and
+	// alternative aliases (e.g. #ops-.*:example\.org)
+	AllowAliases []string `toml:"allow_aliases,omitempty"`
+	DenyAliases  []string `toml:"deny_aliases,omitempty"`
+	// AllowSenders and DenySenders are patterns for the sender's user ID
+	AllowSenders []string `toml:"allow_senders,omitempty"`
+	DenySenders  []string `toml:"deny_senders,omitempty"`
+	// AllowServers and DenyServers are server names from the sender's user ID
+	AllowServers []string `toml:"allow_servers,omitempty"`
+	DenyServers  []string `toml:"deny_servers,omitempty"`
+}
+
+// EgressConfig restricts the addresses webhooks are sent to. Loopback,
+// private, link-local and cloud metadata addresses are blocked unless
+// allowed here.
+type EgressConfig struct {
+	// AllowCIDRs are address ranges allowed even if they would be blocked (e.g. 10.1.0.0/16)
+	AllowCIDRs []string `toml:"allow_cidrs,omitempty"`
+	// AllowHosts are host names allowed whatever they resolve to; a leading
+	// "*." matches subdomains (e.g. *.svc.cluster.local)
+	AllowHosts []string `toml:"allow_hosts,omitempty"`
+	// MaxRedirects is how many redirects a webhook request follows (default: 3)
+	MaxRedirects int `toml:"max_redirects,omitempty"`
+	// Proxy is an http or https URL webhooks are sent through. The
+	// environment's HTTP_PROXY and HTTPS_PROXY are not used.
+	Proxy string `toml:"proxy,omitempty"`
+}
+
+// SigningConfig holds the asymmetric keys routes with signing = "http-signature"
+// or "jws" sign with. Every key is published on the JWKS endpoint.
+type SigningConfig struct {
+	// Keys lists the signing keys; keep the old key listed while receivers
+	// pick up a new one
+	Keys []SigningKeyConfig `toml:"keys"`
+	// ActiveKey is the ID of the key that signs requests (default: the first key)
+	ActiveKey string `toml:"active_key,omitempty"`
+}
+
+// SigningKeyConfig is a single asymmetric signing key.
+type SigningKeyConfig struct {
+	// ID is the key ID sent with signatures (default: the key's RFC 7638 thumbprint)
+	ID string `toml:"id,omitempty"`
+	// PrivateKeyFile is a PEM-encoded PKCS#8 Ed25519 or ECDSA P-256 private key
+	PrivateKeyFile string `toml:"private_key_file"`
+}
+
+// EncryptionConfig controls end-to-end encryption support for the bot user.
+type EncryptionConfig struct {
+	// Enabled creates a device for the bot, decrypts Megolm events before
+	// routing and encrypts messages sent into encrypted rooms
+	Enabled bool `toml:"enabled"`
+	// StorePath is the file crypto keys and sessions are persisted to (default: crypto-store.json)
+	StorePath string `toml:"store_path,omitempty"`
+	// PickleKey encrypts the store at rest when set
+	PickleKey Secret `toml:"pickle_key,omitempty"`
+	// DeviceDisplayName is the display name of the bot's device (default: matrix-as-webhook)
+	DeviceDisplayName string `toml:"device_display_name,omitempty"`
+}
+
+// EnrichmentConfig controls adding room and sender context to routed events.
+type EnrichmentConfig struct {
+	// Enabled adds a "context" object to routed events and webhook payloads
+	Enabled bool `toml:"enabled"`
+	// TTL is how long fetched room state is cached (default: 5m)
+	TTL time.Duration `toml:"ttl,omitempty"`
+}
+
+// HomeserverConfig describes how to reach the homeserver's Client-Server API.
+type HomeserverConfig struct {
+	// URL is the base URL of the homeserver (e.g. https://matrix.example.org)
+	URL string `toml:"url"`
+	// Domain is the server name used in user IDs (e.g. example.org)
+	Domain string `toml:"domain"`
+	// SenderLocalpart is the localpart of the appservice bot user (default: webhook)
+	SenderLocalpart string `toml:"sender_localpart,omitempty"`
 }
 
 // RouteConfig defines a routing rule for messages.
 type RouteConfig struct {
-	// Optional human-friendly route name.
+	// Optional human-friendly route name (default: route-N, N being the
+	// route's position counting from 1).
 	Name string `toml:"name"`
 	// Selector is a CEL expression evaluated against the event JSON as `event`.
 	// Should return a boolean indicating whether this route matches.
@@ -32,7 +264,149 @@ type RouteConfig struct {
 	SendBody *bool `toml:"send_body,omitempty"`
 	// SharedSecret is used to sign webhook requests with HMAC-SHA256 (optional)
 	// The signature is sent in the X-Webhook-Signature header
-	SharedSecret string `toml:"shared_secret,omitempty"`
+	SharedSecret Secret `toml:"shared_secret,omitempty"`
+	// Signing selects how requests are signed: legacy signs the body with
+	// SharedSecret, standard follows the Standard Webhooks spec, http-signature
+	// (RFC 9421) and jws use the keys in [signing] (default: legacy)
+	Signing string `toml:"signing,omitempty"`
+	// SigningSecrets are the "whsec_" base64 secrets for standard signing. Each
+	// adds a signature, so old and new secrets can overlap during rotation.
+	SigningSecrets []Secret `toml:"signing_secrets,omitempty"`
+	// Auth holds the credentials presented to the receiver (optional)
+	Auth AuthConfig `toml:"auth,omitempty"`
+	// TLS configures client certificates and trusted CAs for the receiver (optional)
+	TLS TLSConfig `toml:"tls,omitempty"`
+	// Media controls how attachments of m.image/m.file/m.audio/m.video messages
+	// are forwarded: none, base64, multipart or proxy (default: none)
+	Media string `toml:"media,omitempty"`
+	// MediaMaxBytes is the largest attachment forwarded (default: 10 MiB)
+	MediaMaxBytes int64 `toml:"media_max_bytes,omitempty"`
+	// MediaMimeTypes restricts forwarded attachments to these MIME types; a
+	// trailing /* matches a whole family (e.g. image/*). Empty allows all.
+	MediaMimeTypes []string `toml:"media_mime_types,omitempty"`
+	// Ephemeral makes the route match ephemeral events (m.receipt, m.typing,
+	// m.presence) instead of room messages (default: false)
+	Ephemeral bool `toml:"ephemeral,omitempty"`
+	// Access restricts the route to some rooms and senders, on top of the
+	// global [access] policy (optional)
+	Access AccessConfig `toml:"access,omitempty"`
+}
+
+// AuthConfig describes how a route authenticates to its receiver.
+type AuthConfig struct {
+	// Type is bearer, basic, api_key or oauth2; empty sends no credentials
+	Type string `toml:"type"`
+	// Token is the static token sent as "Authorization: Bearer" (bearer)
+	Token Secret `toml:"token,omitempty"`
+	// Username and Password are sent with HTTP basic auth (basic)
+	Username string `toml:"username,omitempty"`
+	Password Secret `toml:"password,omitempty"`
+	// Header carries Key for api_key (default: X-API-Key)
+	Header string `toml:"header,omitempty"`
+	Key    Secret `toml:"key,omitempty"`
+	// TokenURL, ClientID and ClientSecret configure the OAuth2 client
+	// credentials grant; the access token is sent as a bearer token (oauth2)
+	TokenURL     string   `toml:"token_url,omitempty"`
+	ClientID     string   `toml:"client_id,omitempty"`
+	ClientSecret Secret   `toml:"client_secret,omitempty"`
+	Scopes       []string `toml:"scopes,omitempty"`
+	// Audience is sent as the audience parameter some providers require (oauth2)
+	Audience string `toml:"audience,omitempty"`
+}
+
+// TLSConfig describes the TLS settings used to connect to a receiver.
+// Certificate files are reloaded when they change on disk.
+type TLSConfig struct {
+	// CertFile and KeyFile are a PEM client certificate and key for mutual TLS
+	CertFile string `toml:"cert_file,omitempty"`
+	KeyFile  string `toml:"key_file,omitempty"`
+	// CAFile is a PEM bundle of CAs trusted instead of the system roots
+	CAFile string `toml:"ca_file,omitempty"`
+	// ServerName overrides the name the server certificate is checked against
+	ServerName string `toml:"server_name,omitempty"`
+	// MinVersion is the lowest TLS version accepted: 1.2 or 1.3 (default: 1.2)
+	MinVersion string `toml:"min_version,omitempty"`
+	// InsecureSkipVerify disables server certificate checks; for development only
+	InsecureSkipVerify bool `toml:"insecure_skip_verify,omitempty"`
+}
+
+// MediaConfig configures the signed media proxy used by routes with media = "proxy".
+type MediaConfig struct {
+	// PublicURL is the externally reachable base URL of this server
+	PublicURL string `toml:"public_url"`
+	// SigningKey signs proxy URLs; a random key is generated at startup if empty
+	SigningKey Secret `toml:"signing_key,omitempty"`
+	// ProxyTTL is how long a proxy URL stays valid (default: 15m)
+	ProxyTTL time.Duration `toml:"proxy_ttl,omitempty"`
+}
+
+// NamespacesConfig lists the user IDs, room aliases and room IDs the
+// appservice claims. They are written into the registration file.
+type NamespacesConfig struct {
+	Users   []NamespaceConfig `toml:"users"`
+	Aliases []NamespaceConfig `toml:"aliases"`
+	Rooms   []NamespaceConfig `toml:"rooms"`
+}
+
+// NamespaceConfig is a single namespace regex.
+type NamespaceConfig struct {
+	// Regex is matched against the full ID (e.g. @webhook_.*:example\.org)
+	Regex string `toml:"regex"`
+	// Exclusive prevents other users or appservices from claiming matching IDs
+	Exclusive bool `toml:"exclusive"`
+}
+
+// GhostConfig defines the profile of a virtual user managed by the appservice.
+type GhostConfig struct {
+	// Localpart of the ghost user; its full ID must fall in a user namespace
+	Localpart string `toml:"localpart"`
+	// Displayname is set on the ghost's profile when it is first used (optional)
+	Displayname string `toml:"displayname,omitempty"`
+	// AvatarURL is an mxc:// URI set on the ghost's profile (optional)
+	AvatarURL string `toml:"avatar_url,omitempty"`
+}
+
+// RoomAliasConfig describes rooms created on demand when an alias in the
+// appservice's alias namespace is first queried.
+type RoomAliasConfig struct {
+	// LocalpartRegex matches the alias localpart (e.g. ^webhook_(?P<name>.+)$).
+	// Named groups can be referenced as ${name} in Name and Topic.
+	LocalpartRegex string `toml:"localpart_regex"`
+	// Name is the room name
+	Name string `toml:"name,omitempty"`
+	// Topic is the room topic
+	Topic string `toml:"topic,omitempty"`
+	// Preset is the createRoom preset (default: public_chat)
+	Preset string `toml:"preset,omitempty"`
+	// PowerLevels overrides fields of the initial m.room.power_levels content
+	PowerLevels map[string]interface{} `toml:"power_levels,omitempty"`
+}
+
+// HookConfig defines an inbound webhook that posts into a Matrix room.
+type HookConfig struct {
+	// ID identifies the hook in its URL: POST /hooks/{id}
+	ID string `toml:"id"`
+	// RoomID is the Matrix room the rendered message is sent to
+	RoomID string `toml:"room_id"`
+	// Sender is the localpart of the user to send as; empty sends as the bot
+	Sender string `toml:"sender,omitempty"`
+	// Token, if set, must be presented as a Bearer token or ?token= query parameter
+	Token Secret `toml:"token,omitempty"`
+	// SharedSecret, if set, requires a valid X-Webhook-Signature HMAC-SHA256 header
+	SharedSecret Secret `toml:"shared_secret,omitempty"`
+	// Public accepts requests without a token or signature; a hook without
+	// either is refused otherwise
+	Public bool `toml:"public,omitempty"`
+	// Template is a Go text/template rendering the request JSON into the plain-text body
+	Template string `toml:"template,omitempty"`
+	// HTMLTemplate is a Go html/template rendering the request JSON into formatted_body
+	HTMLTemplate string `toml:"html_template,omitempty"`
+	// MsgType is the message type to send (default: m.notice)
+	MsgType string `toml:"msgtype,omitempty"`
+	// Format selects the payload adapter: generic, alertmanager, grafana, github or gitlab (default: generic)
+	Format string `toml:"format,omitempty"`
+	// EditOnResolve edits the previous message for the same alert/issue instead of posting a new one
+	EditOnResolve bool `toml:"edit_on_resolve,omitempty"`
 }
 
 // Load reads configuration from a TOML file and applies defaults.
@@ -48,20 +422,107 @@ func Load(filename string) (*Config, error) {
 		return nil, err
 	}
 
-	// Load AS token from environment variable
-	cfg.ASToken = os.Getenv("AS_TOKEN")
+	if err := loadTokens(&cfg); err != nil {
+		return nil, err
+	}
 
 	ApplyDefaults(&cfg)
 
+	if err := check(&cfg); err != nil {
+		return nil, err
+	}
 	return &cfg, nil
 }
 
+// check returns the problems of a config with defaults applied that would
+// otherwise only show when an event is delivered.
+func check(cfg *Config) error {
+	var errs []error
+	for _, r := range cfg.Routes {
+		if r.Media == "proxy" && !absoluteURL(cfg.Media.PublicURL) {
+			errs = append(errs, fmt.Errorf("route %q: media = \"proxy\" needs [media] public_url, the http(s) URL receivers reach this server at", r.Name))
+		}
+		if r.Signing == "standard" && len(r.SigningSecrets) == 0 {
+			errs = append(errs, fmt.Errorf("route %q: signing = \"standard\" needs signing_secrets", r.Name))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// absoluteURL reports whether s is an http or https URL with a host.
+func absoluteURL(s string) bool {
+	u, err := url.Parse(s)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+// loadTokens sets the AS and HS tokens from the AS_TOKEN and HS_TOKEN
+// environment variables.
+func loadTokens(cfg *Config) error {
+	token, err := ResolveSecret(os.Getenv("AS_TOKEN"))
+	if err != nil {
+		return fmt.Errorf("AS_TOKEN: %w", err)
+	}
+	cfg.ASToken = Secret(token)
+	token, err = ResolveSecret(os.Getenv("HS_TOKEN"))
+	if err != nil {
+		return fmt.Errorf("HS_TOKEN: %w", err)
+	}
+	cfg.HSToken = Secret(token)
+	return nil
+}
+
 // ApplyDefaults ensures missing values are populated with sensible defaults.
 func ApplyDefaults(cfg *Config) {
 	if cfg == nil {
 		return
 	}
 
+	if cfg.Homeserver.SenderLocalpart == "" {
+		cfg.Homeserver.SenderLocalpart = defaultSenderLocalpart
+	}
+	if cfg.Server.ReadTimeout == 0 {
+		cfg.Server.ReadTimeout = defaultReadTimeout
+	}
+	if cfg.Server.WriteTimeout == 0 {
+		cfg.Server.WriteTimeout = defaultWriteTimeout
+	}
+	if cfg.Server.IdleTimeout == 0 {
+		cfg.Server.IdleTimeout = defaultIdleTimeout
+	}
+	if cfg.Server.ShutdownTimeout == 0 {
+		cfg.Server.ShutdownTimeout = defaultShutdownTimeout
+	}
+	if cfg.Media.ProxyTTL == 0 {
+		cfg.Media.ProxyTTL = defaultMediaProxyTTL
+	}
+	if cfg.Egress.MaxRedirects == 0 {
+		cfg.Egress.MaxRedirects = DefaultMaxRedirects
+	}
+	if cfg.History.MaxEntries == 0 {
+		cfg.History.MaxEntries = defaultHistoryEntries
+	}
+	if cfg.History.MaxAge == 0 {
+		cfg.History.MaxAge = defaultHistoryMaxAge
+	}
+	if cfg.Logging.Level == "" {
+		cfg.Logging.Level = defaultLogLevel
+	}
+	if cfg.Logging.Format == "" {
+		cfg.Logging.Format = defaultLogFormat
+	}
+	if cfg.Tracing.ServiceName == "" {
+		cfg.Tracing.ServiceName = defaultServiceName
+	}
+	if cfg.Tracing.SampleRatio == 0 {
+		cfg.Tracing.SampleRatio = defaultSampleRatio
+	}
+	if cfg.Encryption.StorePath == "" {
+		cfg.Encryption.StorePath = defaultCryptoStorePath
+	}
+	if cfg.Encryption.DeviceDisplayName == "" {
+		cfg.Encryption.DeviceDisplayName = defaultDeviceName
+	}
+
 	for i := range cfg.Routes {
 		r := &cfg.Routes[i]
 		if r.Method == "" {
@@ -71,22 +532,66 @@ func ApplyDefaults(cfg *Config) {
 			r.Selector = "true" // default catch-all
 		}
 		if r.Name == "" {
-			r.Name = r.WebhookURL
+			// Not the URL: it may carry credentials, and the name ends up in
+			// metrics labels, logs and history.
+			r.Name = fmt.Sprintf("route-%d", i+1)
 		}
 		// Default SendBody to true if not specified
 		if r.SendBody == nil {
 			v := true
 			r.SendBody = &v
 		}
+		if r.Signing == "" {
+			r.Signing = defaultSigning
+		}
+		if r.Auth.Type == "api_key" && r.Auth.Header == "" {
+			r.Auth.Header = defaultAPIKeyHeader
+		}
+		if r.Media == "" {
+			r.Media = defaultMediaMode
+		}
+		if r.MediaMaxBytes == 0 {
+			r.MediaMaxBytes = defaultMediaMaxBytes
+		}
+	}
+
+	for i := range cfg.RoomAliases {
+		a := &cfg.RoomAliases[i]
+		if a.Preset == "" {
+			a.Preset = defaultRoomPreset
+		}
+	}
+
+	for i := range cfg.Hooks {
+		h := &cfg.Hooks[i]
+		if h.MsgType == "" {
+			h.MsgType = defaultHookMsgType
+		}
+		if h.Format == "" {
+			h.Format = defaultHookFormat
+		}
 	}
 }
 
-// NewDefault creates a default configuration with defaults applied.
-func NewDefault() *Config {
-	cfg := &Config{
-		ASToken: os.Getenv("AS_TOKEN"),
-		Routes:  []RouteConfig{},
+// ReceivesEphemeral reports whether any route routes ephemeral events, in
+// which case the homeserver must be asked to push them.
+func (c *Config) ReceivesEphemeral() bool {
+	for _, r := range c.Routes {
+		if r.Ephemeral {
+			return true
+		}
+	}
+	return false
+}
+
+// NewDefault creates a default configuration with defaults applied and the
+// tokens from the environment. It returns an error if AS_TOKEN or HS_TOKEN
+// is a secret reference that cannot be resolved.
+func NewDefault() (*Config, error) {
+	cfg := &Config{Routes: []RouteConfig{}}
+	if err := loadTokens(cfg); err != nil {
+		return nil, err
 	}
 	ApplyDefaults(cfg)
-	return cfg
+	return cfg, nil
 }
@@ -0,0 +1,130 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+)
+
+// maskedSecret is what a non-empty Secret prints as.
+const maskedSecret = "********"
+
+// Secret is a credential from the configuration. It prints and marshals as
+// a mask so it cannot leak into logs or API responses; Value returns the
+// real value.
+//
+// In the configuration file a secret is either the literal value or a
+// reference "<scheme>:<ref>" to a registered provider, e.g. env:HOOK_TOKEN
+// or file:/run/secrets/hook_token. References are resolved when the file is
+// loaded. Values whose prefix is not a registered scheme are literals.
+type Secret string
+
+// Value returns the secret itself.
+func (s Secret) Value() string {
+	return string(s)
+}
+
+// String returns a mask, or "" if the secret is not set.
+func (s Secret) String() string {
+	if s == "" {
+		return ""
+	}
+	return maskedSecret
+}
+
+// GoString masks the secret in %#v output.
+func (s Secret) GoString() string {
+	return fmt.Sprintf("%q", s.String())
+}
+
+// MarshalText masks the secret in JSON, TOML and YAML output.
+func (s Secret) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// UnmarshalText resolves a secret reference or keeps a literal value.
+func (s *Secret) UnmarshalText(text []byte) error {
+	value, err := ResolveSecret(string(text))
+	if err != nil {
+		return err
+	}
+	*s = Secret(value)
+	return nil
+}
+
+// SecretValues returns the values of secrets.
+func SecretValues(secrets []Secret) []string {
+	out := make([]string, len(secrets))
+	for i, s := range secrets {
+		out[i] = s.Value()
+	}
+	return out
+}
+
+// SecretProvider resolves the reference part of "<scheme>:<ref>".
+type SecretProvider interface {
+	Resolve(ref string) (string, error)
+}
+
+// SecretProviderFunc adapts a function to a SecretProvider.
+type SecretProviderFunc func(ref string) (string, error)
+
+// Resolve calls f(ref).
+func (f SecretProviderFunc) Resolve(ref string) (string, error) {
+	return f(ref)
+}
+
+var (
+	secretProvidersMu sync.RWMutex
+	secretProviders   = map[string]SecretProvider{
+		"env":  SecretProviderFunc(envSecret),
+		"file": SecretProviderFunc(fileSecret),
+	}
+)
+
+// RegisterSecretProvider makes references with the given scheme resolve
+// through p, e.g. a "vault" scheme for vault:secret/data/hooks#token.
+func RegisterSecretProvider(scheme string, p SecretProvider) {
+	secretProvidersMu.Lock()
+	defer secretProvidersMu.Unlock()
+	secretProviders[scheme] = p
+}
+
+// ResolveSecret returns the value a secret reference points to, or value
+// itself if it is not a reference.
+func ResolveSecret(value string) (string, error) {
+	scheme, ref, ok := strings.Cut(value, ":")
+	if !ok {
+		return value, nil
+	}
+	secretProvidersMu.RLock()
+	p, ok := secretProviders[scheme]
+	secretProvidersMu.RUnlock()
+	if !ok {
+		return value, nil
+	}
+	resolved, err := p.Resolve(ref)
+	if err != nil {
+		return "", fmt.Errorf("secret %s:%s: %w", scheme, ref, err)
+	}
+	return resolved, nil
+}
+
+func envSecret(name string) (string, error) {
+	value, ok := os.LookupEnv(name)
+	if !ok {
+		return "", fmt.Errorf("environment variable %s is not set", name)
+	}
+	return value, nil
+}
+
+// fileSecret reads a secret file, dropping the trailing newline most
+// editors and secret mounts add.
+func fileSecret(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
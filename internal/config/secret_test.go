@@ -0,0 +1,122 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadConfigSecretReferences(t *testing.T) {
+	dir := t.TempDir()
+	secretFile := filepath.Join(dir, "hook_secret")
+	if err := os.WriteFile(secretFile, []byte("from-file\n"), 0o600); err != nil {
+		t.Fatalf("Failed to write secret file: %v", err)
+	}
+	t.Setenv("ROUTE_SECRET", "from-env")
+	t.Setenv("AS_TOKEN", "file:"+secretFile)
+
+	configFile := filepath.Join(dir, "config.toml")
+	// The AS token only comes from the environment
+	content := `
+ASToken = "from-config"
+
+[[routes]]
+webhook_url = "http://localhost:9000/"
+shared_secret = "env:ROUTE_SECRET"
+auth = { type = "basic", username = "u", password = "https://not-a-reference" }
+
+[[hooks]]
+id = "ci"
+shared_secret = "file:` + secretFile + `"
+token = "literal"
+`
+	if err := os.WriteFile(configFile, []byte(content), 0o600); err != nil {
+		t.Fatalf("Failed to write config: %v", err)
+	}
+
+	cfg, err := Load(configFile)
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+	if got := cfg.Routes[0].SharedSecret.Value(); got != "from-env" {
+		t.Errorf("Expected env reference to resolve, got %q", got)
+	}
+	if got := cfg.Hooks[0].SharedSecret.Value(); got != "from-file" {
+		t.Errorf("Expected file reference to resolve without the newline, got %q", got)
+	}
+	if got := cfg.Routes[0].Auth.Password.Value(); got != "https://not-a-reference" {
+		t.Errorf("Expected an unknown scheme to be a literal, got %q", got)
+	}
+	if cfg.Hooks[0].Token.Value() != "literal" || cfg.ASToken.Value() != "from-file" {
+		t.Errorf("Unexpected tokens: %q, %q", cfg.Hooks[0].Token.Value(), cfg.ASToken.Value())
+	}
+
+	// A missing secret fails the load instead of leaving the secret empty.
+	if err := os.WriteFile(configFile, []byte("[[routes]]\nshared_secret = \"env:MISSING_SECRET\"\n"), 0o600); err != nil {
+		t.Fatalf("Failed to write config: %v", err)
+	}
+	if _, err := Load(configFile); err == nil || !strings.Contains(err.Error(), "MISSING_SECRET") {
+		t.Errorf("Expected an error naming the missing variable, got %v", err)
+	}
+}
+
+func TestNewDefaultUnresolvableTokens(t *testing.T) {
+	for _, name := range []string{"AS_TOKEN", "HS_TOKEN"} {
+		t.Run(name, func(t *testing.T) {
+			t.Setenv("AS_TOKEN", "as-literal")
+			t.Setenv("HS_TOKEN", "hs-literal")
+			t.Setenv(name, "env:MISSING_TOKEN")
+
+			// The reference must not become the token
+			cfg, err := NewDefault()
+			if err == nil || !strings.Contains(err.Error(), name) {
+				t.Errorf("Expected an error naming %s, got %v with %+v", name, err, cfg)
+			}
+		})
+	}
+
+	t.Setenv("AS_TOKEN", "as-literal")
+	t.Setenv("HS_TOKEN", "hs-literal")
+	cfg, err := NewDefault()
+	if err != nil || cfg.ASToken.Value() != "as-literal" || cfg.HSToken.Value() != "hs-literal" {
+		t.Errorf("Expected the literal tokens, got %v", err)
+	}
+}
+
+func TestSecretMasking(t *testing.T) {
+	route := RouteConfig{Name: "r", SharedSecret: "hunter2", SigningSecrets: []Secret{"whsec_abc"}, Auth: AuthConfig{Token: "bearer-123"}}
+
+	for _, out := range []string{
+		fmt.Sprintf("%v", route),
+		fmt.Sprintf("%+v", route),
+		fmt.Sprintf("%#v", route),
+		fmt.Sprint(route.SharedSecret),
+	} {
+		if strings.Contains(out, "hunter2") || strings.Contains(out, "whsec_abc") || strings.Contains(out, "bearer-123") {
+			t.Errorf("Expected secrets to be masked, got %s", out)
+		}
+	}
+
+	data, err := json.Marshal(route)
+	if err != nil {
+		t.Fatalf("Marshal failed: %v", err)
+	}
+	if strings.Contains(string(data), "hunter2") || !strings.Contains(string(data), maskedSecret) {
+		t.Errorf("Expected JSON to be masked, got %s", data)
+	}
+	if Secret("").String() != "" {
+		t.Error("Expected an unset secret to print as empty")
+	}
+}
+
+func TestRegisterSecretProvider(t *testing.T) {
+	RegisterSecretProvider("test", SecretProviderFunc(func(ref string) (string, error) {
+		return strings.ToUpper(ref), nil
+	}))
+	if got, err := ResolveSecret("test:value"); err != nil || got != "VALUE" {
+		t.Errorf("Expected the custom provider to resolve, got %q, %v", got, err)
+	}
+}
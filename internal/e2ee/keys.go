@@ -0,0 +1,115 @@
+package e2ee
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/json"
+	"fmt"
+
+	"github.com/yamatt/matrix-as-webhook/internal/e2ee/olm"
+)
+
+// Device is a verified device of another user.
+type Device struct {
+	UserID     string
+	DeviceID   string
+	Curve25519 string
+	Ed25519    string
+}
+
+type deviceKeys struct {
+	UserID     string                       `json:"user_id"`
+	DeviceID   string                       `json:"device_id"`
+	Algorithms []string                     `json:"algorithms"`
+	Keys       map[string]string            `json:"keys"`
+	Signatures map[string]map[string]string `json:"signatures"`
+}
+
+// parseDevice checks a device's self-signature and that it is the device it
+// claims to be.
+func parseDevice(userID, deviceID string, raw json.RawMessage) (*Device, error) {
+	var keys deviceKeys
+	if err := json.Unmarshal(raw, &keys); err != nil {
+		return nil, err
+	}
+	if keys.UserID != userID || keys.DeviceID != deviceID {
+		return nil, fmt.Errorf("e2ee: device keys for %s/%s claim to be %s/%s", userID, deviceID, keys.UserID, keys.DeviceID)
+	}
+	d := &Device{
+		UserID:     userID,
+		DeviceID:   deviceID,
+		Curve25519: keys.Keys["curve25519:"+deviceID],
+		Ed25519:    keys.Keys["ed25519:"+deviceID],
+	}
+	if d.Curve25519 == "" || d.Ed25519 == "" {
+		return nil, fmt.Errorf("e2ee: device %s/%s is missing keys", userID, deviceID)
+	}
+	if err := verifySigned(raw, userID, deviceID, d.Ed25519); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// verifySigned checks the Ed25519 signature by userID's deviceID over the
+// canonical JSON of a signed object.
+func verifySigned(raw json.RawMessage, userID, deviceID, ed25519Key string) error {
+	var signed struct {
+		Signatures map[string]map[string]string `json:"signatures"`
+	}
+	if err := json.Unmarshal(raw, &signed); err != nil {
+		return err
+	}
+	sig, err := olm.Decode(signed.Signatures[userID]["ed25519:"+deviceID])
+	if err != nil || len(sig) == 0 {
+		return fmt.Errorf("e2ee: missing signature by %s/%s", userID, deviceID)
+	}
+	pub, err := olm.Decode(ed25519Key)
+	if err != nil || len(pub) != ed25519.PublicKeySize {
+		return fmt.Errorf("e2ee: bad ed25519 key for %s/%s", userID, deviceID)
+	}
+	canonical, err := canonicalJSON(raw)
+	if err != nil {
+		return err
+	}
+	if !ed25519.Verify(pub, canonical, sig) {
+		return fmt.Errorf("e2ee: invalid signature by %s/%s", userID, deviceID)
+	}
+	return nil
+}
+
+// canonicalJSON encodes a JSON object the way Matrix signs it: sorted keys,
+// no insignificant whitespace and without "signatures" and "unsigned".
+func canonicalJSON(raw []byte) ([]byte, error) {
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.UseNumber()
+	var obj map[string]interface{}
+	if err := dec.Decode(&obj); err != nil {
+		return nil, err
+	}
+	delete(obj, "signatures")
+	delete(obj, "unsigned")
+
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(obj); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
+}
+
+// sign adds the account's signature to obj under signatures.userID.
+func sign(account *olm.Account, userID, deviceID string, obj map[string]interface{}) error {
+	raw, err := json.Marshal(obj)
+	if err != nil {
+		return err
+	}
+	canonical, err := canonicalJSON(raw)
+	if err != nil {
+		return err
+	}
+	obj["signatures"] = map[string]interface{}{
+		userID: map[string]string{"ed25519:" + deviceID: account.Sign(canonical)},
+	}
+	return nil
+}
@@ -0,0 +1,840 @@
+// Package e2ee adds end-to-end encryption support to the appservice bot:
+// it owns the bot's device and keys, receives Olm-encrypted room keys over
+// the MSC2409 to-device extension, decrypts Megolm room events and encrypts
+// messages the bot sends into encrypted rooms.
+package e2ee
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/yamatt/matrix-as-webhook/internal/e2ee/olm"
+	"github.com/yamatt/matrix-as-webhook/internal/matrix"
+)
+
+// Encryption algorithms.
+const (
+	AlgorithmOlm    = "m.olm.v1.curve25519-aes-sha2"
+	AlgorithmMegolm = "m.megolm.v1.aes-sha2"
+)
+
+const (
+	signedCurve25519 = "signed_curve25519"
+	// targetOneTimeKeys is how many one-time keys are kept on the server.
+	targetOneTimeKeys = 50
+	// Outbound Megolm sessions are rotated after this many messages or this
+	// long, the defaults of m.room.encryption.
+	rotationMessages = 100
+	rotationPeriod   = 7 * 24 * time.Hour
+	// maxSeenIndices bounds the replay detection map.
+	maxSeenIndices = 10000
+)
+
+// ErrNoSession is returned when a room event was encrypted with a Megolm
+// session whose key has not been received (yet).
+var ErrNoSession = errors.New("e2ee: unknown megolm session")
+
+// Client is the subset of *matrix.Client the machine uses.
+type Client interface {
+	LoginAppService(ctx context.Context, localpart, deviceID, displayName string) (string, error)
+	UploadKeys(ctx context.Context, userID string, keys map[string]interface{}) (map[string]int, error)
+	QueryKeys(ctx context.Context, userID string, users []string) (map[string]map[string]json.RawMessage, error)
+	ClaimKeys(ctx context.Context, userID string, devices map[string]map[string]string) (map[string]map[string]map[string]json.RawMessage, error)
+	SendToDevice(ctx context.Context, userID, eventType string, messages map[string]map[string]interface{}) error
+	JoinedMembers(ctx context.Context, roomID string) ([]string, error)
+}
+
+// deviceMasquerader is implemented by clients that can act as a specific
+// device of the masqueraded user (MSC3202).
+type deviceMasquerader interface {
+	WithDevice(deviceID string) *matrix.Client
+}
+
+// ToDeviceEvent is a to-device event pushed in a transaction (MSC2409).
+type ToDeviceEvent struct {
+	Type       string          `json:"type"`
+	Sender     string          `json:"sender"`
+	Content    json.RawMessage `json:"content"`
+	ToUserID   string          `json:"to_user_id"`
+	ToDeviceID string          `json:"to_device_id"`
+}
+
+// DeviceLists lists users whose devices changed (MSC3202).
+type DeviceLists struct {
+	Changed []string `json:"changed,omitempty"`
+	Left    []string `json:"left,omitempty"`
+}
+
+// Extensions are the encryption-related fields of an appservice transaction.
+type Extensions struct {
+	ToDevice               []ToDeviceEvent                      `json:"de.sorunome.msc2409.to_device,omitempty"`
+	DeviceLists            *DeviceLists                         `json:"org.matrix.msc3202.device_lists,omitempty"`
+	OneTimeKeyCounts       map[string]map[string]map[string]int `json:"org.matrix.msc3202.device_one_time_keys_count,omitempty"`
+	UnusedFallbackKeyTypes map[string]map[string][]string       `json:"org.matrix.msc3202.device_unused_fallback_key_types,omitempty"`
+}
+
+// Machine manages the bot's device keys and sessions.
+type Machine struct {
+	client      Client
+	store       *Store
+	userID      string
+	localpart   string
+	displayName string
+	now         func() time.Time
+
+	// encryptMu serialises Encrypt, so a room's outbound session does not
+	// change while its key is being shared. mu guards the state and is
+	// not held across requests to the homeserver.
+	encryptMu sync.Mutex
+
+	mu      sync.Mutex
+	state   *State
+	devices map[string]map[string]*Device
+	// devicesGen counts device list invalidations, so that a /keys/query
+	// started before one does not cache stale devices.
+	devicesGen uint64
+	seen       map[string]string
+}
+
+// NewMachine creates a Machine for the bot user. Start must be called before use.
+func NewMachine(client Client, store *Store, userID, localpart, displayName string) *Machine {
+	return &Machine{
+		client:      client,
+		store:       store,
+		userID:      userID,
+		localpart:   localpart,
+		displayName: displayName,
+		now:         time.Now,
+		devices:     make(map[string]map[string]*Device),
+		seen:        make(map[string]string),
+	}
+}
+
+// Start loads the store, creates the bot's device on first run and uploads
+// its identity and one-time keys.
+func (m *Machine) Start(ctx context.Context) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	state, err := m.store.Load()
+	if err != nil {
+		return err
+	}
+	if state.Account == nil {
+		if state.Account, err = olm.NewAccount(); err != nil {
+			return err
+		}
+		state.DeviceID = ""
+	}
+	if state.Sessions == nil {
+		state.Sessions = make(map[string][]*olm.Session)
+	}
+	if state.GroupSessions == nil {
+		state.GroupSessions = make(map[string]*GroupSession)
+	}
+	if state.Outbound == nil {
+		state.Outbound = make(map[string]*OutboundSession)
+	}
+	m.state = state
+
+	if state.DeviceID == "" {
+		deviceID, err := m.client.LoginAppService(ctx, m.localpart, "", m.displayName)
+		if err != nil {
+			return fmt.Errorf("e2ee: creating device: %w", err)
+		}
+		state.DeviceID = deviceID
+		slog.Info("created E2EE device", "device_id", deviceID, "user_id", m.userID)
+	}
+	if dm, ok := m.client.(deviceMasquerader); ok {
+		m.client = dm.WithDevice(state.DeviceID)
+	}
+	if err := m.save(); err != nil {
+		return err
+	}
+
+	if state.Account.FallbackKey == nil {
+		if err := state.Account.GenerateFallbackKey(); err != nil {
+			return err
+		}
+	}
+	counts, err := m.uploadKeys(ctx, true)
+	if err != nil {
+		return fmt.Errorf("e2ee: uploading device keys: %w", err)
+	}
+	return m.topUpOneTimeKeys(ctx, counts[signedCurve25519])
+}
+
+// DeviceID returns the bot's device ID.
+func (m *Machine) DeviceID() string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.state.DeviceID
+}
+
+// IdentityKeys returns the bot device's Curve25519 and Ed25519 keys.
+func (m *Machine) IdentityKeys() (string, string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.state.Account.Curve25519(), m.state.Account.Ed25519()
+}
+
+// ProcessExtensions handles the to-device events, device list changes and
+// key counts of a transaction.
+func (m *Machine) ProcessExtensions(ctx context.Context, ext Extensions) {
+	m.mu.Lock()
+	changed := false
+	var roomKeys []*receivedRoomKey
+	for _, ev := range ext.ToDevice {
+		if ev.ToUserID != m.userID || (ev.ToDeviceID != m.state.DeviceID && ev.ToDeviceID != "*") {
+			continue
+		}
+		if ev.Type != "m.room.encrypted" {
+			continue
+		}
+		changed = true
+		roomKey, err := m.handleEncryptedToDevice(ev)
+		if err != nil {
+			slog.Warn("error decrypting to-device event", "sender", ev.Sender, "error", err)
+			continue
+		}
+		if roomKey != nil {
+			roomKeys = append(roomKeys, roomKey)
+		}
+	}
+	if ext.DeviceLists != nil {
+		for _, userID := range append(ext.DeviceLists.Changed, ext.DeviceLists.Left...) {
+			delete(m.devices, userID)
+		}
+		m.devicesGen++
+	}
+	m.mu.Unlock()
+
+	for _, k := range roomKeys {
+		if err := m.addRoomKey(ctx, k); err != nil {
+			slog.Warn("ignoring room key", "session_id", k.SessionID, "room_id", k.RoomID, "sender", k.sender, "error", err)
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if counts, ok := ext.OneTimeKeyCounts[m.userID][m.state.DeviceID]; ok && counts[signedCurve25519] < targetOneTimeKeys/2 {
+		if err := m.topUpOneTimeKeys(ctx, counts[signedCurve25519]); err != nil {
+			slog.Error("error uploading one-time keys", "error", err)
+		}
+	}
+	if types, ok := ext.UnusedFallbackKeyTypes[m.userID][m.state.DeviceID]; ok && !slices.Contains(types, signedCurve25519) {
+		if err := m.state.Account.GenerateFallbackKey(); err == nil {
+			if _, err := m.uploadKeys(ctx, false); err != nil {
+				slog.Error("error uploading fallback key", "error", err)
+			}
+		}
+	}
+
+	if !changed {
+		return
+	}
+	if err := m.save(); err != nil {
+		slog.Error("error saving crypto store", "error", err)
+	}
+}
+
+// Decrypt decrypts the content of an m.room.encrypted event sent by sender,
+// returning the original event type and content. It returns ErrNoSession
+// when the room key has not been received, and an error when the session
+// belongs to a device of another user.
+func (m *Machine) Decrypt(roomID, eventID, sender string, content map[string]interface{}) (string, map[string]interface{}, error) {
+	algorithm, _ := content["algorithm"].(string)
+	if algorithm != AlgorithmMegolm {
+		return "", nil, fmt.Errorf("e2ee: unsupported algorithm %q", algorithm)
+	}
+	sessionID, _ := content["session_id"].(string)
+	ciphertext, _ := content["ciphertext"].(string)
+	senderKey, _ := content["sender_key"].(string)
+	deviceID, _ := content["device_id"].(string)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	gs, ok := m.state.GroupSessions[roomID+"|"+sessionID]
+	if !ok {
+		return "", nil, fmt.Errorf("%w %s", ErrNoSession, sessionID)
+	}
+	// Sessions stored before their owner was recorded are not trusted
+	if gs.SenderUserID != sender {
+		return "", nil, fmt.Errorf("e2ee: session %s belongs to %q, not to sender %s", sessionID, gs.SenderUserID, sender)
+	}
+	if senderKey != "" && senderKey != gs.SenderKey {
+		return "", nil, fmt.Errorf("e2ee: session %s does not belong to sender key %s", sessionID, senderKey)
+	}
+	if deviceID != "" && deviceID != gs.SenderDeviceID {
+		return "", nil, fmt.Errorf("e2ee: session %s does not belong to device %s", sessionID, deviceID)
+	}
+	plaintext, index, err := gs.Session.Decrypt(ciphertext)
+	if err != nil {
+		return "", nil, err
+	}
+
+	seenKey := fmt.Sprintf("%s|%d", sessionID, index)
+	if prev, ok := m.seen[seenKey]; ok && prev != eventID {
+		return "", nil, fmt.Errorf("e2ee: message index %d of session %s replayed in %s", index, sessionID, eventID)
+	}
+	if len(m.seen) >= maxSeenIndices {
+		clear(m.seen)
+	}
+	m.seen[seenKey] = eventID
+
+	var payload struct {
+		Type    string                 `json:"type"`
+		Content map[string]interface{} `json:"content"`
+		RoomID  string                 `json:"room_id"`
+	}
+	if err := json.Unmarshal(plaintext, &payload); err != nil {
+		return "", nil, fmt.Errorf("e2ee: decoding plaintext: %w", err)
+	}
+	if payload.RoomID != roomID {
+		return "", nil, fmt.Errorf("e2ee: event for %s was encrypted for %s", roomID, payload.RoomID)
+	}
+	if payload.Content == nil {
+		payload.Content = map[string]interface{}{}
+	}
+	// Relations are sent in the clear so the server can aggregate them.
+	if rel, ok := content["m.relates_to"]; ok {
+		if _, ok := payload.Content["m.relates_to"]; !ok {
+			payload.Content["m.relates_to"] = rel
+		}
+	}
+
+	// The advanced ratchet is a shortcut that is recomputed from the
+	// session key after a restart, so it is not worth a save.
+	return payload.Type, payload.Content, nil
+}
+
+// Encrypt encrypts an event for roomID with the bot's Megolm session for
+// the room, sharing the session key with any member devices that lack it.
+// It returns the m.room.encrypted content.
+func (m *Machine) Encrypt(ctx context.Context, roomID, eventType string, content map[string]interface{}) (map[string]interface{}, error) {
+	m.encryptMu.Lock()
+	defer m.encryptMu.Unlock()
+
+	members, err := m.client.JoinedMembers(ctx, roomID)
+	if err != nil {
+		return nil, err
+	}
+	devices, err := m.devicesFor(ctx, members)
+	if err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	out, err := m.outboundSession(roomID, members)
+	m.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	if err := m.shareSession(ctx, roomID, out, devices); err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	plaintext, err := json.Marshal(map[string]interface{}{
+		"type":    eventType,
+		"content": content,
+		"room_id": roomID,
+	})
+	if err != nil {
+		return nil, err
+	}
+	ciphertext, err := out.Session.Encrypt(plaintext)
+	if err != nil {
+		return nil, err
+	}
+	out.Messages++
+	if err := m.save(); err != nil {
+		return nil, err
+	}
+
+	encrypted := map[string]interface{}{
+		"algorithm":  AlgorithmMegolm,
+		"sender_key": m.state.Account.Curve25519(),
+		"ciphertext": ciphertext,
+		"session_id": out.Session.ID(),
+		"device_id":  m.state.DeviceID,
+	}
+	if rel, ok := content["m.relates_to"]; ok {
+		encrypted["m.relates_to"] = rel
+	}
+	return encrypted, nil
+}
+
+// outboundSession returns the room's Megolm session, replacing it when it
+// is due for rotation or a user it was shared with has left.
+func (m *Machine) outboundSession(roomID string, members []string) (*OutboundSession, error) {
+	out := m.state.Outbound[roomID]
+	if out != nil {
+		rotate := out.Messages >= rotationMessages || m.now().Sub(out.CreatedAt) > rotationPeriod
+		for shared := range out.SharedWith {
+			userID, _, _ := strings.Cut(shared, "|")
+			if !slices.Contains(members, userID) {
+				rotate = true
+				break
+			}
+		}
+		if !rotate {
+			return out, nil
+		}
+	}
+
+	session, err := olm.NewOutboundGroupSession()
+	if err != nil {
+		return nil, err
+	}
+	out = &OutboundSession{Session: session, CreatedAt: m.now(), SharedWith: make(map[string]bool)}
+	m.state.Outbound[roomID] = out
+	return out, nil
+}
+
+// shareSession sends the session key to devices it has not been sent to.
+// Devices without an Olm session and no claimable one-time key are skipped.
+// It is called without m.mu held.
+func (m *Machine) shareSession(ctx context.Context, roomID string, out *OutboundSession, devices []*Device) error {
+	m.mu.Lock()
+	var pending, unsessioned []*Device
+	for _, d := range devices {
+		if out.SharedWith[d.UserID+"|"+d.DeviceID] {
+			continue
+		}
+		pending = append(pending, d)
+		if len(m.state.Sessions[d.Curve25519]) == 0 {
+			unsessioned = append(unsessioned, d)
+		}
+	}
+	m.mu.Unlock()
+	if len(pending) == 0 {
+		return nil
+	}
+	claimed, err := m.claimOneTimeKeys(ctx, unsessioned)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	m.establishSessions(unsessioned, claimed)
+	roomKey := map[string]interface{}{
+		"algorithm":   AlgorithmMegolm,
+		"room_id":     roomID,
+		"session_id":  out.Session.ID(),
+		"session_key": out.Session.SessionKey(),
+	}
+	messages := make(map[string]map[string]interface{})
+	var sent []*Device
+	for _, d := range pending {
+		encrypted, err := m.encryptOlm(d, "m.room_key", roomKey)
+		if err != nil {
+			slog.Warn("not sharing room key", "user_id", d.UserID, "device_id", d.DeviceID, "error", err)
+			continue
+		}
+		if messages[d.UserID] == nil {
+			messages[d.UserID] = make(map[string]interface{})
+		}
+		messages[d.UserID][d.DeviceID] = encrypted
+		sent = append(sent, d)
+	}
+	// The Olm ratchets have moved on whether or not the keys are delivered
+	err = m.save()
+	m.mu.Unlock()
+	if err != nil || len(messages) == 0 {
+		return err
+	}
+
+	if err := m.client.SendToDevice(ctx, m.userID, "m.room.encrypted", messages); err != nil {
+		return fmt.Errorf("e2ee: sharing room key: %w", err)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, d := range sent {
+		out.SharedWith[d.UserID+"|"+d.DeviceID] = true
+	}
+	return nil
+}
+
+// claimOneTimeKeys claims a one-time key of each device. It is called
+// without m.mu held.
+func (m *Machine) claimOneTimeKeys(ctx context.Context, devices []*Device) (map[string]map[string]map[string]json.RawMessage, error) {
+	if len(devices) == 0 {
+		return nil, nil
+	}
+	claim := make(map[string]map[string]string)
+	for _, d := range devices {
+		if claim[d.UserID] == nil {
+			claim[d.UserID] = make(map[string]string)
+		}
+		claim[d.UserID][d.DeviceID] = signedCurve25519
+	}
+	claimed, err := m.client.ClaimKeys(ctx, m.userID, claim)
+	if err != nil {
+		return nil, fmt.Errorf("e2ee: claiming one-time keys: %w", err)
+	}
+	return claimed, nil
+}
+
+// establishSessions creates outbound Olm sessions to devices with the
+// one-time keys claimed for them.
+func (m *Machine) establishSessions(devices []*Device, claimed map[string]map[string]map[string]json.RawMessage) {
+	for _, d := range devices {
+		if len(m.state.Sessions[d.Curve25519]) > 0 {
+			continue
+		}
+		for _, raw := range claimed[d.UserID][d.DeviceID] {
+			var otk struct {
+				Key string `json:"key"`
+			}
+			if err := json.Unmarshal(raw, &otk); err != nil {
+				continue
+			}
+			if err := verifySigned(raw, d.UserID, d.DeviceID, d.Ed25519); err != nil {
+				slog.Warn("ignoring one-time key", "user_id", d.UserID, "device_id", d.DeviceID, "error", err)
+				continue
+			}
+			session, err := m.state.Account.NewOutboundSession(d.Curve25519, otk.Key)
+			if err != nil {
+				slog.Warn("error creating Olm session", "user_id", d.UserID, "device_id", d.DeviceID, "error", err)
+				continue
+			}
+			m.state.Sessions[d.Curve25519] = append(m.state.Sessions[d.Curve25519], session)
+			break
+		}
+	}
+}
+
+// encryptOlm encrypts a to-device event for a device with its newest session.
+func (m *Machine) encryptOlm(d *Device, eventType string, content map[string]interface{}) (map[string]interface{}, error) {
+	sessions := m.state.Sessions[d.Curve25519]
+	if len(sessions) == 0 {
+		return nil, errors.New("no olm session")
+	}
+	session := sessions[len(sessions)-1]
+
+	plaintext, err := json.Marshal(map[string]interface{}{
+		"type":           eventType,
+		"content":        content,
+		"sender":         m.userID,
+		"sender_device":  m.state.DeviceID,
+		"keys":           map[string]string{"ed25519": m.state.Account.Ed25519()},
+		"recipient":      d.UserID,
+		"recipient_keys": map[string]string{"ed25519": d.Ed25519},
+	})
+	if err != nil {
+		return nil, err
+	}
+	msgType, body, err := session.Encrypt(plaintext)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{
+		"algorithm":  AlgorithmOlm,
+		"sender_key": m.state.Account.Curve25519(),
+		"ciphertext": map[string]interface{}{
+			d.Curve25519: map[string]interface{}{"type": msgType, "body": olm.Encode(body)},
+		},
+	}, nil
+}
+
+// receivedRoomKey is a room key decrypted from a to-device event, not yet
+// checked against its sender's devices.
+type receivedRoomKey struct {
+	RoomID     string `json:"room_id"`
+	SessionID  string `json:"session_id"`
+	SessionKey string `json:"session_key"`
+	Algorithm  string `json:"algorithm"`
+
+	sender       string
+	senderKey    string
+	senderDevice string
+	ed25519      string
+}
+
+// handleEncryptedToDevice decrypts an Olm to-device event, returning the
+// room key it carries, if any.
+func (m *Machine) handleEncryptedToDevice(ev ToDeviceEvent) (*receivedRoomKey, error) {
+	var content struct {
+		Algorithm  string `json:"algorithm"`
+		SenderKey  string `json:"sender_key"`
+		Ciphertext map[string]struct {
+			Type int    `json:"type"`
+			Body string `json:"body"`
+		} `json:"ciphertext"`
+	}
+	if err := json.Unmarshal(ev.Content, &content); err != nil {
+		return nil, err
+	}
+	if content.Algorithm != AlgorithmOlm {
+		return nil, fmt.Errorf("unsupported algorithm %q", content.Algorithm)
+	}
+	ours, ok := content.Ciphertext[m.state.Account.Curve25519()]
+	if !ok {
+		return nil, errors.New("not encrypted for this device")
+	}
+	body, err := olm.Decode(ours.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	plaintext, err := m.decryptOlm(content.SenderKey, ours.Type, body)
+	if err != nil {
+		return nil, err
+	}
+
+	var payload struct {
+		Type          string            `json:"type"`
+		Content       json.RawMessage   `json:"content"`
+		Sender        string            `json:"sender"`
+		SenderDevice  string            `json:"sender_device"`
+		Recipient     string            `json:"recipient"`
+		RecipientKeys map[string]string `json:"recipient_keys"`
+		Keys          map[string]string `json:"keys"`
+	}
+	if err := json.Unmarshal(plaintext, &payload); err != nil {
+		return nil, err
+	}
+	if payload.Sender != ev.Sender || payload.Recipient != m.userID || payload.RecipientKeys["ed25519"] != m.state.Account.Ed25519() {
+		return nil, errors.New("plaintext sender or recipient does not match")
+	}
+
+	if payload.Type != "m.room_key" {
+		return nil, nil
+	}
+	var roomKey receivedRoomKey
+	if err := json.Unmarshal(payload.Content, &roomKey); err != nil {
+		return nil, err
+	}
+	if roomKey.Algorithm != AlgorithmMegolm {
+		return nil, fmt.Errorf("unsupported room key algorithm %q", roomKey.Algorithm)
+	}
+	roomKey.sender = ev.Sender
+	roomKey.senderKey = content.SenderKey
+	roomKey.senderDevice = payload.SenderDevice
+	roomKey.ed25519 = payload.Keys["ed25519"]
+	return &roomKey, nil
+}
+
+// addRoomKey stores a room key once its sender's devices confirm it came
+// from one of them. It is called without m.mu held.
+func (m *Machine) addRoomKey(ctx context.Context, k *receivedRoomKey) error {
+	session, err := olm.NewInboundGroupSession(k.SessionKey)
+	if err != nil {
+		return err
+	}
+	if session.ID() != k.SessionID {
+		return errors.New("room key session ID mismatch")
+	}
+
+	// The room key is only as trustworthy as the device it came from: the
+	// Curve25519 key the Olm session is with must be one of the sender's
+	// devices, and the Ed25519 key claimed in the plaintext that device's.
+	d, err := m.senderDevice(ctx, k.sender, k.senderKey)
+	if err != nil {
+		return err
+	}
+	if k.ed25519 != d.Ed25519 {
+		return fmt.Errorf("claimed ed25519 key does not match device %s", d.DeviceID)
+	}
+	if k.senderDevice != "" && k.senderDevice != d.DeviceID {
+		return fmt.Errorf("claimed device %s does not own the sender key", k.senderDevice)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := k.RoomID + "|" + k.SessionID
+	if existing, ok := m.state.GroupSessions[key]; ok && existing.Session.FirstKnownIndex() <= session.FirstKnownIndex() {
+		return nil
+	}
+	m.state.GroupSessions[key] = &GroupSession{
+		RoomID:         k.RoomID,
+		SenderUserID:   k.sender,
+		SenderDeviceID: d.DeviceID,
+		SenderKey:      k.senderKey,
+		SigningKey:     d.Ed25519,
+		Session:        session,
+	}
+	slog.Info("received room key", "session_id", k.SessionID, "room_id", k.RoomID, "sender", k.sender)
+	return nil
+}
+
+// decryptOlm decrypts with an existing session or, for pre-key messages,
+// a new inbound session.
+func (m *Machine) decryptOlm(senderKey string, msgType int, body []byte) ([]byte, error) {
+	for _, s := range m.state.Sessions[senderKey] {
+		if msgType == olm.MsgTypePreKey && !s.MatchesInbound(senderKey, body) {
+			continue
+		}
+		if plaintext, err := s.Decrypt(msgType, body); err == nil {
+			return plaintext, nil
+		}
+	}
+	if msgType != olm.MsgTypePreKey {
+		return nil, errors.New("no matching olm session")
+	}
+
+	session, err := m.state.Account.NewInboundSession(senderKey, body)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := session.Decrypt(msgType, body)
+	if err != nil {
+		return nil, err
+	}
+	m.state.Account.RemoveOneTimeKeys(session)
+	m.state.Sessions[senderKey] = append(m.state.Sessions[senderKey], session)
+	return plaintext, nil
+}
+
+// senderDevice returns the device of userID with the Curve25519 key
+// senderKey, querying the device list again if the cached one lacks it. It
+// is called without m.mu held.
+func (m *Machine) senderDevice(ctx context.Context, userID, senderKey string) (*Device, error) {
+	for attempt := 0; attempt < 2; attempt++ {
+		devices, err := m.devicesFor(ctx, []string{userID})
+		if err != nil {
+			return nil, err
+		}
+		for _, d := range devices {
+			if d.Curve25519 == senderKey {
+				return d, nil
+			}
+		}
+		m.mu.Lock()
+		delete(m.devices, userID)
+		m.mu.Unlock()
+	}
+	return nil, fmt.Errorf("no device of %s has sender key %s", userID, senderKey)
+}
+
+// devicesFor returns the verified devices of users, other than the bot's
+// own. It is called without m.mu held.
+func (m *Machine) devicesFor(ctx context.Context, users []string) ([]*Device, error) {
+	m.mu.Lock()
+	var missing []string
+	for _, u := range users {
+		if _, ok := m.devices[u]; !ok {
+			missing = append(missing, u)
+		}
+	}
+	gen := m.devicesGen
+	m.mu.Unlock()
+
+	queried := make(map[string]map[string]*Device)
+	if len(missing) > 0 {
+		keys, err := m.client.QueryKeys(ctx, m.userID, missing)
+		if err != nil {
+			return nil, fmt.Errorf("e2ee: querying device keys: %w", err)
+		}
+		for _, u := range missing {
+			devices := make(map[string]*Device)
+			for deviceID, raw := range keys[u] {
+				d, err := parseDevice(u, deviceID, raw)
+				if err != nil {
+					slog.Warn("ignoring device", "error", err)
+					continue
+				}
+				devices[deviceID] = d
+			}
+			queried[u] = devices
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	// Device lists that changed during the query are fetched again next time
+	if gen == m.devicesGen {
+		for u, devices := range queried {
+			m.devices[u] = devices
+		}
+	}
+	var devices []*Device
+	for _, u := range users {
+		userDevices, ok := queried[u]
+		if !ok {
+			userDevices = m.devices[u]
+		}
+		for _, d := range userDevices {
+			if u == m.userID && d.DeviceID == m.state.DeviceID {
+				continue
+			}
+			devices = append(devices, d)
+		}
+	}
+	return devices, nil
+}
+
+// uploadKeys publishes unpublished one-time and fallback keys, and the
+// device keys when withDevice is set. It returns the one-time key counts.
+func (m *Machine) uploadKeys(ctx context.Context, withDevice bool) (map[string]int, error) {
+	account := m.state.Account
+	deviceID := m.state.DeviceID
+	body := map[string]interface{}{}
+
+	if withDevice {
+		deviceKeys := map[string]interface{}{
+			"user_id":    m.userID,
+			"device_id":  deviceID,
+			"algorithms": []string{AlgorithmOlm, AlgorithmMegolm},
+			"keys": map[string]string{
+				"curve25519:" + deviceID: account.Curve25519(),
+				"ed25519:" + deviceID:    account.Ed25519(),
+			},
+		}
+		if err := sign(account, m.userID, deviceID, deviceKeys); err != nil {
+			return nil, err
+		}
+		body["device_keys"] = deviceKeys
+	}
+
+	oneTimeKeys := map[string]interface{}{}
+	for _, k := range account.UnpublishedOneTimeKeys() {
+		obj := map[string]interface{}{"key": olm.Encode(k.Public)}
+		if err := sign(account, m.userID, deviceID, obj); err != nil {
+			return nil, err
+		}
+		oneTimeKeys[signedCurve25519+":"+k.KeyID()] = obj
+	}
+	body["one_time_keys"] = oneTimeKeys
+
+	if k := account.UnpublishedFallbackKey(); k != nil {
+		obj := map[string]interface{}{"key": olm.Encode(k.Public), "fallback": true}
+		if err := sign(account, m.userID, deviceID, obj); err != nil {
+			return nil, err
+		}
+		body["fallback_keys"] = map[string]interface{}{signedCurve25519 + ":" + k.KeyID(): obj}
+	}
+
+	counts, err := m.client.UploadKeys(ctx, m.userID, body)
+	if err != nil {
+		return nil, err
+	}
+	account.MarkKeysAsPublished()
+	return counts, m.save()
+}
+
+// topUpOneTimeKeys uploads enough new one-time keys to reach the target.
+func (m *Machine) topUpOneTimeKeys(ctx context.Context, count int) error {
+	if count >= targetOneTimeKeys {
+		return nil
+	}
+	if err := m.state.Account.GenerateOneTimeKeys(targetOneTimeKeys - count); err != nil {
+		return err
+	}
+	_, err := m.uploadKeys(ctx, false)
+	return err
+}
+
+func (m *Machine) save() error {
+	return m.store.Save(m.state)
+}
@@ -0,0 +1,337 @@
+package e2ee
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// fakeHomeserver keeps uploaded keys and queued to-device events in memory
+// so that two machines can talk to each other.
+type fakeHomeserver struct {
+	deviceKeys  map[string]map[string]json.RawMessage
+	oneTimeKeys map[string]map[string]map[string]json.RawMessage
+	toDevice    map[string][]ToDeviceEvent
+	members     map[string][]string
+	logins      int
+	// joining, when set, receives a channel that JoinedMembers waits on
+	joining chan chan struct{}
+}
+
+func newFakeHomeserver() *fakeHomeserver {
+	return &fakeHomeserver{
+		deviceKeys:  make(map[string]map[string]json.RawMessage),
+		oneTimeKeys: make(map[string]map[string]map[string]json.RawMessage),
+		toDevice:    make(map[string][]ToDeviceEvent),
+		members:     make(map[string][]string),
+	}
+}
+
+// drain returns the extensions of a transaction carrying userID's queued
+// to-device events.
+func (hs *fakeHomeserver) drain(userID string) Extensions {
+	events := hs.toDevice[userID]
+	delete(hs.toDevice, userID)
+	return Extensions{ToDevice: events}
+}
+
+type fakeClient struct {
+	hs       *fakeHomeserver
+	userID   string
+	deviceID string
+}
+
+func (c *fakeClient) LoginAppService(_ context.Context, _, _, _ string) (string, error) {
+	c.hs.logins++
+	return c.deviceID, nil
+}
+
+func (c *fakeClient) UploadKeys(_ context.Context, userID string, keys map[string]interface{}) (map[string]int, error) {
+	raw, _ := json.Marshal(keys)
+	var body struct {
+		DeviceKeys  json.RawMessage            `json:"device_keys"`
+		OneTimeKeys map[string]json.RawMessage `json:"one_time_keys"`
+	}
+	_ = json.Unmarshal(raw, &body)
+	if body.DeviceKeys != nil {
+		if c.hs.deviceKeys[userID] == nil {
+			c.hs.deviceKeys[userID] = make(map[string]json.RawMessage)
+		}
+		c.hs.deviceKeys[userID][c.deviceID] = body.DeviceKeys
+	}
+	if c.hs.oneTimeKeys[userID] == nil {
+		c.hs.oneTimeKeys[userID] = make(map[string]map[string]json.RawMessage)
+	}
+	otks := c.hs.oneTimeKeys[userID][c.deviceID]
+	if otks == nil {
+		otks = make(map[string]json.RawMessage)
+		c.hs.oneTimeKeys[userID][c.deviceID] = otks
+	}
+	for id, k := range body.OneTimeKeys {
+		otks[id] = k
+	}
+	return map[string]int{signedCurve25519: len(otks)}, nil
+}
+
+func (c *fakeClient) QueryKeys(_ context.Context, _ string, users []string) (map[string]map[string]json.RawMessage, error) {
+	out := make(map[string]map[string]json.RawMessage)
+	for _, u := range users {
+		out[u] = c.hs.deviceKeys[u]
+	}
+	return out, nil
+}
+
+func (c *fakeClient) ClaimKeys(_ context.Context, _ string, devices map[string]map[string]string) (map[string]map[string]map[string]json.RawMessage, error) {
+	out := make(map[string]map[string]map[string]json.RawMessage)
+	for userID, ds := range devices {
+		out[userID] = make(map[string]map[string]json.RawMessage)
+		for deviceID := range ds {
+			for id, k := range c.hs.oneTimeKeys[userID][deviceID] {
+				out[userID][deviceID] = map[string]json.RawMessage{id: k}
+				delete(c.hs.oneTimeKeys[userID][deviceID], id)
+				break
+			}
+		}
+	}
+	return out, nil
+}
+
+func (c *fakeClient) SendToDevice(_ context.Context, userID, eventType string, messages map[string]map[string]interface{}) error {
+	for toUser, devices := range messages {
+		for toDevice, content := range devices {
+			raw, _ := json.Marshal(content)
+			c.hs.toDevice[toUser] = append(c.hs.toDevice[toUser], ToDeviceEvent{
+				Type: eventType, Sender: userID, Content: raw, ToUserID: toUser, ToDeviceID: toDevice,
+			})
+		}
+	}
+	return nil
+}
+
+func (c *fakeClient) JoinedMembers(_ context.Context, roomID string) ([]string, error) {
+	if c.hs.joining != nil {
+		release := make(chan struct{})
+		c.hs.joining <- release
+		<-release
+	}
+	return c.hs.members[roomID], nil
+}
+
+func startMachine(t *testing.T, hs *fakeHomeserver, userID, localpart string, store *Store) *Machine {
+	t.Helper()
+	client := &fakeClient{hs: hs, userID: userID, deviceID: "DEVICE_" + strings.ToUpper(localpart)}
+	m := NewMachine(client, store, userID, localpart, "test")
+	if err := m.Start(context.Background()); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	return m
+}
+
+const roomID = "!room:example.org"
+
+func TestMachine_EncryptDecrypt(t *testing.T) {
+	hs := newFakeHomeserver()
+	hs.members[roomID] = []string{"@webhook:example.org", "@alice:example.org"}
+	dir := t.TempDir()
+	bot := startMachine(t, hs, "@webhook:example.org", "webhook", NewStore(filepath.Join(dir, "bot.json"), ""))
+	alice := startMachine(t, hs, "@alice:example.org", "alice", NewStore(filepath.Join(dir, "alice.json"), ""))
+
+	if n := len(hs.oneTimeKeys["@webhook:example.org"]["DEVICE_WEBHOOK"]); n != targetOneTimeKeys {
+		t.Errorf("Expected %d one-time keys uploaded, got %d", targetOneTimeKeys, n)
+	}
+
+	// The bot sends into the room; Alice receives the room key over Olm.
+	encrypted, err := bot.Encrypt(context.Background(), roomID, "m.room.message", map[string]interface{}{"msgtype": "m.notice", "body": "hello"})
+	if err != nil {
+		t.Fatalf("Encrypt failed: %v", err)
+	}
+	if encrypted["algorithm"] != AlgorithmMegolm || encrypted["device_id"] != "DEVICE_WEBHOOK" {
+		t.Errorf("Unexpected encrypted content: %v", encrypted)
+	}
+	alice.ProcessExtensions(context.Background(), hs.drain("@alice:example.org"))
+	eventType, content, err := alice.Decrypt(roomID, "$1", "@webhook:example.org", encrypted)
+	if err != nil {
+		t.Fatalf("Alice Decrypt failed: %v", err)
+	}
+	if eventType != "m.room.message" || content["body"] != "hello" {
+		t.Errorf("Unexpected decrypted event: %s %v", eventType, content)
+	}
+
+	// Alice replies; the bot receives her room key and decrypts.
+	reply, err := alice.Encrypt(context.Background(), roomID, "m.room.message", map[string]interface{}{"msgtype": "m.text", "body": "!deploy"})
+	if err != nil {
+		t.Fatalf("Encrypt failed: %v", err)
+	}
+	if _, _, err := bot.Decrypt(roomID, "$2", "@alice:example.org", reply); !errors.Is(err, ErrNoSession) {
+		t.Errorf("Expected ErrNoSession before the key arrives, got %v", err)
+	}
+	bot.ProcessExtensions(context.Background(), hs.drain("@webhook:example.org"))
+	_, content, err = bot.Decrypt(roomID, "$2", "@alice:example.org", reply)
+	if err != nil || content["body"] != "!deploy" {
+		t.Fatalf("Unexpected bot decryption: %v, %v", content, err)
+	}
+
+	// The same ciphertext under another event ID is a replay.
+	if _, _, err := bot.Decrypt(roomID, "$3", "@alice:example.org", reply); err == nil {
+		t.Error("Expected replayed message index to be rejected")
+	}
+	// And it cannot be moved into another room.
+	if _, _, err := bot.Decrypt("!other:example.org", "$2", "@alice:example.org", reply); err == nil {
+		t.Error("Expected decryption in another room to fail")
+	}
+	// Nor attributed to another sender or device.
+	if _, _, err := bot.Decrypt(roomID, "$2", "@mallory:example.org", reply); err == nil {
+		t.Error("Expected decryption for another sender to fail")
+	}
+	reply["device_id"] = "DEVICE_MALLORY"
+	if _, _, err := bot.Decrypt(roomID, "$2", "@alice:example.org", reply); err == nil {
+		t.Error("Expected decryption for another device to fail")
+	}
+}
+
+func TestMachine_RoomKeyOwner(t *testing.T) {
+	hs := newFakeHomeserver()
+	hs.members[roomID] = []string{"@webhook:example.org", "@mallory:example.org"}
+	dir := t.TempDir()
+	bot := startMachine(t, hs, "@webhook:example.org", "webhook", NewStore(filepath.Join(dir, "bot.json"), ""))
+	mallory := startMachine(t, hs, "@mallory:example.org", "mallory", NewStore(filepath.Join(dir, "mallory.json"), ""))
+
+	// A room key from a device the homeserver does not list for its sender
+	// is not accepted.
+	msg, err := mallory.Encrypt(context.Background(), roomID, "m.room.message", map[string]interface{}{"body": "unverified"})
+	if err != nil {
+		t.Fatalf("Encrypt failed: %v", err)
+	}
+	published := hs.deviceKeys["@mallory:example.org"]
+	delete(hs.deviceKeys, "@mallory:example.org")
+	bot.ProcessExtensions(context.Background(), hs.drain("@webhook:example.org"))
+	if _, _, err := bot.Decrypt(roomID, "$1", "@mallory:example.org", msg); !errors.Is(err, ErrNoSession) {
+		t.Errorf("Expected the room key of an unlisted device to be dropped, got %v", err)
+	}
+
+	// Once accepted, the session only decrypts events of the key's sender.
+	hs.deviceKeys["@mallory:example.org"] = published
+	mallory.state.Outbound = make(map[string]*OutboundSession)
+	msg, err = mallory.Encrypt(context.Background(), roomID, "m.room.message", map[string]interface{}{"body": "as alice"})
+	if err != nil {
+		t.Fatalf("Encrypt failed: %v", err)
+	}
+	bot.ProcessExtensions(context.Background(), hs.drain("@webhook:example.org"))
+	if _, _, err := bot.Decrypt(roomID, "$2", "@alice:example.org", msg); err == nil {
+		t.Error("Expected an event attributed to another user to be rejected")
+	}
+	if _, content, err := bot.Decrypt(roomID, "$2", "@mallory:example.org", msg); err != nil || content["body"] != "as alice" {
+		t.Errorf("Unexpected decryption: %v, %v", content, err)
+	}
+}
+
+func TestMachine_EncryptDoesNotBlockDecrypt(t *testing.T) {
+	hs := newFakeHomeserver()
+	hs.members[roomID] = []string{"@webhook:example.org", "@alice:example.org"}
+	dir := t.TempDir()
+	bot := startMachine(t, hs, "@webhook:example.org", "webhook", NewStore(filepath.Join(dir, "bot.json"), ""))
+	alice := startMachine(t, hs, "@alice:example.org", "alice", NewStore(filepath.Join(dir, "alice.json"), ""))
+	msg, err := alice.Encrypt(context.Background(), roomID, "m.room.message", map[string]interface{}{"body": "hi"})
+	if err != nil {
+		t.Fatalf("Encrypt failed: %v", err)
+	}
+	bot.ProcessExtensions(context.Background(), hs.drain("@webhook:example.org"))
+
+	// While the bot's Encrypt waits for the homeserver, decryption goes on
+	hs.joining = make(chan chan struct{})
+	done := make(chan error)
+	go func() {
+		_, err := bot.Encrypt(context.Background(), roomID, "m.room.message", map[string]interface{}{"body": "reply"})
+		done <- err
+	}()
+	release := <-hs.joining
+	if _, content, err := bot.Decrypt(roomID, "$1", "@alice:example.org", msg); err != nil || content["body"] != "hi" {
+		t.Errorf("Unexpected decryption: %v, %v", content, err)
+	}
+	close(release)
+	if err := <-done; err != nil {
+		t.Errorf("Encrypt failed: %v", err)
+	}
+}
+
+func TestMachine_RestoresFromStore(t *testing.T) {
+	hs := newFakeHomeserver()
+	hs.members[roomID] = []string{"@webhook:example.org", "@alice:example.org"}
+	dir := t.TempDir()
+	botStore := NewStore(filepath.Join(dir, "bot.json"), "pickle")
+	bot := startMachine(t, hs, "@webhook:example.org", "webhook", botStore)
+	alice := startMachine(t, hs, "@alice:example.org", "alice", NewStore(filepath.Join(dir, "alice.json"), ""))
+
+	msg, err := alice.Encrypt(context.Background(), roomID, "m.room.message", map[string]interface{}{"body": "before restart"})
+	if err != nil {
+		t.Fatalf("Encrypt failed: %v", err)
+	}
+	bot.ProcessExtensions(context.Background(), hs.drain("@webhook:example.org"))
+	curve, _ := bot.IdentityKeys()
+
+	restarted := startMachine(t, hs, "@webhook:example.org", "webhook", botStore)
+	if hs.logins != 2 {
+		t.Errorf("Expected the restarted bot to reuse its device, got %d logins", hs.logins)
+	}
+	if c, _ := restarted.IdentityKeys(); c != curve {
+		t.Error("Expected identity keys to be restored")
+	}
+	if _, content, err := restarted.Decrypt(roomID, "$1", "@alice:example.org", msg); err != nil || content["body"] != "before restart" {
+		t.Errorf("Unexpected decryption after restart: %v, %v", content, err)
+	}
+
+	// Later messages reuse the existing Olm session, with no new key claims.
+	remaining := len(hs.oneTimeKeys["@webhook:example.org"]["DEVICE_WEBHOOK"])
+	msg, _ = alice.Encrypt(context.Background(), roomID, "m.room.message", map[string]interface{}{"body": "again"})
+	if _, content, err := restarted.Decrypt(roomID, "$2", "@alice:example.org", msg); err != nil || content["body"] != "again" {
+		t.Errorf("Unexpected decryption: %v, %v", content, err)
+	}
+	if n := len(hs.oneTimeKeys["@webhook:example.org"]["DEVICE_WEBHOOK"]); n != remaining {
+		t.Errorf("Expected no further one-time key claims, %d -> %d", remaining, n)
+	}
+}
+
+func TestStore_PickleKey(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "store.json")
+	if err := NewStore(path, "secret").Save(&State{DeviceID: "DEVICE"}); err != nil {
+		t.Fatalf("Save failed: %v", err)
+	}
+
+	raw, _ := os.ReadFile(path)
+	if strings.Contains(string(raw), "DEVICE") {
+		t.Error("Expected the store to be encrypted at rest")
+	}
+	if info, _ := os.Stat(path); info.Mode().Perm() != 0o600 {
+		t.Errorf("Expected mode 0600, got %v", info.Mode().Perm())
+	}
+
+	state, err := NewStore(path, "secret").Load()
+	if err != nil || state.DeviceID != "DEVICE" {
+		t.Errorf("Unexpected state: %+v, %v", state, err)
+	}
+	if _, err := NewStore(path, "wrong").Load(); err == nil {
+		t.Error("Expected loading with the wrong pickle key to fail")
+	}
+}
+
+func TestVerifySigned(t *testing.T) {
+	hs := newFakeHomeserver()
+	startMachine(t, hs, "@alice:example.org", "alice", NewStore(filepath.Join(t.TempDir(), "alice.json"), ""))
+
+	raw := hs.deviceKeys["@alice:example.org"]["DEVICE_ALICE"]
+	if _, err := parseDevice("@alice:example.org", "DEVICE_ALICE", raw); err != nil {
+		t.Fatalf("Expected device keys to verify, got %v", err)
+	}
+	if _, err := parseDevice("@mallory:example.org", "DEVICE_ALICE", raw); err == nil {
+		t.Error("Expected keys claimed for another user to be rejected")
+	}
+
+	tampered := []byte(strings.Replace(string(raw), "m.megolm.v1.aes-sha2", "m.megolm.v2.aes-sha2", 1))
+	if _, err := parseDevice("@alice:example.org", "DEVICE_ALICE", tampered); err == nil {
+		t.Error("Expected tampered device keys to be rejected")
+	}
+}
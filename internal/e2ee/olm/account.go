@@ -0,0 +1,263 @@
+package olm
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// maxOneTimeKeys is the number of one-time keys an account keeps, matching libolm.
+const maxOneTimeKeys = 100
+
+// ErrUnknownOneTimeKey is returned when a pre-key message references a
+// one-time key this account does not hold.
+var ErrUnknownOneTimeKey = errors.New("olm: unknown one-time key")
+
+// OneTimeKey is a Curve25519 key published for establishing sessions.
+type OneTimeKey struct {
+	ID        uint32 `json:"id"`
+	Private   []byte `json:"private"`
+	Public    []byte `json:"public"`
+	Published bool   `json:"published"`
+}
+
+// KeyID returns the key's identifier as used in /keys/upload.
+func (k *OneTimeKey) KeyID() string {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], k.ID)
+	return Encode(b[:])
+}
+
+// Account holds a device's long-term identity keys and one-time keys.
+// It is serialisable with encoding/json.
+type Account struct {
+	IdentityPrivate []byte             `json:"identity_private"`
+	IdentityPublic  []byte             `json:"identity_public"`
+	SigningKey      ed25519.PrivateKey `json:"signing_key"`
+	OneTimeKeys     []*OneTimeKey      `json:"one_time_keys"`
+	FallbackKey     *OneTimeKey        `json:"fallback_key,omitempty"`
+	PrevFallbackKey *OneTimeKey        `json:"prev_fallback_key,omitempty"`
+	NextKeyID       uint32             `json:"next_key_id"`
+}
+
+// NewAccount generates fresh identity keys.
+func NewAccount() (*Account, error) {
+	identity, err := newCurveKey()
+	if err != nil {
+		return nil, err
+	}
+	_, signing, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return &Account{
+		IdentityPrivate: identity.Bytes(),
+		IdentityPublic:  identity.PublicKey().Bytes(),
+		SigningKey:      signing,
+		NextKeyID:       1,
+	}, nil
+}
+
+// Curve25519 returns the base64 identity key.
+func (a *Account) Curve25519() string {
+	return Encode(a.IdentityPublic)
+}
+
+// Ed25519 returns the base64 fingerprint key.
+func (a *Account) Ed25519() string {
+	return Encode(a.SigningKey.Public().(ed25519.PublicKey))
+}
+
+// Sign returns the base64 Ed25519 signature of message.
+func (a *Account) Sign(message []byte) string {
+	return Encode(ed25519.Sign(a.SigningKey, message))
+}
+
+// GenerateOneTimeKeys adds n unpublished one-time keys, discarding the
+// oldest keys beyond the maximum the account keeps.
+func (a *Account) GenerateOneTimeKeys(n int) error {
+	for i := 0; i < n; i++ {
+		key, err := a.newKey()
+		if err != nil {
+			return err
+		}
+		a.OneTimeKeys = append(a.OneTimeKeys, key)
+	}
+	if extra := len(a.OneTimeKeys) - maxOneTimeKeys; extra > 0 {
+		a.OneTimeKeys = a.OneTimeKeys[extra:]
+	}
+	return nil
+}
+
+// GenerateFallbackKey rotates the fallback key, keeping the previous one
+// so that in-flight pre-key messages can still be decrypted.
+func (a *Account) GenerateFallbackKey() error {
+	key, err := a.newKey()
+	if err != nil {
+		return err
+	}
+	a.PrevFallbackKey = a.FallbackKey
+	a.FallbackKey = key
+	return nil
+}
+
+func (a *Account) newKey() (*OneTimeKey, error) {
+	priv, err := newCurveKey()
+	if err != nil {
+		return nil, err
+	}
+	key := &OneTimeKey{ID: a.NextKeyID, Private: priv.Bytes(), Public: priv.PublicKey().Bytes()}
+	a.NextKeyID++
+	return key, nil
+}
+
+// UnpublishedOneTimeKeys returns the one-time keys not yet uploaded.
+func (a *Account) UnpublishedOneTimeKeys() []*OneTimeKey {
+	var keys []*OneTimeKey
+	for _, k := range a.OneTimeKeys {
+		if !k.Published {
+			keys = append(keys, k)
+		}
+	}
+	return keys
+}
+
+// UnpublishedFallbackKey returns the fallback key if it has not been uploaded.
+func (a *Account) UnpublishedFallbackKey() *OneTimeKey {
+	if a.FallbackKey != nil && !a.FallbackKey.Published {
+		return a.FallbackKey
+	}
+	return nil
+}
+
+// MarkKeysAsPublished marks all one-time and fallback keys as uploaded.
+func (a *Account) MarkKeysAsPublished() {
+	for _, k := range a.OneTimeKeys {
+		k.Published = true
+	}
+	if a.FallbackKey != nil {
+		a.FallbackKey.Published = true
+	}
+}
+
+// findKey returns the private part of a one-time or fallback key.
+func (a *Account) findKey(public []byte) (*OneTimeKey, bool) {
+	for _, k := range a.OneTimeKeys {
+		if bytes.Equal(k.Public, public) {
+			return k, false
+		}
+	}
+	for _, k := range []*OneTimeKey{a.FallbackKey, a.PrevFallbackKey} {
+		if k != nil && bytes.Equal(k.Public, public) {
+			return k, true
+		}
+	}
+	return nil, false
+}
+
+// RemoveOneTimeKeys deletes the one-time key used to establish session.
+// Fallback keys are reusable and are left in place.
+func (a *Account) RemoveOneTimeKeys(s *Session) {
+	for i, k := range a.OneTimeKeys {
+		if bytes.Equal(k.Public, s.BobOneTimeKey) {
+			a.OneTimeKeys = append(a.OneTimeKeys[:i], a.OneTimeKeys[i+1:]...)
+			return
+		}
+	}
+}
+
+// NewInboundSession creates a session from a pre-key message sent by the
+// device with the given identity key. The caller should decrypt the message
+// with the session and then call RemoveOneTimeKeys.
+func (a *Account) NewInboundSession(theirIdentityKey string, message []byte) (*Session, error) {
+	pre, err := decodePreKeyMessage(message)
+	if err != nil {
+		return nil, err
+	}
+	identity, err := Decode(theirIdentityKey)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(identity, pre.identityKey) {
+		return nil, fmt.Errorf("%w: identity key mismatch", ErrBadMessage)
+	}
+	otk, _ := a.findKey(pre.oneTimeKey)
+	if otk == nil {
+		return nil, ErrUnknownOneTimeKey
+	}
+	inner, err := decodeMessage(pre.message)
+	if err != nil {
+		return nil, err
+	}
+
+	// The triple Diffie-Hellman from the sender's point of view is
+	// I_A·E_B || E_A·I_B || E_A·E_B, which we compute from our side.
+	var secret []byte
+	for _, pair := range [][2][]byte{
+		{otk.Private, pre.identityKey},
+		{a.IdentityPrivate, pre.baseKey},
+		{otk.Private, pre.baseKey},
+	} {
+		s, err := sharedSecret(pair[0], pair[1])
+		if err != nil {
+			return nil, err
+		}
+		secret = append(secret, s...)
+	}
+
+	s := &Session{
+		AliceIdentityKey: pre.identityKey,
+		AliceBaseKey:     pre.baseKey,
+		BobOneTimeKey:    pre.oneTimeKey,
+	}
+	if err := s.initialiseAsBob(secret, inner.ratchetKey); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// NewOutboundSession creates a session to the device with the given base64
+// identity key and one-time key.
+func (a *Account) NewOutboundSession(theirIdentityKey, theirOneTimeKey string) (*Session, error) {
+	identity, err := Decode(theirIdentityKey)
+	if err != nil {
+		return nil, err
+	}
+	otk, err := Decode(theirOneTimeKey)
+	if err != nil {
+		return nil, err
+	}
+	if len(identity) != keyLength || len(otk) != keyLength {
+		return nil, fmt.Errorf("%w: bad key length", ErrBadMessage)
+	}
+	base, err := newCurveKey()
+	if err != nil {
+		return nil, err
+	}
+
+	var secret []byte
+	for _, pair := range [][2][]byte{
+		{a.IdentityPrivate, otk},
+		{base.Bytes(), identity},
+		{base.Bytes(), otk},
+	} {
+		s, err := sharedSecret(pair[0], pair[1])
+		if err != nil {
+			return nil, err
+		}
+		secret = append(secret, s...)
+	}
+
+	s := &Session{
+		AliceIdentityKey: a.IdentityPublic,
+		AliceBaseKey:     base.PublicKey().Bytes(),
+		BobOneTimeKey:    otk,
+	}
+	if err := s.initialiseAsAlice(secret); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
@@ -0,0 +1,279 @@
+package olm
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+)
+
+const (
+	megolmParts      = 4
+	megolmPartLength = 32
+	megolmKeysInfo   = "MEGOLM_KEYS"
+
+	sessionKeyVersion = 2
+	sessionKeyLength  = 1 + 4 + megolmParts*megolmPartLength + ed25519.PublicKeySize + ed25519.SignatureSize
+
+	// Session exports, as in key backups and m.forwarded_room_key, carry
+	// the ratchet and public key without a signature.
+	exportVersion = 1
+	exportLength  = 1 + 4 + megolmParts*megolmPartLength + ed25519.PublicKeySize
+
+	// Megolm message field tags.
+	tagMessageIndex    = 0x08
+	tagGroupCiphertext = 0x12
+)
+
+// megolmRatchet is the four-part hash ratchet behind a Megolm session.
+type megolmRatchet struct {
+	Data    []byte `json:"data"`
+	Counter uint32 `json:"counter"`
+}
+
+func (r *megolmRatchet) part(i int) []byte {
+	return r.Data[i*megolmPartLength : (i+1)*megolmPartLength]
+}
+
+// rehash sets R(to) = HMAC(R(from), to).
+func (r *megolmRatchet) rehash(from, to int) {
+	copy(r.part(to), hmacSHA256(r.part(from), []byte{byte(to)}))
+}
+
+func (r *megolmRatchet) advance() {
+	mask := uint32(0x00FFFFFF)
+	h := 0
+	r.Counter++
+	for h < megolmParts {
+		if r.Counter&mask == 0 {
+			break
+		}
+		h++
+		mask >>= 8
+	}
+	for i := megolmParts - 1; i >= h; i-- {
+		r.rehash(h, i)
+	}
+}
+
+// advanceTo advances the ratchet to index, taking shortcuts through the
+// higher-order parts as libolm does.
+func (r *megolmRatchet) advanceTo(index uint32) {
+	for j := 0; j < megolmParts; j++ {
+		shift := uint((megolmParts - j - 1) * 8)
+		mask := ^uint32(0) << shift
+		steps := ((index >> shift) - (r.Counter >> shift)) & 0xff
+		if steps == 0 {
+			if index < r.Counter {
+				steps = 0x100
+			} else {
+				continue
+			}
+		}
+		for ; steps > 1; steps-- {
+			r.rehash(j, j)
+		}
+		for k := megolmParts - 1; k >= j; k-- {
+			r.rehash(j, k)
+		}
+		r.Counter = index & mask
+	}
+}
+
+func (r megolmRatchet) clone() megolmRatchet {
+	return megolmRatchet{Data: append([]byte{}, r.Data...), Counter: r.Counter}
+}
+
+// OutboundGroupSession encrypts room messages with Megolm.
+type OutboundGroupSession struct {
+	Ratchet    megolmRatchet      `json:"ratchet"`
+	SigningKey ed25519.PrivateKey `json:"signing_key"`
+}
+
+// NewOutboundGroupSession creates a session with a random ratchet.
+func NewOutboundGroupSession() (*OutboundGroupSession, error) {
+	data := make([]byte, megolmParts*megolmPartLength)
+	if _, err := rand.Read(data); err != nil {
+		return nil, err
+	}
+	_, signing, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return &OutboundGroupSession{Ratchet: megolmRatchet{Data: data}, SigningKey: signing}, nil
+}
+
+// ID returns the session ID, the base64 Ed25519 public key.
+func (s *OutboundGroupSession) ID() string {
+	return Encode(s.SigningKey.Public().(ed25519.PublicKey))
+}
+
+// MessageIndex returns the index of the next message.
+func (s *OutboundGroupSession) MessageIndex() uint32 {
+	return s.Ratchet.Counter
+}
+
+// SessionKey exports the current ratchet state for sharing in m.room_key.
+func (s *OutboundGroupSession) SessionKey() string {
+	b := []byte{sessionKeyVersion}
+	b = binary.BigEndian.AppendUint32(b, s.Ratchet.Counter)
+	b = append(b, s.Ratchet.Data...)
+	b = append(b, s.SigningKey.Public().(ed25519.PublicKey)...)
+	b = append(b, ed25519.Sign(s.SigningKey, b)...)
+	return Encode(b)
+}
+
+// Encrypt encrypts plaintext and advances the ratchet. It returns the base64
+// ciphertext as used in m.room.encrypted events.
+func (s *OutboundGroupSession) Encrypt(plaintext []byte) (string, error) {
+	keys, err := deriveKeys(s.Ratchet.Data, megolmKeysInfo)
+	if err != nil {
+		return "", err
+	}
+	ciphertext, err := keys.encryptCBC(plaintext)
+	if err != nil {
+		return "", err
+	}
+	msg := []byte{messageVersion}
+	msg = appendVarintField(msg, tagMessageIndex, uint64(s.Ratchet.Counter))
+	msg = appendBytesField(msg, tagGroupCiphertext, ciphertext)
+	msg = append(msg, keys.mac(msg)...)
+	msg = append(msg, ed25519.Sign(s.SigningKey, msg)...)
+	s.Ratchet.advance()
+	return Encode(msg), nil
+}
+
+// InboundGroupSession decrypts room messages from one sender's Megolm session.
+type InboundGroupSession struct {
+	InitialRatchet megolmRatchet     `json:"initial_ratchet"`
+	LatestRatchet  megolmRatchet     `json:"latest_ratchet"`
+	SigningKey     ed25519.PublicKey `json:"signing_key"`
+}
+
+// NewInboundGroupSession imports a base64 session key from an m.room_key event.
+func NewInboundGroupSession(sessionKey string) (*InboundGroupSession, error) {
+	b, err := Decode(sessionKey)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) != sessionKeyLength || b[0] != sessionKeyVersion {
+		return nil, fmt.Errorf("%w: bad session key", ErrBadMessage)
+	}
+	signed := b[:len(b)-ed25519.SignatureSize]
+	pub := ed25519.PublicKey(signed[len(signed)-ed25519.PublicKeySize:])
+	if !ed25519.Verify(pub, signed, b[len(signed):]) {
+		return nil, ErrBadSignature
+	}
+	r := megolmRatchet{
+		Data:    append([]byte{}, b[5:5+megolmParts*megolmPartLength]...),
+		Counter: binary.BigEndian.Uint32(b[1:5]),
+	}
+	return &InboundGroupSession{
+		InitialRatchet: r,
+		LatestRatchet:  r.clone(),
+		SigningKey:     append(ed25519.PublicKey{}, pub...),
+	}, nil
+}
+
+// ImportInboundGroupSession imports a base64 session export. Exports are
+// not signed, so the caller must trust whoever it got the export from.
+func ImportInboundGroupSession(exported string) (*InboundGroupSession, error) {
+	b, err := Decode(exported)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) != exportLength || b[0] != exportVersion {
+		return nil, fmt.Errorf("%w: bad session export", ErrBadMessage)
+	}
+	r := megolmRatchet{
+		Data:    append([]byte{}, b[5:5+megolmParts*megolmPartLength]...),
+		Counter: binary.BigEndian.Uint32(b[1:5]),
+	}
+	return &InboundGroupSession{
+		InitialRatchet: r,
+		LatestRatchet:  r.clone(),
+		SigningKey:     append(ed25519.PublicKey{}, b[5+megolmParts*megolmPartLength:]...),
+	}, nil
+}
+
+// Export returns the base64 session export from message index on. It
+// fails for an index before the first known one.
+func (s *InboundGroupSession) Export(index uint32) (string, error) {
+	if index < s.InitialRatchet.Counter {
+		return "", fmt.Errorf("olm: unknown message index %d (first known %d)", index, s.InitialRatchet.Counter)
+	}
+	r := s.InitialRatchet.clone()
+	if index >= s.LatestRatchet.Counter {
+		r = s.LatestRatchet.clone()
+	}
+	r.advanceTo(index)
+	b := []byte{exportVersion}
+	b = binary.BigEndian.AppendUint32(b, r.Counter)
+	b = append(b, r.Data...)
+	b = append(b, s.SigningKey...)
+	return Encode(b), nil
+}
+
+// ID returns the session ID, the base64 Ed25519 public key.
+func (s *InboundGroupSession) ID() string {
+	return Encode(s.SigningKey)
+}
+
+// FirstKnownIndex returns the earliest message index the session can decrypt.
+func (s *InboundGroupSession) FirstKnownIndex() uint32 {
+	return s.InitialRatchet.Counter
+}
+
+// Decrypt decrypts a base64 Megolm ciphertext, returning the plaintext and
+// the message index.
+func (s *InboundGroupSession) Decrypt(ciphertext string) ([]byte, uint32, error) {
+	b, err := Decode(ciphertext)
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(b) < 1+macLength+ed25519.SignatureSize || b[0] != messageVersion {
+		return nil, 0, ErrBadMessage
+	}
+	signed := b[:len(b)-ed25519.SignatureSize]
+	if !ed25519.Verify(s.SigningKey, signed, b[len(signed):]) {
+		return nil, 0, ErrBadSignature
+	}
+	body := signed[:len(signed)-macLength]
+	ints, data, err := decodeFields(body[1:])
+	if err != nil {
+		return nil, 0, err
+	}
+	index64, ok := ints[tagMessageIndex]
+	if !ok || data[tagGroupCiphertext] == nil {
+		return nil, 0, ErrBadMessage
+	}
+	index := uint32(index64)
+	if index < s.InitialRatchet.Counter {
+		return nil, 0, fmt.Errorf("olm: unknown message index %d (first known %d)", index, s.InitialRatchet.Counter)
+	}
+
+	var r megolmRatchet
+	if index >= s.LatestRatchet.Counter {
+		r = s.LatestRatchet.clone()
+	} else {
+		r = s.InitialRatchet.clone()
+	}
+	r.advanceTo(index)
+
+	keys, err := deriveKeys(r.Data, megolmKeysInfo)
+	if err != nil {
+		return nil, 0, err
+	}
+	if !bytes.Equal(keys.mac(body), signed[len(body):]) {
+		return nil, 0, ErrBadMAC
+	}
+	plaintext, err := keys.decryptCBC(data[tagGroupCiphertext])
+	if err != nil {
+		return nil, 0, err
+	}
+	if index >= s.LatestRatchet.Counter {
+		s.LatestRatchet = r
+	}
+	return plaintext, index, nil
+}
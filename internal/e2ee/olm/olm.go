@@ -0,0 +1,183 @@
+// Package olm is a pure-Go implementation of the Olm and Megolm ratchets
+// used for end-to-end encryption in Matrix. Megolm sessions, messages and
+// session exports are tested against libolm's test vectors, Olm pre-key
+// and normal messages against vectors computed from the specification.
+package olm
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hkdf"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+const (
+	// messageVersion is the protocol version byte of Olm and Megolm messages.
+	messageVersion = 3
+	// macLength is the length of the truncated HMAC appended to messages.
+	macLength = 8
+	// keyLength is the length of Curve25519 and Ed25519 public keys.
+	keyLength = 32
+)
+
+var (
+	// ErrBadMAC is returned when a message fails authentication.
+	ErrBadMAC = errors.New("olm: bad message MAC")
+	// ErrBadMessage is returned for malformed or unsupported messages.
+	ErrBadMessage = errors.New("olm: bad message format")
+	// ErrBadSignature is returned when a Megolm message or session key has an invalid signature.
+	ErrBadSignature = errors.New("olm: bad signature")
+)
+
+// Encode returns the unpadded base64 encoding used throughout Matrix.
+func Encode(b []byte) string {
+	return base64.RawStdEncoding.EncodeToString(b)
+}
+
+// Decode accepts padded or unpadded base64.
+func Decode(s string) ([]byte, error) {
+	return base64.RawStdEncoding.DecodeString(strings.TrimRight(s, "="))
+}
+
+// messageKeys are the AES and HMAC keys derived from a ratchet output.
+type messageKeys struct {
+	aesKey []byte
+	macKey []byte
+	iv     []byte
+}
+
+// deriveKeys expands secret into AES-256 key, HMAC-SHA256 key and IV.
+func deriveKeys(secret []byte, info string) (messageKeys, error) {
+	out, err := hkdf.Key(sha256.New, secret, nil, info, 80)
+	if err != nil {
+		return messageKeys{}, err
+	}
+	return messageKeys{aesKey: out[:32], macKey: out[32:64], iv: out[64:80]}, nil
+}
+
+// encryptCBC encrypts plaintext with AES-256-CBC and PKCS#7 padding.
+func (k messageKeys) encryptCBC(plaintext []byte) ([]byte, error) {
+	block, err := aes.NewCipher(k.aesKey)
+	if err != nil {
+		return nil, err
+	}
+	pad := aes.BlockSize - len(plaintext)%aes.BlockSize
+	padded := append(append([]byte{}, plaintext...), bytes.Repeat([]byte{byte(pad)}, pad)...)
+	out := make([]byte, len(padded))
+	cipher.NewCBCEncrypter(block, k.iv).CryptBlocks(out, padded)
+	return out, nil
+}
+
+// decryptCBC reverses encryptCBC.
+func (k messageKeys) decryptCBC(ciphertext []byte) ([]byte, error) {
+	if len(ciphertext) == 0 || len(ciphertext)%aes.BlockSize != 0 {
+		return nil, ErrBadMessage
+	}
+	block, err := aes.NewCipher(k.aesKey)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]byte, len(ciphertext))
+	cipher.NewCBCDecrypter(block, k.iv).CryptBlocks(out, ciphertext)
+	pad := int(out[len(out)-1])
+	if pad == 0 || pad > aes.BlockSize || pad > len(out) {
+		return nil, ErrBadMessage
+	}
+	for _, b := range out[len(out)-pad:] {
+		if int(b) != pad {
+			return nil, ErrBadMessage
+		}
+	}
+	return out[:len(out)-pad], nil
+}
+
+// mac returns the truncated HMAC-SHA256 of data.
+func (k messageKeys) mac(data []byte) []byte {
+	return hmacSHA256(k.macKey, data)[:macLength]
+}
+
+func hmacSHA256(key, data []byte) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write(data)
+	return h.Sum(nil)
+}
+
+// newCurveKey generates a Curve25519 private key.
+func newCurveKey() (*ecdh.PrivateKey, error) {
+	return ecdh.X25519().GenerateKey(rand.Reader)
+}
+
+// curveKey parses a raw Curve25519 private key.
+func curveKey(priv []byte) (*ecdh.PrivateKey, error) {
+	return ecdh.X25519().NewPrivateKey(priv)
+}
+
+// sharedSecret computes X25519(priv, pub).
+func sharedSecret(priv []byte, pub []byte) ([]byte, error) {
+	key, err := curveKey(priv)
+	if err != nil {
+		return nil, err
+	}
+	pk, err := ecdh.X25519().NewPublicKey(pub)
+	if err != nil {
+		return nil, err
+	}
+	return key.ECDH(pk)
+}
+
+// The message encoding is a minimal protobuf-like format: each field is a
+// tag byte followed by a varint or a varint length and raw bytes.
+
+func appendVarint(b []byte, v uint64) []byte {
+	return binary.AppendUvarint(b, v)
+}
+
+func appendBytesField(b []byte, tag byte, data []byte) []byte {
+	b = append(b, tag)
+	b = appendVarint(b, uint64(len(data)))
+	return append(b, data...)
+}
+
+func appendVarintField(b []byte, tag byte, v uint64) []byte {
+	b = append(b, tag)
+	return appendVarint(b, v)
+}
+
+// decodeFields parses the fields of a message body (after the version byte).
+// Varint fields are returned in ints, length-delimited fields in bytes.
+func decodeFields(b []byte) (map[byte]uint64, map[byte][]byte, error) {
+	ints := make(map[byte]uint64)
+	data := make(map[byte][]byte)
+	for len(b) > 0 {
+		tag := b[0]
+		b = b[1:]
+		switch tag & 7 {
+		case 0:
+			v, n := binary.Uvarint(b)
+			if n <= 0 {
+				return nil, nil, ErrBadMessage
+			}
+			ints[tag] = v
+			b = b[n:]
+		case 2:
+			l, n := binary.Uvarint(b)
+			if n <= 0 || uint64(len(b)-n) < l {
+				return nil, nil, ErrBadMessage
+			}
+			data[tag] = b[n : n+int(l)]
+			b = b[n+int(l):]
+		default:
+			return nil, nil, fmt.Errorf("%w: unknown wire type %d", ErrBadMessage, tag&7)
+		}
+	}
+	return ints, data, nil
+}
@@ -0,0 +1,256 @@
+package olm
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+// newPair returns Alice's outbound session and Bob's account, with Bob's
+// first one-time key used to establish it.
+func newPair(t *testing.T) (*Account, *Session, *Account) {
+	t.Helper()
+	alice, err := NewAccount()
+	if err != nil {
+		t.Fatalf("NewAccount failed: %v", err)
+	}
+	bob, err := NewAccount()
+	if err != nil {
+		t.Fatalf("NewAccount failed: %v", err)
+	}
+	if err := bob.GenerateOneTimeKeys(1); err != nil {
+		t.Fatalf("GenerateOneTimeKeys failed: %v", err)
+	}
+	otk := bob.UnpublishedOneTimeKeys()[0]
+	session, err := alice.NewOutboundSession(bob.Curve25519(), Encode(otk.Public))
+	if err != nil {
+		t.Fatalf("NewOutboundSession failed: %v", err)
+	}
+	return alice, session, bob
+}
+
+func TestOlmSession_RoundTrip(t *testing.T) {
+	alice, aliceSession, bob := newPair(t)
+
+	msgType, msg, err := aliceSession.Encrypt([]byte("hello bob"))
+	if err != nil {
+		t.Fatalf("Encrypt failed: %v", err)
+	}
+	if msgType != MsgTypePreKey {
+		t.Fatalf("Expected first message to be a pre-key message, got type %d", msgType)
+	}
+
+	bobSession, err := bob.NewInboundSession(alice.Curve25519(), msg)
+	if err != nil {
+		t.Fatalf("NewInboundSession failed: %v", err)
+	}
+	if !bobSession.MatchesInbound(alice.Curve25519(), msg) {
+		t.Error("Expected pre-key message to match the new session")
+	}
+	plaintext, err := bobSession.Decrypt(msgType, msg)
+	if err != nil || string(plaintext) != "hello bob" {
+		t.Fatalf("Unexpected decryption: %q, %v", plaintext, err)
+	}
+	bob.RemoveOneTimeKeys(bobSession)
+	if len(bob.OneTimeKeys) != 0 {
+		t.Errorf("Expected one-time key to be removed, %d left", len(bob.OneTimeKeys))
+	}
+	if bobSession.ID() != aliceSession.ID() {
+		t.Errorf("Expected matching session IDs, got %s and %s", bobSession.ID(), aliceSession.ID())
+	}
+
+	// Several exchanges in both directions exercise the ratchet steps.
+	for i := 0; i < 3; i++ {
+		msgType, msg, err = bobSession.Encrypt([]byte(fmt.Sprintf("reply %d", i)))
+		if err != nil || msgType != MsgTypeNormal {
+			t.Fatalf("Bob Encrypt: type %d, %v", msgType, err)
+		}
+		plaintext, err = aliceSession.Decrypt(msgType, msg)
+		if err != nil || string(plaintext) != fmt.Sprintf("reply %d", i) {
+			t.Fatalf("Alice Decrypt: %q, %v", plaintext, err)
+		}
+
+		msgType, msg, err = aliceSession.Encrypt([]byte(fmt.Sprintf("message %d", i)))
+		if err != nil || msgType != MsgTypeNormal {
+			t.Fatalf("Alice Encrypt: type %d, %v", msgType, err)
+		}
+		plaintext, err = bobSession.Decrypt(msgType, msg)
+		if err != nil || string(plaintext) != fmt.Sprintf("message %d", i) {
+			t.Fatalf("Bob Decrypt: %q, %v", plaintext, err)
+		}
+	}
+}
+
+func TestOlmSession_OutOfOrder(t *testing.T) {
+	alice, aliceSession, bob := newPair(t)
+
+	var msgs [][]byte
+	for i := 0; i < 3; i++ {
+		_, msg, err := aliceSession.Encrypt([]byte(fmt.Sprintf("m%d", i)))
+		if err != nil {
+			t.Fatalf("Encrypt failed: %v", err)
+		}
+		msgs = append(msgs, msg)
+	}
+
+	bobSession, err := bob.NewInboundSession(alice.Curve25519(), msgs[2])
+	if err != nil {
+		t.Fatalf("NewInboundSession failed: %v", err)
+	}
+	for _, i := range []int{2, 0, 1} {
+		plaintext, err := bobSession.Decrypt(MsgTypePreKey, msgs[i])
+		if err != nil || string(plaintext) != fmt.Sprintf("m%d", i) {
+			t.Errorf("Decrypt m%d: %q, %v", i, plaintext, err)
+		}
+	}
+	if _, err := bobSession.Decrypt(MsgTypePreKey, msgs[0]); err == nil {
+		t.Error("Expected replayed message to fail")
+	}
+}
+
+func TestOlmSession_Tampered(t *testing.T) {
+	alice, aliceSession, bob := newPair(t)
+	_, msg, _ := aliceSession.Encrypt([]byte("hello"))
+	bobSession, err := bob.NewInboundSession(alice.Curve25519(), msg)
+	if err != nil {
+		t.Fatalf("NewInboundSession failed: %v", err)
+	}
+
+	tampered := append([]byte{}, msg...)
+	tampered[len(tampered)-1] ^= 0xff
+	if _, err := bobSession.Decrypt(MsgTypePreKey, tampered); !errors.Is(err, ErrBadMAC) {
+		t.Errorf("Expected ErrBadMAC, got %v", err)
+	}
+	if _, err := bobSession.Decrypt(MsgTypePreKey, msg); err != nil {
+		t.Errorf("Expected failed decryption to leave session intact, got %v", err)
+	}
+}
+
+func TestOlmSession_JSON(t *testing.T) {
+	alice, aliceSession, bob := newPair(t)
+	_, msg, _ := aliceSession.Encrypt([]byte("hello"))
+
+	data, err := json.Marshal(bob)
+	if err != nil {
+		t.Fatalf("Marshal failed: %v", err)
+	}
+	var restored Account
+	if err := json.Unmarshal(data, &restored); err != nil {
+		t.Fatalf("Unmarshal failed: %v", err)
+	}
+	if restored.Ed25519() != bob.Ed25519() || restored.Curve25519() != bob.Curve25519() {
+		t.Error("Expected identity keys to survive a round trip")
+	}
+
+	session, err := restored.NewInboundSession(alice.Curve25519(), msg)
+	if err != nil {
+		t.Fatalf("NewInboundSession on restored account failed: %v", err)
+	}
+	if _, err := session.Decrypt(MsgTypePreKey, msg); err != nil {
+		t.Errorf("Decrypt failed: %v", err)
+	}
+}
+
+func TestAccount_FallbackKey(t *testing.T) {
+	alice, _ := NewAccount()
+	bob, _ := NewAccount()
+	if err := bob.GenerateFallbackKey(); err != nil {
+		t.Fatalf("GenerateFallbackKey failed: %v", err)
+	}
+	fallback := bob.UnpublishedFallbackKey()
+	bob.MarkKeysAsPublished()
+	if bob.UnpublishedFallbackKey() != nil {
+		t.Error("Expected fallback key to be published")
+	}
+
+	out, _ := alice.NewOutboundSession(bob.Curve25519(), Encode(fallback.Public))
+	_, msg, _ := out.Encrypt([]byte("via fallback"))
+	in, err := bob.NewInboundSession(alice.Curve25519(), msg)
+	if err != nil {
+		t.Fatalf("NewInboundSession failed: %v", err)
+	}
+	if plaintext, err := in.Decrypt(MsgTypePreKey, msg); err != nil || string(plaintext) != "via fallback" {
+		t.Errorf("Unexpected decryption: %q, %v", plaintext, err)
+	}
+	if bob.FallbackKey == nil {
+		t.Error("Expected fallback key to be reusable")
+	}
+}
+
+func TestAccount_UnknownOneTimeKey(t *testing.T) {
+	alice, aliceSession, _ := newPair(t)
+	other, _ := NewAccount()
+	_, msg, _ := aliceSession.Encrypt([]byte("hello"))
+	if _, err := other.NewInboundSession(alice.Curve25519(), msg); !errors.Is(err, ErrUnknownOneTimeKey) {
+		t.Errorf("Expected ErrUnknownOneTimeKey, got %v", err)
+	}
+}
+
+func TestMegolm_RoundTrip(t *testing.T) {
+	out, err := NewOutboundGroupSession()
+	if err != nil {
+		t.Fatalf("NewOutboundGroupSession failed: %v", err)
+	}
+	first, _ := out.Encrypt([]byte("before share"))
+
+	in, err := NewInboundGroupSession(out.SessionKey())
+	if err != nil {
+		t.Fatalf("NewInboundGroupSession failed: %v", err)
+	}
+	if in.ID() != out.ID() {
+		t.Errorf("Expected matching session IDs")
+	}
+	if in.FirstKnownIndex() != 1 {
+		t.Errorf("Expected first known index 1, got %d", in.FirstKnownIndex())
+	}
+	if _, _, err := in.Decrypt(first); err == nil {
+		t.Error("Expected message before the shared index to fail")
+	}
+
+	var msgs []string
+	for i := 0; i < 5; i++ {
+		m, _ := out.Encrypt([]byte(fmt.Sprintf("m%d", i)))
+		msgs = append(msgs, m)
+	}
+	for _, i := range []int{3, 0, 4, 1} {
+		plaintext, index, err := in.Decrypt(msgs[i])
+		if err != nil || string(plaintext) != fmt.Sprintf("m%d", i) || index != uint32(i+1) {
+			t.Errorf("Decrypt m%d: %q, %d, %v", i, plaintext, index, err)
+		}
+	}
+
+	raw, _ := Decode(msgs[2])
+	raw[len(raw)-1] ^= 0xff
+	if _, _, err := in.Decrypt(Encode(raw)); !errors.Is(err, ErrBadSignature) {
+		t.Errorf("Expected ErrBadSignature, got %v", err)
+	}
+}
+
+func TestMegolm_BadSessionKey(t *testing.T) {
+	out, _ := NewOutboundGroupSession()
+	raw, _ := Decode(out.SessionKey())
+	raw[10] ^= 0xff
+	if _, err := NewInboundGroupSession(Encode(raw)); !errors.Is(err, ErrBadSignature) {
+		t.Errorf("Expected ErrBadSignature, got %v", err)
+	}
+}
+
+func TestMegolmRatchet_AdvanceTo(t *testing.T) {
+	data := make([]byte, megolmParts*megolmPartLength)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	// Crossing the 2^8 and 2^16 boundaries exercises the rehash of the higher parts.
+	for _, target := range []uint32{1, 255, 256, 257, 1000, 65537} {
+		stepped := megolmRatchet{Data: append([]byte{}, data...)}
+		for stepped.Counter < target {
+			stepped.advance()
+		}
+		jumped := megolmRatchet{Data: append([]byte{}, data...)}
+		jumped.advanceTo(target)
+		if string(stepped.Data) != string(jumped.Data) || jumped.Counter != target {
+			t.Errorf("advanceTo(%d) disagrees with repeated advance", target)
+		}
+	}
+}
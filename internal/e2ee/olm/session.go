@@ -0,0 +1,357 @@
+package olm
+
+import (
+	"bytes"
+	"crypto/hkdf"
+	"crypto/sha256"
+	"fmt"
+)
+
+// Message types of Olm ciphertexts in m.room.encrypted to-device events.
+const (
+	MsgTypePreKey = 0
+	MsgTypeNormal = 1
+)
+
+const (
+	rootInfo    = "OLM_ROOT"
+	ratchetInfo = "OLM_RATCHET"
+	keysInfo    = "OLM_KEYS"
+
+	// maxReceiverChains and maxSkippedKeys bound session state, and
+	// maxMessageGap bounds how far a chain is advanced for one message,
+	// all matching libolm.
+	maxReceiverChains = 5
+	maxSkippedKeys    = 40
+	maxMessageGap     = 2000
+
+	// Olm message field tags.
+	tagRatchetKey  = 0x0A
+	tagCounter     = 0x10
+	tagCiphertext  = 0x22
+	tagOneTimeKey  = 0x0A
+	tagBaseKey     = 0x12
+	tagIdentityKey = 0x1A
+	tagMessage     = 0x22
+)
+
+// SenderChain is the chain used to encrypt messages.
+type SenderChain struct {
+	RatchetPrivate []byte `json:"ratchet_private"`
+	RatchetPublic  []byte `json:"ratchet_public"`
+	ChainKey       []byte `json:"chain_key"`
+	Index          uint32 `json:"index"`
+}
+
+// ReceiverChain is a chain used to decrypt messages from the other party.
+type ReceiverChain struct {
+	RatchetKey []byte `json:"ratchet_key"`
+	ChainKey   []byte `json:"chain_key"`
+	Index      uint32 `json:"index"`
+}
+
+// SkippedKey is a message key kept for a message that has not arrived yet.
+type SkippedKey struct {
+	RatchetKey []byte `json:"ratchet_key"`
+	Index      uint32 `json:"index"`
+	MessageKey []byte `json:"message_key"`
+}
+
+// Session is an Olm double-ratchet session between two devices. It is
+// serialisable with encoding/json.
+type Session struct {
+	ReceivedMessage  bool            `json:"received_message"`
+	AliceIdentityKey []byte          `json:"alice_identity_key"`
+	AliceBaseKey     []byte          `json:"alice_base_key"`
+	BobOneTimeKey    []byte          `json:"bob_one_time_key"`
+	RootKey          []byte          `json:"root_key"`
+	SenderChain      *SenderChain    `json:"sender_chain,omitempty"`
+	ReceiverChains   []ReceiverChain `json:"receiver_chains,omitempty"`
+	SkippedKeys      []SkippedKey    `json:"skipped_keys,omitempty"`
+}
+
+// ID returns the session identifier, derived the same way as libolm.
+func (s *Session) ID() string {
+	h := sha256.New()
+	h.Write(s.AliceIdentityKey)
+	h.Write(s.AliceBaseKey)
+	h.Write(s.BobOneTimeKey)
+	return Encode(h.Sum(nil))
+}
+
+func (s *Session) initialiseAsBob(secret, theirRatchetKey []byte) error {
+	derived, err := hkdf.Key(sha256.New, secret, nil, rootInfo, 64)
+	if err != nil {
+		return err
+	}
+	s.RootKey = derived[:32]
+	s.ReceiverChains = []ReceiverChain{{RatchetKey: theirRatchetKey, ChainKey: derived[32:]}}
+	return nil
+}
+
+func (s *Session) initialiseAsAlice(secret []byte) error {
+	derived, err := hkdf.Key(sha256.New, secret, nil, rootInfo, 64)
+	if err != nil {
+		return err
+	}
+	ratchet, err := newCurveKey()
+	if err != nil {
+		return err
+	}
+	s.RootKey = derived[:32]
+	s.SenderChain = &SenderChain{
+		RatchetPrivate: ratchet.Bytes(),
+		RatchetPublic:  ratchet.PublicKey().Bytes(),
+		ChainKey:       derived[32:],
+	}
+	return nil
+}
+
+// advanceRoot derives a new root key and chain key from a ratchet step.
+func advanceRoot(rootKey, ourPrivate, theirPublic []byte) (newRoot, chainKey []byte, err error) {
+	secret, err := sharedSecret(ourPrivate, theirPublic)
+	if err != nil {
+		return nil, nil, err
+	}
+	derived, err := hkdf.Key(sha256.New, secret, rootKey, ratchetInfo, 64)
+	if err != nil {
+		return nil, nil, err
+	}
+	return derived[:32], derived[32:], nil
+}
+
+func messageKey(chainKey []byte) []byte {
+	return hmacSHA256(chainKey, []byte{0x01})
+}
+
+func nextChainKey(chainKey []byte) []byte {
+	return hmacSHA256(chainKey, []byte{0x02})
+}
+
+// MatchesInbound reports whether a pre-key message belongs to this session.
+func (s *Session) MatchesInbound(theirIdentityKey string, message []byte) bool {
+	pre, err := decodePreKeyMessage(message)
+	if err != nil {
+		return false
+	}
+	if identity, err := Decode(theirIdentityKey); err != nil || !bytes.Equal(identity, pre.identityKey) {
+		return false
+	}
+	return bytes.Equal(s.AliceIdentityKey, pre.identityKey) &&
+		bytes.Equal(s.AliceBaseKey, pre.baseKey) &&
+		bytes.Equal(s.BobOneTimeKey, pre.oneTimeKey)
+}
+
+// Encrypt encrypts plaintext, returning the message type and the raw message.
+// Until a reply has been received, messages are pre-key messages.
+func (s *Session) Encrypt(plaintext []byte) (int, []byte, error) {
+	if s.SenderChain == nil {
+		if len(s.ReceiverChains) == 0 {
+			return 0, nil, fmt.Errorf("olm: session has no chains")
+		}
+		ratchet, err := newCurveKey()
+		if err != nil {
+			return 0, nil, err
+		}
+		root, chain, err := advanceRoot(s.RootKey, ratchet.Bytes(), s.ReceiverChains[0].RatchetKey)
+		if err != nil {
+			return 0, nil, err
+		}
+		s.RootKey = root
+		s.SenderChain = &SenderChain{
+			RatchetPrivate: ratchet.Bytes(),
+			RatchetPublic:  ratchet.PublicKey().Bytes(),
+			ChainKey:       chain,
+		}
+	}
+
+	chain := s.SenderChain
+	keys, err := deriveKeys(messageKey(chain.ChainKey), keysInfo)
+	if err != nil {
+		return 0, nil, err
+	}
+	ciphertext, err := keys.encryptCBC(plaintext)
+	if err != nil {
+		return 0, nil, err
+	}
+	msg := []byte{messageVersion}
+	msg = appendBytesField(msg, tagRatchetKey, chain.RatchetPublic)
+	msg = appendVarintField(msg, tagCounter, uint64(chain.Index))
+	msg = appendBytesField(msg, tagCiphertext, ciphertext)
+	msg = append(msg, keys.mac(msg)...)
+
+	chain.ChainKey = nextChainKey(chain.ChainKey)
+	chain.Index++
+
+	if s.ReceivedMessage {
+		return MsgTypeNormal, msg, nil
+	}
+	pre := []byte{messageVersion}
+	pre = appendBytesField(pre, tagOneTimeKey, s.BobOneTimeKey)
+	pre = appendBytesField(pre, tagBaseKey, s.AliceBaseKey)
+	pre = appendBytesField(pre, tagIdentityKey, s.AliceIdentityKey)
+	pre = appendBytesField(pre, tagMessage, msg)
+	return MsgTypePreKey, pre, nil
+}
+
+// Decrypt decrypts a message of the given type. The session is only updated
+// when decryption succeeds.
+func (s *Session) Decrypt(msgType int, message []byte) ([]byte, error) {
+	raw := message
+	if msgType == MsgTypePreKey {
+		pre, err := decodePreKeyMessage(message)
+		if err != nil {
+			return nil, err
+		}
+		raw = pre.message
+	}
+	msg, err := decodeMessage(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, sk := range s.SkippedKeys {
+		if sk.Index == msg.counter && bytes.Equal(sk.RatchetKey, msg.ratchetKey) {
+			plaintext, err := msg.open(sk.MessageKey)
+			if err != nil {
+				return nil, err
+			}
+			s.SkippedKeys = append(s.SkippedKeys[:i], s.SkippedKeys[i+1:]...)
+			s.ReceivedMessage = true
+			return plaintext, nil
+		}
+	}
+
+	var chain *ReceiverChain
+	for i := range s.ReceiverChains {
+		if bytes.Equal(s.ReceiverChains[i].RatchetKey, msg.ratchetKey) {
+			c := s.ReceiverChains[i]
+			chain = &c
+			break
+		}
+	}
+	newChain := chain == nil
+	newRoot := s.RootKey
+	if newChain {
+		if s.SenderChain == nil {
+			return nil, fmt.Errorf("%w: unknown ratchet key", ErrBadMessage)
+		}
+		root, chainKey, err := advanceRoot(s.RootKey, s.SenderChain.RatchetPrivate, msg.ratchetKey)
+		if err != nil {
+			return nil, err
+		}
+		newRoot = root
+		chain = &ReceiverChain{RatchetKey: msg.ratchetKey, ChainKey: chainKey}
+	}
+
+	if msg.counter < chain.Index {
+		return nil, fmt.Errorf("%w: message key already used", ErrBadMessage)
+	}
+	if msg.counter-chain.Index > maxMessageGap {
+		return nil, fmt.Errorf("%w: message gap too large", ErrBadMessage)
+	}
+	var skipped []SkippedKey
+	for chain.Index < msg.counter {
+		skipped = append(skipped, SkippedKey{RatchetKey: chain.RatchetKey, Index: chain.Index, MessageKey: messageKey(chain.ChainKey)})
+		chain.ChainKey = nextChainKey(chain.ChainKey)
+		chain.Index++
+	}
+	plaintext, err := msg.open(messageKey(chain.ChainKey))
+	if err != nil {
+		return nil, err
+	}
+	chain.ChainKey = nextChainKey(chain.ChainKey)
+	chain.Index++
+
+	if newChain {
+		s.RootKey = newRoot
+		s.SenderChain = nil
+		s.ReceiverChains = append([]ReceiverChain{*chain}, s.ReceiverChains...)
+		if len(s.ReceiverChains) > maxReceiverChains {
+			s.ReceiverChains = s.ReceiverChains[:maxReceiverChains]
+		}
+	} else {
+		for i := range s.ReceiverChains {
+			if bytes.Equal(s.ReceiverChains[i].RatchetKey, chain.RatchetKey) {
+				s.ReceiverChains[i] = *chain
+			}
+		}
+	}
+	s.SkippedKeys = append(s.SkippedKeys, skipped...)
+	if extra := len(s.SkippedKeys) - maxSkippedKeys; extra > 0 {
+		s.SkippedKeys = s.SkippedKeys[extra:]
+	}
+	s.ReceivedMessage = true
+	return plaintext, nil
+}
+
+// message is a decoded Olm message.
+type message struct {
+	ratchetKey []byte
+	counter    uint32
+	ciphertext []byte
+	body       []byte // version and fields, covered by the MAC
+	mac        []byte
+}
+
+func decodeMessage(b []byte) (*message, error) {
+	if len(b) < 1+macLength || b[0] != messageVersion {
+		return nil, ErrBadMessage
+	}
+	body := b[:len(b)-macLength]
+	ints, data, err := decodeFields(body[1:])
+	if err != nil {
+		return nil, err
+	}
+	counter, ok := ints[tagCounter]
+	if !ok || len(data[tagRatchetKey]) != keyLength || data[tagCiphertext] == nil {
+		return nil, ErrBadMessage
+	}
+	return &message{
+		ratchetKey: data[tagRatchetKey],
+		counter:    uint32(counter),
+		ciphertext: data[tagCiphertext],
+		body:       body,
+		mac:        b[len(b)-macLength:],
+	}, nil
+}
+
+// open verifies the MAC and decrypts the message with a message key.
+func (m *message) open(key []byte) ([]byte, error) {
+	keys, err := deriveKeys(key, keysInfo)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(keys.mac(m.body), m.mac) {
+		return nil, ErrBadMAC
+	}
+	return keys.decryptCBC(m.ciphertext)
+}
+
+// preKeyMessage is a decoded Olm pre-key message.
+type preKeyMessage struct {
+	oneTimeKey  []byte
+	baseKey     []byte
+	identityKey []byte
+	message     []byte
+}
+
+func decodePreKeyMessage(b []byte) (*preKeyMessage, error) {
+	if len(b) < 1 || b[0] != messageVersion {
+		return nil, ErrBadMessage
+	}
+	_, data, err := decodeFields(b[1:])
+	if err != nil {
+		return nil, err
+	}
+	pre := &preKeyMessage{
+		oneTimeKey:  data[tagOneTimeKey],
+		baseKey:     data[tagBaseKey],
+		identityKey: data[tagIdentityKey],
+		message:     data[tagMessage],
+	}
+	if len(pre.oneTimeKey) != keyLength || len(pre.baseKey) != keyLength || len(pre.identityKey) != keyLength || pre.message == nil {
+		return nil, ErrBadMessage
+	}
+	return pre, nil
+}
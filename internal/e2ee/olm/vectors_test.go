@@ -0,0 +1,151 @@
+package olm
+
+import (
+	"errors"
+	"testing"
+)
+
+// libolm's Megolm test vector, from tests/test_group_session.cpp: a session
+// key and the message "Message" encrypted with it at index 0.
+const (
+	libolmSessionKey = "AgAAAAAwMTIzNDU2Nzg5QUJERUYwMTIzNDU2Nzg5QUJDREVGMDEyMzQ1Njc4OUFCREVGM" +
+		"DEyMzQ1Njc4OUFCQ0RFRjAxMjM0NTY3ODlBQkRFRjAxMjM0NTY3ODlBQkNERUYwMTIzND" +
+		"U2Nzg5QUJERUYwMTIzNDU2Nzg5QUJDREVGMDEyMw0bdg1BDq4Px/slBow06q8n/B9WBfw" +
+		"WYyNOB8DlUmXGGwrFmaSb9bR/eY8xgERrxmP07hFmD9uqA2p8PMHdnV5ysmgufE6oLZ5+" +
+		"8/mWQOW3VVTnDIlnwd8oHUYRuk8TCQ"
+	libolmGroupMessage = "AwgAEhAcbh6UpbByoyZxufQ+h2B+8XHMjhR69G8F4+qjMaFlnIXusJZX3r8LnRORG9T3D" +
+		"XFdbVuvIWrLyRfm4i8QRbe8VPwGRFG57B1CtmxanuP8bHtnnYqlwPsD"
+	// libolmSessionExport is the same session in the export format
+	libolmSessionExport = "AQAAAAAwMTIzNDU2Nzg5QUJERUYwMTIzNDU2Nzg5QUJDREVGMDEyMzQ1Njc4OUFCREVGMD" +
+		"EyMzQ1Njc4OUFCQ0RFRjAxMjM0NTY3ODlBQkRFRjAxMjM0NTY3ODlBQkNERUYwMTIzNDU2" +
+		"Nzg5QUJERUYwMTIzNDU2Nzg5QUJDREVGMDEyMw0bdg1BDq4Px/slBow06q8n/B9WBfwWYy" +
+		"NOB8DlUmXG"
+)
+
+// An Olm session from Alice to Bob with fixed keys, each private key a
+// repeated byte, computed from the Olm specification by a reference
+// implementation separate from this package. The pre-key message carries
+// "first message" at chain index 0, the normal message "second message" at
+// index 1.
+const (
+	olmBobIdentityPrivate  = "REREREREREREREREREREREREREREREREREREREREREQ"
+	olmBobIdentityPublic   = "/y7kVgHsG2cxDHeQQEWFrmlzMe7hwfjPJBlzHB//Pms"
+	olmBobOneTimePrivate   = "VVVVVVVVVVVVVVVVVVVVVVVVVVVVVVVVVVVVVVVVVVU"
+	olmBobOneTimePublic    = "OKtmS9hvd9fma92a4HkpE6lP2LM6EmACfktGwfSITGc"
+	olmAliceIdentityPublic = "e06Qm75//kTEZaIgA31gjuNYl9Me+XLwf3SJLLD3PxM"
+	olmSessionID           = "62SJmXR0D+WHOz+H6TVe8MAEBvsE2LV1shUHfT9wEqg"
+	olmPreKeyMessage       = "AwogOKtmS9hvd9fma92a4HkpE6lP2LM6EmACfktGwfSITGcSIA+qaE7SiGe5f0pqLe5d+M6XTna3AY4/IqHEzyZ4Vw8gGiB7TpCbvn/+RMRloiADfWCO41iX0x75cvB/dIkssPc/EyI/Awogew1H2TQn+DERYHgcfHM/2J+IlwrvSQ2KoO4ZpMuKGxQQACIQBnSzLa5tKY65T3tbejDTOVnAjqblR1Nv"
+	olmNormalMessage       = "Awogew1H2TQn+DERYHgcfHM/2J+IlwrvSQ2KoO4ZpMuKGxQQASIQDMAT2Z2XhtxZJCYOjj/EyEe5ac1zky22"
+	olmPreKeyMessagePlain  = "first message"
+	olmNormalMessagePlain  = "second message"
+)
+
+func mustDecode(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := Decode(s)
+	if err != nil {
+		t.Fatalf("Decode(%q) failed: %v", s, err)
+	}
+	return b
+}
+
+func TestMegolm_LibolmVector(t *testing.T) {
+	s, err := NewInboundGroupSession(libolmSessionKey)
+	if err != nil {
+		t.Fatalf("NewInboundGroupSession failed: %v", err)
+	}
+	plaintext, index, err := s.Decrypt(libolmGroupMessage)
+	if err != nil || string(plaintext) != "Message" || index != 0 {
+		t.Fatalf("Expected \"Message\" at index 0, got %q at %d, %v", plaintext, index, err)
+	}
+
+	exported, err := s.Export(0)
+	if err != nil {
+		t.Fatalf("Export failed: %v", err)
+	}
+	if exported != libolmSessionExport {
+		t.Errorf("Expected export %s, got %s", libolmSessionExport, exported)
+	}
+}
+
+func TestMegolm_ImportLibolmExport(t *testing.T) {
+	s, err := ImportInboundGroupSession(libolmSessionExport)
+	if err != nil {
+		t.Fatalf("ImportInboundGroupSession failed: %v", err)
+	}
+	if s.ID() != "DRt2DUEOrg/H+yUGjDTqryf8H1YF/BZjI04HwOVSZcY" {
+		t.Errorf("Unexpected session ID %s", s.ID())
+	}
+	plaintext, _, err := s.Decrypt(libolmGroupMessage)
+	if err != nil || string(plaintext) != "Message" {
+		t.Fatalf("Expected \"Message\", got %q, %v", plaintext, err)
+	}
+
+	// An export from a later index cannot decrypt earlier messages
+	later, err := s.Export(1)
+	if err != nil {
+		t.Fatalf("Export failed: %v", err)
+	}
+	imported, err := ImportInboundGroupSession(later)
+	if err != nil {
+		t.Fatalf("ImportInboundGroupSession failed: %v", err)
+	}
+	if imported.FirstKnownIndex() != 1 {
+		t.Errorf("Expected first known index 1, got %d", imported.FirstKnownIndex())
+	}
+	if _, _, err := imported.Decrypt(libolmGroupMessage); err == nil {
+		t.Error("Expected an error decrypting before the first known index")
+	}
+	if _, err := imported.Export(0); err == nil {
+		t.Error("Expected an error exporting before the first known index")
+	}
+
+	// A signed session key is not an export, nor the other way around
+	if _, err := ImportInboundGroupSession(libolmSessionKey); !errors.Is(err, ErrBadMessage) {
+		t.Errorf("Expected ErrBadMessage importing a session key, got %v", err)
+	}
+	if _, err := NewInboundGroupSession(libolmSessionExport); !errors.Is(err, ErrBadMessage) {
+		t.Errorf("Expected ErrBadMessage for an export as session key, got %v", err)
+	}
+}
+
+func TestOlmSession_Vector(t *testing.T) {
+	bob := &Account{
+		IdentityPrivate: mustDecode(t, olmBobIdentityPrivate),
+		IdentityPublic:  mustDecode(t, olmBobIdentityPublic),
+		OneTimeKeys: []*OneTimeKey{{
+			ID:      1,
+			Private: mustDecode(t, olmBobOneTimePrivate),
+			Public:  mustDecode(t, olmBobOneTimePublic),
+		}},
+	}
+	// The fixed private keys match their public halves
+	if key, err := curveKey(bob.IdentityPrivate); err != nil || Encode(key.PublicKey().Bytes()) != olmBobIdentityPublic {
+		t.Fatalf("Identity key does not match the vector: %v", err)
+	}
+
+	preKey := mustDecode(t, olmPreKeyMessage)
+	session, err := bob.NewInboundSession(olmAliceIdentityPublic, preKey)
+	if err != nil {
+		t.Fatalf("NewInboundSession failed: %v", err)
+	}
+	if session.ID() != olmSessionID {
+		t.Errorf("Expected session ID %s, got %s", olmSessionID, session.ID())
+	}
+	if !session.MatchesInbound(olmAliceIdentityPublic, preKey) {
+		t.Error("Expected the pre-key message to match its session")
+	}
+	plaintext, err := session.Decrypt(0, preKey)
+	if err != nil || string(plaintext) != olmPreKeyMessagePlain {
+		t.Fatalf("Expected %q, got %q, %v", olmPreKeyMessagePlain, plaintext, err)
+	}
+	bob.RemoveOneTimeKeys(session)
+	if len(bob.OneTimeKeys) != 0 {
+		t.Errorf("Expected the one-time key to be removed, %d left", len(bob.OneTimeKeys))
+	}
+
+	plaintext, err = session.Decrypt(1, mustDecode(t, olmNormalMessage))
+	if err != nil || string(plaintext) != olmNormalMessagePlain {
+		t.Fatalf("Expected %q, got %q, %v", olmNormalMessagePlain, plaintext, err)
+	}
+}
@@ -0,0 +1,173 @@
+package e2ee
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/yamatt/matrix-as-webhook/internal/e2ee/olm"
+)
+
+// State is the crypto state persisted between restarts.
+type State struct {
+	DeviceID string       `json:"device_id,omitempty"`
+	Account  *olm.Account `json:"account,omitempty"`
+	// Sessions are Olm sessions keyed by the other device's Curve25519 key.
+	Sessions map[string][]*olm.Session `json:"sessions,omitempty"`
+	// GroupSessions are inbound Megolm sessions keyed by room ID and session ID.
+	GroupSessions map[string]*GroupSession `json:"group_sessions,omitempty"`
+	// Outbound are the bot's Megolm sessions keyed by room ID.
+	Outbound map[string]*OutboundSession `json:"outbound,omitempty"`
+}
+
+// GroupSession is an inbound Megolm session and where it came from: the
+// device that sent the room key, verified against its published keys.
+type GroupSession struct {
+	RoomID         string                   `json:"room_id"`
+	SenderUserID   string                   `json:"sender,omitempty"`
+	SenderDeviceID string                   `json:"sender_device,omitempty"`
+	SenderKey      string                   `json:"sender_key"`
+	SigningKey     string                   `json:"signing_key"`
+	Session        *olm.InboundGroupSession `json:"session"`
+}
+
+// OutboundSession is a Megolm session the bot encrypts a room's messages with.
+type OutboundSession struct {
+	Session   *olm.OutboundGroupSession `json:"session"`
+	CreatedAt time.Time                 `json:"created_at"`
+	Messages  int                       `json:"messages"`
+	// SharedWith records the devices the session key was sent to, as
+	// "user_id|device_id".
+	SharedWith map[string]bool `json:"shared_with"`
+}
+
+// Store persists State as a JSON file, optionally encrypted with a key
+// derived from a pickle key.
+type Store struct {
+	path string
+	key  []byte
+}
+
+// NewStore creates a Store at path. A non-empty pickleKey encrypts the file.
+func NewStore(path, pickleKey string) *Store {
+	s := &Store{path: path}
+	if pickleKey != "" {
+		sum := sha256.Sum256([]byte(pickleKey))
+		s.key = sum[:]
+	}
+	return s
+}
+
+// Pending returns a Store next to this one, sealed with the same key, for
+// the encrypted events still waiting for their room keys at shutdown.
+func (s *Store) Pending() *Store {
+	return &Store{path: s.path + ".pending", key: s.key}
+}
+
+// Load reads the state, returning an empty state if the file does not exist.
+func (s *Store) Load() (*State, error) {
+	var state State
+	if err := s.LoadValue(&state); err != nil {
+		return nil, err
+	}
+	return &state, nil
+}
+
+// Save atomically writes the state, readable only by the current user.
+func (s *Store) Save(state *State) error {
+	return s.SaveValue(state)
+}
+
+// LoadValue decodes the file into v, leaving v untouched if the file does
+// not exist.
+func (s *Store) LoadValue(v any) error {
+	data, err := os.ReadFile(s.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if s.key != nil {
+		if data, err = s.open(data); err != nil {
+			return fmt.Errorf("e2ee: decrypting store: %w", err)
+		}
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("e2ee: decoding store: %w", err)
+	}
+	return nil
+}
+
+// Remove deletes the file, if there is one.
+func (s *Store) Remove() error {
+	if err := os.Remove(s.path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// SaveValue atomically writes v as JSON, readable only by the current user.
+func (s *Store) SaveValue(v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if s.key != nil {
+		if data, err = s.seal(data); err != nil {
+			return err
+		}
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path)
+}
+
+func (s *Store) seal(plaintext []byte) ([]byte, error) {
+	gcm, err := s.aead()
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+func (s *Store) open(data []byte) ([]byte, error) {
+	gcm, err := s.aead()
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < gcm.NonceSize() {
+		return nil, errors.New("store too short")
+	}
+	return gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], nil)
+}
+
+func (s *Store) aead() (cipher.AEAD, error) {
+	block, err := aes.NewCipher(s.key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
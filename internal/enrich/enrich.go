@@ -0,0 +1,172 @@
+package enrich
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/yamatt/matrix-as-webhook/internal/logging"
+	"github.com/yamatt/matrix-as-webhook/internal/matrix"
+)
+
+// DefaultTTL is how long fetched state is cached when no TTL is configured.
+const DefaultTTL = 5 * time.Minute
+
+const (
+	// errorTTL is how long a failed lookup is remembered, so that a
+	// homeserver outage does not cost six requests per event.
+	errorTTL = 30 * time.Second
+	// maxEntries bounds the cache. Each room has a few state events and
+	// one member event per sender seen.
+	maxEntries = 10000
+)
+
+// Context is the room and sender information added to routed events.
+type Context struct {
+	Room   RoomInfo   `json:"room"`
+	Sender SenderInfo `json:"sender"`
+}
+
+// RoomInfo describes the room an event was sent in.
+type RoomInfo struct {
+	Name           string `json:"name,omitempty"`
+	CanonicalAlias string `json:"canonical_alias,omitempty"`
+	Topic          string `json:"topic,omitempty"`
+	Encrypted      bool   `json:"encrypted"`
+}
+
+// SenderInfo describes the sender of an event within its room.
+type SenderInfo struct {
+	Displayname string `json:"displayname,omitempty"`
+	AvatarURL   string `json:"avatar_url,omitempty"`
+	PowerLevel  int    `json:"power_level"`
+}
+
+// StateFetcher reads room state; *matrix.Client implements it.
+type StateFetcher interface {
+	GetStateEvent(ctx context.Context, roomID, eventType, stateKey string) (map[string]interface{}, error)
+}
+
+type stateKey struct {
+	roomID    string
+	eventType string
+	stateKey  string
+}
+
+type entry struct {
+	content map[string]interface{}
+	expires time.Time
+}
+
+// Enricher looks up room and sender context, caching room state for a TTL.
+// The cache is also fed with state events seen in transactions.
+type Enricher struct {
+	fetcher StateFetcher
+	ttl     time.Duration
+	now     func() time.Time
+
+	mu    sync.Mutex
+	state map[stateKey]entry
+}
+
+// NewEnricher creates an Enricher. A zero TTL uses DefaultTTL.
+func NewEnricher(fetcher StateFetcher, ttl time.Duration) *Enricher {
+	if ttl == 0 {
+		ttl = DefaultTTL
+	}
+	return &Enricher{
+		fetcher: fetcher,
+		ttl:     ttl,
+		now:     time.Now,
+		state:   make(map[stateKey]entry),
+	}
+}
+
+// Observe updates the cache with a state event from a transaction.
+func (e *Enricher) Observe(roomID, eventType, key string, content map[string]interface{}) {
+	e.store(stateKey{roomID, eventType, key}, content, e.ttl)
+}
+
+// store caches content for ttl. When the cache is full, expired entries
+// are swept out; if that is not enough, a tenth of the entries are dropped
+// at random, so that a full cache is not swept on every store.
+func (e *Enricher) store(k stateKey, content map[string]interface{}, ttl time.Duration) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	now := e.now()
+	if _, ok := e.state[k]; !ok && len(e.state) >= maxEntries {
+		for key, cached := range e.state {
+			if !now.Before(cached.expires) {
+				delete(e.state, key)
+			}
+		}
+		for key := range e.state {
+			if len(e.state) < maxEntries*9/10 {
+				break
+			}
+			delete(e.state, key)
+		}
+	}
+	e.state[k] = entry{content: content, expires: now.Add(ttl)}
+}
+
+// Enrich returns the context for an event sent by sender in roomID. Lookups
+// that fail leave the corresponding fields empty.
+func (e *Enricher) Enrich(ctx context.Context, roomID, sender string) Context {
+	var c Context
+
+	c.Room.Name, _ = e.get(ctx, roomID, "m.room.name", "")["name"].(string)
+	c.Room.CanonicalAlias, _ = e.get(ctx, roomID, "m.room.canonical_alias", "")["alias"].(string)
+	c.Room.Topic, _ = e.get(ctx, roomID, "m.room.topic", "")["topic"].(string)
+	c.Room.Encrypted = e.get(ctx, roomID, "m.room.encryption", "")["algorithm"] != nil
+
+	member := e.get(ctx, roomID, "m.room.member", sender)
+	c.Sender.Displayname, _ = member["displayname"].(string)
+	c.Sender.AvatarURL, _ = member["avatar_url"].(string)
+	c.Sender.PowerLevel = powerLevel(e.get(ctx, roomID, "m.room.power_levels", ""), sender)
+
+	return c
+}
+
+// get returns cached state content, fetching it when missing or expired.
+// Absent state is cached as nil content, and so are failed lookups, for
+// errorTTL.
+func (e *Enricher) get(ctx context.Context, roomID, eventType, key string) map[string]interface{} {
+	k := stateKey{roomID, eventType, key}
+
+	e.mu.Lock()
+	cached, ok := e.state[k]
+	e.mu.Unlock()
+	if ok && e.now().Before(cached.expires) {
+		return cached.content
+	}
+
+	content, err := e.fetcher.GetStateEvent(ctx, roomID, eventType, key)
+	var mErr *matrix.Error
+	if errors.As(err, &mErr) && mErr.ErrCode == "M_NOT_FOUND" {
+		content, err = nil, nil
+	}
+	if err != nil {
+		logging.FromContext(ctx).Warn("error fetching room state", "event_type", eventType, logging.KeyRoomID, roomID, "error", err)
+		e.store(k, nil, errorTTL)
+		return nil
+	}
+
+	e.Observe(roomID, eventType, key, content)
+	return content
+}
+
+// powerLevel returns the user's power level from m.room.power_levels content,
+// falling back to users_default.
+func powerLevel(content map[string]interface{}, userID string) int {
+	if users, ok := content["users"].(map[string]interface{}); ok {
+		if level, ok := users[userID].(float64); ok {
+			return int(level)
+		}
+	}
+	if level, ok := content["users_default"].(float64); ok {
+		return int(level)
+	}
+	return 0
+}
@@ -0,0 +1,142 @@
+package enrich
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/yamatt/matrix-as-webhook/internal/matrix"
+)
+
+// fakeFetcher serves room state from a map and counts lookups. A non-nil
+// err fails every lookup.
+type fakeFetcher struct {
+	state map[string]map[string]interface{}
+	err   error
+	calls int
+}
+
+func (f *fakeFetcher) GetStateEvent(_ context.Context, roomID, eventType, stateKey string) (map[string]interface{}, error) {
+	f.calls++
+	if f.err != nil {
+		return nil, f.err
+	}
+	content, ok := f.state[roomID+"|"+eventType+"|"+stateKey]
+	if !ok {
+		return nil, &matrix.Error{StatusCode: http.StatusNotFound, ErrCode: "M_NOT_FOUND"}
+	}
+	return content, nil
+}
+
+func newFetcher() *fakeFetcher {
+	return &fakeFetcher{state: map[string]map[string]interface{}{
+		"!room:example.org|m.room.name|":                      {"name": "Support"},
+		"!room:example.org|m.room.canonical_alias|":           {"alias": "#support:example.org"},
+		"!room:example.org|m.room.encryption|":                {"algorithm": "m.megolm.v1.aes-sha2"},
+		"!room:example.org|m.room.member|@alice:example.org":  {"membership": "join", "displayname": "Alice", "avatar_url": "mxc://example.org/alice"},
+		"!room:example.org|m.room.power_levels|":              {"users": map[string]interface{}{"@alice:example.org": float64(50)}, "users_default": float64(0)},
+		"!other:example.org|m.room.power_levels|":             {"users_default": float64(10)},
+		"!other:example.org|m.room.member|@alice:example.org": {"membership": "join"},
+	}}
+}
+
+func TestEnrich(t *testing.T) {
+	e := NewEnricher(newFetcher(), time.Minute)
+
+	c := e.Enrich(context.Background(), "!room:example.org", "@alice:example.org")
+
+	if c.Room.Name != "Support" {
+		t.Errorf("Expected room name 'Support', got '%s'", c.Room.Name)
+	}
+	if c.Room.CanonicalAlias != "#support:example.org" {
+		t.Errorf("Expected canonical alias, got '%s'", c.Room.CanonicalAlias)
+	}
+	if c.Room.Topic != "" {
+		t.Errorf("Expected empty topic, got '%s'", c.Room.Topic)
+	}
+	if !c.Room.Encrypted {
+		t.Error("Expected room to be encrypted")
+	}
+	if c.Sender.Displayname != "Alice" || c.Sender.AvatarURL != "mxc://example.org/alice" {
+		t.Errorf("Unexpected sender profile: %+v", c.Sender)
+	}
+	if c.Sender.PowerLevel != 50 {
+		t.Errorf("Expected power level 50, got %d", c.Sender.PowerLevel)
+	}
+
+	other := e.Enrich(context.Background(), "!other:example.org", "@alice:example.org")
+	if other.Sender.PowerLevel != 10 {
+		t.Errorf("Expected users_default power level 10, got %d", other.Sender.PowerLevel)
+	}
+}
+
+func TestEnrich_CachesUntilExpiry(t *testing.T) {
+	f := newFetcher()
+	e := NewEnricher(f, time.Minute)
+	now := time.Now()
+	e.now = func() time.Time { return now }
+
+	e.Enrich(context.Background(), "!room:example.org", "@alice:example.org")
+	first := f.calls
+
+	e.Enrich(context.Background(), "!room:example.org", "@alice:example.org")
+	if f.calls != first {
+		t.Errorf("Expected cached lookups, got %d extra calls", f.calls-first)
+	}
+
+	now = now.Add(2 * time.Minute)
+	e.Enrich(context.Background(), "!room:example.org", "@alice:example.org")
+	if f.calls != 2*first {
+		t.Errorf("Expected all state to be refetched after expiry, got %d calls", f.calls)
+	}
+}
+
+func TestEnrich_CachesErrorsBriefly(t *testing.T) {
+	f := newFetcher()
+	f.err = errors.New("connection refused")
+	e := NewEnricher(f, time.Minute)
+	now := time.Now()
+	e.now = func() time.Time { return now }
+
+	e.Enrich(context.Background(), "!room:example.org", "@alice:example.org")
+	first := f.calls
+	e.Enrich(context.Background(), "!room:example.org", "@alice:example.org")
+	if f.calls != first {
+		t.Errorf("Expected failed lookups to be cached, got %d extra calls", f.calls-first)
+	}
+
+	f.err = nil
+	now = now.Add(errorTTL + time.Second)
+	if c := e.Enrich(context.Background(), "!room:example.org", "@alice:example.org"); c.Room.Name != "Support" {
+		t.Errorf("Expected the state to be fetched again once the error expired, got %+v", c.Room)
+	}
+}
+
+func TestStore_Bounded(t *testing.T) {
+	e := NewEnricher(newFetcher(), time.Minute)
+	for i := 0; i < 2*maxEntries; i++ {
+		e.Observe(fmt.Sprintf("!room%d:example.org", i), "m.room.name", "", nil)
+	}
+	if n := len(e.state); n > maxEntries {
+		t.Errorf("Expected at most %d cached entries, got %d", maxEntries, n)
+	}
+	if _, ok := e.state[stateKey{fmt.Sprintf("!room%d:example.org", 2*maxEntries-1), "m.room.name", ""}]; !ok {
+		t.Error("Expected the newest entry to be cached")
+	}
+}
+
+func TestObserve_UpdatesCache(t *testing.T) {
+	f := newFetcher()
+	e := NewEnricher(f, time.Minute)
+
+	e.Enrich(context.Background(), "!room:example.org", "@alice:example.org")
+	e.Observe("!room:example.org", "m.room.name", "", map[string]interface{}{"name": "Renamed"})
+
+	c := e.Enrich(context.Background(), "!room:example.org", "@alice:example.org")
+	if c.Room.Name != "Renamed" {
+		t.Errorf("Expected observed room name 'Renamed', got '%s'", c.Room.Name)
+	}
+}
@@ -0,0 +1,179 @@
+package ghost
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/yamatt/matrix-as-webhook/internal/config"
+	"github.com/yamatt/matrix-as-webhook/internal/matrix"
+)
+
+// Manager lazily registers ghost users, applies their configured profiles
+// and joins them to rooms before they are used as senders.
+type Manager struct {
+	client     *matrix.Client
+	domain     string
+	profiles   map[string]config.GhostConfig
+	namespaces []*regexp.Regexp
+
+	mu     sync.Mutex
+	ready  map[string]bool
+	joined map[string]bool
+}
+
+// NewManager creates a Manager for the ghosts and user namespaces in cfg.
+// Invalid namespace regexes are logged and ignored.
+func NewManager(client *matrix.Client, cfg *config.Config) *Manager {
+	m := &Manager{
+		client:   client,
+		domain:   cfg.Homeserver.Domain,
+		profiles: make(map[string]config.GhostConfig, len(cfg.Ghosts)),
+		ready:    make(map[string]bool),
+		joined:   make(map[string]bool),
+	}
+	for _, g := range cfg.Ghosts {
+		m.profiles[g.Localpart] = g
+	}
+	// Hook senders without an explicit profile are ghosts too
+	for _, h := range cfg.Hooks {
+		if _, ok := m.profiles[h.Sender]; !ok && h.Sender != "" && h.Sender != cfg.Homeserver.SenderLocalpart {
+			m.profiles[h.Sender] = config.GhostConfig{Localpart: h.Sender}
+		}
+	}
+	for _, ns := range cfg.Namespaces.Users {
+		re, err := regexp.Compile(ns.Regex)
+		if err != nil {
+			slog.Warn("ignoring invalid user namespace", "regex", ns.Regex, "error", err)
+			continue
+		}
+		m.namespaces = append(m.namespaces, re)
+	}
+	return m
+}
+
+// UserID returns the full user ID for a ghost localpart.
+func (m *Manager) UserID(localpart string) string {
+	return matrix.UserID(localpart, m.domain)
+}
+
+// Known returns the localpart of userID if it is a configured ghost or hook
+// sender on this server.
+func (m *Manager) Known(userID string) (string, bool) {
+	if !strings.HasPrefix(userID, "@") {
+		return "", false
+	}
+	localpart, server, ok := strings.Cut(userID[1:], ":")
+	if !ok || server != m.domain {
+		return "", false
+	}
+	if _, ok := m.profiles[localpart]; !ok {
+		return "", false
+	}
+	return localpart, true
+}
+
+// InNamespace reports whether userID falls in one of the appservice's user namespaces.
+func (m *Manager) InNamespace(userID string) bool {
+	for _, re := range m.namespaces {
+		if re.MatchString(userID) {
+			return true
+		}
+	}
+	return false
+}
+
+// Ensure registers the ghost and sets its profile the first time it is used,
+// returning its user ID.
+func (m *Manager) Ensure(ctx context.Context, localpart string) (string, error) {
+	userID := m.UserID(localpart)
+
+	m.mu.Lock()
+	ready := m.ready[userID]
+	m.mu.Unlock()
+	if ready {
+		return userID, nil
+	}
+
+	if !m.InNamespace(userID) {
+		return "", fmt.Errorf("ghost: %s is outside the appservice user namespaces", userID)
+	}
+
+	if err := m.client.Register(ctx, localpart); err != nil {
+		return "", fmt.Errorf("ghost: registering %s: %w", userID, err)
+	}
+
+	if profile, ok := m.profiles[localpart]; ok {
+		if profile.Displayname != "" {
+			if err := m.client.SetDisplayName(ctx, userID, profile.Displayname); err != nil {
+				return "", fmt.Errorf("ghost: setting displayname of %s: %w", userID, err)
+			}
+		}
+		if profile.AvatarURL != "" {
+			if err := m.client.SetAvatarURL(ctx, userID, profile.AvatarURL); err != nil {
+				return "", fmt.Errorf("ghost: setting avatar of %s: %w", userID, err)
+			}
+		}
+	}
+
+	slog.Info("registered ghost", "user_id", userID)
+
+	m.mu.Lock()
+	m.ready[userID] = true
+	m.mu.Unlock()
+	return userID, nil
+}
+
+// RoomPolicy decides which rooms ghosts may be in; *access.Policy
+// implements it.
+type RoomPolicy interface {
+	Check(ctx context.Context, roomID, sender string) error
+}
+
+// EnsureInRoom makes sure the ghost exists and is joined to roomID, if
+// policy allows the room; a nil policy allows every room. If the ghost
+// cannot join directly, the bot invites it first.
+func (m *Manager) EnsureInRoom(ctx context.Context, localpart, roomID string, policy RoomPolicy) (string, error) {
+	if policy != nil {
+		// Only the room is checked: the sender rules are about who the
+		// events come from, and ghosts post only what hooks send them.
+		if err := policy.Check(ctx, roomID, ""); err != nil {
+			return "", fmt.Errorf("ghost: %s may not join %s: %w", localpart, roomID, err)
+		}
+	}
+	userID, err := m.Ensure(ctx, localpart)
+	if err != nil {
+		return "", err
+	}
+
+	key := userID + "\x00" + roomID
+	m.mu.Lock()
+	joined := m.joined[key]
+	m.mu.Unlock()
+	if joined {
+		return userID, nil
+	}
+
+	if _, err := m.client.JoinRoom(ctx, roomID, userID); err != nil {
+		var mErr *matrix.Error
+		if !errors.As(err, &mErr) || mErr.StatusCode != http.StatusForbidden {
+			return "", fmt.Errorf("ghost: joining %s to %s: %w", userID, roomID, err)
+		}
+		if err := m.client.InviteUser(ctx, roomID, "", userID); err != nil {
+			return "", fmt.Errorf("ghost: inviting %s to %s: %w", userID, roomID, err)
+		}
+		if _, err := m.client.JoinRoom(ctx, roomID, userID); err != nil {
+			return "", fmt.Errorf("ghost: joining %s to %s: %w", userID, roomID, err)
+		}
+	}
+
+	m.mu.Lock()
+	m.joined[key] = true
+	m.mu.Unlock()
+	return userID, nil
+}
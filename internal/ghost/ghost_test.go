@@ -0,0 +1,165 @@
+package ghost
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/yamatt/matrix-as-webhook/internal/config"
+	"github.com/yamatt/matrix-as-webhook/internal/matrix"
+)
+
+// fakeHomeserver records Client-Server API calls and answers them.
+type fakeHomeserver struct {
+	mu    sync.Mutex
+	calls []string
+	// forbidJoin rejects the first join of each user with M_FORBIDDEN
+	forbidJoin bool
+	invited    bool
+}
+
+func (f *fakeHomeserver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls = append(f.calls, r.Method+" "+r.URL.Path)
+
+	if r.Method == http.MethodPost && r.URL.Path == "/_matrix/client/v3/rooms/!room:example.org/invite" {
+		f.invited = true
+	}
+	if f.forbidJoin && !f.invited && r.URL.Path == "/_matrix/client/v3/join/!room:example.org" {
+		w.WriteHeader(http.StatusForbidden)
+		_ = json.NewEncoder(w).Encode(map[string]string{"errcode": "M_FORBIDDEN", "error": "not invited"})
+		return
+	}
+	_ = json.NewEncoder(w).Encode(map[string]string{"room_id": "!room:example.org"})
+}
+
+func newTestManager(hs http.Handler) (*Manager, func()) {
+	server := httptest.NewServer(hs)
+	cfg := &config.Config{
+		Homeserver: config.HomeserverConfig{Domain: "example.org"},
+		Namespaces: config.NamespacesConfig{
+			Users: []config.NamespaceConfig{{Regex: `@webhook_.*:example\.org`, Exclusive: true}},
+		},
+		Ghosts: []config.GhostConfig{{Localpart: "webhook_ci", Displayname: "CI", AvatarURL: "mxc://example.org/ci"}},
+	}
+	return NewManager(matrix.NewClient(server.URL, "as-token", 5*time.Second), cfg), server.Close
+}
+
+func TestEnsure_RegistersOnceAndSetsProfile(t *testing.T) {
+	hs := &fakeHomeserver{}
+	m, closeFn := newTestManager(hs)
+	defer closeFn()
+
+	for i := 0; i < 2; i++ {
+		userID, err := m.Ensure(context.Background(), "webhook_ci")
+		if err != nil {
+			t.Fatalf("Ensure failed: %v", err)
+		}
+		if userID != "@webhook_ci:example.org" {
+			t.Errorf("Expected '@webhook_ci:example.org', got '%s'", userID)
+		}
+	}
+
+	expected := []string{
+		"POST /_matrix/client/v3/register",
+		"PUT /_matrix/client/v3/profile/@webhook_ci:example.org/displayname",
+		"PUT /_matrix/client/v3/profile/@webhook_ci:example.org/avatar_url",
+	}
+	if len(hs.calls) != len(expected) {
+		t.Fatalf("Expected calls %v, got %v", expected, hs.calls)
+	}
+	for i := range expected {
+		if hs.calls[i] != expected[i] {
+			t.Errorf("Call %d: expected '%s', got '%s'", i, expected[i], hs.calls[i])
+		}
+	}
+}
+
+func TestEnsure_OutsideNamespace(t *testing.T) {
+	hs := &fakeHomeserver{}
+	m, closeFn := newTestManager(hs)
+	defer closeFn()
+
+	if _, err := m.Ensure(context.Background(), "someone"); err == nil {
+		t.Error("Expected error for ghost outside the user namespaces")
+	}
+	if len(hs.calls) != 0 {
+		t.Errorf("Expected no homeserver calls, got %v", hs.calls)
+	}
+}
+
+func TestEnsureInRoom_InvitesWhenForbidden(t *testing.T) {
+	hs := &fakeHomeserver{forbidJoin: true}
+	m, closeFn := newTestManager(hs)
+	defer closeFn()
+
+	if _, err := m.EnsureInRoom(context.Background(), "webhook_deploy", "!room:example.org", nil); err != nil {
+		t.Fatalf("EnsureInRoom failed: %v", err)
+	}
+	if !hs.invited {
+		t.Error("Expected bot to invite the ghost after a forbidden join")
+	}
+
+	calls := len(hs.calls)
+	if _, err := m.EnsureInRoom(context.Background(), "webhook_deploy", "!room:example.org", nil); err != nil {
+		t.Fatalf("EnsureInRoom failed: %v", err)
+	}
+	if len(hs.calls) != calls {
+		t.Errorf("Expected membership to be cached, got extra calls %v", hs.calls[calls:])
+	}
+}
+
+// roomList allows only the rooms in it.
+type roomList map[string]bool
+
+func (l roomList) Check(_ context.Context, roomID, _ string) error {
+	if !l[roomID] {
+		return errors.New("room not allowed")
+	}
+	return nil
+}
+
+func TestEnsureInRoom_RespectsPolicy(t *testing.T) {
+	hs := &fakeHomeserver{}
+	m, closeFn := newTestManager(hs)
+	defer closeFn()
+
+	if _, err := m.EnsureInRoom(context.Background(), "webhook_deploy", "!room:example.org", roomList{}); err == nil {
+		t.Error("Expected an error for a room the policy does not allow")
+	}
+	if len(hs.calls) != 0 {
+		t.Errorf("Expected no homeserver calls for a denied room, got %v", hs.calls)
+	}
+	if _, err := m.EnsureInRoom(context.Background(), "webhook_deploy", "!room:example.org", roomList{"!room:example.org": true}); err != nil {
+		t.Fatalf("EnsureInRoom failed: %v", err)
+	}
+}
+
+func TestKnown(t *testing.T) {
+	cfg := &config.Config{
+		Homeserver: config.HomeserverConfig{Domain: "example.org", SenderLocalpart: "webhook"},
+		Ghosts:     []config.GhostConfig{{Localpart: "webhook_ci"}},
+		Hooks:      []config.HookConfig{{ID: "deploy", Sender: "webhook_deploy"}, {ID: "bot", Sender: "webhook"}},
+	}
+	m := NewManager(matrix.NewClient("", "", 0), cfg)
+
+	cases := map[string]bool{
+		"@webhook_ci:example.org":     true,
+		"@webhook_deploy:example.org": true,
+		"@webhook:example.org":        false,
+		"@webhook_ci:other.org":       false,
+		"@someone:example.org":        false,
+		"webhook_ci":                  false,
+	}
+	for userID, want := range cases {
+		if _, got := m.Known(userID); got != want {
+			t.Errorf("Known(%s) = %v, want %v", userID, got, want)
+		}
+	}
+}
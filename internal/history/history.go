@@ -0,0 +1,365 @@
+// Package history records webhook delivery attempts so they can be looked
+// up later, e.g. to answer whether an event reached a route.
+package history
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/yamatt/matrix-as-webhook/internal/config"
+)
+
+// Record is a single delivery attempt.
+type Record struct {
+	Time    time.Time `json:"time"`
+	EventID string    `json:"event_id,omitempty"`
+	RoomID  string    `json:"room_id,omitempty"`
+	Route   string    `json:"route"`
+	URL     string    `json:"url"`
+	Attempt int       `json:"attempt"`
+	// Status is the HTTP status of the response, or 0 if there was none
+	Status    int     `json:"status,omitempty"`
+	Success   bool    `json:"success"`
+	LatencyMS float64 `json:"latency_ms"`
+	// Response is the start of the response body
+	Response string `json:"response,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// Filter selects records. Zero fields match everything.
+type Filter struct {
+	EventID string
+	RoomID  string
+	Route   string
+	// Status is "success", "failure", a status code such as "503" or a
+	// status class such as "5xx"
+	Status string
+	Since  time.Time
+	Until  time.Time
+	// Limit is the largest number of records returned (default: 100)
+	Limit int
+}
+
+// defaultLimit is the number of records a query returns without a limit.
+const defaultLimit = 100
+
+// ParseFilter reads a filter from query parameters: event_id, room_id,
+// route, status, since, until and limit. Times are RFC 3339 or a duration
+// before now, e.g. "1h".
+func ParseFilter(q url.Values, now time.Time) (Filter, error) {
+	f := Filter{
+		EventID: q.Get("event_id"),
+		RoomID:  q.Get("room_id"),
+		Route:   q.Get("route"),
+		Status:  q.Get("status"),
+		Limit:   defaultLimit,
+	}
+	var err error
+	if f.Since, err = parseTime(q.Get("since"), now); err != nil {
+		return Filter{}, fmt.Errorf("since: %w", err)
+	}
+	if f.Until, err = parseTime(q.Get("until"), now); err != nil {
+		return Filter{}, fmt.Errorf("until: %w", err)
+	}
+	if limit := q.Get("limit"); limit != "" {
+		if f.Limit, err = strconv.Atoi(limit); err != nil || f.Limit < 1 {
+			return Filter{}, fmt.Errorf("limit: must be a positive number")
+		}
+	}
+	return f, nil
+}
+
+func parseTime(value string, now time.Time) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if d, err := time.ParseDuration(value); err == nil {
+		return now.Add(-d), nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+// Match reports whether r is selected by the filter, ignoring the limit.
+func (f Filter) Match(r Record) bool {
+	switch {
+	case f.EventID != "" && r.EventID != f.EventID,
+		f.RoomID != "" && r.RoomID != f.RoomID,
+		f.Route != "" && r.Route != f.Route,
+		!f.Since.IsZero() && r.Time.Before(f.Since),
+		!f.Until.IsZero() && r.Time.After(f.Until):
+		return false
+	}
+	switch {
+	case f.Status == "":
+		return true
+	case f.Status == "success":
+		return r.Success
+	case f.Status == "failure":
+		return !r.Success
+	case len(f.Status) == 3 && strings.HasSuffix(f.Status, "xx"):
+		return r.Status/100 == int(f.Status[0]-'0')
+	default:
+		return strconv.Itoa(r.Status) == f.Status
+	}
+}
+
+// Store keeps the most recent records in memory, optionally backed by a
+// JSON Lines file that is appended to and compacted once it holds twice as
+// many lines as records are kept.
+type Store struct {
+	maxEntries int
+	maxAge     time.Duration
+	path       string
+	now        func() time.Time
+
+	mu      sync.Mutex
+	records []Record // oldest first
+	file    *os.File
+	lines   int
+	err     error // the last write error, cleared by a successful write
+}
+
+// New creates a store holding records in memory. It returns nil if the
+// history is disabled; a nil store drops every record.
+func New(conf config.HistoryConfig) *Store {
+	if conf.MaxEntries < 0 {
+		return nil
+	}
+	return &Store{maxEntries: conf.MaxEntries, maxAge: conf.MaxAge, path: conf.Path, now: time.Now}
+}
+
+// Load reads the records kept in the store's file, if it has one, and opens
+// it for appending.
+func (s *Store) Load() error {
+	if s == nil || s.path == "" {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.load(); err != nil {
+		return err
+	}
+	return s.compact()
+}
+
+// load reads the records in the file, skipping lines that do not parse,
+// such as one cut short by a crash.
+func (s *Store) load() error {
+	file, err := os.Open(s.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("history: %w", err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var r Record
+		if json.Unmarshal(scanner.Bytes(), &r) == nil {
+			s.records = append(s.records, r)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("history: reading %s: %w", s.path, err)
+	}
+	s.expire()
+	return nil
+}
+
+// Add records a delivery attempt.
+func (s *Store) Add(r Record) error {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.records = append(s.records, r)
+	s.expire()
+	if s.file == nil {
+		// In memory, not loaded yet, or the file could not be reopened
+		return s.err
+	}
+	s.err = s.write(r)
+	return s.err
+}
+
+// write appends a record to the file, compacting it when it has grown.
+// The caller must hold s.mu.
+func (s *Store) write(r Record) error {
+	line, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	if _, err := s.file.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("history: %w", err)
+	}
+	s.lines++
+	if s.lines > 2*max(s.maxEntries, len(s.records)) {
+		return s.compact()
+	}
+	return nil
+}
+
+// Err returns the error of the last write to the file, or nil if it
+// succeeded.
+func (s *Store) Err() error {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+// Path returns the file the store is kept in, or "" if it is in memory.
+func (s *Store) Path() string {
+	if s == nil {
+		return ""
+	}
+	return s.path
+}
+
+// expire drops records beyond the retention limits; a zero limit is not
+// applied. The slice is cut from the front rather than copied, so a full
+// store does not copy every record on each Add; append moves the records
+// that are left to a new array once the old one's capacity runs out.
+func (s *Store) expire() {
+	drop := 0
+	if over := len(s.records) - s.maxEntries; s.maxEntries > 0 && over > 0 {
+		drop = over
+	}
+	if s.maxAge > 0 {
+		cutoff := s.now().Add(-s.maxAge)
+		for drop < len(s.records) && s.records[drop].Time.Before(cutoff) {
+			drop++
+		}
+	}
+	if drop > 0 {
+		clear(s.records[:drop])
+		s.records = s.records[drop:]
+	}
+}
+
+// compact rewrites the file with the records still kept and reopens it for
+// appending. The caller must hold s.mu.
+func (s *Store) compact() error {
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".*")
+	if err != nil {
+		return fmt.Errorf("history: %w", err)
+	}
+	w := bufio.NewWriter(tmp)
+	enc := json.NewEncoder(w)
+	for _, r := range s.records {
+		if err := enc.Encode(r); err != nil {
+			tmp.Close()
+			os.Remove(tmp.Name())
+			return fmt.Errorf("history: %w", err)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return fmt.Errorf("history: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("history: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), s.path); err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("history: %w", err)
+	}
+
+	if s.file != nil {
+		s.file.Close()
+	}
+	s.file, err = os.OpenFile(s.path, os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		s.file = nil
+		return fmt.Errorf("history: %w", err)
+	}
+	s.lines = len(s.records)
+	return nil
+}
+
+// Query returns the records matching f, newest first.
+func (s *Store) Query(f Filter) []Record {
+	if s == nil {
+		return []Record{}
+	}
+	limit := f.Limit
+	if limit <= 0 {
+		limit = defaultLimit
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := []Record{}
+	for i := len(s.records) - 1; i >= 0 && len(out) < limit; i-- {
+		if f.Match(s.records[i]) {
+			out = append(out, s.records[i])
+		}
+	}
+	return out
+}
+
+// DeadLetters returns the last attempt of each event and route whose last
+// attempt failed, newest first. f.Status is ignored. Deliveries without an
+// event ID, such as those of ephemeral events, are left out because they
+// cannot be looked up again.
+func (s *Store) DeadLetters(f Filter) []Record {
+	if s == nil {
+		return []Record{}
+	}
+	limit := f.Limit
+	if limit <= 0 {
+		limit = defaultLimit
+	}
+	f.Status = ""
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := []Record{}
+	seen := make(map[[2]string]bool)
+	for i := len(s.records) - 1; i >= 0 && len(out) < limit; i-- {
+		r := s.records[i]
+		key := [2]string{r.EventID, r.Route}
+		if r.EventID == "" || seen[key] {
+			continue
+		}
+		seen[key] = true
+		if !r.Success && f.Match(r) {
+			out = append(out, r)
+		}
+	}
+	return out
+}
+
+// Close closes the backing file.
+func (s *Store) Close() error {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.file == nil {
+		return nil
+	}
+	err := s.file.Close()
+	s.file = nil
+	return err
+}
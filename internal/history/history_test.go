@@ -0,0 +1,206 @@
+package history
+
+import (
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/yamatt/matrix-as-webhook/internal/config"
+)
+
+func TestQueryNewestFirst(t *testing.T) {
+	s := New(config.HistoryConfig{MaxEntries: 10})
+	start := time.Now()
+	for i, route := range []string{"a", "b", "a"} {
+		if err := s.Add(Record{Time: start.Add(time.Duration(i) * time.Second), Route: route, Attempt: i + 1}); err != nil {
+			t.Fatalf("Add failed: %v", err)
+		}
+	}
+
+	got := s.Query(Filter{Route: "a"})
+	if len(got) != 2 || got[0].Attempt != 3 || got[1].Attempt != 1 {
+		t.Errorf("Expected attempts 3 and 1 for route a, got %+v", got)
+	}
+	if got := s.Query(Filter{Limit: 1}); len(got) != 1 || got[0].Attempt != 3 {
+		t.Errorf("Expected only the newest record, got %+v", got)
+	}
+}
+
+func TestRetention(t *testing.T) {
+	now := time.Now()
+	s := New(config.HistoryConfig{MaxEntries: 2, MaxAge: time.Hour})
+	s.now = func() time.Time { return now }
+
+	_ = s.Add(Record{Time: now.Add(-2 * time.Hour), Route: "old"})
+	if got := s.Query(Filter{}); len(got) != 0 {
+		t.Errorf("Expected records older than max_age to be dropped, got %+v", got)
+	}
+	for _, route := range []string{"a", "b", "c"} {
+		_ = s.Add(Record{Time: now, Route: route})
+	}
+	got := s.Query(Filter{})
+	if len(got) != 2 || got[0].Route != "c" || got[1].Route != "b" {
+		t.Errorf("Expected the 2 newest records, got %+v", got)
+	}
+}
+
+func TestRetentionKeepsMemoryBounded(t *testing.T) {
+	s := New(config.HistoryConfig{MaxEntries: 100})
+	for i := 0; i < 10000; i++ {
+		_ = s.Add(Record{Time: time.Now(), Attempt: i})
+	}
+	if len(s.records) != 100 || s.records[0].Attempt != 9900 {
+		t.Errorf("Expected the 100 newest records, got %d starting at %d", len(s.records), s.records[0].Attempt)
+	}
+	if cap(s.records) > 400 {
+		t.Errorf("Expected the backing array to stay near max_entries, got capacity %d", cap(s.records))
+	}
+}
+
+func TestFilterStatus(t *testing.T) {
+	tests := []struct {
+		status string
+		record Record
+		want   bool
+	}{
+		{"success", Record{Status: 200, Success: true}, true},
+		{"success", Record{Status: 500}, false},
+		{"failure", Record{Error: "refused"}, true},
+		{"5xx", Record{Status: 503}, true},
+		{"5xx", Record{Status: 404}, false},
+		{"404", Record{Status: 404}, true},
+		{"404", Record{Status: 410}, false},
+	}
+	for _, tt := range tests {
+		if got := (Filter{Status: tt.status}).Match(tt.record); got != tt.want {
+			t.Errorf("Expected status %q on %+v to be %v, got %v", tt.status, tt.record, tt.want, got)
+		}
+	}
+}
+
+func TestParseFilter(t *testing.T) {
+	now := time.Date(2026, 5, 1, 12, 0, 0, 0, time.UTC)
+	f, err := ParseFilter(url.Values{
+		"event_id": {"$e"},
+		"since":    {"1h"},
+		"until":    {"2026-05-01T11:30:00Z"},
+		"limit":    {"5"},
+	}, now)
+	if err != nil {
+		t.Fatalf("ParseFilter failed: %v", err)
+	}
+	if f.EventID != "$e" || f.Limit != 5 {
+		t.Errorf("Expected event_id $e and limit 5, got %+v", f)
+	}
+	if !f.Since.Equal(now.Add(-time.Hour)) {
+		t.Errorf("Expected since an hour ago, got %v", f.Since)
+	}
+	if !f.Until.Equal(now.Add(-30 * time.Minute)) {
+		t.Errorf("Expected until 11:30, got %v", f.Until)
+	}
+
+	for _, q := range []url.Values{{"since": {"yesterday"}}, {"limit": {"0"}}} {
+		if _, err := ParseFilter(q, now); err == nil {
+			t.Errorf("Expected an error for %v", q)
+		}
+	}
+}
+
+func TestPersistence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history.jsonl")
+	conf := config.HistoryConfig{Path: path, MaxEntries: 2}
+
+	s := New(conf)
+	if err := s.Load(); err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	for _, route := range []string{"a", "b", "c", "d", "e"} {
+		if err := s.Add(Record{Time: time.Now(), Route: route}); err != nil {
+			t.Fatalf("Add failed: %v", err)
+		}
+	}
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("ReadFile failed: %v", err)
+	}
+	if lines := strings.Count(string(data), "\n"); lines > 4 {
+		t.Errorf("Expected the file to be compacted, got %d lines", lines)
+	}
+	// A line cut short by a crash is skipped
+	if err := os.WriteFile(path, append(data, `{"route":"f`...), 0o600); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+
+	reopened := New(conf)
+	if err := reopened.Load(); err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	defer reopened.Close()
+	got := reopened.Query(Filter{})
+	if len(got) != 2 || got[0].Route != "e" || got[1].Route != "d" {
+		t.Errorf("Expected records d and e after reopening, got %+v", got)
+	}
+}
+
+func TestDisabled(t *testing.T) {
+	s := New(config.HistoryConfig{MaxEntries: -1})
+	if s != nil {
+		t.Fatal("Expected no store when the history is disabled")
+	}
+	if err := s.Add(Record{Route: "a"}); err != nil {
+		t.Errorf("Expected Add on a disabled store to succeed, got %v", err)
+	}
+	if got := s.Query(Filter{}); len(got) != 0 {
+		t.Errorf("Expected no records, got %+v", got)
+	}
+}
+
+func TestErrReportsWriteFailures(t *testing.T) {
+	s := New(config.HistoryConfig{Path: filepath.Join(t.TempDir(), "history.jsonl"), MaxEntries: 10})
+	if err := s.Load(); err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	if err := s.Add(Record{Time: time.Now(), Route: "a"}); err != nil || s.Err() != nil {
+		t.Fatalf("Expected the write to succeed, got %v", err)
+	}
+
+	s.file.Close()
+	if err := s.Add(Record{Time: time.Now(), Route: "b"}); err == nil || s.Err() == nil {
+		t.Error("Expected the failed write to be reported")
+	}
+	if got := s.Query(Filter{}); len(got) != 2 {
+		t.Errorf("Expected records to be kept in memory, got %d", len(got))
+	}
+}
+
+func TestDeadLetters(t *testing.T) {
+	s := New(config.HistoryConfig{MaxEntries: 10})
+	start := time.Now()
+	for i, r := range []Record{
+		{EventID: "$a", Route: "one", Attempt: 1},
+		{EventID: "$a", Route: "one", Attempt: 2, Success: true},
+		{EventID: "$b", Route: "one", Attempt: 1},
+		{EventID: "$b", Route: "two", Attempt: 1, Success: true},
+		{Route: "typing", Attempt: 1},
+		{EventID: "$c", Route: "two", Attempt: 1, Success: true},
+		{EventID: "$c", Route: "two", Attempt: 2},
+	} {
+		r.Time = start.Add(time.Duration(i) * time.Second)
+		_ = s.Add(r)
+	}
+
+	got := s.DeadLetters(Filter{})
+	if len(got) != 2 || got[0].EventID != "$c" || got[0].Attempt != 2 || got[1].EventID != "$b" || got[1].Route != "one" {
+		t.Errorf("Expected the failed last attempts of $c and $b, got %+v", got)
+	}
+	if got := s.DeadLetters(Filter{Route: "one", Status: "success"}); len(got) != 1 || got[0].EventID != "$b" {
+		t.Errorf("Expected the route filter to apply and the status filter not to, got %+v", got)
+	}
+}
@@ -0,0 +1,72 @@
+package inbound
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"net/http"
+
+	"github.com/yamatt/matrix-as-webhook/internal/config"
+)
+
+// Adapter understands one sender's payload format.
+type Adapter interface {
+	// Verify authenticates the request using the sender's conventions.
+	Verify(r *http.Request, body []byte, conf config.HookConfig) error
+	// Render produces the default message for a payload.
+	Render(header http.Header, body []byte) (Message, error)
+}
+
+// adapters maps HookConfig.Format values to their adapter.
+var adapters = map[string]Adapter{
+	"generic":      genericAdapter{},
+	"alertmanager": alertmanagerAdapter{},
+	"grafana":      grafanaAdapter{},
+	"github":       githubAdapter{},
+	"gitlab":       gitlabAdapter{},
+}
+
+// adapterFor returns the adapter for a format, defaulting to generic.
+func adapterFor(format string) (Adapter, error) {
+	if format == "" {
+		format = "generic"
+	}
+	a, ok := adapters[format]
+	if !ok {
+		return nil, fmt.Errorf("unknown format %q", format)
+	}
+	return a, nil
+}
+
+// genericAdapter accepts any JSON document. A top-level string "key" field
+// correlates messages and "status": "resolved" marks them resolved.
+type genericAdapter struct{}
+
+func (genericAdapter) Verify(r *http.Request, body []byte, conf config.HookConfig) error {
+	if err := verifyToken(r, conf); err != nil {
+		return err
+	}
+	return verifySignature(r, body, conf, "X-Webhook-Signature")
+}
+
+func (genericAdapter) Render(_ http.Header, body []byte) (Message, error) {
+	var data interface{}
+	if err := json.Unmarshal(body, &data); err != nil {
+		return Message{}, fmt.Errorf("invalid JSON: %w", err)
+	}
+
+	pretty, err := toJSON(data)
+	if err != nil {
+		return Message{}, err
+	}
+
+	msg := Message{
+		Body:          pretty,
+		FormattedBody: "<pre><code>" + html.EscapeString(pretty) + "</code></pre>",
+	}
+	if obj, ok := data.(map[string]interface{}); ok {
+		msg.Key, _ = obj["key"].(string)
+		msg.Resolved = obj["status"] == "resolved"
+	}
+	return msg, nil
+}
@@ -0,0 +1,129 @@
+package inbound
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/yamatt/matrix-as-webhook/internal/config"
+)
+
+var update = flag.Bool("update", false, "update golden files")
+
+func TestAdapters_Golden(t *testing.T) {
+	cases := []struct {
+		name   string
+		format string
+		header http.Header
+	}{
+		{"alertmanager_firing", "alertmanager", nil},
+		{"alertmanager_resolved", "alertmanager", nil},
+		{"grafana_firing", "grafana", nil},
+		{"github_push", "github", http.Header{"X-Github-Event": {"push"}}},
+		{"github_pull_request_opened", "github", http.Header{"X-Github-Event": {"pull_request"}}},
+		{"github_pull_request_merged", "github", http.Header{"X-Github-Event": {"pull_request"}}},
+		{"github_issues_opened", "github", http.Header{"X-Github-Event": {"issues"}}},
+		{"gitlab_push", "gitlab", nil},
+		{"gitlab_merge_request_merged", "gitlab", nil},
+		{"gitlab_pipeline_running", "gitlab", nil},
+		{"generic", "generic", nil},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			body, err := os.ReadFile(filepath.Join("testdata", tc.name+".json"))
+			if err != nil {
+				t.Fatalf("Failed to read payload: %v", err)
+			}
+
+			hook, err := NewHook(config.HookConfig{ID: tc.name, Format: tc.format, MsgType: "m.notice", Public: true})
+			if err != nil {
+				t.Fatalf("NewHook failed: %v", err)
+			}
+			msg, err := hook.Render(tc.header, body)
+			if err != nil {
+				t.Fatalf("Render failed: %v", err)
+			}
+
+			got := fmt.Sprintf("key: %s\nresolved: %v\n--- body\n%s\n--- formatted_body\n%s\n", msg.Key, msg.Resolved, msg.Body, msg.FormattedBody)
+			golden := filepath.Join("testdata", tc.name+".golden")
+			if *update {
+				if err := os.WriteFile(golden, []byte(got), 0644); err != nil {
+					t.Fatalf("Failed to update golden file: %v", err)
+				}
+			}
+
+			want, err := os.ReadFile(golden)
+			if err != nil {
+				t.Fatalf("Failed to read golden file (run with -update to create): %v", err)
+			}
+			if got != string(want) {
+				t.Errorf("Rendered output mismatch for %s\n got:\n%s\nwant:\n%s", tc.name, got, want)
+			}
+		})
+	}
+}
+
+func TestNewHook_UnknownFormat(t *testing.T) {
+	if _, err := NewHook(config.HookConfig{ID: "x", Format: "jenkins", Public: true}); err == nil {
+		t.Error("Expected error for unknown format")
+	}
+}
+
+func TestVerify_GitHubSignature(t *testing.T) {
+	hook, _ := NewHook(config.HookConfig{ID: "gh", Format: "github", SharedSecret: "It's a Secret to Everybody"})
+	body := []byte("Hello, World!")
+
+	// Example from GitHub's webhook validation documentation.
+	req := httptest.NewRequest("POST", "/hooks/gh", nil)
+	req.Header.Set("X-Hub-Signature-256", "sha256=757107ea0eb2509fc211221cce984b8a37570b6d7586c22c46f4379c8b043e17")
+	if err := hook.Verify(req, body); err != nil {
+		t.Errorf("Expected GitHub signature to verify, got %v", err)
+	}
+
+	req.Header.Set("X-Hub-Signature-256", "sha256=0000")
+	if err := hook.Verify(req, body); !errors.Is(err, ErrUnauthorized) {
+		t.Errorf("Expected ErrUnauthorized, got %v", err)
+	}
+}
+
+func TestVerify_GitLabToken(t *testing.T) {
+	hook, _ := NewHook(config.HookConfig{ID: "gl", Format: "gitlab", Token: "gl-token"})
+
+	req := httptest.NewRequest("POST", "/hooks/gl", nil)
+	req.Header.Set("X-Gitlab-Token", "gl-token")
+	if err := hook.Verify(req, nil); err != nil {
+		t.Errorf("Expected GitLab token to verify, got %v", err)
+	}
+
+	req.Header.Set("X-Gitlab-Token", "wrong")
+	if err := hook.Verify(req, nil); !errors.Is(err, ErrUnauthorized) {
+		t.Errorf("Expected ErrUnauthorized, got %v", err)
+	}
+}
+
+func TestTracker(t *testing.T) {
+	tr := NewTracker()
+
+	if _, ok := tr.Lookup("am", "group"); ok {
+		t.Error("Expected empty tracker")
+	}
+
+	tr.Remember("am", "group", "$firing")
+	if eventID, ok := tr.Lookup("am", "group"); !ok || eventID != "$firing" {
+		t.Errorf("Expected '$firing', got '%s' (ok=%v)", eventID, ok)
+	}
+	if _, ok := tr.Lookup("other", "group"); ok {
+		t.Error("Expected keys to be scoped per hook")
+	}
+
+	tr.Forget("am", "group")
+	if _, ok := tr.Lookup("am", "group"); ok {
+		t.Error("Expected key to be forgotten")
+	}
+}
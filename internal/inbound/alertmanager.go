@@ -0,0 +1,146 @@
+package inbound
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/yamatt/matrix-as-webhook/internal/config"
+)
+
+// alertmanagerPayload is the Prometheus Alertmanager webhook payload (version 4).
+type alertmanagerPayload struct {
+	Status       string            `json:"status"`
+	Receiver     string            `json:"receiver"`
+	GroupKey     string            `json:"groupKey"`
+	GroupLabels  map[string]string `json:"groupLabels"`
+	CommonLabels map[string]string `json:"commonLabels"`
+	Alerts       []alert           `json:"alerts"`
+}
+
+type alert struct {
+	Status       string            `json:"status"`
+	Labels       map[string]string `json:"labels"`
+	Annotations  map[string]string `json:"annotations"`
+	GeneratorURL string            `json:"generatorURL"`
+}
+
+// alertmanagerAdapter renders Alertmanager notifications grouped by status.
+// Messages are keyed by the alert group so a resolved notification can
+// replace the firing one.
+type alertmanagerAdapter struct{}
+
+func (alertmanagerAdapter) Verify(r *http.Request, body []byte, conf config.HookConfig) error {
+	if err := verifyToken(r, conf); err != nil {
+		return err
+	}
+	return verifySignature(r, body, conf, "X-Webhook-Signature")
+}
+
+func (alertmanagerAdapter) Render(_ http.Header, body []byte) (Message, error) {
+	var p alertmanagerPayload
+	if err := json.Unmarshal(body, &p); err != nil {
+		return Message{}, fmt.Errorf("invalid Alertmanager payload: %w", err)
+	}
+
+	title := p.GroupLabels["alertname"]
+	if title == "" {
+		title = p.CommonLabels["alertname"]
+	}
+	if title == "" {
+		title = p.Receiver
+	}
+
+	msg := renderAlerts(p.Status, title, labelSummary(p.GroupLabels, "alertname"), p.Alerts)
+	msg.Key = p.GroupKey
+	return msg, nil
+}
+
+// renderAlerts formats a group of alerts as firing and resolved lists.
+func renderAlerts(status, title, detail string, alerts []alert) Message {
+	var firing, resolved []alert
+	for _, a := range alerts {
+		if a.Status == "resolved" {
+			resolved = append(resolved, a)
+		} else {
+			firing = append(firing, a)
+		}
+	}
+
+	heading := fmt.Sprintf("[%s:%d] %s", strings.ToUpper(status), len(alerts), title)
+
+	var text, formatted strings.Builder
+	text.WriteString(heading)
+	formatted.WriteString("<strong>" + html.EscapeString(heading) + "</strong>")
+	if detail != "" {
+		text.WriteString(" (" + detail + ")")
+		formatted.WriteString(" (" + html.EscapeString(detail) + ")")
+	}
+
+	for _, group := range []struct {
+		name   string
+		alerts []alert
+	}{{"Firing", firing}, {"Resolved", resolved}} {
+		if len(group.alerts) == 0 {
+			continue
+		}
+		text.WriteString("\n" + group.name + ":")
+		formatted.WriteString("<br><b>" + group.name + "</b><ul>")
+		for _, a := range group.alerts {
+			line := alertLine(a)
+			text.WriteString("\n- " + line)
+			if a.GeneratorURL != "" {
+				formatted.WriteString(fmt.Sprintf(`<li><a href="%s">%s</a></li>`, html.EscapeString(a.GeneratorURL), html.EscapeString(line)))
+			} else {
+				formatted.WriteString("<li>" + html.EscapeString(line) + "</li>")
+			}
+		}
+		formatted.WriteString("</ul>")
+	}
+
+	return Message{
+		Body:          text.String(),
+		FormattedBody: formatted.String(),
+		Resolved:      status == "resolved",
+	}
+}
+
+// alertLine summarises a single alert from its annotations and labels.
+func alertLine(a alert) string {
+	summary := a.Annotations["summary"]
+	if summary == "" {
+		summary = a.Annotations["description"]
+	}
+	if summary == "" {
+		summary = a.Labels["alertname"]
+	}
+	if instance := a.Labels["instance"]; instance != "" {
+		return instance + ": " + summary
+	}
+	return summary
+}
+
+// labelSummary renders labels as sorted key=value pairs, skipping excluded keys.
+func labelSummary(labels map[string]string, exclude ...string) string {
+	skip := make(map[string]bool, len(exclude))
+	for _, k := range exclude {
+		skip[k] = true
+	}
+
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		if !skip[k] {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	pairs := make([]string, 0, len(keys))
+	for _, k := range keys {
+		pairs = append(pairs, k+"="+labels[k])
+	}
+	return strings.Join(pairs, ", ")
+}
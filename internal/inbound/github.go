@@ -0,0 +1,180 @@
+package inbound
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"net/http"
+	"strings"
+
+	"github.com/yamatt/matrix-as-webhook/internal/config"
+)
+
+// maxCommits limits how many commits of a push are listed.
+const maxCommits = 5
+
+// githubPayload holds the fields of GitHub webhook events that are rendered.
+type githubPayload struct {
+	Action     string `json:"action"`
+	Ref        string `json:"ref"`
+	Compare    string `json:"compare"`
+	Zen        string `json:"zen"`
+	Repository struct {
+		FullName string `json:"full_name"`
+		HTMLURL  string `json:"html_url"`
+	} `json:"repository"`
+	Sender struct {
+		Login string `json:"login"`
+	} `json:"sender"`
+	Commits []struct {
+		ID      string `json:"id"`
+		Message string `json:"message"`
+		URL     string `json:"url"`
+	} `json:"commits"`
+	PullRequest *githubItem `json:"pull_request"`
+	Issue       *githubItem `json:"issue"`
+}
+
+type githubItem struct {
+	Number  int    `json:"number"`
+	Title   string `json:"title"`
+	HTMLURL string `json:"html_url"`
+	Merged  bool   `json:"merged"`
+}
+
+// githubAdapter renders GitHub push, pull request and issue events. Pull
+// requests and issues are keyed by repository and number, and resolve when
+// closed.
+type githubAdapter struct{}
+
+func (githubAdapter) Verify(r *http.Request, body []byte, conf config.HookConfig) error {
+	if err := verifyToken(r, conf); err != nil {
+		return err
+	}
+	return verifySignature(r, body, conf, "X-Hub-Signature-256")
+}
+
+func (githubAdapter) Render(header http.Header, body []byte) (Message, error) {
+	var p githubPayload
+	if err := json.Unmarshal(body, &p); err != nil {
+		return Message{}, fmt.Errorf("invalid GitHub payload: %w", err)
+	}
+
+	repo := p.Repository.FullName
+	event := header.Get("X-GitHub-Event")
+
+	switch event {
+	case "ping":
+		text := fmt.Sprintf("GitHub webhook configured for %s: %s", repo, p.Zen)
+		return Message{Body: text, FormattedBody: html.EscapeString(text)}, nil
+
+	case "push":
+		branch := strings.TrimPrefix(p.Ref, "refs/heads/")
+		heading := fmt.Sprintf("%s pushed %s to %s of %s", p.Sender.Login, plural(len(p.Commits), "commit"), branch, repo)
+		return renderCommits(heading, p.Compare, commitLines(p)), nil
+
+	case "pull_request", "issues":
+		item, kind := p.PullRequest, "pull request"
+		if event == "issues" {
+			item, kind = p.Issue, "issue"
+		}
+		if item == nil {
+			return Message{}, fmt.Errorf("GitHub %s event without %s", event, kind)
+		}
+		action := p.Action
+		if action == "closed" && item.Merged {
+			action = "merged"
+		}
+		msg := renderItem(fmt.Sprintf("%s %s %s #%d in %s", p.Sender.Login, action, kind, item.Number, repo), item.Title, item.HTMLURL)
+		msg.Key = fmt.Sprintf("%s#%d", repo, item.Number)
+		msg.Resolved = p.Action == "closed"
+		return msg, nil
+
+	default:
+		text := fmt.Sprintf("%s triggered %s on %s", p.Sender.Login, event, repo)
+		return Message{Body: text, FormattedBody: html.EscapeString(text)}, nil
+	}
+}
+
+// commitLines returns one summary line per pushed commit.
+func commitLines(p githubPayload) []commitLine {
+	lines := make([]commitLine, 0, len(p.Commits))
+	for _, c := range p.Commits {
+		lines = append(lines, commitLine{ID: c.ID, Message: c.Message, URL: c.URL})
+	}
+	return lines
+}
+
+type commitLine struct {
+	ID      string
+	Message string
+	URL     string
+}
+
+// renderCommits formats a push heading followed by a bounded list of commits.
+func renderCommits(heading, compareURL string, commits []commitLine) Message {
+	var text, formatted strings.Builder
+	text.WriteString(heading)
+	if compareURL != "" {
+		formatted.WriteString(fmt.Sprintf(`<a href="%s">%s</a>`, html.EscapeString(compareURL), html.EscapeString(heading)))
+	} else {
+		formatted.WriteString(html.EscapeString(heading))
+	}
+
+	if len(commits) > 0 {
+		formatted.WriteString("<ul>")
+	}
+	for i, c := range commits {
+		if i == maxCommits {
+			more := fmt.Sprintf("… and %d more", len(commits)-maxCommits)
+			text.WriteString("\n- " + more)
+			formatted.WriteString("<li>" + html.EscapeString(more) + "</li>")
+			break
+		}
+		line := shortSHA(c.ID) + " " + firstLine(c.Message)
+		text.WriteString("\n- " + line)
+		if c.URL != "" {
+			formatted.WriteString(fmt.Sprintf(`<li><a href="%s"><code>%s</code></a> %s</li>`, html.EscapeString(c.URL), shortSHA(c.ID), html.EscapeString(firstLine(c.Message))))
+		} else {
+			formatted.WriteString("<li>" + html.EscapeString(line) + "</li>")
+		}
+	}
+	if len(commits) > 0 {
+		formatted.WriteString("</ul>")
+	}
+
+	return Message{Body: text.String(), FormattedBody: formatted.String()}
+}
+
+// renderItem formats a pull request, merge request or issue event.
+func renderItem(heading, title, link string) Message {
+	text := heading + ": " + title
+	formatted := html.EscapeString(heading) + ": "
+	if link != "" {
+		formatted += fmt.Sprintf(`<a href="%s">%s</a>`, html.EscapeString(link), html.EscapeString(title))
+	} else {
+		formatted += html.EscapeString(title)
+	}
+	return Message{Body: text, FormattedBody: formatted}
+}
+
+func shortSHA(id string) string {
+	if len(id) > 7 {
+		return id[:7]
+	}
+	return id
+}
+
+func firstLine(s string) string {
+	if i := strings.IndexByte(s, '\n'); i >= 0 {
+		return s[:i]
+	}
+	return s
+}
+
+func plural(n int, noun string) string {
+	if n == 1 {
+		return "1 " + noun
+	}
+	return fmt.Sprintf("%d %ss", n, noun)
+}
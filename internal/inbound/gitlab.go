@@ -0,0 +1,131 @@
+package inbound
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"net/http"
+	"strings"
+
+	"github.com/yamatt/matrix-as-webhook/internal/config"
+)
+
+// gitlabPayload holds the fields of GitLab webhook events that are rendered.
+type gitlabPayload struct {
+	ObjectKind string `json:"object_kind"`
+	UserName   string `json:"user_name"`
+	Ref        string `json:"ref"`
+	User       struct {
+		Name string `json:"name"`
+	} `json:"user"`
+	Project struct {
+		PathWithNamespace string `json:"path_with_namespace"`
+		WebURL            string `json:"web_url"`
+	} `json:"project"`
+	Commits []struct {
+		ID      string `json:"id"`
+		Message string `json:"message"`
+		URL     string `json:"url"`
+	} `json:"commits"`
+	ObjectAttributes struct {
+		ID     int    `json:"id"`
+		IID    int    `json:"iid"`
+		Title  string `json:"title"`
+		Action string `json:"action"`
+		State  string `json:"state"`
+		Status string `json:"status"`
+		Ref    string `json:"ref"`
+		URL    string `json:"url"`
+	} `json:"object_attributes"`
+}
+
+// gitlabAdapter renders GitLab push, merge request, issue and pipeline
+// events. Merge requests, issues and pipelines are keyed so that closing,
+// merging or finishing them can edit the original message.
+type gitlabAdapter struct{}
+
+func (gitlabAdapter) Verify(r *http.Request, _ []byte, conf config.HookConfig) error {
+	if conf.Token == "" {
+		return nil
+	}
+	return compareToken(r.Header.Get("X-Gitlab-Token"), conf.Token.Value())
+}
+
+func (gitlabAdapter) Render(_ http.Header, body []byte) (Message, error) {
+	var p gitlabPayload
+	if err := json.Unmarshal(body, &p); err != nil {
+		return Message{}, fmt.Errorf("invalid GitLab payload: %w", err)
+	}
+
+	project := p.Project.PathWithNamespace
+	user := p.User.Name
+	if user == "" {
+		user = p.UserName
+	}
+	attrs := p.ObjectAttributes
+
+	switch p.ObjectKind {
+	case "push":
+		branch := strings.TrimPrefix(p.Ref, "refs/heads/")
+		heading := fmt.Sprintf("%s pushed %s to %s of %s", user, plural(len(p.Commits), "commit"), branch, project)
+		commits := make([]commitLine, 0, len(p.Commits))
+		for _, c := range p.Commits {
+			commits = append(commits, commitLine{ID: c.ID, Message: c.Message, URL: c.URL})
+		}
+		return renderCommits(heading, "", commits), nil
+
+	case "merge_request":
+		msg := renderItem(fmt.Sprintf("%s %s merge request !%d in %s", user, pastTense(attrs.Action), attrs.IID, project), attrs.Title, attrs.URL)
+		msg.Key = fmt.Sprintf("%s!%d", project, attrs.IID)
+		msg.Resolved = attrs.State == "merged" || attrs.State == "closed"
+		return msg, nil
+
+	case "issue":
+		msg := renderItem(fmt.Sprintf("%s %s issue #%d in %s", user, pastTense(attrs.Action), attrs.IID, project), attrs.Title, attrs.URL)
+		msg.Key = fmt.Sprintf("%s#%d", project, attrs.IID)
+		msg.Resolved = attrs.State == "closed"
+		return msg, nil
+
+	case "pipeline":
+		heading := fmt.Sprintf("Pipeline #%d for %s on %s: %s", attrs.ID, attrs.Ref, project, attrs.Status)
+		link := fmt.Sprintf("%s/-/pipelines/%d", p.Project.WebURL, attrs.ID)
+		msg := Message{
+			Body:          heading,
+			FormattedBody: fmt.Sprintf(`<a href="%s">%s</a>`, html.EscapeString(link), html.EscapeString(heading)),
+		}
+		msg.Key = fmt.Sprintf("%s/pipelines/%d", project, attrs.ID)
+		switch attrs.Status {
+		case "created", "waiting_for_resource", "preparing", "pending", "running", "scheduled":
+		default:
+			msg.Resolved = true
+		}
+		return msg, nil
+
+	default:
+		text := fmt.Sprintf("%s triggered %s on %s", user, p.ObjectKind, project)
+		return Message{Body: text, FormattedBody: html.EscapeString(text)}, nil
+	}
+}
+
+// pastTense turns GitLab's present-tense actions (open, close, merge) into
+// past tense for display.
+func pastTense(action string) string {
+	switch action {
+	case "open":
+		return "opened"
+	case "close":
+		return "closed"
+	case "reopen":
+		return "reopened"
+	case "update":
+		return "updated"
+	case "merge":
+		return "merged"
+	case "approve":
+		return "approved"
+	case "":
+		return "updated"
+	default:
+		return action
+	}
+}
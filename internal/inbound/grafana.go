@@ -0,0 +1,45 @@
+package inbound
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/yamatt/matrix-as-webhook/internal/config"
+)
+
+// grafanaPayload is the Grafana unified alerting webhook payload, which
+// extends the Alertmanager format with a rendered title.
+type grafanaPayload struct {
+	alertmanagerPayload
+	Title string `json:"title"`
+}
+
+// grafanaAdapter renders Grafana alerting notifications.
+type grafanaAdapter struct{}
+
+func (grafanaAdapter) Verify(r *http.Request, body []byte, conf config.HookConfig) error {
+	if err := verifyToken(r, conf); err != nil {
+		return err
+	}
+	return verifySignature(r, body, conf, "X-Webhook-Signature")
+}
+
+func (grafanaAdapter) Render(_ http.Header, body []byte) (Message, error) {
+	var p grafanaPayload
+	if err := json.Unmarshal(body, &p); err != nil {
+		return Message{}, fmt.Errorf("invalid Grafana payload: %w", err)
+	}
+
+	title := p.GroupLabels["alertname"]
+	if title == "" {
+		title = p.CommonLabels["alertname"]
+	}
+	if title == "" {
+		title = p.Title
+	}
+
+	msg := renderAlerts(p.Status, title, labelSummary(p.GroupLabels, "alertname", "grafana_folder"), p.Alerts)
+	msg.Key = p.GroupKey
+	return msg, nil
+}
@@ -0,0 +1,199 @@
+package inbound
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	htmltemplate "html/template"
+	"net/http"
+	"strings"
+	texttemplate "text/template"
+
+	"github.com/yamatt/matrix-as-webhook/internal/config"
+	"github.com/yamatt/matrix-as-webhook/internal/webhook"
+)
+
+// ErrUnauthorized is returned when a request fails token or signature verification.
+var ErrUnauthorized = errors.New("inbound: unauthorized")
+
+// Hook is a compiled inbound webhook definition.
+type Hook struct {
+	conf    config.HookConfig
+	adapter Adapter
+	text    *texttemplate.Template
+	html    *htmltemplate.Template
+}
+
+// Message is a rendered Matrix message ready to be sent.
+type Message struct {
+	MsgType       string
+	Body          string
+	FormattedBody string
+	// Key correlates messages about the same alert, issue or pull request.
+	// Empty when the payload has no natural identity.
+	Key string
+	// Resolved is true when the payload closes whatever Key refers to.
+	Resolved bool
+}
+
+// Compile compiles the hook definitions, keyed by ID. It returns the hooks
+// that compiled along with an error for each that did not.
+func Compile(hooks []config.HookConfig) (map[string]*Hook, error) {
+	compiled := make(map[string]*Hook, len(hooks))
+	var errs []error
+	for _, conf := range hooks {
+		if _, ok := compiled[conf.ID]; ok {
+			errs = append(errs, fmt.Errorf("hook %s: the ID is used by another hook", conf.ID))
+			continue
+		}
+		hook, err := NewHook(conf)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		compiled[conf.ID] = hook
+	}
+	return compiled, errors.Join(errs...)
+}
+
+// NewHook compiles the templates for a hook definition and selects its
+// adapter. Hooks without a token or shared secret must be marked public.
+// GitLab has no signature scheme, so gitlab hooks need a token.
+func NewHook(conf config.HookConfig) (*Hook, error) {
+	if conf.Token == "" && conf.SharedSecret == "" && !conf.Public {
+		return nil, fmt.Errorf("hook %s: set a token or shared_secret, or public = true to accept unauthenticated requests", conf.ID)
+	}
+	if conf.Format == "gitlab" && conf.Token == "" && !conf.Public {
+		return nil, fmt.Errorf("hook %s: gitlab hooks cannot verify shared_secret; set a token, or public = true to accept unauthenticated requests", conf.ID)
+	}
+	adapter, err := adapterFor(conf.Format)
+	if err != nil {
+		return nil, fmt.Errorf("hook %s: %w", conf.ID, err)
+	}
+	hook := &Hook{conf: conf, adapter: adapter}
+
+	funcs := map[string]interface{}{"json": toJSON}
+	if conf.Template != "" {
+		hook.text, err = texttemplate.New(conf.ID).Funcs(funcs).Parse(conf.Template)
+		if err != nil {
+			return nil, fmt.Errorf("hook %s: template: %w", conf.ID, err)
+		}
+	}
+	if conf.HTMLTemplate != "" {
+		hook.html, err = htmltemplate.New(conf.ID).Funcs(funcs).Parse(conf.HTMLTemplate)
+		if err != nil {
+			return nil, fmt.Errorf("hook %s: html_template: %w", conf.ID, err)
+		}
+	}
+
+	return hook, nil
+}
+
+// Config returns the hook definition.
+func (h *Hook) Config() config.HookConfig {
+	return h.conf
+}
+
+// Verify checks the request's credentials as required by the hook's adapter.
+func (h *Hook) Verify(r *http.Request, body []byte) error {
+	return h.adapter.Verify(r, body, h.conf)
+}
+
+// Render decodes the request JSON and renders it into a Matrix message.
+// The adapter provides the default rendering; configured templates override
+// the body and formatted body.
+func (h *Hook) Render(header http.Header, body []byte) (Message, error) {
+	msg, err := h.adapter.Render(header, body)
+	if err != nil {
+		return Message{}, fmt.Errorf("hook %s: %w", h.conf.ID, err)
+	}
+	msg.MsgType = h.conf.MsgType
+
+	if h.text == nil && h.html == nil {
+		return msg, nil
+	}
+
+	var data interface{}
+	if err := json.Unmarshal(body, &data); err != nil {
+		return Message{}, fmt.Errorf("hook %s: invalid JSON: %w", h.conf.ID, err)
+	}
+
+	if h.text != nil {
+		var text bytes.Buffer
+		if err := h.text.Execute(&text, data); err != nil {
+			return Message{}, fmt.Errorf("hook %s: rendering template: %w", h.conf.ID, err)
+		}
+		msg.Body = text.String()
+		msg.FormattedBody = ""
+	}
+	if h.html != nil {
+		var html bytes.Buffer
+		if err := h.html.Execute(&html, data); err != nil {
+			return Message{}, fmt.Errorf("hook %s: rendering html_template: %w", h.conf.ID, err)
+		}
+		msg.FormattedBody = html.String()
+	}
+	return msg, nil
+}
+
+// Content returns the m.room.message content for the message.
+func (m Message) Content() map[string]interface{} {
+	msgType := m.MsgType
+	if msgType == "" {
+		msgType = "m.notice"
+	}
+	content := map[string]interface{}{
+		"msgtype": msgType,
+		"body":    m.Body,
+	}
+	if m.FormattedBody != "" {
+		content["format"] = "org.matrix.custom.html"
+		content["formatted_body"] = m.FormattedBody
+	}
+	return content
+}
+
+// verifyToken checks the hook token, presented as a Bearer token or ?token= query parameter.
+func verifyToken(r *http.Request, conf config.HookConfig) error {
+	if conf.Token == "" {
+		return nil
+	}
+	token := r.URL.Query().Get("token")
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		token = strings.TrimPrefix(auth, "Bearer ")
+	}
+	return compareToken(token, conf.Token.Value())
+}
+
+// verifySignature checks an HMAC-SHA256 "sha256=" signature in the given header.
+func verifySignature(r *http.Request, body []byte, conf config.HookConfig, header string) error {
+	if conf.SharedSecret == "" {
+		return nil
+	}
+	if !webhook.VerifySignature(body, conf.SharedSecret.Value(), r.Header.Get(header)) {
+		return ErrUnauthorized
+	}
+	return nil
+}
+
+// compareToken compares two tokens in constant time.
+func compareToken(got, want string) error {
+	if subtle.ConstantTimeCompare([]byte(got), []byte(want)) != 1 {
+		return ErrUnauthorized
+	}
+	return nil
+}
+
+// toJSON is a template helper that pretty-prints a value as JSON.
+func toJSON(v interface{}) (string, error) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(buf.String(), "\n"), nil
+}
@@ -0,0 +1,149 @@
+package inbound
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/yamatt/matrix-as-webhook/internal/config"
+)
+
+func TestRender_Templates(t *testing.T) {
+	hook, err := NewHook(config.HookConfig{
+		ID:           "ci",
+		Public:       true,
+		Template:     "{{ .status }}: {{ .message }}",
+		HTMLTemplate: "<b>{{ .status }}</b>: {{ .message }}",
+		MsgType:      "m.text",
+	})
+	if err != nil {
+		t.Fatalf("NewHook failed: %v", err)
+	}
+
+	msg, err := hook.Render(nil, []byte(`{"status":"failed","message":"<script>"}`))
+	if err != nil {
+		t.Fatalf("Render failed: %v", err)
+	}
+
+	if msg.Body != "failed: <script>" {
+		t.Errorf("Unexpected body: %q", msg.Body)
+	}
+	if msg.FormattedBody != "<b>failed</b>: &lt;script&gt;" {
+		t.Errorf("Expected HTML-escaped formatted body, got %q", msg.FormattedBody)
+	}
+
+	content := msg.Content()
+	if content["msgtype"] != "m.text" {
+		t.Errorf("Expected msgtype 'm.text', got '%v'", content["msgtype"])
+	}
+	if content["format"] != "org.matrix.custom.html" {
+		t.Errorf("Expected HTML format, got '%v'", content["format"])
+	}
+}
+
+func TestRender_DefaultTemplate(t *testing.T) {
+	hook, err := NewHook(config.HookConfig{ID: "raw", Public: true})
+	if err != nil {
+		t.Fatalf("NewHook failed: %v", err)
+	}
+
+	msg, err := hook.Render(nil, []byte(`{"a":1}`))
+	if err != nil {
+		t.Fatalf("Render failed: %v", err)
+	}
+
+	if !strings.Contains(msg.Body, `"a": 1`) {
+		t.Errorf("Expected pretty-printed JSON body, got %q", msg.Body)
+	}
+	if !strings.HasPrefix(msg.FormattedBody, "<pre><code>") {
+		t.Errorf("Expected code block formatted body, got %q", msg.FormattedBody)
+	}
+}
+
+func TestRender_InvalidJSON(t *testing.T) {
+	hook, err := NewHook(config.HookConfig{ID: "raw", Public: true})
+	if err != nil {
+		t.Fatalf("NewHook failed: %v", err)
+	}
+	if _, err := hook.Render(nil, []byte("not json")); err == nil {
+		t.Error("Expected error for invalid JSON")
+	}
+}
+
+func TestNewHook_InvalidTemplate(t *testing.T) {
+	if _, err := NewHook(config.HookConfig{ID: "bad", Public: true, Template: "{{ .foo "}); err == nil {
+		t.Error("Expected error for invalid template")
+	}
+}
+
+func TestVerify_Token(t *testing.T) {
+	hook, _ := NewHook(config.HookConfig{ID: "ci", Token: "s3cret"})
+
+	req := httptest.NewRequest("POST", "/hooks/ci", nil)
+	req.Header.Set("Authorization", "Bearer s3cret")
+	if err := hook.Verify(req, nil); err != nil {
+		t.Errorf("Expected bearer token to verify, got %v", err)
+	}
+
+	req = httptest.NewRequest("POST", "/hooks/ci?token=s3cret", nil)
+	if err := hook.Verify(req, nil); err != nil {
+		t.Errorf("Expected query token to verify, got %v", err)
+	}
+
+	req = httptest.NewRequest("POST", "/hooks/ci?token=wrong", nil)
+	if err := hook.Verify(req, nil); !errors.Is(err, ErrUnauthorized) {
+		t.Errorf("Expected ErrUnauthorized, got %v", err)
+	}
+}
+
+func TestVerify_Signature(t *testing.T) {
+	hook, _ := NewHook(config.HookConfig{ID: "ci", SharedSecret: "secret"})
+	body := []byte(`{"a":1}`)
+
+	mac := hmac.New(sha256.New, []byte("secret"))
+	mac.Write(body)
+
+	req := httptest.NewRequest("POST", "/hooks/ci", nil)
+	req.Header.Set("X-Webhook-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	if err := hook.Verify(req, body); err != nil {
+		t.Errorf("Expected signature to verify, got %v", err)
+	}
+
+	if err := hook.Verify(req, []byte(`{"a":2}`)); !errors.Is(err, ErrUnauthorized) {
+		t.Errorf("Expected ErrUnauthorized for tampered body, got %v", err)
+	}
+}
+
+func TestCompile(t *testing.T) {
+	hooks, err := Compile([]config.HookConfig{
+		{ID: "a", Token: "a-token"},
+		{ID: "b", RoomID: "!b:example.org", SharedSecret: "b-secret"},
+		{ID: "open", Public: true},
+	})
+	if err != nil {
+		t.Fatalf("Compile failed: %v", err)
+	}
+	if h, ok := hooks["b"]; !ok || h.Config().RoomID != "!b:example.org" {
+		t.Errorf("Expected to find hook 'b', got %+v", hooks)
+	}
+
+	hooks, err = Compile([]config.HookConfig{
+		{ID: "ok", Token: "t"},
+		{ID: "ok", Token: "t"},
+		{ID: "unauthenticated"},
+		{ID: "gitlab", Format: "gitlab", SharedSecret: "s"},
+		{ID: "template", Token: "t", Template: "{{ .foo "},
+	})
+	for _, want := range []string{"hook ok: the ID is used", "hook unauthenticated: set a token", "hook gitlab: gitlab hooks cannot verify shared_secret", "hook template: template"} {
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("Expected an error containing %q, got %v", want, err)
+		}
+	}
+	if len(hooks) != 1 || hooks["ok"] == nil {
+		t.Errorf("Expected only the valid hook to be compiled, got %v", hooks)
+	}
+}
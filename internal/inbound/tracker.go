@@ -0,0 +1,48 @@
+package inbound
+
+import "sync"
+
+// maxTracked bounds how many open messages are remembered for editing.
+const maxTracked = 10000
+
+// Tracker remembers the Matrix event posted for each open alert, issue or
+// pull request so a later resolution can edit it.
+type Tracker struct {
+	mu     sync.Mutex
+	events map[string]string
+}
+
+// NewTracker creates an empty Tracker.
+func NewTracker() *Tracker {
+	return &Tracker{events: make(map[string]string)}
+}
+
+// Lookup returns the event ID recorded for a hook and message key.
+func (t *Tracker) Lookup(hookID, key string) (string, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	eventID, ok := t.events[hookID+"\x00"+key]
+	return eventID, ok
+}
+
+// Remember records the event ID posted for a hook and message key. When the
+// tracker is full an arbitrary entry is evicted.
+func (t *Tracker) Remember(hookID, key, eventID string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	k := hookID + "\x00" + key
+	if _, ok := t.events[k]; !ok && len(t.events) >= maxTracked {
+		for evict := range t.events {
+			delete(t.events, evict)
+			break
+		}
+	}
+	t.events[k] = eventID
+}
+
+// Forget removes the record for a hook and message key.
+func (t *Tracker) Forget(hookID, key string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.events, hookID+"\x00"+key)
+}
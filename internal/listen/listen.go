@@ -0,0 +1,125 @@
+// Package listen opens the sockets the server listens on: TCP addresses,
+// Unix domain sockets and sockets passed by systemd, optionally with TLS.
+package listen
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/yamatt/matrix-as-webhook/internal/config"
+	"github.com/yamatt/matrix-as-webhook/internal/tlsreload"
+)
+
+// socketMode is the permission of Unix sockets, so that a reverse proxy
+// running as another user in the same group can connect.
+const socketMode = 0o660
+
+// listenFDsStart is the first file descriptor systemd passes.
+var listenFDsStart = 3
+
+// Open opens the listener conf describes. The address is host:port,
+// unix:/path/to.sock, systemd for the first socket passed by systemd, or
+// systemd:name for the socket named name in LISTEN_FDNAMES. With a
+// certificate and key the listener serves TLS.
+func Open(conf config.ListenerConfig) (net.Listener, error) {
+	if (conf.CertFile == "") != (conf.KeyFile == "") {
+		return nil, errors.New("listen: cert_file and key_file must be set together")
+	}
+
+	var l net.Listener
+	var err error
+	switch {
+	case strings.HasPrefix(conf.Listen, "unix:"):
+		l, err = unixListener(strings.TrimPrefix(conf.Listen, "unix:"))
+	case conf.Listen == "systemd" || strings.HasPrefix(conf.Listen, "systemd:"):
+		l, err = systemdListener(strings.TrimPrefix(strings.TrimPrefix(conf.Listen, "systemd"), ":"))
+	default:
+		l, err = net.Listen("tcp", conf.Listen)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if conf.CertFile == "" {
+		return l, nil
+	}
+
+	cert := tlsreload.New(func() (*tls.Certificate, error) {
+		cert, err := tls.LoadX509KeyPair(conf.CertFile, conf.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("listen: certificate: %w", err)
+		}
+		return &cert, nil
+	}, conf.CertFile, conf.KeyFile)
+	if _, _, err := cert.Get(); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return tls.NewListener(l, &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		NextProtos: []string{"h2", "http/1.1"},
+		// The files are checked for changes on every handshake
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			c, _, err := cert.Get()
+			return c, err
+		},
+	}), nil
+}
+
+// unixListener listens on a Unix domain socket, replacing a socket left
+// behind by a previous run.
+func unixListener(path string) (net.Listener, error) {
+	if path == "" {
+		return nil, errors.New("listen: unix: needs a socket path")
+	}
+	if info, err := os.Stat(path); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("listen: %s exists and is not a socket", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, fmt.Errorf("listen: removing stale socket: %w", err)
+		}
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, socketMode); err != nil {
+		l.Close()
+		return nil, fmt.Errorf("listen: %w", err)
+	}
+	return l, nil
+}
+
+// systemdListener returns a socket passed by systemd socket activation: the
+// one named name in LISTEN_FDNAMES, or the first one if name is empty.
+func systemdListener(name string) (net.Listener, error) {
+	if os.Getenv("LISTEN_PID") != strconv.Itoa(os.Getpid()) {
+		return nil, errors.New("listen: no sockets were passed by systemd (LISTEN_PID is not this process)")
+	}
+	count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || count < 1 {
+		return nil, errors.New("listen: no sockets were passed by systemd (LISTEN_FDS)")
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+
+	for i := 0; i < count; i++ {
+		if name != "" && (i >= len(names) || names[i] != name) {
+			continue
+		}
+		f := os.NewFile(uintptr(listenFDsStart+i), "systemd:"+name)
+		// FileListener works on a duplicate, so the passed descriptor is
+		// closed and cannot be taken twice
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("listen: systemd socket %d: %w", i, err)
+		}
+		return l, nil
+	}
+	return nil, fmt.Errorf("listen: systemd passed no socket named %q (LISTEN_FDNAMES=%q)", name, os.Getenv("LISTEN_FDNAMES"))
+}
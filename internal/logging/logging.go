@@ -0,0 +1,73 @@
+// Package logging sets up structured logging with log/slog and carries
+// request fields such as the transaction and event ID in contexts.
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+	"sync/atomic"
+
+	"github.com/yamatt/matrix-as-webhook/internal/config"
+)
+
+// Field names shared by all log records.
+const (
+	KeyTxnID   = "txn_id"
+	KeyEventID = "event_id"
+	KeyRoomID  = "room_id"
+	KeyRoute   = "route"
+	KeyAttempt = "attempt"
+)
+
+// logContent reports whether message bodies are logged unredacted.
+var logContent atomic.Bool
+
+// Setup installs the default logger, which the log package then writes
+// through as well.
+func Setup(w io.Writer, conf config.LoggingConfig) error {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(conf.Level)); err != nil {
+		return fmt.Errorf("logging: invalid level %q", conf.Level)
+	}
+	opts := &slog.HandlerOptions{Level: level}
+
+	var handler slog.Handler
+	switch strings.ToLower(conf.Format) {
+	case "text":
+		handler = slog.NewTextHandler(w, opts)
+	case "json":
+		handler = slog.NewJSONHandler(w, opts)
+	default:
+		return fmt.Errorf("logging: invalid format %q", conf.Format)
+	}
+	slog.SetDefault(slog.New(handler))
+	logContent.Store(conf.LogContent)
+	return nil
+}
+
+// Content returns an attribute for message content, redacted to its length
+// unless content logging is enabled.
+func Content(key, value string) slog.Attr {
+	if logContent.Load() {
+		return slog.String(key, value)
+	}
+	return slog.String(key, fmt.Sprintf("[redacted %d bytes]", len(value)))
+}
+
+type loggerKey struct{}
+
+// With returns a context whose logger adds args to every record.
+func With(ctx context.Context, args ...any) context.Context {
+	return context.WithValue(ctx, loggerKey{}, FromContext(ctx).With(args...))
+}
+
+// FromContext returns the logger of ctx, or the default logger.
+func FromContext(ctx context.Context) *slog.Logger {
+	if logger, ok := ctx.Value(loggerKey{}).(*slog.Logger); ok {
+		return logger
+	}
+	return slog.Default()
+}
@@ -0,0 +1,70 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"strings"
+	"testing"
+
+	"github.com/yamatt/matrix-as-webhook/internal/config"
+)
+
+// capture sets up logging into a buffer, restoring the previous default
+// logger when the test ends.
+func capture(t *testing.T, conf config.LoggingConfig) *bytes.Buffer {
+	t.Helper()
+	prev := slog.Default()
+	t.Cleanup(func() {
+		slog.SetDefault(prev)
+		logContent.Store(false)
+	})
+	var buf bytes.Buffer
+	if err := Setup(&buf, conf); err != nil {
+		t.Fatalf("Setup failed: %v", err)
+	}
+	return &buf
+}
+
+func TestSetupJSON(t *testing.T) {
+	buf := capture(t, config.LoggingConfig{Level: "warn", Format: "json"})
+
+	slog.Info("hidden")
+	ctx := With(context.Background(), KeyTxnID, "txn1")
+	FromContext(With(ctx, KeyEventID, "$ev")).Warn("shown", Content("body", "secret message"))
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("Expected one record above the warn level, got %q", buf.String())
+	}
+	var record map[string]interface{}
+	if err := json.Unmarshal([]byte(lines[0]), &record); err != nil {
+		t.Fatalf("Expected JSON output: %v", err)
+	}
+	if record["msg"] != "shown" || record[KeyTxnID] != "txn1" || record[KeyEventID] != "$ev" {
+		t.Errorf("Unexpected record: %v", record)
+	}
+	if record["body"] != "[redacted 14 bytes]" {
+		t.Errorf("Expected the body to be redacted, got %v", record["body"])
+	}
+}
+
+func TestSetupLogContent(t *testing.T) {
+	buf := capture(t, config.LoggingConfig{Level: "debug", Format: "text", LogContent: true})
+
+	slog.Debug("message", Content("body", "hello"))
+
+	if !strings.Contains(buf.String(), "body=hello") {
+		t.Errorf("Expected the body to be logged, got %q", buf.String())
+	}
+}
+
+func TestSetupInvalid(t *testing.T) {
+	if err := Setup(&bytes.Buffer{}, config.LoggingConfig{Level: "loud", Format: "text"}); err == nil {
+		t.Error("Expected an error for an invalid level")
+	}
+	if err := Setup(&bytes.Buffer{}, config.LoggingConfig{Level: "info", Format: "xml"}); err == nil {
+		t.Error("Expected an error for an invalid format")
+	}
+}
@@ -0,0 +1,427 @@
+package matrix
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Client talks to the homeserver's Client-Server API as the application service.
+type Client struct {
+	homeserverURL string
+	asToken       string
+	deviceID      string
+	httpClient    *http.Client
+}
+
+// NewClient creates a Client authenticating with the given AS token.
+func NewClient(homeserverURL, asToken string, timeout time.Duration) *Client {
+	if timeout == 0 {
+		timeout = 30 * time.Second
+	}
+	return &Client{
+		homeserverURL: strings.TrimRight(homeserverURL, "/"),
+		asToken:       asToken,
+		httpClient:    &http.Client{Timeout: timeout},
+	}
+}
+
+// Error is a standard Matrix error response.
+type Error struct {
+	StatusCode int    `json:"-"`
+	ErrCode    string `json:"errcode"`
+	Message    string `json:"error"`
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("matrix: %d %s: %s", e.StatusCode, e.ErrCode, e.Message)
+}
+
+// UserID builds a fully qualified Matrix user ID from a localpart and server name.
+func UserID(localpart, domain string) string {
+	return "@" + localpart + ":" + domain
+}
+
+// WithDevice returns a copy of the client that also masquerades as deviceID
+// of the masqueraded user (MSC3202), as needed by the E2EE endpoints.
+func (c *Client) WithDevice(deviceID string) *Client {
+	dup := *c
+	dup.deviceID = deviceID
+	return &dup
+}
+
+// SendMessage sends an m.room.message event to roomID, masquerading as userID
+// when it is non-empty. It returns the new event ID.
+func (c *Client) SendMessage(ctx context.Context, roomID, userID string, content map[string]interface{}) (string, error) {
+	return c.SendEvent(ctx, roomID, userID, "m.room.message", content)
+}
+
+// SendEvent sends a room event of any type. It returns the new event ID.
+func (c *Client) SendEvent(ctx context.Context, roomID, userID, eventType string, content map[string]interface{}) (string, error) {
+	txnID, err := newTxnID()
+	if err != nil {
+		return "", err
+	}
+	path := fmt.Sprintf("/_matrix/client/v3/rooms/%s/send/%s/%s", url.PathEscape(roomID), url.PathEscape(eventType), txnID)
+
+	var resp struct {
+		EventID string `json:"event_id"`
+	}
+	if err := c.do(ctx, http.MethodPut, path, userID, content, &resp); err != nil {
+		return "", err
+	}
+	return resp.EventID, nil
+}
+
+// EditMessage replaces the content of a previously sent message (m.replace).
+// It returns the event ID of the edit event.
+func (c *Client) EditMessage(ctx context.Context, roomID, userID, eventID string, content map[string]interface{}) (string, error) {
+	return c.SendMessage(ctx, roomID, userID, EditContent(eventID, content))
+}
+
+// EditContent builds the content of an m.replace edit of eventID, with a
+// "* " prefixed fallback for clients that do not support edits.
+func EditContent(eventID string, content map[string]interface{}) map[string]interface{} {
+	edit := make(map[string]interface{}, len(content)+2)
+	for k, v := range content {
+		edit[k] = v
+	}
+	if body, ok := content["body"].(string); ok {
+		edit["body"] = "* " + body
+	}
+	if formatted, ok := content["formatted_body"].(string); ok {
+		edit["formatted_body"] = "* " + formatted
+	}
+	edit["m.new_content"] = content
+	edit["m.relates_to"] = map[string]interface{}{
+		"rel_type": "m.replace",
+		"event_id": eventID,
+	}
+	return edit
+}
+
+// Register creates a user in the appservice namespace. A user that already
+// exists is not an error.
+func (c *Client) Register(ctx context.Context, localpart string) error {
+	body := map[string]interface{}{
+		"type":          "m.login.application_service",
+		"username":      localpart,
+		"inhibit_login": true,
+	}
+	err := c.do(ctx, http.MethodPost, "/_matrix/client/v3/register", "", body, nil)
+	var mErr *Error
+	if errors.As(err, &mErr) && mErr.ErrCode == "M_USER_IN_USE" {
+		return nil
+	}
+	return err
+}
+
+// SetDisplayName sets the display name of userID.
+func (c *Client) SetDisplayName(ctx context.Context, userID, displayName string) error {
+	path := fmt.Sprintf("/_matrix/client/v3/profile/%s/displayname", url.PathEscape(userID))
+	return c.do(ctx, http.MethodPut, path, userID, map[string]string{"displayname": displayName}, nil)
+}
+
+// SetAvatarURL sets the avatar of userID to an mxc:// URI.
+func (c *Client) SetAvatarURL(ctx context.Context, userID, avatarURL string) error {
+	path := fmt.Sprintf("/_matrix/client/v3/profile/%s/avatar_url", url.PathEscape(userID))
+	return c.do(ctx, http.MethodPut, path, userID, map[string]string{"avatar_url": avatarURL}, nil)
+}
+
+// JoinRoom joins userID (or the bot when empty) to a room ID or alias.
+func (c *Client) JoinRoom(ctx context.Context, roomIDOrAlias, userID string) (string, error) {
+	path := fmt.Sprintf("/_matrix/client/v3/join/%s", url.PathEscape(roomIDOrAlias))
+	var resp struct {
+		RoomID string `json:"room_id"`
+	}
+	if err := c.do(ctx, http.MethodPost, path, userID, map[string]interface{}{}, &resp); err != nil {
+		return "", err
+	}
+	return resp.RoomID, nil
+}
+
+// LeaveRoom makes userID (or the bot when empty) leave a room, or reject an
+// invite to it.
+func (c *Client) LeaveRoom(ctx context.Context, roomID, userID string) error {
+	path := fmt.Sprintf("/_matrix/client/v3/rooms/%s/leave", url.PathEscape(roomID))
+	return c.do(ctx, http.MethodPost, path, userID, map[string]interface{}{}, nil)
+}
+
+// InviteUser invites inviteeID to roomID on behalf of userID (or the bot when empty).
+func (c *Client) InviteUser(ctx context.Context, roomID, userID, inviteeID string) error {
+	path := fmt.Sprintf("/_matrix/client/v3/rooms/%s/invite", url.PathEscape(roomID))
+	return c.do(ctx, http.MethodPost, path, userID, map[string]string{"user_id": inviteeID}, nil)
+}
+
+// GetStateEvent returns the content of a room state event as seen by the bot.
+// A missing state event is returned as an *Error with errcode M_NOT_FOUND.
+func (c *Client) GetStateEvent(ctx context.Context, roomID, eventType, stateKey string) (map[string]interface{}, error) {
+	path := fmt.Sprintf("/_matrix/client/v3/rooms/%s/state/%s/%s", url.PathEscape(roomID), url.PathEscape(eventType), url.PathEscape(stateKey))
+	var content map[string]interface{}
+	if err := c.do(ctx, http.MethodGet, path, "", nil, &content); err != nil {
+		return nil, err
+	}
+	return content, nil
+}
+
+// GetEvent fetches a room event as seen by the bot and decodes it into event.
+func (c *Client) GetEvent(ctx context.Context, roomID, eventID string, event interface{}) error {
+	path := fmt.Sprintf("/_matrix/client/v3/rooms/%s/event/%s", url.PathEscape(roomID), url.PathEscape(eventID))
+	return c.do(ctx, http.MethodGet, path, "", nil, event)
+}
+
+// ErrMediaTooLarge is returned when downloaded media exceeds the size limit.
+var ErrMediaTooLarge = errors.New("matrix: media exceeds size limit")
+
+// Media is downloaded media content.
+type Media struct {
+	Data        []byte
+	ContentType string
+	Filename    string
+}
+
+// DownloadMedia fetches media through the authenticated media endpoint,
+// reading at most maxBytes.
+func (c *Client) DownloadMedia(ctx context.Context, serverName, mediaID string, maxBytes int64) (*Media, error) {
+	if c.homeserverURL == "" {
+		return nil, fmt.Errorf("matrix: homeserver URL not configured")
+	}
+	u := fmt.Sprintf("%s/_matrix/client/v1/media/download/%s/%s", c.homeserverURL, url.PathEscape(serverName), url.PathEscape(mediaID))
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.asToken)
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 400 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+		return nil, parseError(resp.StatusCode, body)
+	}
+	if resp.ContentLength > maxBytes {
+		return nil, ErrMediaTooLarge
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > maxBytes {
+		return nil, ErrMediaTooLarge
+	}
+
+	media := &Media{Data: data, ContentType: resp.Header.Get("Content-Type")}
+	if _, params, err := mime.ParseMediaType(resp.Header.Get("Content-Disposition")); err == nil {
+		media.Filename = params["filename"]
+	}
+	return media, nil
+}
+
+// CreateRoomRequest is the body of a createRoom call.
+type CreateRoomRequest struct {
+	RoomAliasName             string                 `json:"room_alias_name,omitempty"`
+	Name                      string                 `json:"name,omitempty"`
+	Topic                     string                 `json:"topic,omitempty"`
+	Preset                    string                 `json:"preset,omitempty"`
+	Visibility                string                 `json:"visibility,omitempty"`
+	PowerLevelContentOverride map[string]interface{} `json:"power_level_content_override,omitempty"`
+}
+
+// CreateRoom creates a room as userID (or the bot when empty) and returns its ID.
+func (c *Client) CreateRoom(ctx context.Context, userID string, req CreateRoomRequest) (string, error) {
+	var resp struct {
+		RoomID string `json:"room_id"`
+	}
+	if err := c.do(ctx, http.MethodPost, "/_matrix/client/v3/createRoom", userID, req, &resp); err != nil {
+		return "", err
+	}
+	return resp.RoomID, nil
+}
+
+// JoinedMembers returns the user IDs of the members joined to roomID.
+func (c *Client) JoinedMembers(ctx context.Context, roomID string) ([]string, error) {
+	path := fmt.Sprintf("/_matrix/client/v3/rooms/%s/joined_members", url.PathEscape(roomID))
+	var resp struct {
+		Joined map[string]json.RawMessage `json:"joined"`
+	}
+	if err := c.do(ctx, http.MethodGet, path, "", nil, &resp); err != nil {
+		return nil, err
+	}
+	members := make([]string, 0, len(resp.Joined))
+	for userID := range resp.Joined {
+		members = append(members, userID)
+	}
+	return members, nil
+}
+
+// LoginAppService logs in as an appservice user to create (or reuse) a
+// device, returning its device ID. An empty deviceID lets the homeserver
+// pick one.
+func (c *Client) LoginAppService(ctx context.Context, localpart, deviceID, displayName string) (string, error) {
+	body := map[string]interface{}{
+		"type":       "m.login.application_service",
+		"identifier": map[string]string{"type": "m.id.user", "user": localpart},
+	}
+	if deviceID != "" {
+		body["device_id"] = deviceID
+	}
+	if displayName != "" {
+		body["initial_device_display_name"] = displayName
+	}
+	var resp struct {
+		DeviceID string `json:"device_id"`
+	}
+	if err := c.do(ctx, http.MethodPost, "/_matrix/client/v3/login", "", body, &resp); err != nil {
+		return "", err
+	}
+	return resp.DeviceID, nil
+}
+
+// UploadKeys publishes device, one-time and fallback keys for userID and
+// returns the server's one-time key counts.
+func (c *Client) UploadKeys(ctx context.Context, userID string, keys map[string]interface{}) (map[string]int, error) {
+	var resp struct {
+		OneTimeKeyCounts map[string]int `json:"one_time_key_counts"`
+	}
+	if err := c.do(ctx, http.MethodPost, "/_matrix/client/v3/keys/upload", userID, keys, &resp); err != nil {
+		return nil, err
+	}
+	return resp.OneTimeKeyCounts, nil
+}
+
+// QueryKeys returns the signed device keys of users, keyed by user ID then
+// device ID. Keys are left raw so that their signatures can be checked.
+func (c *Client) QueryKeys(ctx context.Context, userID string, users []string) (map[string]map[string]json.RawMessage, error) {
+	query := make(map[string][]string, len(users))
+	for _, u := range users {
+		query[u] = []string{}
+	}
+	var resp struct {
+		DeviceKeys map[string]map[string]json.RawMessage `json:"device_keys"`
+	}
+	if err := c.do(ctx, http.MethodPost, "/_matrix/client/v3/keys/query", userID, map[string]interface{}{"device_keys": query}, &resp); err != nil {
+		return nil, err
+	}
+	return resp.DeviceKeys, nil
+}
+
+// ClaimKeys claims one-time keys for devices, given as user ID to device ID
+// to key algorithm. The result maps user and device IDs to key ID and key.
+func (c *Client) ClaimKeys(ctx context.Context, userID string, devices map[string]map[string]string) (map[string]map[string]map[string]json.RawMessage, error) {
+	var resp struct {
+		OneTimeKeys map[string]map[string]map[string]json.RawMessage `json:"one_time_keys"`
+	}
+	if err := c.do(ctx, http.MethodPost, "/_matrix/client/v3/keys/claim", userID, map[string]interface{}{"one_time_keys": devices}, &resp); err != nil {
+		return nil, err
+	}
+	return resp.OneTimeKeys, nil
+}
+
+// SendToDevice sends to-device events, given as user ID to device ID to content.
+func (c *Client) SendToDevice(ctx context.Context, userID, eventType string, messages map[string]map[string]interface{}) error {
+	txnID, err := newTxnID()
+	if err != nil {
+		return err
+	}
+	path := fmt.Sprintf("/_matrix/client/v3/sendToDevice/%s/%s", url.PathEscape(eventType), txnID)
+	return c.do(ctx, http.MethodPut, path, userID, map[string]interface{}{"messages": messages}, nil)
+}
+
+// Ping checks that the homeserver answers client API requests.
+func (c *Client) Ping(ctx context.Context) error {
+	return c.do(ctx, http.MethodGet, "/_matrix/client/versions", "", nil, nil)
+}
+
+// do performs an authenticated JSON request and decodes the response into out.
+func (c *Client) do(ctx context.Context, method, path, userID string, body, out interface{}) error {
+	if c.homeserverURL == "" {
+		return fmt.Errorf("matrix: homeserver URL not configured")
+	}
+
+	var reqBody io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reqBody = bytes.NewReader(b)
+	}
+
+	u := c.homeserverURL + path
+	if userID != "" {
+		sep := "?"
+		if strings.Contains(u, "?") {
+			sep = "&"
+		}
+		u += sep + "user_id=" + url.QueryEscape(userID)
+		if c.deviceID != "" {
+			u += "&org.matrix.msc3202.device_id=" + url.QueryEscape(c.deviceID)
+		}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, u, reqBody)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.asToken)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(io.LimitReader(resp.Body, 1024*1024))
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode >= 400 {
+		return parseError(resp.StatusCode, respBody)
+	}
+
+	if out != nil && len(respBody) > 0 {
+		if err := json.Unmarshal(respBody, out); err != nil {
+			return fmt.Errorf("matrix: decoding response: %w", err)
+		}
+	}
+	return nil
+}
+
+// parseError converts an error response body into an *Error.
+func parseError(statusCode int, body []byte) *Error {
+	mErr := &Error{StatusCode: statusCode}
+	if err := json.Unmarshal(body, mErr); err != nil || mErr.ErrCode == "" {
+		mErr.ErrCode = "M_UNKNOWN"
+		mErr.Message = string(body)
+	}
+	return mErr
+}
+
+// newTxnID returns a random transaction ID for idempotent sends.
+func newTxnID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,263 @@
+package matrix
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSendMessage(t *testing.T) {
+	var gotPath, gotUser, gotAuth string
+	var gotContent map[string]interface{}
+
+	hs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotPath = r.URL.EscapedPath()
+		gotUser = r.URL.Query().Get("user_id")
+		gotAuth = r.Header.Get("Authorization")
+		if err := json.NewDecoder(r.Body).Decode(&gotContent); err != nil {
+			t.Errorf("Failed to decode body: %v", err)
+		}
+		_ = json.NewEncoder(w).Encode(map[string]string{"event_id": "$sent"})
+	}))
+	defer hs.Close()
+
+	c := NewClient(hs.URL, "as-token", 5*time.Second)
+	eventID, err := c.SendMessage(context.Background(), "!room:example.org", "@webhook_ci:example.org", map[string]interface{}{
+		"msgtype": "m.notice",
+		"body":    "hello",
+	})
+	if err != nil {
+		t.Fatalf("SendMessage failed: %v", err)
+	}
+
+	if eventID != "$sent" {
+		t.Errorf("Expected event ID '$sent', got '%s'", eventID)
+	}
+	if !strings.HasPrefix(gotPath, "/_matrix/client/v3/rooms/%21room:example.org/send/m.room.message/") {
+		t.Errorf("Unexpected path: %s", gotPath)
+	}
+	if gotUser != "@webhook_ci:example.org" {
+		t.Errorf("Expected user_id masquerade, got '%s'", gotUser)
+	}
+	if gotAuth != "Bearer as-token" {
+		t.Errorf("Expected AS token auth, got '%s'", gotAuth)
+	}
+	if gotContent["body"] != "hello" {
+		t.Errorf("Expected body 'hello', got '%v'", gotContent["body"])
+	}
+}
+
+func TestSendMessage_Error(t *testing.T) {
+	hs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+		_ = json.NewEncoder(w).Encode(map[string]string{"errcode": "M_FORBIDDEN", "error": "not in room"})
+	}))
+	defer hs.Close()
+
+	c := NewClient(hs.URL, "as-token", 5*time.Second)
+	_, err := c.SendMessage(context.Background(), "!room:example.org", "", map[string]interface{}{"body": "x"})
+
+	var mErr *Error
+	if !errors.As(err, &mErr) {
+		t.Fatalf("Expected *Error, got %v", err)
+	}
+	if mErr.StatusCode != http.StatusForbidden || mErr.ErrCode != "M_FORBIDDEN" {
+		t.Errorf("Unexpected error: %+v", mErr)
+	}
+}
+
+func TestUserID(t *testing.T) {
+	if got := UserID("webhook", "example.org"); got != "@webhook:example.org" {
+		t.Errorf("Expected '@webhook:example.org', got '%s'", got)
+	}
+}
+
+func TestEditMessage(t *testing.T) {
+	var gotContent map[string]interface{}
+
+	hs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := json.NewDecoder(r.Body).Decode(&gotContent); err != nil {
+			t.Errorf("Failed to decode body: %v", err)
+		}
+		_ = json.NewEncoder(w).Encode(map[string]string{"event_id": "$edit"})
+	}))
+	defer hs.Close()
+
+	c := NewClient(hs.URL, "as-token", 5*time.Second)
+	_, err := c.EditMessage(context.Background(), "!room:example.org", "", "$original", map[string]interface{}{
+		"msgtype": "m.notice",
+		"body":    "resolved",
+	})
+	if err != nil {
+		t.Fatalf("EditMessage failed: %v", err)
+	}
+
+	if gotContent["body"] != "* resolved" {
+		t.Errorf("Expected fallback body '* resolved', got '%v'", gotContent["body"])
+	}
+	newContent, _ := gotContent["m.new_content"].(map[string]interface{})
+	if newContent["body"] != "resolved" {
+		t.Errorf("Expected m.new_content body 'resolved', got '%v'", newContent["body"])
+	}
+	relates, _ := gotContent["m.relates_to"].(map[string]interface{})
+	if relates["rel_type"] != "m.replace" || relates["event_id"] != "$original" {
+		t.Errorf("Unexpected m.relates_to: %v", relates)
+	}
+}
+
+func TestRegister_UserInUse(t *testing.T) {
+	var gotBody map[string]interface{}
+
+	hs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/_matrix/client/v3/register" {
+			t.Errorf("Unexpected path: %s", r.URL.Path)
+		}
+		_ = json.NewDecoder(r.Body).Decode(&gotBody)
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(map[string]string{"errcode": "M_USER_IN_USE", "error": "taken"})
+	}))
+	defer hs.Close()
+
+	c := NewClient(hs.URL, "as-token", 5*time.Second)
+	if err := c.Register(context.Background(), "webhook_ci"); err != nil {
+		t.Fatalf("Expected M_USER_IN_USE to be ignored, got %v", err)
+	}
+
+	if gotBody["type"] != "m.login.application_service" {
+		t.Errorf("Expected appservice login type, got '%v'", gotBody["type"])
+	}
+	if gotBody["username"] != "webhook_ci" {
+		t.Errorf("Expected username 'webhook_ci', got '%v'", gotBody["username"])
+	}
+}
+
+func TestDownloadMedia(t *testing.T) {
+	hs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/_matrix/client/v1/media/download/example.org/abc123" {
+			t.Errorf("Unexpected path: %s", r.URL.Path)
+		}
+		if r.Header.Get("Authorization") != "Bearer as-token" {
+			t.Errorf("Expected AS token auth, got '%s'", r.Header.Get("Authorization"))
+		}
+		w.Header().Set("Content-Type", "image/png")
+		w.Header().Set("Content-Disposition", `inline; filename="cat.png"`)
+		_, _ = w.Write([]byte("png-bytes"))
+	}))
+	defer hs.Close()
+
+	c := NewClient(hs.URL, "as-token", 5*time.Second)
+
+	media, err := c.DownloadMedia(context.Background(), "example.org", "abc123", 1024)
+	if err != nil {
+		t.Fatalf("DownloadMedia failed: %v", err)
+	}
+	if string(media.Data) != "png-bytes" || media.ContentType != "image/png" || media.Filename != "cat.png" {
+		t.Errorf("Unexpected media: %+v", media)
+	}
+
+	if _, err := c.DownloadMedia(context.Background(), "example.org", "abc123", 4); !errors.Is(err, ErrMediaTooLarge) {
+		t.Errorf("Expected ErrMediaTooLarge, got %v", err)
+	}
+}
+
+func TestWithDevice_UploadKeys(t *testing.T) {
+	var gotUser, gotDevice string
+	var gotBody map[string]interface{}
+	hs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/_matrix/client/v3/keys/upload" {
+			t.Errorf("Unexpected path: %s", r.URL.Path)
+		}
+		gotUser = r.URL.Query().Get("user_id")
+		gotDevice = r.URL.Query().Get("org.matrix.msc3202.device_id")
+		_ = json.NewDecoder(r.Body).Decode(&gotBody)
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"one_time_key_counts": map[string]int{"signed_curve25519": 50}})
+	}))
+	defer hs.Close()
+
+	base := NewClient(hs.URL, "as-token", 5*time.Second)
+	c := base.WithDevice("BOTDEVICE")
+	counts, err := c.UploadKeys(context.Background(), "@webhook:example.org", map[string]interface{}{"one_time_keys": map[string]interface{}{}})
+	if err != nil {
+		t.Fatalf("UploadKeys failed: %v", err)
+	}
+	if counts["signed_curve25519"] != 50 {
+		t.Errorf("Expected 50 one-time keys, got %v", counts)
+	}
+	if gotUser != "@webhook:example.org" || gotDevice != "BOTDEVICE" {
+		t.Errorf("Expected user and device masquerade, got '%s' '%s'", gotUser, gotDevice)
+	}
+	if _, ok := gotBody["one_time_keys"]; !ok {
+		t.Errorf("Expected keys in body, got %v", gotBody)
+	}
+
+	// The original client is left without a device.
+	_, _ = base.UploadKeys(context.Background(), "@webhook:example.org", map[string]interface{}{})
+	if gotDevice != "" {
+		t.Errorf("Expected no device masquerade on the base client, got '%s'", gotDevice)
+	}
+}
+
+func TestSendEvent(t *testing.T) {
+	var gotPath string
+	hs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotPath = r.URL.EscapedPath()
+		_ = json.NewEncoder(w).Encode(map[string]string{"event_id": "$enc"})
+	}))
+	defer hs.Close()
+
+	c := NewClient(hs.URL, "as-token", 5*time.Second)
+	if _, err := c.SendEvent(context.Background(), "!room:example.org", "", "m.room.encrypted", map[string]interface{}{}); err != nil {
+		t.Fatalf("SendEvent failed: %v", err)
+	}
+	if !strings.HasPrefix(gotPath, "/_matrix/client/v3/rooms/%21room:example.org/send/m.room.encrypted/") {
+		t.Errorf("Unexpected path: %s", gotPath)
+	}
+}
+
+func TestPing(t *testing.T) {
+	hs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/_matrix/client/versions" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"versions": []string{"v1.11"}})
+	}))
+	c := NewClient(hs.URL, "as-token", 5*time.Second)
+	if err := c.Ping(context.Background()); err != nil {
+		t.Errorf("Expected the ping to succeed, got %v", err)
+	}
+
+	hs.Close()
+	if err := c.Ping(context.Background()); err == nil {
+		t.Error("Expected an error when the homeserver is down")
+	}
+}
+
+func TestGetEvent(t *testing.T) {
+	var gotPath string
+	hs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotPath = r.URL.EscapedPath()
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"event_id": "$ev", "type": "m.room.message"})
+	}))
+	defer hs.Close()
+
+	var event struct {
+		EventID string `json:"event_id"`
+		Type    string `json:"type"`
+	}
+	c := NewClient(hs.URL, "as-token", 5*time.Second)
+	if err := c.GetEvent(context.Background(), "!room:example.org", "$ev", &event); err != nil {
+		t.Fatalf("GetEvent failed: %v", err)
+	}
+	if gotPath != "/_matrix/client/v3/rooms/%21room:example.org/event/$ev" {
+		t.Errorf("Unexpected path: %s", gotPath)
+	}
+	if event.EventID != "$ev" || event.Type != "m.room.message" {
+		t.Errorf("Unexpected event: %+v", event)
+	}
+}
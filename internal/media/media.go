@@ -0,0 +1,306 @@
+package media
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"mime"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/yamatt/matrix-as-webhook/internal/matrix"
+	"github.com/yamatt/matrix-as-webhook/internal/webhook"
+)
+
+// Forwarding modes for RouteConfig.Media.
+const (
+	ModeNone      = "none"
+	ModeBase64    = "base64"
+	ModeMultipart = "multipart"
+	ModeProxy     = "proxy"
+)
+
+// ErrNotAllowed is returned when media's MIME type is not in the allowlist.
+var ErrNotAllowed = errors.New("media: MIME type not allowed")
+
+// ErrEncryptedProxy is returned for attachments of encrypted rooms in proxy
+// mode: the proxy serves files as the homeserver has them, which for these
+// is ciphertext.
+var ErrEncryptedProxy = errors.New("media: encrypted attachments cannot be proxied")
+
+// mediaMsgTypes are the message types that carry an attachment.
+var mediaMsgTypes = map[string]bool{
+	"m.image": true,
+	"m.file":  true,
+	"m.audio": true,
+	"m.video": true,
+}
+
+// Options are the per-route media settings.
+type Options struct {
+	Mode      string
+	MaxBytes  int64
+	MimeTypes []string
+}
+
+// Downloader fetches media; *matrix.Client implements it.
+type Downloader interface {
+	DownloadMedia(ctx context.Context, serverName, mediaID string, maxBytes int64) (*matrix.Media, error)
+}
+
+// Forwarder resolves mxc:// attachments of message events for webhooks.
+type Forwarder struct {
+	downloader Downloader
+	signer     *Signer
+	publicURL  string
+	ttl        time.Duration
+	now        func() time.Time
+}
+
+// NewForwarder creates a Forwarder. publicURL and ttl are used to build
+// signed proxy URLs.
+func NewForwarder(downloader Downloader, signer *Signer, publicURL string, ttl time.Duration) *Forwarder {
+	return &Forwarder{
+		downloader: downloader,
+		signer:     signer,
+		publicURL:  strings.TrimRight(publicURL, "/"),
+		ttl:        ttl,
+		now:        time.Now,
+	}
+}
+
+// Forward returns a description of the event's attachment to add to the
+// payload under "media", plus any files to send as multipart parts. It
+// returns nil for events without an mxc:// attachment or when mode is none.
+// Attachments of encrypted rooms, in content.file instead of content.url,
+// are decrypted after download.
+func (f *Forwarder) Forward(ctx context.Context, content map[string]interface{}, opts Options) (map[string]interface{}, []webhook.Attachment, error) {
+	if opts.Mode == "" || opts.Mode == ModeNone {
+		return nil, nil, nil
+	}
+	msgType, _ := content["msgtype"].(string)
+	if !mediaMsgTypes[msgType] {
+		return nil, nil, nil
+	}
+	mxc, _ := content["url"].(string)
+	var file *encryptedFile
+	if fileContent, ok := content["file"].(map[string]interface{}); ok {
+		var err error
+		if file, err = parseEncryptedFile(fileContent); err != nil {
+			return nil, nil, err
+		}
+		mxc = file.url
+	}
+	serverName, mediaID, err := ParseMXC(mxc)
+	if err != nil {
+		if file != nil {
+			return nil, nil, err
+		}
+		return nil, nil, nil
+	}
+
+	filename, _ := content["filename"].(string)
+	if filename == "" {
+		filename, _ = content["body"].(string)
+	}
+	info, _ := content["info"].(map[string]interface{})
+	declaredType, _ := info["mimetype"].(string)
+	declaredSize, _ := info["size"].(float64)
+
+	if opts.Mode == ModeProxy {
+		if file != nil {
+			return nil, nil, ErrEncryptedProxy
+		}
+		if !MIMEAllowed(declaredType, opts.MimeTypes) {
+			return nil, nil, ErrNotAllowed
+		}
+		if int64(declaredSize) > opts.MaxBytes {
+			return nil, nil, matrix.ErrMediaTooLarge
+		}
+		expires := f.now().Add(f.ttl).Unix()
+		return map[string]interface{}{
+			"url":          f.ProxyURL(serverName, mediaID, expires, opts.MaxBytes, opts.MimeTypes),
+			"expires":      expires,
+			"content_type": declaredType,
+			"filename":     filename,
+			"size":         int64(declaredSize),
+		}, nil, nil
+	}
+
+	m, err := f.downloader.DownloadMedia(ctx, serverName, mediaID, opts.MaxBytes)
+	if err != nil {
+		return nil, nil, err
+	}
+	contentType := m.ContentType
+	if file != nil {
+		if m.Data, err = file.decrypt(m.Data); err != nil {
+			return nil, nil, err
+		}
+		// The homeserver only has the ciphertext, so it cannot know the type
+		contentType = declaredType
+	}
+	if contentType == "" {
+		contentType = declaredType
+	}
+	if !MIMEAllowed(contentType, opts.MimeTypes) {
+		return nil, nil, ErrNotAllowed
+	}
+	if m.Filename != "" {
+		filename = m.Filename
+	}
+
+	desc := map[string]interface{}{
+		"content_type": contentType,
+		"filename":     filename,
+		"size":         len(m.Data),
+	}
+	switch opts.Mode {
+	case ModeBase64:
+		desc["data"] = base64.StdEncoding.EncodeToString(m.Data)
+		return desc, nil, nil
+	case ModeMultipart:
+		desc["field"] = "file"
+		return desc, []webhook.Attachment{{FieldName: "file", Filename: filename, ContentType: contentType, Data: m.Data}}, nil
+	default:
+		return nil, nil, fmt.Errorf("media: unknown mode %q", opts.Mode)
+	}
+}
+
+// encryptedFile is an EncryptedFile object: an attachment encrypted with
+// AES-256-CTR, with the SHA-256 hash of the ciphertext.
+type encryptedFile struct {
+	url    string
+	key    []byte
+	iv     []byte
+	sha256 []byte
+}
+
+// parseEncryptedFile reads the content.file object of an encrypted
+// attachment.
+func parseEncryptedFile(file map[string]interface{}) (*encryptedFile, error) {
+	mxc, _ := file["url"].(string)
+	jwk, _ := file["key"].(map[string]interface{})
+	alg, _ := jwk["alg"].(string)
+	k, _ := jwk["k"].(string)
+	iv, _ := file["iv"].(string)
+	hashes, _ := file["hashes"].(map[string]interface{})
+	hash, _ := hashes["sha256"].(string)
+	if alg != "A256CTR" {
+		return nil, fmt.Errorf("media: unsupported attachment encryption %q", alg)
+	}
+
+	f := &encryptedFile{url: mxc}
+	var err error
+	// The spec uses unpadded base64, but some clients pad it
+	if f.key, err = base64.RawURLEncoding.DecodeString(strings.TrimRight(k, "=")); err != nil || len(f.key) != 32 {
+		return nil, errors.New("media: invalid attachment key")
+	}
+	if f.iv, err = base64.RawStdEncoding.DecodeString(strings.TrimRight(iv, "=")); err != nil || len(f.iv) != aes.BlockSize {
+		return nil, errors.New("media: invalid attachment IV")
+	}
+	if f.sha256, err = base64.RawStdEncoding.DecodeString(strings.TrimRight(hash, "=")); err != nil || len(f.sha256) != sha256.Size {
+		return nil, errors.New("media: attachment has no SHA-256 hash")
+	}
+	return f, nil
+}
+
+// decrypt checks the ciphertext's hash and decrypts it.
+func (f *encryptedFile) decrypt(data []byte) ([]byte, error) {
+	sum := sha256.Sum256(data)
+	if subtle.ConstantTimeCompare(sum[:], f.sha256) != 1 {
+		return nil, errors.New("media: attachment does not match its SHA-256 hash")
+	}
+	block, err := aes.NewCipher(f.key)
+	if err != nil {
+		return nil, fmt.Errorf("media: %w", err)
+	}
+	plain := make([]byte, len(data))
+	cipher.NewCTR(block, f.iv).XORKeyStream(plain, data)
+	return plain, nil
+}
+
+// ProxyURL builds a signed URL at which this server serves the media. The
+// route's MIME allowlist is carried in the URL, since the type declared in
+// the event is not what the homeserver necessarily returns.
+func (f *Forwarder) ProxyURL(serverName, mediaID string, expires, maxBytes int64, mimeTypes []string) string {
+	types := strings.Join(mimeTypes, ",")
+	q := url.Values{}
+	q.Set("expires", strconv.FormatInt(expires, 10))
+	q.Set("max", strconv.FormatInt(maxBytes, 10))
+	if types != "" {
+		q.Set("types", types)
+	}
+	q.Set("sig", f.signer.Sign(serverName, mediaID, expires, maxBytes, types))
+	return fmt.Sprintf("%s/media/%s/%s?%s", f.publicURL, url.PathEscape(serverName), url.PathEscape(mediaID), q.Encode())
+}
+
+// ParseMXC splits an mxc://server/media-id URI.
+func ParseMXC(uri string) (string, string, error) {
+	rest, ok := strings.CutPrefix(uri, "mxc://")
+	if !ok {
+		return "", "", fmt.Errorf("media: not an mxc URI: %q", uri)
+	}
+	serverName, mediaID, ok := strings.Cut(rest, "/")
+	if !ok || serverName == "" || mediaID == "" || strings.Contains(mediaID, "/") {
+		return "", "", fmt.Errorf("media: malformed mxc URI: %q", uri)
+	}
+	return serverName, mediaID, nil
+}
+
+// MIMEAllowed reports whether contentType matches the allowlist. An empty
+// allowlist allows everything; "type/*" entries match a whole family.
+func MIMEAllowed(contentType string, allowlist []string) bool {
+	if len(allowlist) == 0 {
+		return true
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	for _, allowed := range allowlist {
+		if family, ok := strings.CutSuffix(allowed, "/*"); ok {
+			if strings.HasPrefix(mediaType, family+"/") {
+				return true
+			}
+		} else if strings.EqualFold(mediaType, allowed) {
+			return true
+		}
+	}
+	return false
+}
+
+// Signer signs and verifies media proxy URLs.
+type Signer struct {
+	key []byte
+}
+
+// NewSigner creates a Signer with the given HMAC key.
+func NewSigner(key []byte) *Signer {
+	return &Signer{key: key}
+}
+
+// Sign returns the hex HMAC-SHA256 signature of a proxy URL's parameters.
+// types is the comma-separated MIME allowlist, empty for all types.
+func (s *Signer) Sign(serverName, mediaID string, expires, maxBytes int64, types string) string {
+	h := hmac.New(sha256.New, s.key)
+	fmt.Fprintf(h, "%s/%s/%d/%d/%s", serverName, mediaID, expires, maxBytes, types)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Verify checks a proxy URL's signature and expiry.
+func (s *Signer) Verify(serverName, mediaID string, expires, maxBytes int64, types, sig string, now time.Time) bool {
+	if now.Unix() > expires {
+		return false
+	}
+	expected := s.Sign(serverName, mediaID, expires, maxBytes, types)
+	return hmac.Equal([]byte(sig), []byte(expected))
+}
@@ -0,0 +1,220 @@
+package media
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/yamatt/matrix-as-webhook/internal/matrix"
+)
+
+type fakeDownloader struct {
+	media *matrix.Media
+	calls int
+}
+
+func (f *fakeDownloader) DownloadMedia(_ context.Context, serverName, mediaID string, maxBytes int64) (*matrix.Media, error) {
+	f.calls++
+	if int64(len(f.media.Data)) > maxBytes {
+		return nil, matrix.ErrMediaTooLarge
+	}
+	return f.media, nil
+}
+
+func imageContent() map[string]interface{} {
+	return map[string]interface{}{
+		"msgtype": "m.image",
+		"body":    "cat.png",
+		"url":     "mxc://example.org/abc123",
+		"info":    map[string]interface{}{"mimetype": "image/png", "size": float64(9)},
+	}
+}
+
+func TestForward_Base64(t *testing.T) {
+	d := &fakeDownloader{media: &matrix.Media{Data: []byte("png-bytes"), ContentType: "image/png"}}
+	f := NewForwarder(d, NewSigner([]byte("key")), "https://as.example.org", time.Minute)
+
+	desc, files, err := f.Forward(context.Background(), imageContent(), Options{Mode: ModeBase64, MaxBytes: 1024})
+	if err != nil {
+		t.Fatalf("Forward failed: %v", err)
+	}
+	if len(files) != 0 {
+		t.Errorf("Expected no multipart files, got %d", len(files))
+	}
+	if desc["data"] != base64.StdEncoding.EncodeToString([]byte("png-bytes")) {
+		t.Errorf("Unexpected base64 data: %v", desc["data"])
+	}
+	if desc["filename"] != "cat.png" || desc["content_type"] != "image/png" {
+		t.Errorf("Unexpected media description: %v", desc)
+	}
+}
+
+func TestForward_Multipart(t *testing.T) {
+	d := &fakeDownloader{media: &matrix.Media{Data: []byte("png-bytes"), ContentType: "image/png"}}
+	f := NewForwarder(d, NewSigner([]byte("key")), "", time.Minute)
+
+	desc, files, err := f.Forward(context.Background(), imageContent(), Options{Mode: ModeMultipart, MaxBytes: 1024})
+	if err != nil {
+		t.Fatalf("Forward failed: %v", err)
+	}
+	if len(files) != 1 || string(files[0].Data) != "png-bytes" || files[0].Filename != "cat.png" {
+		t.Errorf("Unexpected attachments: %+v", files)
+	}
+	if desc["field"] != "file" {
+		t.Errorf("Expected payload to name the file field, got %v", desc)
+	}
+}
+
+func TestForward_Limits(t *testing.T) {
+	d := &fakeDownloader{media: &matrix.Media{Data: []byte("png-bytes"), ContentType: "image/png"}}
+	f := NewForwarder(d, NewSigner([]byte("key")), "", time.Minute)
+
+	if _, _, err := f.Forward(context.Background(), imageContent(), Options{Mode: ModeBase64, MaxBytes: 4}); !errors.Is(err, matrix.ErrMediaTooLarge) {
+		t.Errorf("Expected ErrMediaTooLarge, got %v", err)
+	}
+	if _, _, err := f.Forward(context.Background(), imageContent(), Options{Mode: ModeBase64, MaxBytes: 1024, MimeTypes: []string{"application/pdf"}}); !errors.Is(err, ErrNotAllowed) {
+		t.Errorf("Expected ErrNotAllowed, got %v", err)
+	}
+	if _, _, err := f.Forward(context.Background(), imageContent(), Options{Mode: ModeProxy, MaxBytes: 4}); !errors.Is(err, matrix.ErrMediaTooLarge) {
+		t.Errorf("Expected ErrMediaTooLarge for proxy mode, got %v", err)
+	}
+}
+
+func TestForward_SkipsNonMedia(t *testing.T) {
+	d := &fakeDownloader{media: &matrix.Media{}}
+	f := NewForwarder(d, NewSigner([]byte("key")), "", time.Minute)
+
+	text := map[string]interface{}{"msgtype": "m.text", "body": "hi"}
+	desc, _, err := f.Forward(context.Background(), text, Options{Mode: ModeBase64, MaxBytes: 1024})
+	if err != nil || desc != nil {
+		t.Errorf("Expected text message to be skipped, got %v, %v", desc, err)
+	}
+
+	desc, _, err = f.Forward(context.Background(), imageContent(), Options{Mode: ModeNone})
+	if err != nil || desc != nil || d.calls != 0 {
+		t.Errorf("Expected mode none to skip media, got %v, %v", desc, err)
+	}
+}
+
+// encryptedImageContent returns an attachment encrypted with the AES-256-CTR
+// vector of NIST SP 800-38A, F.5.5, and the downloaded ciphertext.
+func encryptedImageContent() (map[string]interface{}, []byte) {
+	key, _ := hex.DecodeString("603deb1015ca71be2b73aef0857d77811f352c073b6108d72d9810a30914dff4")
+	iv, _ := hex.DecodeString("f0f1f2f3f4f5f6f7f8f9fafbfcfdfeff")
+	ciphertext, _ := hex.DecodeString("601ec313775789a5b7a7f504bbf3d228")
+	hash := sha256.Sum256(ciphertext)
+	return map[string]interface{}{
+		"msgtype": "m.image",
+		"body":    "cat.png",
+		"info":    map[string]interface{}{"mimetype": "image/png", "size": float64(16)},
+		"file": map[string]interface{}{
+			"v":      "v2",
+			"url":    "mxc://example.org/enc123",
+			"key":    map[string]interface{}{"kty": "oct", "alg": "A256CTR", "ext": true, "k": base64.RawURLEncoding.EncodeToString(key)},
+			"iv":     base64.RawStdEncoding.EncodeToString(iv),
+			"hashes": map[string]interface{}{"sha256": base64.RawStdEncoding.EncodeToString(hash[:])},
+		},
+	}, ciphertext
+}
+
+func TestForward_Encrypted(t *testing.T) {
+	content, ciphertext := encryptedImageContent()
+	d := &fakeDownloader{media: &matrix.Media{Data: ciphertext, ContentType: "application/octet-stream"}}
+	f := NewForwarder(d, NewSigner([]byte("key")), "https://as.example.org", time.Minute)
+
+	desc, _, err := f.Forward(context.Background(), content, Options{Mode: ModeBase64, MaxBytes: 1024, MimeTypes: []string{"image/*"}})
+	if err != nil {
+		t.Fatalf("Forward failed: %v", err)
+	}
+	want := "6bc1bee22e409f96e93d7e117393172a"
+	if data, _ := base64.StdEncoding.DecodeString(desc["data"].(string)); hex.EncodeToString(data) != want {
+		t.Errorf("Expected the decrypted attachment %s, got %x", want, data)
+	}
+	if desc["content_type"] != "image/png" {
+		t.Errorf("Expected the declared type, got %v", desc["content_type"])
+	}
+
+	d.media = &matrix.Media{Data: append([]byte{0}, ciphertext[1:]...)}
+	if _, _, err := f.Forward(context.Background(), content, Options{Mode: ModeBase64, MaxBytes: 1024}); err == nil || !strings.Contains(err.Error(), "SHA-256") {
+		t.Errorf("Expected a tampered attachment to be refused, got %v", err)
+	}
+	if _, _, err := f.Forward(context.Background(), content, Options{Mode: ModeProxy, MaxBytes: 1024}); !errors.Is(err, ErrEncryptedProxy) {
+		t.Errorf("Expected ErrEncryptedProxy, got %v", err)
+	}
+}
+
+func TestForward_ProxyURL(t *testing.T) {
+	signer := NewSigner([]byte("key"))
+	f := NewForwarder(&fakeDownloader{}, signer, "https://as.example.org/", time.Minute)
+	now := time.Unix(1700000000, 0)
+	f.now = func() time.Time { return now }
+
+	desc, _, err := f.Forward(context.Background(), imageContent(), Options{Mode: ModeProxy, MaxBytes: 1024, MimeTypes: []string{"image/*"}})
+	if err != nil {
+		t.Fatalf("Forward failed: %v", err)
+	}
+
+	raw, _ := desc["url"].(string)
+	if !strings.HasPrefix(raw, "https://as.example.org/media/example.org/abc123?") {
+		t.Fatalf("Unexpected proxy URL: %s", raw)
+	}
+	u, _ := url.Parse(raw)
+	q := u.Query()
+	expires, _ := strconv.ParseInt(q.Get("expires"), 10, 64)
+	if expires != now.Add(time.Minute).Unix() {
+		t.Errorf("Unexpected expiry: %d", expires)
+	}
+	if q.Get("types") != "image/*" {
+		t.Errorf("Expected the MIME allowlist in the URL, got %q", q.Get("types"))
+	}
+	if !signer.Verify("example.org", "abc123", expires, 1024, "image/*", q.Get("sig"), now) {
+		t.Error("Expected proxy URL signature to verify")
+	}
+	if signer.Verify("example.org", "abc123", expires, 1024, "image/*", q.Get("sig"), now.Add(2*time.Minute)) {
+		t.Error("Expected expired proxy URL to be rejected")
+	}
+	if signer.Verify("example.org", "other", expires, 1024, "image/*", q.Get("sig"), now) {
+		t.Error("Expected signature for another media ID to be rejected")
+	}
+	if signer.Verify("example.org", "abc123", expires, 1024, "", q.Get("sig"), now) {
+		t.Error("Expected signature without the MIME allowlist to be rejected")
+	}
+}
+
+func TestMIMEAllowed(t *testing.T) {
+	cases := []struct {
+		contentType string
+		allowlist   []string
+		want        bool
+	}{
+		{"image/png", nil, true},
+		{"image/png", []string{"image/*"}, true},
+		{"image/png; charset=binary", []string{"image/png"}, true},
+		{"application/pdf", []string{"image/*"}, false},
+		{"", []string{"image/*"}, false},
+	}
+	for _, tc := range cases {
+		if got := MIMEAllowed(tc.contentType, tc.allowlist); got != tc.want {
+			t.Errorf("MIMEAllowed(%q, %v) = %v, want %v", tc.contentType, tc.allowlist, got, tc.want)
+		}
+	}
+}
+
+func TestParseMXC(t *testing.T) {
+	server, id, err := ParseMXC("mxc://example.org/abc123")
+	if err != nil || server != "example.org" || id != "abc123" {
+		t.Errorf("Unexpected result: %s, %s, %v", server, id, err)
+	}
+	for _, bad := range []string{"https://example.org/abc", "mxc://example.org", "mxc:///abc", "mxc://example.org/a/b"} {
+		if _, _, err := ParseMXC(bad); err == nil {
+			t.Errorf("Expected error for %q", bad)
+		}
+	}
+}
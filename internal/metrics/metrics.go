@@ -0,0 +1,167 @@
+// Package metrics defines the Prometheus metrics served on /metrics.
+//
+// Labels only carry values from a bounded set: route names from the
+// configuration, a fixed list of event types and HTTP status classes. Room
+// IDs, senders and URLs are never used as labels.
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "as_webhook"
+
+// Registry holds every metric of the process.
+var Registry = prometheus.NewRegistry()
+
+var (
+	// Transactions counts transactions received from the homeserver.
+	Transactions = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "transactions_total",
+		Help:      "Transactions received from the homeserver.",
+	})
+	// Events counts events received in transactions, by event type.
+	Events = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "events_total",
+		Help:      "Events received in transactions, by type.",
+	}, []string{"type"})
+
+	// SelectorMatches counts events a route's selector matched.
+	SelectorMatches = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "selector_matches_total",
+		Help:      "Events matched by a route's selector.",
+	}, []string{"route"})
+	// SelectorErrors counts selector evaluations that failed.
+	SelectorErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "selector_errors_total",
+		Help:      "Selector evaluations that returned an error.",
+	}, []string{"route"})
+
+	// DeliveryAttempts counts webhook requests, by route and status class.
+	DeliveryAttempts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "delivery_attempts_total",
+		Help:      "Webhook requests attempted, by route and status class.",
+	}, []string{"route", "status_class"})
+	// DeliverySuccesses counts webhook requests answered with a 2xx status.
+	DeliverySuccesses = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "delivery_successes_total",
+		Help:      "Webhook requests answered with a 2xx status.",
+	}, []string{"route"})
+	// DeliveryFailures counts webhook requests that failed or were answered
+	// with a non-2xx status.
+	DeliveryFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "delivery_failures_total",
+		Help:      "Webhook requests that failed or got a non-2xx status, by route and status class.",
+	}, []string{"route", "status_class"})
+	// DeliveryDuration observes how long webhook requests took.
+	DeliveryDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "delivery_duration_seconds",
+		Help:      "Time taken by webhook requests, by route and status class.",
+		Buckets:   []float64{0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30},
+	}, []string{"route", "status_class"})
+	// DeliveryRetries counts webhook requests that were not the first
+	// attempt at their event.
+	DeliveryRetries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "delivery_retries_total",
+		Help:      "Webhook requests that were not the first attempt at their event, by route.",
+	}, []string{"route"})
+	// DeliveriesInFlight is the number of webhook requests waiting for a
+	// response.
+	DeliveriesInFlight = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "deliveries_in_flight",
+		Help:      "Webhook requests waiting for a response, by route.",
+	}, []string{"route"})
+
+	// UndecryptedEvents is the number of encrypted events waiting for their
+	// room keys.
+	UndecryptedEvents = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "undecrypted_events",
+		Help:      "Encrypted events waiting for their room keys.",
+	})
+	// AccessDenied counts events and invites the access policy denied.
+	AccessDenied = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "access_denied_total",
+		Help:      "Events and invites denied by the access policy, by reason.",
+	}, []string{"reason"})
+)
+
+func init() {
+	Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		Transactions,
+		Events,
+		SelectorMatches,
+		SelectorErrors,
+		DeliveryAttempts,
+		DeliverySuccesses,
+		DeliveryFailures,
+		DeliveryDuration,
+		DeliveryRetries,
+		DeliveriesInFlight,
+		UndecryptedEvents,
+		AccessDenied,
+	)
+}
+
+// Handler serves the metrics in the Prometheus exposition format.
+func Handler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{})
+}
+
+// eventTypes are the event types counted under their own label value.
+var eventTypes = map[string]bool{
+	"m.room.message":            true,
+	"m.room.encrypted":          true,
+	"m.room.member":             true,
+	"m.room.redaction":          true,
+	"m.reaction":                true,
+	"m.sticker":                 true,
+	"m.room.create":             true,
+	"m.room.name":               true,
+	"m.room.topic":              true,
+	"m.room.avatar":             true,
+	"m.room.canonical_alias":    true,
+	"m.room.power_levels":       true,
+	"m.room.join_rules":         true,
+	"m.room.history_visibility": true,
+	"m.room.encryption":         true,
+	"m.receipt":                 true,
+	"m.typing":                  true,
+	"m.presence":                true,
+}
+
+// EventType returns the label value for an event type. Custom types are
+// counted as "other", since anyone in a room can invent new ones.
+func EventType(eventType string) string {
+	if eventTypes[eventType] {
+		return eventType
+	}
+	return "other"
+}
+
+// StatusClass returns the label value for a response status, e.g. "2xx",
+// or "error" when no response was received.
+func StatusClass(statusCode int) string {
+	if statusCode < 100 || statusCode > 599 {
+		return "error"
+	}
+	return strconv.Itoa(statusCode/100) + "xx"
+}
@@ -0,0 +1,21 @@
+package metrics
+
+import "testing"
+
+func TestEventType(t *testing.T) {
+	if got := EventType("m.room.message"); got != "m.room.message" {
+		t.Errorf("Expected 'm.room.message', got '%s'", got)
+	}
+	if got := EventType("com.example.custom"); got != "other" {
+		t.Errorf("Expected custom type to be 'other', got '%s'", got)
+	}
+}
+
+func TestStatusClass(t *testing.T) {
+	tests := map[int]string{200: "2xx", 204: "2xx", 301: "3xx", 404: "4xx", 503: "5xx", 0: "error"}
+	for code, want := range tests {
+		if got := StatusClass(code); got != want {
+			t.Errorf("StatusClass(%d): expected '%s', got '%s'", code, want, got)
+		}
+	}
+}
@@ -2,25 +2,38 @@ package registration
 
 import (
 	"crypto/rand"
+	"crypto/subtle"
 	"encoding/hex"
 	"fmt"
 	"os"
 	"path/filepath"
+	"slices"
 
+	"github.com/yamatt/matrix-as-webhook/internal/config"
 	"gopkg.in/yaml.v3"
 )
 
+// defaultSenderLocalpart is the bot user's localpart when none is configured.
+const defaultSenderLocalpart = "webhook"
+
 // RegistrationFile represents the Matrix Application Service registration file.
 type RegistrationFile struct {
-	ID          string                 `yaml:"id"`
-	Url         string                 `yaml:"url"`
-	AsToken     string                 `yaml:"as_token"`
-	HsToken     string                 `yaml:"hs_token"`
-	RateLimited bool                   `yaml:"rate_limited"`
-	Namespaces  Namespaces             `yaml:"namespaces"`
-	SoloUnit    bool                   `yaml:"solo_unit,omitempty"`
-	Protocols   []string               `yaml:"protocols,omitempty"`
-	Limits      map[string]interface{} `yaml:"limits,omitempty"`
+	ID              string                 `yaml:"id"`
+	Url             string                 `yaml:"url"`
+	AsToken         string                 `yaml:"as_token"`
+	HsToken         string                 `yaml:"hs_token"`
+	SenderLocalpart string                 `yaml:"sender_localpart"`
+	RateLimited     bool                   `yaml:"rate_limited"`
+	Namespaces      Namespaces             `yaml:"namespaces"`
+	SoloUnit        bool                   `yaml:"solo_unit,omitempty"`
+	Protocols       []string               `yaml:"protocols,omitempty"`
+	Limits          map[string]interface{} `yaml:"limits,omitempty"`
+	// ReceiveEphemeral makes the homeserver push receipts, typing and presence
+	ReceiveEphemeral bool `yaml:"receive_ephemeral,omitempty"`
+	// PushEphemeral (MSC2409) and MSC3202 make the homeserver push to-device
+	// events, device list changes and key counts; encryption needs both.
+	PushEphemeral bool `yaml:"de.sorunome.msc2409.push_ephemeral,omitempty"`
+	MSC3202       bool `yaml:"org.matrix.msc3202,omitempty"`
 }
 
 // Namespaces defines the namespace configuration
@@ -37,7 +50,7 @@ type Namespace struct {
 }
 
 // Generate creates a new registration file with the given configuration
-func Generate(serverURL string, asToken string) (*RegistrationFile, error) {
+func Generate(serverURL, asToken, hsToken string) (*RegistrationFile, error) {
 	// Generate tokens if not provided
 	if asToken == "" {
 		token, err := generateToken()
@@ -46,18 +59,21 @@ func Generate(serverURL string, asToken string) (*RegistrationFile, error) {
 		}
 		asToken = token
 	}
-
-	hsToken, err := generateToken()
-	if err != nil {
-		return nil, fmt.Errorf("failed to generate HS token: %w", err)
+	if hsToken == "" {
+		token, err := generateToken()
+		if err != nil {
+			return nil, fmt.Errorf("failed to generate HS token: %w", err)
+		}
+		hsToken = token
 	}
 
 	reg := &RegistrationFile{
-		ID:          "matrix-as-webhook",
-		Url:         serverURL,
-		AsToken:     asToken,
-		HsToken:     hsToken,
-		RateLimited: false,
+		ID:              "matrix-as-webhook",
+		Url:             serverURL,
+		AsToken:         asToken,
+		HsToken:         hsToken,
+		SenderLocalpart: defaultSenderLocalpart,
+		RateLimited:     false,
 		Namespaces: Namespaces{
 			Users:   []Namespace{},
 			Aliases: []Namespace{},
@@ -68,6 +84,36 @@ func Generate(serverURL string, asToken string) (*RegistrationFile, error) {
 	return reg, nil
 }
 
+// ApplyConfig copies the bot localpart and namespaces from the configuration,
+// and opts in to ephemeral events and the encryption extensions when routes
+// or encryption need them.
+func (r *RegistrationFile) ApplyConfig(cfg *config.Config) {
+	if cfg.Homeserver.SenderLocalpart != "" {
+		r.SenderLocalpart = cfg.Homeserver.SenderLocalpart
+	}
+	r.Namespaces = NamespacesFromConfig(cfg.Namespaces)
+	r.ReceiveEphemeral = cfg.ReceivesEphemeral()
+	r.PushEphemeral = cfg.Encryption.Enabled || r.ReceiveEphemeral
+	r.MSC3202 = cfg.Encryption.Enabled
+}
+
+// NamespacesFromConfig converts configured namespaces to registration namespaces.
+func NamespacesFromConfig(ns config.NamespacesConfig) Namespaces {
+	return Namespaces{
+		Users:   convertNamespaces(ns.Users),
+		Aliases: convertNamespaces(ns.Aliases),
+		Rooms:   convertNamespaces(ns.Rooms),
+	}
+}
+
+func convertNamespaces(in []config.NamespaceConfig) []Namespace {
+	out := make([]Namespace, 0, len(in))
+	for _, n := range in {
+		out = append(out, Namespace{Exclusive: n.Exclusive, Regex: n.Regex})
+	}
+	return out
+}
+
 // WriteToFile saves the registration to a YAML file
 func (r *RegistrationFile) WriteToFile(path string) error {
 	data, err := yaml.Marshal(r)
@@ -90,6 +136,68 @@ func (r *RegistrationFile) WriteToFile(path string) error {
 	return nil
 }
 
+// Load reads a registration file.
+func Load(path string) (*RegistrationFile, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read registration file: %w", err)
+	}
+	var reg RegistrationFile
+	if err := yaml.Unmarshal(data, &reg); err != nil {
+		return nil, fmt.Errorf("failed to parse registration file: %w", err)
+	}
+	return &reg, nil
+}
+
+// Check compares the registration with the configuration and returns the
+// differences that would stop the server from working as configured.
+func (r *RegistrationFile) Check(cfg *config.Config) []string {
+	var problems []string
+	if r.Url == "" {
+		problems = append(problems, "url is empty, so the homeserver cannot reach the server")
+	}
+	switch {
+	case cfg.ASToken == "":
+		problems = append(problems, "no AS token is configured to compare as_token with")
+	case subtle.ConstantTimeCompare([]byte(r.AsToken), []byte(cfg.ASToken.Value())) != 1:
+		problems = append(problems, "as_token does not match the configured AS token")
+	}
+	switch {
+	case cfg.HSToken == "":
+		problems = append(problems, "no HS token is configured to compare hs_token with")
+	case subtle.ConstantTimeCompare([]byte(r.HsToken), []byte(cfg.HSToken.Value())) != 1:
+		problems = append(problems, "hs_token does not match the configured HS token")
+	}
+
+	want := *r
+	want.ApplyConfig(cfg)
+	if r.SenderLocalpart != want.SenderLocalpart {
+		problems = append(problems, fmt.Sprintf("sender_localpart is %q, the config uses %q", r.SenderLocalpart, want.SenderLocalpart))
+	}
+	for _, ns := range []struct {
+		name      string
+		got, want []Namespace
+	}{
+		{"users", r.Namespaces.Users, want.Namespaces.Users},
+		{"aliases", r.Namespaces.Aliases, want.Namespaces.Aliases},
+		{"rooms", r.Namespaces.Rooms, want.Namespaces.Rooms},
+	} {
+		if !slices.Equal(ns.got, ns.want) {
+			problems = append(problems, fmt.Sprintf("namespaces.%s differs from [namespaces] %s in the config", ns.name, ns.name))
+		}
+	}
+	if want.ReceiveEphemeral && !r.ReceiveEphemeral {
+		problems = append(problems, "receive_ephemeral is off, but routes match ephemeral events")
+	}
+	if want.PushEphemeral && !r.PushEphemeral {
+		problems = append(problems, "de.sorunome.msc2409.push_ephemeral is off, but ephemeral routes or encryption need it")
+	}
+	if want.MSC3202 && !r.MSC3202 {
+		problems = append(problems, "org.matrix.msc3202 is off, but encryption is enabled")
+	}
+	return problems
+}
+
 // generateToken creates a random token (32 bytes as hex string)
 func generateToken() (string, error) {
 	token := make([]byte, 32)
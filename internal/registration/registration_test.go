@@ -3,12 +3,16 @@ package registration
 import (
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
+
+	"github.com/yamatt/matrix-as-webhook/internal/config"
+	"gopkg.in/yaml.v3"
 )
 
 func TestGenerateBasic(t *testing.T) {
 	serverURL := "http://localhost:8080"
-	reg, err := Generate(serverURL, "")
+	reg, err := Generate(serverURL, "", "")
 
 	if err != nil {
 		t.Fatalf("Generate failed: %v", err)
@@ -43,7 +47,7 @@ func TestGenerateWithCustomAsToken(t *testing.T) {
 	serverURL := "https://example.com"
 	customToken := "my-custom-token-12345"
 
-	reg, err := Generate(serverURL, customToken)
+	reg, err := Generate(serverURL, customToken, "")
 
 	if err != nil {
 		t.Fatalf("Generate failed: %v", err)
@@ -62,11 +66,83 @@ func TestGenerateWithCustomAsToken(t *testing.T) {
 	}
 }
 
-// Namespace generation is no longer supported via CLI; namespaces remain empty by default.
+func TestApplyConfig(t *testing.T) {
+	reg, err := Generate("http://localhost:8080", "", "")
+	if err != nil {
+		t.Fatalf("Generate failed: %v", err)
+	}
+
+	if reg.SenderLocalpart != "webhook" {
+		t.Errorf("Expected default sender_localpart 'webhook', got '%s'", reg.SenderLocalpart)
+	}
+
+	reg.ApplyConfig(&config.Config{
+		Homeserver: config.HomeserverConfig{SenderLocalpart: "hookbot"},
+		Namespaces: config.NamespacesConfig{
+			Users:   []config.NamespaceConfig{{Regex: "@webhook_.*:example\\.org", Exclusive: true}},
+			Aliases: []config.NamespaceConfig{{Regex: "#webhook_.*:example\\.org", Exclusive: true}},
+		},
+	})
+
+	if reg.SenderLocalpart != "hookbot" {
+		t.Errorf("Expected sender_localpart 'hookbot', got '%s'", reg.SenderLocalpart)
+	}
+	if len(reg.Namespaces.Users) != 1 || !reg.Namespaces.Users[0].Exclusive || reg.Namespaces.Users[0].Regex != "@webhook_.*:example\\.org" {
+		t.Errorf("Unexpected user namespaces: %+v", reg.Namespaces.Users)
+	}
+	if len(reg.Namespaces.Aliases) != 1 {
+		t.Errorf("Expected 1 alias namespace, got %d", len(reg.Namespaces.Aliases))
+	}
+	if len(reg.Namespaces.Rooms) != 0 {
+		t.Errorf("Expected no room namespaces, got %d", len(reg.Namespaces.Rooms))
+	}
+	if reg.PushEphemeral || reg.MSC3202 || reg.ReceiveEphemeral {
+		t.Error("Expected ephemeral events and encryption extensions to be off by default")
+	}
+}
+
+func TestApplyConfigEphemeral(t *testing.T) {
+	reg, err := Generate("http://localhost:8080", "", "")
+	if err != nil {
+		t.Fatalf("Generate failed: %v", err)
+	}
+	reg.ApplyConfig(&config.Config{Routes: []config.RouteConfig{{Name: "typing", Ephemeral: true}}})
+
+	data, err := yaml.Marshal(reg)
+	if err != nil {
+		t.Fatalf("Marshal failed: %v", err)
+	}
+	for _, key := range []string{"receive_ephemeral: true", "de.sorunome.msc2409.push_ephemeral: true"} {
+		if !strings.Contains(string(data), key) {
+			t.Errorf("Expected registration to contain %q, got:\n%s", key, data)
+		}
+	}
+	if reg.MSC3202 {
+		t.Error("Expected MSC3202 to stay off without encryption")
+	}
+}
+
+func TestApplyConfigEncryption(t *testing.T) {
+	reg, err := Generate("http://localhost:8080", "", "")
+	if err != nil {
+		t.Fatalf("Generate failed: %v", err)
+	}
+	reg.ApplyConfig(&config.Config{Encryption: config.EncryptionConfig{Enabled: true}})
+
+	data, err := yaml.Marshal(reg)
+	if err != nil {
+		t.Fatalf("Marshal failed: %v", err)
+	}
+	for _, key := range []string{"de.sorunome.msc2409.push_ephemeral: true", "org.matrix.msc3202: true"} {
+		if !strings.Contains(string(data), key) {
+			t.Errorf("Expected registration to contain %q, got:\n%s", key, data)
+		}
+	}
+}
 
 func TestGenerateTokenUniqueness(t *testing.T) {
-	reg1, _ := Generate("http://localhost:8080", "")
-	reg2, _ := Generate("http://localhost:8080", "")
+	reg1, _ := Generate("http://localhost:8080", "", "")
+	reg2, _ := Generate("http://localhost:8080", "", "")
 
 	if reg1.AsToken == reg2.AsToken {
 		t.Error("Expected different AS tokens for different generations")
@@ -81,7 +157,7 @@ func TestWriteToFile(t *testing.T) {
 	tmpDir := t.TempDir()
 	filePath := filepath.Join(tmpDir, "registration.yaml")
 
-	reg, _ := Generate("http://localhost:8080", "test-token")
+	reg, _ := Generate("http://localhost:8080", "test-token", "")
 	err := reg.WriteToFile(filePath)
 
 	if err != nil {
@@ -123,7 +199,7 @@ func TestWriteToFileCreatesDirectory(t *testing.T) {
 	tmpDir := t.TempDir()
 	filePath := filepath.Join(tmpDir, "subdir", "nested", "registration.yaml")
 
-	reg, _ := Generate("http://localhost:8080", "")
+	reg, _ := Generate("http://localhost:8080", "", "")
 	err := reg.WriteToFile(filePath)
 
 	if err != nil {
@@ -139,7 +215,7 @@ func TestWriteToFilePermissions(t *testing.T) {
 	tmpDir := t.TempDir()
 	filePath := filepath.Join(tmpDir, "registration.yaml")
 
-	reg, _ := Generate("http://localhost:8080", "")
+	reg, _ := Generate("http://localhost:8080", "", "")
 	err := reg.WriteToFile(filePath)
 
 	if err != nil {
@@ -164,7 +240,7 @@ func TestGenerateWithAllParameters(t *testing.T) {
 	serverURL := "https://webhook.example.com"
 	asToken := "custom-as-token"
 
-	reg, err := Generate(serverURL, asToken)
+	reg, err := Generate(serverURL, asToken, "")
 
 	if err != nil {
 		t.Fatalf("Generate failed: %v", err)
@@ -192,3 +268,43 @@ func contains(str, substr string) bool {
 	}
 	return false
 }
+
+func TestLoadAndCheck(t *testing.T) {
+	cfg := &config.Config{
+		ASToken:    "as-secret",
+		HSToken:    "hs-secret",
+		Homeserver: config.HomeserverConfig{SenderLocalpart: "hookbot"},
+		Namespaces: config.NamespacesConfig{
+			Users: []config.NamespaceConfig{{Regex: "@webhook_.*:example\\.org", Exclusive: true}},
+		},
+	}
+	reg, _ := Generate("http://localhost:8080", "as-secret", "hs-secret")
+	reg.ApplyConfig(cfg)
+	path := filepath.Join(t.TempDir(), "registration.yaml")
+	if err := reg.WriteToFile(path); err != nil {
+		t.Fatalf("WriteToFile failed: %v", err)
+	}
+
+	loaded, err := Load(path)
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	if problems := loaded.Check(cfg); len(problems) != 0 {
+		t.Errorf("Expected a generated registration to match its config, got %v", problems)
+	}
+
+	cfg.ASToken = "rotated"
+	cfg.HSToken = "rotated"
+	cfg.Namespaces.Rooms = []config.NamespaceConfig{{Regex: "!.*:example\\.org"}}
+	cfg.Encryption.Enabled = true
+	problems := loaded.Check(cfg)
+	for _, want := range []string{"as_token", "hs_token", "namespaces.rooms", "org.matrix.msc3202"} {
+		found := false
+		for _, p := range problems {
+			found = found || contains(p, want)
+		}
+		if !found {
+			t.Errorf("Expected a problem about %s, got %v", want, problems)
+		}
+	}
+}
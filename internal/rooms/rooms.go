@@ -0,0 +1,104 @@
+package rooms
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"regexp"
+	"strings"
+
+	"github.com/yamatt/matrix-as-webhook/internal/config"
+	"github.com/yamatt/matrix-as-webhook/internal/matrix"
+)
+
+// ErrUnknownAlias is returned for aliases that match no configured pattern.
+var ErrUnknownAlias = errors.New("rooms: unknown alias")
+
+type pattern struct {
+	conf config.RoomAliasConfig
+	re   *regexp.Regexp
+}
+
+// Provisioner creates rooms lazily for configured alias patterns.
+type Provisioner struct {
+	client   *matrix.Client
+	domain   string
+	patterns []pattern
+}
+
+// NewProvisioner compiles the room alias patterns in cfg. Invalid patterns
+// are logged and ignored.
+func NewProvisioner(client *matrix.Client, cfg *config.Config) *Provisioner {
+	p := &Provisioner{client: client, domain: cfg.Homeserver.Domain}
+	for _, a := range cfg.RoomAliases {
+		re, err := regexp.Compile(a.LocalpartRegex)
+		if err != nil {
+			slog.Warn("ignoring invalid localpart_regex", "regex", a.LocalpartRegex, "error", err)
+			continue
+		}
+		p.patterns = append(p.patterns, pattern{conf: a, re: re})
+	}
+	return p
+}
+
+// Request builds the createRoom request for alias, or returns ErrUnknownAlias
+// if the alias is on another server or matches no pattern.
+func (p *Provisioner) Request(alias string) (matrix.CreateRoomRequest, error) {
+	localpart, ok := p.localpart(alias)
+	if !ok {
+		return matrix.CreateRoomRequest{}, ErrUnknownAlias
+	}
+
+	for _, pt := range p.patterns {
+		match := pt.re.FindStringSubmatchIndex(localpart)
+		if match == nil {
+			continue
+		}
+		expand := func(tmpl string) string {
+			return string(pt.re.ExpandString(nil, tmpl, localpart, match))
+		}
+		return matrix.CreateRoomRequest{
+			RoomAliasName:             localpart,
+			Name:                      expand(pt.conf.Name),
+			Topic:                     expand(pt.conf.Topic),
+			Preset:                    pt.conf.Preset,
+			PowerLevelContentOverride: pt.conf.PowerLevels,
+		}, nil
+	}
+	return matrix.CreateRoomRequest{}, ErrUnknownAlias
+}
+
+// Provision creates the room for alias. An alias that is already taken is
+// treated as provisioned.
+func (p *Provisioner) Provision(ctx context.Context, alias string) error {
+	req, err := p.Request(alias)
+	if err != nil {
+		return err
+	}
+
+	roomID, err := p.client.CreateRoom(ctx, "", req)
+	var mErr *matrix.Error
+	if errors.As(err, &mErr) && mErr.ErrCode == "M_ROOM_IN_USE" {
+		slog.Info("room alias already exists", "alias", alias)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("rooms: creating %s: %w", alias, err)
+	}
+
+	slog.Info("created room for alias", "room_id", roomID, "alias", alias)
+	return nil
+}
+
+// localpart extracts the localpart of an alias on the configured server.
+func (p *Provisioner) localpart(alias string) (string, bool) {
+	if !strings.HasPrefix(alias, "#") {
+		return "", false
+	}
+	localpart, server, ok := strings.Cut(alias[1:], ":")
+	if !ok || server != p.domain || localpart == "" {
+		return "", false
+	}
+	return localpart, true
+}
@@ -0,0 +1,89 @@
+package rooms
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/yamatt/matrix-as-webhook/internal/config"
+	"github.com/yamatt/matrix-as-webhook/internal/matrix"
+)
+
+func testConfig() *config.Config {
+	return &config.Config{
+		Homeserver: config.HomeserverConfig{Domain: "example.org"},
+		RoomAliases: []config.RoomAliasConfig{
+			{
+				LocalpartRegex: `^webhook_(?P<name>[a-z0-9_-]+)$`,
+				Name:           "Webhook ${name}",
+				Topic:          "Notifications for ${name}",
+				Preset:         "public_chat",
+				PowerLevels:    map[string]interface{}{"events_default": 50},
+			},
+		},
+	}
+}
+
+func TestRequest(t *testing.T) {
+	p := NewProvisioner(matrix.NewClient("", "", 0), testConfig())
+
+	req, err := p.Request("#webhook_ci:example.org")
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+
+	if req.RoomAliasName != "webhook_ci" {
+		t.Errorf("Expected alias localpart 'webhook_ci', got '%s'", req.RoomAliasName)
+	}
+	if req.Name != "Webhook ci" {
+		t.Errorf("Expected name 'Webhook ci', got '%s'", req.Name)
+	}
+	if req.Topic != "Notifications for ci" {
+		t.Errorf("Expected topic 'Notifications for ci', got '%s'", req.Topic)
+	}
+	if req.Preset != "public_chat" {
+		t.Errorf("Expected preset 'public_chat', got '%s'", req.Preset)
+	}
+	if req.PowerLevelContentOverride["events_default"] != 50 {
+		t.Errorf("Expected power level override, got %v", req.PowerLevelContentOverride)
+	}
+}
+
+func TestRequest_Unknown(t *testing.T) {
+	p := NewProvisioner(matrix.NewClient("", "", 0), testConfig())
+
+	for _, alias := range []string{"#other:example.org", "#webhook_ci:elsewhere.org", "webhook_ci", "#webhook_CI!:example.org"} {
+		if _, err := p.Request(alias); !errors.Is(err, ErrUnknownAlias) {
+			t.Errorf("Expected ErrUnknownAlias for %s, got %v", alias, err)
+		}
+	}
+}
+
+func TestProvision(t *testing.T) {
+	var got map[string]interface{}
+
+	hs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/_matrix/client/v3/createRoom" {
+			t.Errorf("Unexpected path: %s", r.URL.Path)
+		}
+		_ = json.NewDecoder(r.Body).Decode(&got)
+		_ = json.NewEncoder(w).Encode(map[string]string{"room_id": "!new:example.org"})
+	}))
+	defer hs.Close()
+
+	p := NewProvisioner(matrix.NewClient(hs.URL, "as-token", 5*time.Second), testConfig())
+	if err := p.Provision(context.Background(), "#webhook_ci:example.org"); err != nil {
+		t.Fatalf("Provision failed: %v", err)
+	}
+
+	if got["room_alias_name"] != "webhook_ci" {
+		t.Errorf("Expected room_alias_name 'webhook_ci', got '%v'", got["room_alias_name"])
+	}
+	if got["name"] != "Webhook ci" {
+		t.Errorf("Expected name 'Webhook ci', got '%v'", got["name"])
+	}
+}
@@ -2,102 +2,262 @@ package router
 
 import (
 	"encoding/json"
-	"log"
+	"log/slog"
 
 	"github.com/google/cel-go/cel"
 	"github.com/yamatt/matrix-as-webhook/internal/config"
+	"github.com/yamatt/matrix-as-webhook/internal/logging"
+	"github.com/yamatt/matrix-as-webhook/internal/metrics"
 )
 
 type Target struct {
-	Name         string
-	URL          string
-	Method       string
-	StopOnMatch  bool
-	SendBody     bool
-	SharedSecret string
+	Name           string
+	URL            string
+	Method         string
+	StopOnMatch    bool
+	SendBody       bool
+	SharedSecret   config.Secret
+	Signing        string
+	SigningSecrets []config.Secret
+	Auth           config.AuthConfig
+	TLS            config.TLSConfig
+	Media          string
+	MediaMaxBytes  int64
+	MediaMimeTypes []string
 }
 
 type compiledRoute struct {
-	conf config.RouteConfig
-	prog cel.Program
+	index int
+	conf  config.RouteConfig
+	prog  cel.Program
 }
 
-// Resolver evaluates CEL selectors to pick webhook targets.
+// Filter reports whether a route may be considered for the event being
+// resolved; index is the route's position in the configuration.
+type Filter func(index int, conf config.RouteConfig) bool
+
+// Resolver evaluates CEL selectors to pick webhook targets. The selectors
+// are compiled once, and a Resolver is not modified after NewResolver, so it
+// can be shared between goroutines; WithFilter and WithLogger return copies.
 type Resolver struct {
 	routes []compiledRoute
+	filter Filter
+	logger *slog.Logger
 }
 
 func NewResolver(cfg *config.Config) (*Resolver, error) {
-	env, err := cel.NewEnv(
-		cel.Variable("event", cel.DynType),
-	)
+	env, err := newEnv()
 	if err != nil {
 		return nil, err
 	}
 
 	crs := make([]compiledRoute, 0, len(cfg.Routes))
-	for _, rc := range cfg.Routes {
-		ast, issues := env.Compile(rc.Selector)
-		if issues != nil && issues.Err() != nil {
-			return nil, issues.Err()
-		}
-		prog, err := env.Program(ast)
+	for i, rc := range cfg.Routes {
+		prog, err := compile(env, rc.Selector)
 		if err != nil {
 			return nil, err
 		}
-		crs = append(crs, compiledRoute{conf: rc, prog: prog})
+		crs = append(crs, compiledRoute{index: i, conf: rc, prog: prog})
 	}
-	return &Resolver{routes: crs}, nil
+	return &Resolver{routes: crs, logger: slog.Default()}, nil
 }
 
-// Resolve returns targets for the given event (as struct or map).
-func (r *Resolver) Resolve(event interface{}) ([]Target, error) {
-	b, err := json.Marshal(event)
+func newEnv() (*cel.Env, error) {
+	return cel.NewEnv(
+		cel.Variable("event", cel.DynType),
+	)
+}
+
+func compile(env *cel.Env, selector string) (cel.Program, error) {
+	ast, issues := env.Compile(selector)
+	if issues != nil && issues.Err() != nil {
+		return nil, issues.Err()
+	}
+	return env.Program(ast)
+}
+
+// CheckSelector reports whether selector compiles.
+func CheckSelector(selector string) error {
+	env, err := newEnv()
 	if err != nil {
-		return nil, err
+		return err
 	}
-	var js any
-	if err := json.Unmarshal(b, &js); err != nil {
+	_, err = compile(env, selector)
+	return err
+}
+
+// WithFilter returns a resolver that skips routes f rejects, as if their
+// selector did not match.
+func (r *Resolver) WithFilter(f Filter) *Resolver {
+	copied := *r
+	copied.filter = f
+	return &copied
+}
+
+// WithLogger returns a resolver that logs selector results to logger, e.g.
+// one carrying the event's fields.
+func (r *Resolver) WithLogger(logger *slog.Logger) *Resolver {
+	copied := *r
+	copied.logger = logger
+	return &copied
+}
+
+// Resolve returns targets for the given room event (as struct or map).
+func (r *Resolver) Resolve(event interface{}) ([]Target, error) {
+	return r.resolve(event, false)
+}
+
+// ResolveEphemeral returns targets for an ephemeral event, considering only
+// routes with ephemeral enabled.
+func (r *Resolver) ResolveEphemeral(event interface{}) ([]Target, error) {
+	return r.resolve(event, true)
+}
+
+func (r *Resolver) resolve(event interface{}, ephemeral bool) ([]Target, error) {
+	js, err := toJSON(event)
+	if err != nil {
 		return nil, err
 	}
 
 	var out []Target
 	for _, rt := range r.routes {
-		val, _, err := rt.prog.Eval(map[string]any{"event": js})
-		if err != nil {
-			log.Printf("Router: selector eval error for route '%s': %v", rt.conf.Name, err)
+		if rt.conf.Ephemeral != ephemeral {
+			continue
+		}
+		if r.filter != nil && !r.filter(rt.index, rt.conf) {
+			r.logger.Debug("route skipped by filter", logging.KeyRoute, rt.conf.Name)
 			continue
 		}
-		matched := false
-		if b, ok := val.Value().(bool); ok {
-			matched = b
+		matched, err := rt.eval(js)
+		if err != nil {
+			r.logger.Warn("selector evaluation failed", logging.KeyRoute, rt.conf.Name, "error", err)
+			metrics.SelectorErrors.WithLabelValues(rt.conf.Name).Inc()
+			continue
 		}
 		if matched {
-			log.Printf("Router: selector matched for route '%s' -> %s", rt.conf.Name, rt.conf.WebhookURL)
-			m := rt.conf.Method
-			if m == "" {
-				m = "POST"
-			}
-			sendBody := true
-			if rt.conf.SendBody != nil {
-				sendBody = *rt.conf.SendBody
-			}
-			target := Target{
-				Name:         rt.conf.Name,
-				URL:          rt.conf.WebhookURL,
-				Method:       m,
-				StopOnMatch:  rt.conf.StopOnMatch,
-				SendBody:     sendBody,
-				SharedSecret: rt.conf.SharedSecret,
-			}
-			out = append(out, target)
+			metrics.SelectorMatches.WithLabelValues(rt.conf.Name).Inc()
+			r.logger.Debug("selector matched", logging.KeyRoute, rt.conf.Name)
+			out = append(out, rt.target())
 			if rt.conf.StopOnMatch {
-				log.Printf("Router: stop_on_match enabled for route '%s', stopping evaluation", rt.conf.Name)
+				r.logger.Debug("stop_on_match set, skipping remaining routes", logging.KeyRoute, rt.conf.Name)
 				break
 			}
 		} else {
-			log.Printf("Router: selector did not match for route '%s'", rt.conf.Name)
+			r.logger.Debug("selector did not match", logging.KeyRoute, rt.conf.Name)
 		}
 	}
 	return out, nil
 }
+
+// Outcomes of a route in a dry run.
+const (
+	OutcomeMatched    = "matched"
+	OutcomeNotMatched = "not_matched"
+	OutcomeFiltered   = "filtered"
+	OutcomeError      = "error"
+	// OutcomeNotReached follows a matched route with stop_on_match
+	OutcomeNotReached = "not_reached"
+)
+
+// Trial is what resolving an event did with one route.
+type Trial struct {
+	Route   string `json:"route"`
+	Outcome string `json:"outcome"`
+	Error   string `json:"error,omitempty"`
+	// Target is set for matched routes
+	Target *Target `json:"-"`
+}
+
+// DryRun resolves an event like Resolve or ResolveEphemeral, without
+// recording metrics, and reports the outcome of every route considered.
+func (r *Resolver) DryRun(event interface{}, ephemeral bool) ([]Trial, error) {
+	js, err := toJSON(event)
+	if err != nil {
+		return nil, err
+	}
+
+	var trials []Trial
+	stopped := false
+	for _, rt := range r.routes {
+		if rt.conf.Ephemeral != ephemeral {
+			continue
+		}
+		trial := Trial{Route: rt.conf.Name}
+		switch {
+		case stopped:
+			trial.Outcome = OutcomeNotReached
+		case r.filter != nil && !r.filter(rt.index, rt.conf):
+			trial.Outcome = OutcomeFiltered
+		default:
+			matched, err := rt.eval(js)
+			switch {
+			case err != nil:
+				trial.Outcome, trial.Error = OutcomeError, err.Error()
+			case matched:
+				target := rt.target()
+				trial.Outcome, trial.Target = OutcomeMatched, &target
+				stopped = rt.conf.StopOnMatch
+			default:
+				trial.Outcome = OutcomeNotMatched
+			}
+		}
+		trials = append(trials, trial)
+	}
+	return trials, nil
+}
+
+// toJSON converts an event to the generic form selectors see.
+func toJSON(event interface{}) (any, error) {
+	b, err := json.Marshal(event)
+	if err != nil {
+		return nil, err
+	}
+	var js any
+	if err := json.Unmarshal(b, &js); err != nil {
+		return nil, err
+	}
+	return js, nil
+}
+
+// eval reports whether the route's selector matches the event.
+func (rt compiledRoute) eval(js any) (bool, error) {
+	val, _, err := rt.prog.Eval(map[string]any{"event": js})
+	if err != nil {
+		return false, err
+	}
+	matched, _ := val.Value().(bool)
+	return matched, nil
+}
+
+// target returns where events matching the route are sent.
+func (rt compiledRoute) target() Target {
+	return NewTarget(rt.conf)
+}
+
+// NewTarget returns where events sent to a route go, without evaluating its
+// selector.
+func NewTarget(rc config.RouteConfig) Target {
+	m := rc.Method
+	if m == "" {
+		m = "POST"
+	}
+	sendBody := true
+	if rc.SendBody != nil {
+		sendBody = *rc.SendBody
+	}
+	return Target{
+		Name:           rc.Name,
+		URL:            rc.WebhookURL,
+		Method:         m,
+		StopOnMatch:    rc.StopOnMatch,
+		SendBody:       sendBody,
+		SharedSecret:   rc.SharedSecret,
+		Signing:        rc.Signing,
+		SigningSecrets: rc.SigningSecrets,
+		Auth:           rc.Auth,
+		TLS:            rc.TLS,
+		Media:          rc.Media,
+		MediaMaxBytes:  rc.MediaMaxBytes,
+		MediaMimeTypes: rc.MediaMimeTypes,
+	}
+}
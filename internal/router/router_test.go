@@ -103,3 +103,81 @@ func TestResolve_NoMatch(t *testing.T) {
 		t.Fatalf("expected 0 targets, got %d", len(targets))
 	}
 }
+
+func TestResolve_Ephemeral(t *testing.T) {
+	cfg := &config.Config{Routes: []config.RouteConfig{
+		{Name: "messages", Selector: "true", WebhookURL: "http://example/messages"},
+		{Name: "typing", Selector: "event.type == 'm.typing' && size(event.content.user_ids) > 0", WebhookURL: "http://example/typing", Ephemeral: true},
+	}}
+	res, err := NewResolver(cfg)
+	if err != nil {
+		t.Fatalf("new resolver: %v", err)
+	}
+
+	typing := map[string]interface{}{
+		"type":    "m.typing",
+		"room_id": "!support:example.org",
+		"content": map[string]interface{}{"user_ids": []interface{}{"@alice:example.org"}},
+	}
+	targets, err := res.ResolveEphemeral(typing)
+	if err != nil {
+		t.Fatalf("resolve error: %v", err)
+	}
+	if len(targets) != 1 || targets[0].Name != "typing" {
+		t.Errorf("expected only the ephemeral route, got %+v", targets)
+	}
+
+	message := map[string]interface{}{"type": "m.room.message", "content": map[string]interface{}{"body": "hi"}}
+	targets, err = res.Resolve(message)
+	if err != nil {
+		t.Fatalf("resolve error: %v", err)
+	}
+	if len(targets) != 1 || targets[0].Name != "messages" {
+		t.Errorf("expected ephemeral routes to be skipped for messages, got %+v", targets)
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	cfg := &config.Config{Routes: []config.RouteConfig{
+		{Name: "paused", Selector: "true", WebhookURL: "http://example/paused"},
+		{Name: "other", Selector: "event.type == 'm.reaction'", WebhookURL: "http://example/other"},
+		{Name: "broken", Selector: "event.content.missing == 'x'", WebhookURL: "http://example/broken"},
+		{Name: "stop", Selector: "true", WebhookURL: "http://example/stop", StopOnMatch: true},
+		{Name: "after", Selector: "true", WebhookURL: "http://example/after"},
+		{Name: "typing", Selector: "true", WebhookURL: "http://example/typing", Ephemeral: true},
+	}}
+	res, err := NewResolver(cfg)
+	if err != nil {
+		t.Fatalf("new resolver: %v", err)
+	}
+	res = res.WithFilter(func(_ int, conf config.RouteConfig) bool { return conf.Name != "paused" })
+
+	trials, err := res.DryRun(map[string]interface{}{"type": "m.room.message", "content": map[string]interface{}{}}, false)
+	if err != nil {
+		t.Fatalf("dry run error: %v", err)
+	}
+	want := []string{OutcomeFiltered, OutcomeNotMatched, OutcomeError, OutcomeMatched, OutcomeNotReached}
+	if len(trials) != len(want) {
+		t.Fatalf("expected %d trials, got %+v", len(want), trials)
+	}
+	for i, outcome := range want {
+		if trials[i].Outcome != outcome {
+			t.Errorf("expected %s to be %s, got %s", trials[i].Route, outcome, trials[i].Outcome)
+		}
+	}
+	if trials[3].Target == nil || trials[3].Target.URL != "http://example/stop" {
+		t.Errorf("expected the matched trial to carry its target, got %+v", trials[3].Target)
+	}
+	if trials[2].Error == "" {
+		t.Error("expected the selector error to be reported")
+	}
+}
+
+func TestCheckSelector(t *testing.T) {
+	if err := CheckSelector("event.type == 'm.room.message'"); err != nil {
+		t.Errorf("expected a valid selector, got %v", err)
+	}
+	if err := CheckSelector("event.type =="); err == nil {
+		t.Error("expected an error for an invalid selector")
+	}
+}
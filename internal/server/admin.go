@@ -0,0 +1,441 @@
+package server
+
+import (
+	"context"
+	"crypto/subtle"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/yamatt/matrix-as-webhook/internal/access"
+	"github.com/yamatt/matrix-as-webhook/internal/config"
+	"github.com/yamatt/matrix-as-webhook/internal/history"
+	"github.com/yamatt/matrix-as-webhook/internal/inbound"
+	"github.com/yamatt/matrix-as-webhook/internal/router"
+	"github.com/yamatt/matrix-as-webhook/internal/webhook"
+)
+
+// openAPI describes the admin API.
+//
+//go:embed openapi.yaml
+var openAPI []byte
+
+// adminRoutes registers the admin API under /admin/v1. It is only served
+// when an admin token is configured.
+func (s *AppServer) adminRoutes(r *mux.Router) {
+	if s.config.Admin.Token == "" {
+		return
+	}
+	admin := r.PathPrefix("/admin/v1").Subrouter()
+	admin.Use(s.validateAdminToken)
+	admin.HandleFunc("/openapi.yaml", handleOpenAPI).Methods("GET")
+	admin.HandleFunc("/routes", s.handleRoutes).Methods("GET")
+	admin.HandleFunc("/routes/{name}/pause", s.handlePause).Methods("POST")
+	admin.HandleFunc("/routes/{name}/resume", s.handlePause).Methods("POST")
+	admin.HandleFunc("/test", s.handleTest).Methods("POST")
+	admin.HandleFunc("/reload", s.handleReload).Methods("POST")
+	admin.HandleFunc("/queues", s.handleQueues).Methods("GET")
+	admin.HandleFunc("/deliveries", s.handleDeliveries).Methods("GET")
+	admin.HandleFunc("/deadletters", s.handleDeadLetters).Methods("GET")
+	admin.HandleFunc("/deadletters/replay", s.handleReplay).Methods("POST")
+}
+
+// validateAdminToken checks the bearer token of admin API requests.
+func (s *AppServer) validateAdminToken(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(s.config.Admin.Token.Value())) != 1 {
+			slog.Warn("admin request with invalid token", "path", r.URL.Path)
+			writeError(w, http.StatusUnauthorized, "M_UNKNOWN_TOKEN", "Invalid admin token")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// writeJSON writes v as a 200 response.
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func handleOpenAPI(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/yaml")
+	_, _ = w.Write(openAPI)
+}
+
+// routeControl holds the paused routes and per-route delivery stats. Both are
+// keyed by route name, so they survive reloads.
+type routeControl struct {
+	mu     sync.Mutex
+	paused map[string]bool
+	stats  map[string]*routeStats
+}
+
+// routeStats counts what happened to a route's events since startup.
+type routeStats struct {
+	Successes     uint64     `json:"successes"`
+	Failures      uint64     `json:"failures"`
+	SkippedPaused uint64     `json:"skipped_paused"`
+	LastDelivery  *time.Time `json:"last_delivery,omitempty"`
+	LastStatus    int        `json:"last_status,omitempty"`
+	LastLatencyMS float64    `json:"last_latency_ms,omitempty"`
+	LastError     string     `json:"last_error,omitempty"`
+	// The sender's requests to the route
+	webhook.Load
+	// DeadLetters is the number of events whose last delivery failed
+	DeadLetters int `json:"dead_letters"`
+}
+
+func newRouteControl() *routeControl {
+	return &routeControl{paused: make(map[string]bool), stats: make(map[string]*routeStats)}
+}
+
+// statsFor returns the stats of a route. The caller must hold c.mu.
+func (c *routeControl) statsFor(route string) *routeStats {
+	st, ok := c.stats[route]
+	if !ok {
+		st = &routeStats{}
+		c.stats[route] = st
+	}
+	return st
+}
+
+// skipPaused reports whether a route is paused, counting the event it skips.
+func (c *routeControl) skipPaused(route string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.paused[route] {
+		return false
+	}
+	c.statsFor(route).SkippedPaused++
+	return true
+}
+
+func (c *routeControl) isPaused(route string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.paused[route]
+}
+
+func (c *routeControl) setPaused(route string, paused bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if paused {
+		c.paused[route] = true
+	} else {
+		delete(c.paused, route)
+	}
+}
+
+// record counts a delivery attempt.
+func (c *routeControl) record(rec history.Record) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	st := c.statsFor(rec.Route)
+	if rec.Success {
+		st.Successes++
+	} else {
+		st.Failures++
+	}
+	at := rec.Time
+	st.LastDelivery, st.LastStatus, st.LastLatencyMS, st.LastError = &at, rec.Status, rec.LatencyMS, rec.Error
+}
+
+func (c *routeControl) snapshot(route string) routeStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if st, ok := c.stats[route]; ok {
+		return *st
+	}
+	return routeStats{}
+}
+
+// routeView is a route as listed by the admin API.
+type routeView struct {
+	Name          string     `json:"name"`
+	Selector      string     `json:"selector"`
+	SelectorError string     `json:"selector_error,omitempty"`
+	Ephemeral     bool       `json:"ephemeral"`
+	WebhookURL    string     `json:"webhook_url"`
+	Method        string     `json:"method"`
+	StopOnMatch   bool       `json:"stop_on_match"`
+	Paused        bool       `json:"paused"`
+	Stats         routeStats `json:"stats"`
+}
+
+// routeView describes a route; deadLetters counts the dead letters by route.
+func (s *AppServer) routeView(rc config.RouteConfig, deadLetters map[string]int) routeView {
+	method := rc.Method
+	if method == "" {
+		method = "POST"
+	}
+	view := routeView{
+		Name:        rc.Name,
+		Selector:    rc.Selector,
+		Ephemeral:   rc.Ephemeral,
+		WebhookURL:  webhook.RedactURL(rc.WebhookURL),
+		Method:      method,
+		StopOnMatch: rc.StopOnMatch,
+		Paused:      s.routes.isPaused(rc.Name),
+		Stats:       s.routes.snapshot(rc.Name),
+	}
+	view.Stats.Load = s.webhookSender.Load(rc.Name)
+	view.Stats.DeadLetters = deadLetters[rc.Name]
+	if err := router.CheckSelector(rc.Selector); err != nil {
+		view.SelectorError = err.Error()
+	}
+	return view
+}
+
+// deadLetterCounts returns the number of dead letters of each route.
+func (s *AppServer) deadLetterCounts() map[string]int {
+	counts := make(map[string]int)
+	for _, rec := range s.history.DeadLetters(history.Filter{Limit: math.MaxInt}) {
+		counts[rec.Route]++
+	}
+	return counts
+}
+
+// handleRoutes lists the configured routes with their state and stats.
+func (s *AppServer) handleRoutes(w http.ResponseWriter, r *http.Request) {
+	routes := []routeView{}
+	deadLetters := s.deadLetterCounts()
+	for _, rc := range s.current().config.Routes {
+		routes = append(routes, s.routeView(rc, deadLetters))
+	}
+	writeJSON(w, map[string]interface{}{"routes": routes})
+}
+
+// handlePause pauses or resumes a route. Events a paused route would have
+// received are dropped, not queued.
+func (s *AppServer) handlePause(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	for _, rc := range s.current().config.Routes {
+		if rc.Name != name {
+			continue
+		}
+		paused := strings.HasSuffix(r.URL.Path, "/pause")
+		s.routes.setPaused(name, paused)
+		slog.Info("route state changed by admin", "route", name, "paused", paused)
+		writeJSON(w, s.routeView(rc, s.deadLetterCounts()))
+		return
+	}
+	writeError(w, http.StatusNotFound, "M_NOT_FOUND", fmt.Sprintf("Route %s not found", name))
+}
+
+// testRequest is the body of a dry run.
+type testRequest struct {
+	Event     MatrixEvent `json:"event"`
+	Ephemeral bool        `json:"ephemeral"`
+}
+
+// TestRoute is the outcome of a dry run for one route.
+type TestRoute struct {
+	router.Trial
+	// Reason explains a filtered route: paused or an access policy reason
+	Reason  string                 `json:"reason,omitempty"`
+	Payload map[string]interface{} `json:"payload,omitempty"`
+}
+
+// TestResult is the outcome of a dry run. Skipped or Denied is set if the
+// event never reaches the routes.
+type TestResult struct {
+	Skipped string      `json:"skipped,omitempty"`
+	Denied  string      `json:"denied,omitempty"`
+	Routes  []TestRoute `json:"routes,omitempty"`
+}
+
+// errRoutesDoNotCompile is returned by DryRun if the live routes do not
+// compile, which is the server's fault rather than the event's.
+var errRoutesDoNotCompile = errors.New("routes do not compile")
+
+// handleTest routes an event without sending it, reporting what each route
+// would do and the payloads matched routes would receive.
+func (s *AppServer) handleTest(w http.ResponseWriter, r *http.Request) {
+	var req testRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "M_BAD_JSON", "Invalid test request: "+err.Error())
+		return
+	}
+	result, err := s.DryRun(r.Context(), req.Event, req.Ephemeral)
+	switch {
+	case errors.Is(err, errRoutesDoNotCompile):
+		writeError(w, http.StatusInternalServerError, "M_UNKNOWN", err.Error())
+	case err != nil:
+		writeError(w, http.StatusBadRequest, "M_BAD_JSON", err.Error())
+	default:
+		writeJSON(w, result)
+	}
+}
+
+// DryRun runs the access policies and selectors against an event without
+// sending anything or recording metrics. Ephemeral events are routed like
+// receipts, typing and presence.
+func (s *AppServer) DryRun(ctx context.Context, event MatrixEvent, ephemeral bool) (TestResult, error) {
+	ctx = access.DryRun(ctx)
+	live := s.current()
+
+	if !ephemeral {
+		if _, ok := event.Content["body"].(string); event.Type != "m.room.message" || !ok {
+			return TestResult{Skipped: "only m.room.message events with a body are routed"}, nil
+		}
+	}
+	if err := live.access.Check(ctx, event.RoomID, event.Sender); err != nil {
+		return TestResult{Denied: accessReason(err)}, nil
+	}
+
+	routed := routedEvent{MatrixEvent: event}
+	if s.enricher != nil && !ephemeral {
+		eventCtx := s.enricher.Enrich(ctx, event.RoomID, event.Sender)
+		routed.Context = &eventCtx
+	}
+
+	if live.resolver == nil {
+		return TestResult{}, fmt.Errorf("%w: %v", errRoutesDoNotCompile, live.routesErr)
+	}
+	reasons := make(map[string]string)
+	res := live.resolver.WithFilter(func(i int, conf config.RouteConfig) bool {
+		if s.routes.isPaused(conf.Name) {
+			reasons[conf.Name] = "paused"
+			return false
+		}
+		if err := live.access.CheckRoute(ctx, i, conf.Name, event.RoomID, event.Sender); err != nil {
+			reasons[conf.Name] = accessReason(err)
+			return false
+		}
+		return true
+	})
+	trials, err := res.DryRun(routed, ephemeral)
+	if err != nil {
+		return TestResult{}, err
+	}
+
+	var result TestResult
+	for _, trial := range trials {
+		out := TestRoute{Trial: trial, Reason: reasons[trial.Route]}
+		if trial.Target != nil {
+			out.Payload = webhookPayload(routed, *trial.Target)
+		}
+		result.Routes = append(result.Routes, out)
+	}
+	return result, nil
+}
+
+// accessReason returns the reason code of an access policy denial.
+func accessReason(err error) string {
+	var denied *access.DeniedError
+	if errors.As(err, &denied) {
+		return denied.Reason
+	}
+	return err.Error()
+}
+
+// SetConfigPath sets the file the configuration was loaded from, which
+// reloads read. Without one the server is running on defaults, so reloads
+// are refused and the readiness check fails.
+func (s *AppServer) SetConfigPath(path string) {
+	s.configPath = path
+}
+
+// Reload replaces the routes, hooks and access policies with those of cfg.
+// Other settings only change on restart. Nothing is replaced if a selector
+// or hook does not compile.
+func (s *AppServer) Reload(cfg *config.Config) error {
+	next := *s.config
+	next.Routes, next.Hooks, next.Access = cfg.Routes, cfg.Hooks, cfg.Access
+	resolver, err := router.NewResolver(&next)
+	if err != nil {
+		return fmt.Errorf("invalid route selector: %w", err)
+	}
+	hooks, err := inbound.Compile(cfg.Hooks)
+	if err != nil {
+		return fmt.Errorf("invalid hook: %w", err)
+	}
+	s.live.Store(&liveConfig{
+		config:   &next,
+		access:   access.NewPolicy(&next, s.matrixClient),
+		hooks:    hooks,
+		resolver: resolver,
+	})
+	slog.Info("configuration reloaded", "routes", len(next.Routes), "hooks", len(next.Hooks))
+	return nil
+}
+
+func (s *AppServer) handleReload(w http.ResponseWriter, r *http.Request) {
+	if s.configPath == "" {
+		writeError(w, http.StatusConflict, "M_UNKNOWN", "The server was not started with a config file")
+		return
+	}
+	cfg, err := config.Load(s.configPath)
+	if err == nil {
+		err = s.Reload(cfg)
+	}
+	if err != nil {
+		slog.Warn("reload failed", "path", s.configPath, "error", err)
+		writeError(w, http.StatusBadRequest, "M_UNKNOWN", "Reload failed: "+err.Error())
+		return
+	}
+	live := s.current().config
+	writeJSON(w, map[string]int{"routes": len(live.Routes), "hooks": len(live.Hooks)})
+}
+
+// handleQueues reports the deliveries in progress, the dead letters and the
+// events held back for later. Webhooks are sent once while the transaction
+// is handled, so there is no delivery queue or circuit breaker; the only
+// queue is that of encrypted events waiting for room keys.
+func (s *AppServer) handleQueues(w http.ResponseWriter, r *http.Request) {
+	s.undecryptedMu.Lock()
+	waiting := len(s.undecrypted)
+	s.undecryptedMu.Unlock()
+
+	inFlight := 0
+	loads := make(map[string]webhook.Load)
+	for _, rc := range s.current().config.Routes {
+		load := s.webhookSender.Load(rc.Name)
+		loads[rc.Name] = load
+		inFlight += load.InFlight
+	}
+	deadLetters := s.deadLetterCounts()
+	total := 0
+	for _, n := range deadLetters {
+		total += n
+	}
+
+	writeJSON(w, map[string]interface{}{
+		"deliveries": map[string]interface{}{
+			"in_flight": inFlight,
+			"routes":    loads,
+		},
+		"dead_letters": map[string]interface{}{
+			"count":  total,
+			"routes": deadLetters,
+		},
+		"undecrypted_events": map[string]interface{}{
+			"enabled":       s.crypto != nil,
+			"length":        waiting,
+			"capacity":      maxUndecrypted,
+			"max_wait_secs": int(undecryptedTTL.Seconds()),
+		},
+	})
+}
+
+// handleDeliveries lists recorded delivery attempts, newest first.
+func (s *AppServer) handleDeliveries(w http.ResponseWriter, r *http.Request) {
+	filter, err := history.ParseFilter(r.URL.Query(), time.Now())
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "M_INVALID_PARAM", err.Error())
+		return
+	}
+	writeJSON(w, map[string]interface{}{
+		"deliveries": s.history.Query(filter),
+	})
+}
@@ -0,0 +1,427 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	configpkg "github.com/yamatt/matrix-as-webhook/internal/config"
+	"github.com/yamatt/matrix-as-webhook/internal/history"
+	"github.com/yamatt/matrix-as-webhook/internal/webhook"
+	"gopkg.in/yaml.v3"
+)
+
+// adminRequest sends an admin API request with the test token and decodes
+// the JSON response into out, if given.
+func adminRequest(t *testing.T, srv *AppServer, method, path, body string, out interface{}) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer admin-secret")
+	w := httptest.NewRecorder()
+	srv.Router().ServeHTTP(w, req)
+	if out != nil {
+		if err := json.Unmarshal(w.Body.Bytes(), out); err != nil {
+			t.Fatalf("Expected JSON from %s %s, got %d: %s", method, path, w.Code, w.Body.String())
+		}
+	}
+	return w
+}
+
+func TestAdminDeliveries(t *testing.T) {
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.URL.Path, "broken") {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			_, _ = w.Write([]byte("try later"))
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer testServer.Close()
+
+	cfg := &configpkg.Config{
+		Egress: loopbackEgress,
+		Admin:  configpkg.AdminConfig{Token: "admin-secret"},
+		Routes: []configpkg.RouteConfig{
+			{Name: "ok", Selector: "true", WebhookURL: testServer.URL + "/ok?token=hidden"},
+			{Name: "broken", Selector: "true", WebhookURL: testServer.URL + "/broken"},
+		},
+	}
+	srv := NewAppServer(cfg)
+	srv.processEvent(context.Background(), MatrixEvent{
+		Type: "m.room.message", EventID: "$delivered", RoomID: "!room:example.org",
+		Sender: "@alice:example.org", Content: map[string]interface{}{"body": "hi"},
+	})
+
+	query := func(token, params string) (*httptest.ResponseRecorder, []history.Record) {
+		req := httptest.NewRequest("GET", "/admin/v1/deliveries?"+params, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		srv.Router().ServeHTTP(w, req)
+		var body struct {
+			Deliveries []history.Record `json:"deliveries"`
+		}
+		_ = json.Unmarshal(w.Body.Bytes(), &body)
+		return w, body.Deliveries
+	}
+
+	if w, _ := query("", ""); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 without a token, got %d", w.Code)
+	}
+	if w, _ := query("wrong", ""); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 with a wrong token, got %d", w.Code)
+	}
+
+	w, all := query("admin-secret", "event_id=$delivered")
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	if len(all) != 2 {
+		t.Fatalf("Expected 2 deliveries, got %d", len(all))
+	}
+
+	_, failed := query("admin-secret", "status=5xx")
+	if len(failed) != 1 || failed[0].Route != "broken" || failed[0].Status != 503 || failed[0].Response != "try later" || failed[0].Success {
+		t.Errorf("Expected the failed delivery to broken, got %+v", failed)
+	}
+	_, ok := query("admin-secret", "route=ok&status=success")
+	if len(ok) != 1 || strings.Contains(ok[0].URL, "hidden") || ok[0].Attempt != 1 {
+		t.Errorf("Expected one successful delivery with a redacted URL, got %+v", ok)
+	}
+
+	if w, _ := query("admin-secret", "since=yesterday"); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for an invalid since, got %d", w.Code)
+	}
+}
+
+func TestAdminDisabledWithoutToken(t *testing.T) {
+	srv := NewAppServer(&configpkg.Config{})
+	w := httptest.NewRecorder()
+	srv.Router().ServeHTTP(w, httptest.NewRequest("GET", "/admin/v1/deliveries", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 without an admin token, got %d", w.Code)
+	}
+}
+
+func TestAdminPauseResume(t *testing.T) {
+	var hits int
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits++
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer testServer.Close()
+
+	cfg := &configpkg.Config{
+		Egress: loopbackEgress,
+		Admin:  configpkg.AdminConfig{Token: "admin-secret"},
+		Routes: []configpkg.RouteConfig{{Name: "ci", Selector: "true", WebhookURL: testServer.URL + "/?key=hidden"}},
+	}
+	srv := NewAppServer(cfg)
+	event := MatrixEvent{Type: "m.room.message", EventID: "$e", RoomID: "!room:example.org", Content: map[string]interface{}{"body": "hi"}}
+
+	var paused routeView
+	if w := adminRequest(t, srv, "POST", "/admin/v1/routes/ci/pause", "", &paused); w.Code != http.StatusOK || !paused.Paused {
+		t.Fatalf("Expected the route to be paused, got %d: %+v", w.Code, paused)
+	}
+	srv.processEvent(context.Background(), event)
+	if hits != 0 {
+		t.Errorf("Expected no webhook while paused, got %d", hits)
+	}
+
+	adminRequest(t, srv, "POST", "/admin/v1/routes/ci/resume", "", nil)
+	srv.processEvent(context.Background(), event)
+	if hits != 1 {
+		t.Errorf("Expected 1 webhook after resuming, got %d", hits)
+	}
+
+	var list struct {
+		Routes []routeView `json:"routes"`
+	}
+	adminRequest(t, srv, "GET", "/admin/v1/routes", "", &list)
+	if len(list.Routes) != 1 {
+		t.Fatalf("Expected 1 route, got %+v", list.Routes)
+	}
+	route := list.Routes[0]
+	if route.Paused || route.Stats.Successes != 1 || route.Stats.SkippedPaused != 1 || route.Stats.LastStatus != 200 {
+		t.Errorf("Expected 1 success and 1 skipped event, got %+v", route)
+	}
+	if strings.Contains(route.WebhookURL, "hidden") {
+		t.Errorf("Expected the webhook URL to be redacted, got %s", route.WebhookURL)
+	}
+
+	if w := adminRequest(t, srv, "POST", "/admin/v1/routes/missing/pause", "", nil); w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for an unknown route, got %d", w.Code)
+	}
+}
+
+func TestAdminDryRun(t *testing.T) {
+	var hits int
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits++
+	}))
+	defer testServer.Close()
+
+	cfg := &configpkg.Config{
+		Egress: loopbackEgress,
+		Admin:  configpkg.AdminConfig{Token: "admin-secret"},
+		Routes: []configpkg.RouteConfig{
+			{Name: "ops-only", Selector: "true", WebhookURL: testServer.URL,
+				Access: configpkg.AccessConfig{AllowRooms: []string{"!ops:example.org"}}},
+			{Name: "deploys", Selector: "event.content.body.contains('deploy')", WebhookURL: testServer.URL},
+			{Name: "other", Selector: "event.content.body.contains('other')", WebhookURL: testServer.URL},
+		},
+	}
+	srv := NewAppServer(cfg)
+
+	body := `{"event": {"type": "m.room.message", "event_id": "$e", "room_id": "!room:example.org",
+		"sender": "@alice:example.org", "content": {"body": "deploy done"}}}`
+	var result struct {
+		Routes []TestRoute `json:"routes"`
+	}
+	if w := adminRequest(t, srv, "POST", "/admin/v1/test", body, &result); w.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	if hits != 0 {
+		t.Errorf("Expected no webhook in a dry run, got %d", hits)
+	}
+	if len(result.Routes) != 3 {
+		t.Fatalf("Expected 3 routes, got %+v", result.Routes)
+	}
+	if r := result.Routes[0]; r.Outcome != "filtered" || r.Reason != "room_not_allowed" {
+		t.Errorf("Expected ops-only to be filtered by its access policy, got %+v", r)
+	}
+	if r := result.Routes[1]; r.Outcome != "matched" || r.Payload["message"] != "deploy done" {
+		t.Errorf("Expected deploys to match with a payload, got %+v", r)
+	}
+	if r := result.Routes[2]; r.Outcome != "not_matched" {
+		t.Errorf("Expected other not to match, got %+v", r)
+	}
+	if denied := srv.current().access.Denied(); len(denied) != 0 {
+		t.Errorf("Expected dry runs not to count denials, got %v", denied)
+	}
+
+	var skipped map[string]interface{}
+	adminRequest(t, srv, "POST", "/admin/v1/test", `{"event": {"type": "m.reaction"}}`, &skipped)
+	if skipped["skipped"] == nil {
+		t.Errorf("Expected reactions to be skipped, got %v", skipped)
+	}
+}
+
+func TestAdminReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.toml")
+	write := func(content string) {
+		if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatalf("WriteFile failed: %v", err)
+		}
+	}
+	write(`
+[[routes]]
+name = "first"
+selector = "true"
+webhook_url = "http://example.org/first"
+`)
+	cfg, err := configpkg.Load(path)
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	cfg.Admin.Token = "admin-secret"
+	srv := NewAppServer(cfg)
+
+	if w := adminRequest(t, srv, "POST", "/admin/v1/reload", "", nil); w.Code != http.StatusConflict {
+		t.Errorf("Expected 409 without a config path, got %d", w.Code)
+	}
+	srv.SetConfigPath(path)
+
+	write(`
+[[routes]]
+name = "first"
+selector = "true"
+webhook_url = "http://example.org/first"
+
+[[routes]]
+name = "second"
+selector = "event.type == 'm.room.message'"
+webhook_url = "http://example.org/second"
+`)
+	var counts map[string]int
+	if w := adminRequest(t, srv, "POST", "/admin/v1/reload", "", &counts); w.Code != http.StatusOK || counts["routes"] != 2 {
+		t.Fatalf("Expected 2 routes after reloading, got %d: %v", w.Code, counts)
+	}
+
+	write(`
+[[routes]]
+name = "broken"
+selector = "event.type =="
+webhook_url = "http://example.org/broken"
+`)
+	if w := adminRequest(t, srv, "POST", "/admin/v1/reload", "", nil); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for an invalid selector, got %d", w.Code)
+	}
+	if n := len(srv.current().config.Routes); n != 2 {
+		t.Errorf("Expected a failed reload to keep the 2 routes, got %d", n)
+	}
+	if srv.current().config.Admin.Token != "admin-secret" {
+		t.Error("Expected settings other than routes, hooks and access to be kept")
+	}
+
+	write(`
+[[hooks]]
+id = "open"
+room_id = "!ci:example.org"
+`)
+	if w := adminRequest(t, srv, "POST", "/admin/v1/reload", "", nil); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for a hook without authentication, got %d", w.Code)
+	}
+	if n := len(srv.current().config.Routes); n != 2 {
+		t.Errorf("Expected a failed reload to keep the 2 routes, got %d", n)
+	}
+
+	write(`
+[[hooks]]
+id = "open"
+room_id = "!ci:example.org"
+public = true
+`)
+	if w := adminRequest(t, srv, "POST", "/admin/v1/reload", "", &counts); w.Code != http.StatusOK || counts["hooks"] != 1 {
+		t.Fatalf("Expected 1 hook after reloading, got %d: %v", w.Code, counts)
+	}
+	if _, ok := srv.current().hooks["open"]; !ok {
+		t.Error("Expected the reloaded hook to be compiled")
+	}
+}
+
+func TestAdminQueues(t *testing.T) {
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer testServer.Close()
+
+	srv := NewAppServer(&configpkg.Config{
+		Egress: loopbackEgress,
+		Admin:  configpkg.AdminConfig{Token: "admin-secret"},
+		Routes: []configpkg.RouteConfig{{Name: "broken", Selector: "true", WebhookURL: testServer.URL}},
+	})
+	for _, id := range []string{"$one", "$two"} {
+		srv.processEvent(context.Background(), MatrixEvent{
+			Type: "m.room.message", EventID: id, RoomID: "!room:example.org",
+			Sender: "@alice:example.org", Content: map[string]interface{}{"body": "hi"},
+		})
+	}
+
+	var queues struct {
+		Deliveries struct {
+			InFlight int                     `json:"in_flight"`
+			Routes   map[string]webhook.Load `json:"routes"`
+		} `json:"deliveries"`
+		DeadLetters struct {
+			Count  int            `json:"count"`
+			Routes map[string]int `json:"routes"`
+		} `json:"dead_letters"`
+		Undecrypted map[string]interface{} `json:"undecrypted_events"`
+	}
+	adminRequest(t, srv, "GET", "/admin/v1/queues", "", &queues)
+	if _, ok := queues.Deliveries.Routes["broken"]; !ok || queues.Deliveries.InFlight != 0 {
+		t.Errorf("Expected the broken route with nothing in flight, got %+v", queues.Deliveries)
+	}
+	if queues.DeadLetters.Count != 2 || queues.DeadLetters.Routes["broken"] != 2 {
+		t.Errorf("Expected 2 dead letters for broken, got %+v", queues.DeadLetters)
+	}
+	if queues.Undecrypted["enabled"] != false || queues.Undecrypted["capacity"] != float64(maxUndecrypted) {
+		t.Errorf("Expected the undecrypted event queue, got %v", queues.Undecrypted)
+	}
+
+	var routes struct {
+		Routes []routeView `json:"routes"`
+	}
+	adminRequest(t, srv, "GET", "/admin/v1/routes", "", &routes)
+	if len(routes.Routes) != 1 || routes.Routes[0].Stats.DeadLetters != 2 || routes.Routes[0].Stats.LastStatus != http.StatusBadGateway {
+		t.Errorf("Expected the route's dead letters in its stats, got %+v", routes.Routes)
+	}
+}
+
+// TestOpenAPICoversAdminRoutes keeps the OpenAPI description in step with
+// the registered admin routes.
+func TestOpenAPICoversAdminRoutes(t *testing.T) {
+	var doc struct {
+		Paths map[string]map[string]interface{} `yaml:"paths"`
+	}
+	if err := yaml.Unmarshal(openAPI, &doc); err != nil {
+		t.Fatalf("Expected valid YAML, got %v", err)
+	}
+
+	srv := NewAppServer(&configpkg.Config{Admin: configpkg.AdminConfig{Token: "admin-secret"}})
+	registered := 0
+	err := srv.Router().(*mux.Router).Walk(func(route *mux.Route, _ *mux.Router, _ []*mux.Route) error {
+		path, err := route.GetPathTemplate()
+		if err != nil || !strings.HasPrefix(path, "/admin/v1/") {
+			return nil
+		}
+		methods, err := route.GetMethods()
+		if err != nil {
+			return nil
+		}
+		registered++
+		ops, ok := doc.Paths[strings.TrimPrefix(path, "/admin/v1")]
+		if !ok {
+			t.Errorf("Expected %s in the OpenAPI description", path)
+			return nil
+		}
+		for _, m := range methods {
+			if _, ok := ops[strings.ToLower(m)]; !ok {
+				t.Errorf("Expected %s %s in the OpenAPI description", m, path)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Walk failed: %v", err)
+	}
+	if registered != len(doc.Paths) {
+		t.Errorf("Expected %d admin routes, got %d", len(doc.Paths), registered)
+	}
+
+	w := adminRequest(t, srv, "GET", "/admin/v1/openapi.yaml", "", nil)
+	if w.Code != http.StatusOK || !strings.HasPrefix(w.Body.String(), "openapi:") {
+		t.Errorf("Expected the OpenAPI document, got %d", w.Code)
+	}
+}
+
+func TestSeparateListeners(t *testing.T) {
+	cfg := &configpkg.Config{
+		Admin: configpkg.AdminConfig{Token: "admin-secret"},
+		Server: configpkg.ServerConfig{
+			Admin:   configpkg.ListenerConfig{Listen: "127.0.0.1:9001"},
+			Metrics: configpkg.ListenerConfig{Listen: "127.0.0.1:9002"},
+		},
+	}
+	srv := NewAppServer(cfg)
+
+	get := func(h http.Handler, path string) int {
+		req := httptest.NewRequest("GET", path, nil)
+		req.Header.Set("Authorization", "Bearer admin-secret")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w.Code
+	}
+	for _, path := range []string{"/admin/v1/routes", "/metrics"} {
+		if code := get(srv.Router(), path); code != http.StatusNotFound {
+			t.Errorf("Expected %s to be left off the main listener, got %d", path, code)
+		}
+	}
+	if code := get(srv.AdminRouter(), "/admin/v1/routes"); code != http.StatusOK {
+		t.Errorf("Expected the admin API on the admin listener, got %d", code)
+	}
+	if code := get(srv.MetricsRouter(), "/metrics"); code != http.StatusOK {
+		t.Errorf("Expected metrics on the metrics listener, got %d", code)
+	}
+	if code := get(srv.Router(), "/livez"); code != http.StatusOK {
+		t.Errorf("Expected probes to stay on the main listener, got %d", code)
+	}
+}
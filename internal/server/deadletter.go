@@ -0,0 +1,133 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/yamatt/matrix-as-webhook/internal/config"
+	"github.com/yamatt/matrix-as-webhook/internal/history"
+	"github.com/yamatt/matrix-as-webhook/internal/logging"
+	"github.com/yamatt/matrix-as-webhook/internal/router"
+)
+
+// ReplayResult is the outcome of sending a dead letter again.
+type ReplayResult struct {
+	EventID string `json:"event_id"`
+	RoomID  string `json:"room_id"`
+	Route   string `json:"route"`
+	// Attempt is the number of the new attempt, or of the failed one if the
+	// event was not sent again
+	Attempt int    `json:"attempt"`
+	Sent    bool   `json:"sent"`
+	Status  int    `json:"status,omitempty"`
+	Success bool   `json:"success"`
+	Error   string `json:"error,omitempty"`
+}
+
+// handleDeadLetters lists the events whose last delivery to a route failed.
+func (s *AppServer) handleDeadLetters(w http.ResponseWriter, r *http.Request) {
+	filter, err := history.ParseFilter(r.URL.Query(), time.Now())
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "M_INVALID_PARAM", err.Error())
+		return
+	}
+	writeJSON(w, map[string]interface{}{
+		"deadletters": s.history.DeadLetters(filter),
+	})
+}
+
+// handleReplay sends the selected dead letters again.
+func (s *AppServer) handleReplay(w http.ResponseWriter, r *http.Request) {
+	filter, err := history.ParseFilter(r.URL.Query(), time.Now())
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "M_INVALID_PARAM", err.Error())
+		return
+	}
+	writeJSON(w, map[string]interface{}{
+		"replayed": s.Replay(r.Context(), filter),
+	})
+}
+
+// Replay sends the dead letters selected by f to their routes again. The
+// history keeps no payloads, so each event is fetched from the homeserver
+// and decrypted if needed. The route's selector is not evaluated again, but
+// paused routes and routes the access policy now denies are skipped.
+func (s *AppServer) Replay(ctx context.Context, f history.Filter) []ReplayResult {
+	live := s.current()
+	events := make(map[string]routedEvent)
+	results := []ReplayResult{}
+	for _, rec := range s.history.DeadLetters(f) {
+		ctx := logging.With(ctx, logging.KeyEventID, rec.EventID, logging.KeyRoomID, rec.RoomID, logging.KeyRoute, rec.Route)
+		result, err := s.replay(ctx, live, rec, events)
+		if err != nil {
+			result = ReplayResult{Attempt: rec.Attempt, Error: err.Error()}
+		}
+		result.EventID, result.RoomID, result.Route = rec.EventID, rec.RoomID, rec.Route
+		results = append(results, result)
+	}
+	slog.Info("replayed dead letters", "count", len(results))
+	return results
+}
+
+// replay sends one dead letter again. events holds the events already
+// fetched, by ID. An error means the event was not sent.
+func (s *AppServer) replay(ctx context.Context, live *liveConfig, rec history.Record, events map[string]routedEvent) (ReplayResult, error) {
+	index := slices.IndexFunc(live.config.Routes, func(rc config.RouteConfig) bool { return rc.Name == rec.Route })
+	if index < 0 {
+		return ReplayResult{}, errors.New("the route is no longer configured")
+	}
+	if s.routes.isPaused(rec.Route) {
+		return ReplayResult{}, errors.New("the route is paused")
+	}
+	event, ok := events[rec.EventID]
+	if !ok {
+		var err error
+		if event, err = s.fetchEvent(ctx, rec.RoomID, rec.EventID); err != nil {
+			return ReplayResult{}, fmt.Errorf("fetching event: %w", err)
+		}
+		events[rec.EventID] = event
+	}
+	if err := live.access.Check(ctx, event.RoomID, event.Sender); err != nil {
+		return ReplayResult{}, fmt.Errorf("denied: %s", accessReason(err))
+	}
+	if err := live.access.CheckRoute(ctx, index, rec.Route, event.RoomID, event.Sender); err != nil {
+		return ReplayResult{}, fmt.Errorf("denied: %s", accessReason(err))
+	}
+
+	result := ReplayResult{Attempt: rec.Attempt + 1, Sent: true}
+	logging.FromContext(ctx).Info("replaying delivery", logging.KeyAttempt, result.Attempt)
+	resp := s.deliver(ctx, event, router.NewTarget(live.config.Routes[index]), result.Attempt)
+	result.Status = resp.StatusCode
+	result.Success = resp.Error == nil && resp.StatusCode >= 200 && resp.StatusCode < 300
+	if resp.Error != nil {
+		result.Error = resp.Error.Error()
+	}
+	return result, nil
+}
+
+// fetchEvent gets an event from the homeserver, decrypting it if it is
+// encrypted, and adds its context when enrichment is enabled.
+func (s *AppServer) fetchEvent(ctx context.Context, roomID, eventID string) (routedEvent, error) {
+	var event MatrixEvent
+	if err := s.matrixClient.GetEvent(ctx, roomID, eventID, &event); err != nil {
+		return routedEvent{}, err
+	}
+	if event.Type == "m.room.encrypted" && s.crypto != nil {
+		decrypted, err := s.decryptEvent(event)
+		if err != nil {
+			return routedEvent{}, err
+		}
+		event = decrypted
+	}
+	routed := routedEvent{MatrixEvent: event}
+	if s.enricher != nil {
+		eventCtx := s.enricher.Enrich(ctx, event.RoomID, event.Sender)
+		routed.Context = &eventCtx
+	}
+	return routed, nil
+}
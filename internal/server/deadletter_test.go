@@ -0,0 +1,98 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	configpkg "github.com/yamatt/matrix-as-webhook/internal/config"
+	"github.com/yamatt/matrix-as-webhook/internal/history"
+)
+
+func TestAdminDeadLetterReplay(t *testing.T) {
+	var failing atomic.Bool
+	failing.Store(true)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.URL.Path, "flaky") && failing.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer receiver.Close()
+
+	event := MatrixEvent{
+		Type: "m.room.message", EventID: "$ev", RoomID: "!room:example.org",
+		Sender: "@alice:example.org", Content: map[string]interface{}{"body": "hi"},
+	}
+	var fetched atomic.Int32
+	hs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.EscapedPath() != "/_matrix/client/v3/rooms/%21room:example.org/event/$ev" {
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte(`{"errcode":"M_NOT_FOUND","error":"Event not found"}`))
+			return
+		}
+		fetched.Add(1)
+		_ = json.NewEncoder(w).Encode(event)
+	}))
+	defer hs.Close()
+
+	cfg := &configpkg.Config{
+		Homeserver: configpkg.HomeserverConfig{URL: hs.URL},
+		Egress:     loopbackEgress,
+		Admin:      configpkg.AdminConfig{Token: "admin-secret"},
+		Routes: []configpkg.RouteConfig{
+			{Name: "ok", Selector: "true", WebhookURL: receiver.URL + "/ok"},
+			{Name: "flaky", Selector: "true", WebhookURL: receiver.URL + "/flaky"},
+			{Name: "paused", Selector: "true", WebhookURL: receiver.URL + "/flaky"},
+		},
+	}
+	srv := NewAppServer(cfg)
+	srv.processEvent(context.Background(), event)
+	srv.routes.setPaused("paused", true)
+
+	var listed struct {
+		DeadLetters []history.Record `json:"deadletters"`
+	}
+	adminRequest(t, srv, "GET", "/admin/v1/deadletters", "", &listed)
+	if len(listed.DeadLetters) != 2 || listed.DeadLetters[0].Route != "paused" || listed.DeadLetters[1].Route != "flaky" {
+		t.Fatalf("Expected dead letters for paused and flaky, got %+v", listed.DeadLetters)
+	}
+
+	failing.Store(false)
+	var replayed struct {
+		Replayed []ReplayResult `json:"replayed"`
+	}
+	if w := adminRequest(t, srv, "POST", "/admin/v1/deadletters/replay", "", &replayed); w.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	if len(replayed.Replayed) != 2 {
+		t.Fatalf("Expected 2 results, got %+v", replayed.Replayed)
+	}
+	if r := replayed.Replayed[0]; r.Sent || r.Attempt != 1 || r.Error != "the route is paused" {
+		t.Errorf("Expected the paused route to be skipped, got %+v", r)
+	}
+	if r := replayed.Replayed[1]; !r.Sent || !r.Success || r.Attempt != 2 || r.Status != http.StatusOK {
+		t.Errorf("Expected flaky to be delivered as attempt 2, got %+v", r)
+	}
+	if n := fetched.Load(); n != 1 {
+		t.Errorf("Expected the event to be fetched once, got %d", n)
+	}
+	w := httptest.NewRecorder()
+	srv.Router().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	if want := `as_webhook_delivery_retries_total{route="flaky"} 1`; !strings.Contains(w.Body.String(), want) {
+		t.Errorf("Expected metrics to contain %s", want)
+	}
+
+	adminRequest(t, srv, "GET", "/admin/v1/deadletters?route=flaky", "", &listed)
+	if len(listed.DeadLetters) != 0 {
+		t.Errorf("Expected no dead letters for flaky after the replay, got %+v", listed.DeadLetters)
+	}
+	if got := srv.history.Query(history.Filter{Route: "flaky", Status: "success"}); len(got) != 1 || got[0].Attempt != 2 {
+		t.Errorf("Expected the replay in the history as attempt 2, got %+v", got)
+	}
+}
@@ -0,0 +1,208 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/yamatt/matrix-as-webhook/internal/router"
+)
+
+// homeserverPingInterval is how often the homeserver is pinged for the
+// readiness check.
+const homeserverPingInterval = 30 * time.Second
+
+// States of a readiness check. A failing check makes the server unready;
+// a warning is reported but does not.
+const (
+	checkOK   = "ok"
+	checkWarn = "warn"
+	checkFail = "fail"
+)
+
+// check is the result of one readiness check.
+type check struct {
+	Status  string `json:"status"`
+	Message string `json:"message,omitempty"`
+}
+
+// pingState is the result of the last homeserver ping.
+type pingState struct {
+	mu   sync.Mutex
+	at   time.Time
+	err  error
+	done bool
+}
+
+func (p *pingState) set(at time.Time, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.at, p.err, p.done = at, err, true
+}
+
+func (p *pingState) get() (at time.Time, done bool, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.at, p.done, p.err
+}
+
+// pingHomeserver pings the homeserver until ctx is done.
+func (s *AppServer) pingHomeserver(ctx context.Context) {
+	ticker := time.NewTicker(homeserverPingInterval)
+	defer ticker.Stop()
+	for {
+		s.ping(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// ping records whether the homeserver answers.
+func (s *AppServer) ping(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	err := s.matrixClient.Ping(ctx)
+	_, done, prev := s.lastPing.get()
+	switch {
+	case err != nil && (!done || prev == nil):
+		slog.Warn("homeserver is unreachable", "error", err)
+	case err == nil && prev != nil:
+		slog.Info("homeserver is reachable again")
+	}
+	s.lastPing.set(time.Now(), err)
+}
+
+// handleLivez reports that the process is serving requests. It does no
+// checks, so that a restart is not triggered by a dependency being down.
+func (s *AppServer) handleLivez(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, map[string]string{"status": "ok"})
+}
+
+// handleReadyz runs the readiness checks and answers 503 if any fails.
+func (s *AppServer) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	checks := s.readiness()
+	status := checkOK
+	for _, c := range checks {
+		switch c.Status {
+		case checkFail:
+			status = checkFail
+		case checkWarn:
+			if status == checkOK {
+				status = checkWarn
+			}
+		}
+	}
+
+	code := http.StatusOK
+	if status == checkFail {
+		code = http.StatusServiceUnavailable
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{"status": status, "checks": checks})
+}
+
+// readiness runs the readiness checks. None of them makes network requests.
+func (s *AppServer) readiness() map[string]check {
+	return map[string]check{
+		"shutdown":           s.checkShutdown(),
+		"config":             s.checkConfig(),
+		"selectors":          s.checkSelectors(),
+		"homeserver":         s.checkHomeserver(),
+		"undecrypted_events": s.checkUndecrypted(),
+		"history":            s.checkHistory(),
+		"security":           s.checkSecurity(),
+	}
+}
+
+func (s *AppServer) checkShutdown() check {
+	if s.draining.Load() {
+		return check{checkFail, fmt.Sprintf("shutting down; %d transactions in flight", s.InFlight())}
+	}
+	return check{checkOK, "serving"}
+}
+
+func (s *AppServer) checkConfig() check {
+	if s.configPath == "" {
+		return check{checkFail, "running on built-in defaults; no config file was loaded"}
+	}
+	if len(s.current().config.Routes) == 0 {
+		return check{checkWarn, fmt.Sprintf("loaded %s, but it has no routes", s.configPath)}
+	}
+	return check{checkOK, "loaded " + s.configPath}
+}
+
+func (s *AppServer) checkSelectors() check {
+	routes := s.current().config.Routes
+	var broken []string
+	for _, rc := range routes {
+		if err := router.CheckSelector(rc.Selector); err != nil {
+			broken = append(broken, rc.Name)
+		}
+	}
+	if len(broken) > 0 {
+		return check{checkFail, "selectors do not compile: " + strings.Join(broken, ", ")}
+	}
+	return check{checkOK, fmt.Sprintf("%d selectors compile", len(routes))}
+}
+
+func (s *AppServer) checkHomeserver() check {
+	at, done, err := s.lastPing.get()
+	switch {
+	case !done:
+		return check{checkWarn, "not pinged yet"}
+	case err != nil:
+		return check{checkFail, fmt.Sprintf("unreachable at %s: %v", at.Format(time.RFC3339), err)}
+	default:
+		return check{checkOK, "reachable at " + at.Format(time.RFC3339)}
+	}
+}
+
+func (s *AppServer) checkUndecrypted() check {
+	if s.crypto == nil {
+		return check{checkOK, "encryption disabled"}
+	}
+	s.undecryptedMu.Lock()
+	waiting := len(s.undecrypted)
+	s.undecryptedMu.Unlock()
+
+	// A full queue only drops the oldest events, so it is not a reason to
+	// take the server out of rotation
+	msg := fmt.Sprintf("%d of %d events waiting for room keys", waiting, maxUndecrypted)
+	if waiting*5 >= maxUndecrypted*4 {
+		return check{checkWarn, msg}
+	}
+	return check{checkOK, msg}
+}
+
+func (s *AppServer) checkHistory() check {
+	switch {
+	case s.history == nil:
+		return check{checkOK, "disabled"}
+	case s.history.Path() == "":
+		return check{checkOK, "in memory"}
+	}
+	if err := s.history.Err(); err != nil {
+		return check{checkFail, err.Error()}
+	}
+	return check{checkOK, "writing " + s.history.Path()}
+}
+
+func (s *AppServer) checkSecurity() check {
+	if !s.insecureDev {
+		return check{checkOK, "strict"}
+	}
+	msg := "insecure development mode"
+	if s.config.HSToken == "" {
+		msg += "; homeserver requests are not authenticated"
+	}
+	return check{checkWarn, msg}
+}
@@ -0,0 +1,155 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	configpkg "github.com/yamatt/matrix-as-webhook/internal/config"
+	"github.com/yamatt/matrix-as-webhook/internal/e2ee"
+)
+
+// readyz returns the status code and checks of GET /readyz.
+func readyz(t *testing.T, srv *AppServer) (int, string, map[string]check) {
+	t.Helper()
+	w := httptest.NewRecorder()
+	srv.Router().ServeHTTP(w, httptest.NewRequest("GET", "/readyz", nil))
+	var body struct {
+		Status string           `json:"status"`
+		Checks map[string]check `json:"checks"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatalf("Expected JSON, got %s", w.Body.String())
+	}
+	return w.Code, body.Status, body.Checks
+}
+
+func TestLivez(t *testing.T) {
+	srv := NewAppServer(&configpkg.Config{})
+	w := httptest.NewRecorder()
+	srv.Router().ServeHTTP(w, httptest.NewRequest("GET", "/livez", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected 200, got %d", w.Code)
+	}
+}
+
+func TestReadyz(t *testing.T) {
+	homeserver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"versions": []string{"v1.11"}})
+	}))
+	defer homeserver.Close()
+
+	cfg := &configpkg.Config{
+		Homeserver: configpkg.HomeserverConfig{URL: homeserver.URL},
+		History:    configpkg.HistoryConfig{Path: filepath.Join(t.TempDir(), "history.jsonl")},
+		Routes:     []configpkg.RouteConfig{{Name: "all", Selector: "true", WebhookURL: "http://example.org"}},
+	}
+	srv := NewAppServer(cfg)
+
+	// Running on defaults, not pinged yet and the history not opened
+	code, status, checks := readyz(t, srv)
+	if code != http.StatusServiceUnavailable || status != checkFail {
+		t.Errorf("Expected 503 when running on defaults, got %d %s", code, status)
+	}
+	if checks["config"].Status != checkFail || checks["homeserver"].Status != checkWarn {
+		t.Errorf("Expected config to fail and homeserver to warn, got %+v", checks)
+	}
+
+	srv.SetConfigPath("config.toml")
+	if err := srv.history.Load(); err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	srv.ping(context.Background())
+	code, status, checks = readyz(t, srv)
+	if code != http.StatusOK || status != checkOK {
+		t.Errorf("Expected 200 ok, got %d %s: %+v", code, status, checks)
+	}
+	for _, name := range []string{"config", "selectors", "homeserver", "undecrypted_events", "history"} {
+		if checks[name].Status != checkOK {
+			t.Errorf("Expected %s to be ok, got %+v", name, checks[name])
+		}
+	}
+
+	homeserver.Close()
+	srv.ping(context.Background())
+	if code, _, checks = readyz(t, srv); code != http.StatusServiceUnavailable || checks["homeserver"].Status != checkFail {
+		t.Errorf("Expected 503 with the homeserver down, got %d: %+v", code, checks["homeserver"])
+	}
+}
+
+func TestReadyzBrokenSelector(t *testing.T) {
+	srv := NewAppServer(&configpkg.Config{Routes: []configpkg.RouteConfig{
+		{Name: "good", Selector: "true"},
+		{Name: "bad", Selector: "event.type =="},
+	}})
+	_, _, checks := readyz(t, srv)
+	if c := checks["selectors"]; c.Status != checkFail || !strings.Contains(c.Message, "bad") || strings.Contains(c.Message, "good") {
+		t.Errorf("Expected the bad selector to be reported, got %+v", c)
+	}
+}
+
+func TestReadyzInsecureDev(t *testing.T) {
+	srv := NewAppServer(&configpkg.Config{})
+	srv.SetInsecureDev(true)
+	_, _, checks := readyz(t, srv)
+	if c := checks["security"]; c.Status != checkWarn || !strings.Contains(c.Message, "not authenticated") {
+		t.Errorf("Expected a warning about insecure development mode, got %+v", c)
+	}
+}
+
+func TestShutdownRefusesTransactions(t *testing.T) {
+	cfg, _ := configpkg.NewDefault()
+	cfg.ASToken = testASToken
+	cfg.HSToken = testHSToken
+	srv := NewAppServer(cfg)
+	srv.BeginShutdown()
+
+	w := httptest.NewRecorder()
+	srv.Router().ServeHTTP(w, asRequest("PUT", "/_matrix/app/v1/transactions/late", strings.NewReader(`{"events":[]}`)))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected status 503 while shutting down, got %d", w.Code)
+	}
+	if n := srv.InFlight(); n != 0 {
+		t.Errorf("Expected a refused transaction not to stay in flight, got %d", n)
+	}
+
+	code, _, checks := readyz(t, srv)
+	if code != http.StatusServiceUnavailable || checks["shutdown"].Status != checkFail {
+		t.Errorf("Expected the shutdown check to fail, got %d %+v", code, checks["shutdown"])
+	}
+}
+
+func TestReadyzUndecryptedQueue(t *testing.T) {
+	cfg, _ := configpkg.NewDefault()
+	srv := NewAppServer(cfg)
+	srv.SetConfigPath("config.toml")
+	srv.crypto = e2ee.NewMachine(nil, nil, "@webhook:domain.com", "webhook", "")
+	for i := 0; i < maxUndecrypted; i++ {
+		srv.queueUndecrypted(MatrixEvent{EventID: fmt.Sprintf("$%d", i)})
+	}
+
+	// A full queue warns without making the server unready
+	_, _, checks := readyz(t, srv)
+	if c := checks["undecrypted_events"]; c.Status != checkWarn {
+		t.Errorf("Expected a full queue to warn, got %+v", c)
+	}
+
+	// Events that waited too long are dropped without a transaction
+	srv.expireUndecrypted(time.Now().Add(undecryptedTTL - time.Second))
+	if n := len(srv.undecrypted); n != maxUndecrypted {
+		t.Errorf("Expected no events dropped before they expire, %d left", n)
+	}
+	srv.expireUndecrypted(time.Now().Add(undecryptedTTL + time.Second))
+	if n := len(srv.undecrypted); n != 0 {
+		t.Errorf("Expected expired events to be dropped, %d left", n)
+	}
+	if _, _, checks = readyz(t, srv); checks["undecrypted_events"].Status != checkOK {
+		t.Errorf("Expected an empty queue to be ok, got %+v", checks["undecrypted_events"])
+	}
+}
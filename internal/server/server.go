@@ -1,64 +1,272 @@
 package server
 
 import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
+	"mime"
 	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/mux"
+	"github.com/yamatt/matrix-as-webhook/internal/access"
 	"github.com/yamatt/matrix-as-webhook/internal/config"
+	"github.com/yamatt/matrix-as-webhook/internal/e2ee"
+	"github.com/yamatt/matrix-as-webhook/internal/enrich"
+	"github.com/yamatt/matrix-as-webhook/internal/ghost"
+	"github.com/yamatt/matrix-as-webhook/internal/history"
+	"github.com/yamatt/matrix-as-webhook/internal/inbound"
+	"github.com/yamatt/matrix-as-webhook/internal/logging"
+	"github.com/yamatt/matrix-as-webhook/internal/matrix"
+	"github.com/yamatt/matrix-as-webhook/internal/media"
+	"github.com/yamatt/matrix-as-webhook/internal/metrics"
+	"github.com/yamatt/matrix-as-webhook/internal/rooms"
 	"github.com/yamatt/matrix-as-webhook/internal/router"
+	"github.com/yamatt/matrix-as-webhook/internal/signing"
+	"github.com/yamatt/matrix-as-webhook/internal/tracing"
 	"github.com/yamatt/matrix-as-webhook/internal/webhook"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // AppServer represents the Matrix Application Server.
 type AppServer struct {
 	config        *config.Config
 	webhookSender *webhook.Sender
+	matrixClient  *matrix.Client
+	ghosts        *ghost.Manager
+	rooms         *rooms.Provisioner
+	hookTracker   *inbound.Tracker
+	live          atomic.Pointer[liveConfig]
+	routes        *routeControl
+	configPath    string // the file the configuration was loaded from
+	lastPing      pingState
+	insecureDev   bool             // run without a config file or AS token
+	draining      atomic.Bool      // refusing transactions during shutdown
+	inFlight      atomic.Int64     // transactions being handled
+	history       *history.Store   // nil if the history is disabled
+	enricher      *enrich.Enricher // nil unless enrichment is enabled
+	mediaSigner   *media.Signer
+	media         *media.Forwarder
+	crypto        *e2ee.Machine    // nil unless encryption is enabled
+	signingKeys   *signing.Keyring // nil unless [signing] keys are configured
+	hooksErr      error            // why hooks in the initial config did not compile
+	mediaKeyErr   error            // why no media signing key could be generated
+
+	// undecrypted holds encrypted events whose room key has not arrived yet,
+	// keyed by event ID. They are kept in undecryptedStore over a restart.
+	undecryptedMu    sync.Mutex
+	undecrypted      map[string]pendingEvent
+	undecryptedStore *e2ee.Store
+
+	encryptedRoomsMu sync.Mutex
+	encryptedRooms   map[string]bool
+}
+
+// liveConfig holds the routes, hooks and access policies, which a reload
+// replaces while requests are being handled.
+type liveConfig struct {
+	config   *config.Config
+	access   *access.Policy
+	hooks    map[string]*inbound.Hook // compiled hooks by ID
+	resolver *router.Resolver         // nil if a selector does not compile
+	// routesErr is why the selectors did not compile
+	routesErr error
+}
+
+// current returns the routes, hooks and access policies in use.
+func (s *AppServer) current() *liveConfig {
+	return s.live.Load()
+}
+
+// pendingEvent is an encrypted event waiting for its room key.
+type pendingEvent struct {
+	event    MatrixEvent
+	received time.Time
+}
+
+// savedEvent is a pendingEvent as kept in the file over a restart.
+type savedEvent struct {
+	Event    MatrixEvent `json:"event"`
+	Received time.Time   `json:"received"`
 }
 
+const (
+	// undecryptedTTL is how long an event waits for its room key.
+	undecryptedTTL = 10 * time.Minute
+	// maxUndecrypted bounds the number of events waiting for room keys.
+	maxUndecrypted = 100
+	// undecryptedSweepInterval is how often events that waited too long are
+	// dropped when no transactions arrive to retry them.
+	undecryptedSweepInterval = time.Minute
+)
+
 // NewAppServer creates a new application server instance.
 func NewAppServer(cfg *config.Config) *AppServer {
-	return &AppServer{
-		config:        cfg,
-		webhookSender: webhook.NewSender(30 * time.Second),
+	matrixClient := matrix.NewClient(cfg.Homeserver.URL, cfg.ASToken.Value(), 30*time.Second)
+	s := &AppServer{
+		config:         cfg,
+		webhookSender:  webhook.NewSender(30 * time.Second),
+		matrixClient:   matrixClient,
+		ghosts:         ghost.NewManager(matrixClient, cfg),
+		rooms:          rooms.NewProvisioner(matrixClient, cfg),
+		hookTracker:    inbound.NewTracker(),
+		routes:         newRouteControl(),
+		history:        history.New(cfg.History),
+		undecrypted:    make(map[string]pendingEvent),
+		encryptedRooms: make(map[string]bool),
+	}
+	// Start refuses to run with hooks that do not compile
+	hooks, hooksErr := inbound.Compile(cfg.Hooks)
+	s.hooksErr = hooksErr
+	// While a selector does not compile, resolving an event returns why
+	resolver, routesErr := router.NewResolver(cfg)
+	s.live.Store(&liveConfig{
+		config:    cfg,
+		access:    access.NewPolicy(cfg, matrixClient),
+		hooks:     hooks,
+		resolver:  resolver,
+		routesErr: routesErr,
+	})
+	s.webhookSender.SetEgressPolicy(webhook.NewEgressPolicy(cfg.Egress))
+	if cfg.Enrichment.Enabled {
+		s.enricher = enrich.NewEnricher(matrixClient, cfg.Enrichment.TTL)
 	}
+	// Start refuses to run without a media signing key
+	mediaKey, mediaKeyErr := mediaSigningKey(cfg.Media.SigningKey.Value())
+	s.mediaKeyErr = mediaKeyErr
+	s.mediaSigner = media.NewSigner(mediaKey)
+	s.media = media.NewForwarder(matrixClient, s.mediaSigner, cfg.Media.PublicURL, cfg.Media.ProxyTTL)
+	if cfg.Encryption.Enabled {
+		store := e2ee.NewStore(cfg.Encryption.StorePath, cfg.Encryption.PickleKey.Value())
+		botID := matrix.UserID(cfg.Homeserver.SenderLocalpart, cfg.Homeserver.Domain)
+		s.crypto = e2ee.NewMachine(matrixClient, store, botID, cfg.Homeserver.SenderLocalpart, cfg.Encryption.DeviceDisplayName)
+		s.undecryptedStore = store.Pending()
+	}
+	return s
+}
+
+// SetInsecureDev lets homeserver requests through without an AS token and
+// makes the readiness check warn about it. It is meant for local testing only.
+func (s *AppServer) SetInsecureDev(enabled bool) {
+	s.insecureDev = enabled
 }
 
-// validateASToken is middleware that validates the AS token from query parameter.
-func (s *AppServer) validateASToken(next http.Handler) http.Handler {
+// BeginShutdown makes the server refuse new transactions with 503, so that
+// the homeserver retries them after the restart, and fail the readiness
+// check. Transactions already being handled carry on.
+func (s *AppServer) BeginShutdown() {
+	s.draining.Store(true)
+}
+
+// InFlight returns the number of transactions being handled.
+func (s *AppServer) InFlight() int64 {
+	return s.inFlight.Load()
+}
+
+// Close releases the files the server keeps open and saves the encrypted
+// events still waiting for room keys. Call it once the HTTP server has
+// stopped.
+func (s *AppServer) Close() error {
+	return errors.Join(s.history.Close(), s.saveUndecrypted())
+}
+
+// Start prepares components that need files or the homeserver before
+// requests are served: the delivery history, the request signing keys and,
+// with encryption enabled, the bot's device and keys. It also starts pinging
+// the homeserver for the readiness check until ctx is done.
+func (s *AppServer) Start(ctx context.Context) error {
+	if s.hooksErr != nil {
+		return fmt.Errorf("invalid hook: %w", s.hooksErr)
+	}
+	if s.mediaKeyErr != nil {
+		return s.mediaKeyErr
+	}
+	if err := s.history.Load(); err != nil {
+		return err
+	}
+	go s.pingHomeserver(ctx)
+
+	keys, err := signing.LoadKeyring(s.config.Signing)
+	if err != nil {
+		return err
+	}
+	if keys != nil {
+		s.signingKeys = keys
+		s.webhookSender.SetKeyring(keys)
+		slog.Info("signing requests", "key_id", keys.Active().ID)
+	}
+
+	if s.crypto == nil {
+		return nil
+	}
+	if err := s.crypto.Start(ctx); err != nil {
+		return err
+	}
+	if err := s.loadUndecrypted(time.Now()); err != nil {
+		return err
+	}
+	go s.sweepUndecrypted(ctx)
+	slog.Info("encryption enabled", "device_id", s.crypto.DeviceID())
+	return nil
+}
+
+// mediaSigningKey returns the configured proxy signing key, or a random one
+// so that proxy URLs stop working when the server restarts.
+func mediaSigningKey(configured string) ([]byte, error) {
+	if configured != "" {
+		return []byte(configured), nil
+	}
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, fmt.Errorf("generating the media signing key: %w", err)
+	}
+	return key, nil
+}
+
+// validateHSToken is middleware that checks homeserver requests carry the
+// registration's hs_token, in the Authorization header or, as older
+// homeservers send it, the access_token query parameter.
+func (s *AppServer) validateHSToken(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		// If no AS token is configured, skip validation
-		if s.config.ASToken == "" {
-			log.Printf("Warning: AS_TOKEN not set, skipping authentication")
+		// Without an HS token, requests are only let through in insecure
+		// development mode
+		if s.config.HSToken == "" {
+			if !s.insecureDev {
+				slog.Error("HS_TOKEN not set, rejecting homeserver request", "path", r.URL.Path)
+				writeError(w, http.StatusForbidden, "M_FORBIDDEN", "The application service has no HS token configured")
+				return
+			}
+			slog.Warn("HS_TOKEN not set, skipping authentication")
 			next.ServeHTTP(w, r)
 			return
 		}
 
-		// Check access_token in query parameters
-		token := r.URL.Query().Get("access_token")
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok {
+			token = r.URL.Query().Get("access_token")
+		}
 		if token == "" {
-			log.Printf("Access denied: missing access_token parameter")
-			w.Header().Set("Content-Type", "application/json")
-			w.WriteHeader(http.StatusForbidden)
-			_ = json.NewEncoder(w).Encode(map[string]string{
-				"errcode": "M_FORBIDDEN",
-				"error":   "Missing access_token",
-			})
+			slog.Warn("homeserver request without access token", "path", r.URL.Path)
+			writeError(w, http.StatusUnauthorized, "M_UNAUTHORIZED", "Missing access token")
 			return
 		}
-
-		if token != s.config.ASToken {
-			log.Printf("Access denied: invalid access_token")
-			w.Header().Set("Content-Type", "application/json")
-			w.WriteHeader(http.StatusForbidden)
-			_ = json.NewEncoder(w).Encode(map[string]string{
-				"errcode": "M_FORBIDDEN",
-				"error":   "Invalid access_token",
-			})
+		if subtle.ConstantTimeCompare([]byte(token), []byte(s.config.HSToken.Value())) != 1 {
+			slog.Warn("homeserver request with invalid access token", "path", r.URL.Path)
+			writeError(w, http.StatusForbidden, "M_FORBIDDEN", "Invalid access token")
 			return
 		}
 
@@ -67,20 +275,59 @@ func (s *AppServer) validateASToken(next http.Handler) http.Handler {
 	})
 }
 
-// Router sets up the HTTP routes for the application server.
+// Router sets up the HTTP routes for the application server. The admin API
+// and metrics are left out if they have their own listener; see AdminRouter
+// and MetricsRouter.
 func (s *AppServer) Router() http.Handler {
 	r := mux.NewRouter()
 
-	// Matrix API endpoints with AS token validation
+	// Matrix API endpoints, authenticated with the HS token
 	matrixAPI := r.PathPrefix("/_matrix/app/v1").Subrouter()
-	matrixAPI.Use(s.validateASToken)
+	matrixAPI.Use(s.validateHSToken)
 	matrixAPI.HandleFunc("/transactions/{txnId}", s.handleTransaction).Methods("PUT")
 	matrixAPI.HandleFunc("/rooms/{roomAlias}", s.handleRoom).Methods("GET")
 	matrixAPI.HandleFunc("/users/{userId}", s.handleUser).Methods("GET")
 
-	// Health check endpoint (no auth required)
+	// Signed media proxy for routes with media = "proxy"
+	r.HandleFunc("/media/{serverName}/{mediaId}", s.handleMedia).Methods("GET")
+
+	// Public keys for routes with signing = "http-signature" or "jws"
+	r.HandleFunc("/.well-known/jwks.json", s.handleJWKS).Methods("GET")
+
+	// Inbound webhooks (authenticated per hook)
+	r.HandleFunc("/hooks/{id}", s.handleHook).Methods("POST")
+
+	// Health check endpoints (no auth required)
 	r.HandleFunc("/health", s.handleHealth).Methods("GET")
+	r.HandleFunc("/livez", s.handleLivez).Methods("GET")
+	r.HandleFunc("/readyz", s.handleReadyz).Methods("GET")
+
+	// Prometheus metrics (no auth required)
+	if s.config.Server.Metrics.Listen == "" {
+		r.Handle("/metrics", metrics.Handler()).Methods("GET")
+	}
+
+	// Admin API (bearer token; only served when [admin] token is set)
+	if s.config.Server.Admin.Listen == "" {
+		s.adminRoutes(r)
+	}
+
+	return r
+}
 
+// AdminRouter serves the admin API on its own listener, with /livez so the
+// listener can be probed.
+func (s *AppServer) AdminRouter() http.Handler {
+	r := mux.NewRouter()
+	r.HandleFunc("/livez", s.handleLivez).Methods("GET")
+	s.adminRoutes(r)
+	return r
+}
+
+// MetricsRouter serves /metrics on its own listener.
+func (s *AppServer) MetricsRouter() http.Handler {
+	r := mux.NewRouter()
+	r.Handle("/metrics", metrics.Handler()).Methods("GET")
 	return r
 }
 
@@ -91,22 +338,56 @@ type MatrixEvent struct {
 	RoomID    string                 `json:"room_id"`
 	Sender    string                 `json:"sender"`
 	Timestamp int64                  `json:"origin_server_ts"`
+	StateKey  *string                `json:"state_key,omitempty"`
 	Content   map[string]interface{} `json:"content"`
+	Unsigned  map[string]interface{} `json:"unsigned,omitempty"`
 }
 
-// Transaction represents a Matrix transaction.
+// routedEvent is the view of an event given to route selectors: the event
+// itself plus, when enrichment is enabled, its room and sender context.
+type routedEvent struct {
+	MatrixEvent
+	Context *enrich.Context `json:"context,omitempty"`
+}
+
+// Transaction represents a Matrix transaction, including ephemeral events
+// and the to-device, device list and key count extensions used for encryption.
 type Transaction struct {
 	Events []MatrixEvent `json:"events"`
+	// Ephemeral carries receipts, typing and presence (MSC2409); older
+	// homeservers only send the unstable field.
+	Ephemeral         []MatrixEvent `json:"ephemeral,omitempty"`
+	UnstableEphemeral []MatrixEvent `json:"de.sorunome.msc2409.ephemeral,omitempty"`
+	e2ee.Extensions
 }
 
 func (s *AppServer) handleTransaction(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	txnID := vars["txnId"]
-	log.Printf("Received transaction: %s", txnID)
+
+	// Counted before draining is checked, so that a shutdown starting in
+	// between either sees this transaction in flight or makes it refused.
+	s.inFlight.Add(1)
+	defer s.inFlight.Add(-1)
+	if s.draining.Load() {
+		// Homeservers retry transactions that were not acknowledged, so the
+		// events are delivered after the restart instead of being cut off.
+		slog.Info("refusing transaction while shutting down", logging.KeyTxnID, txnID)
+		writeError(w, http.StatusServiceUnavailable, "M_UNKNOWN", "Shutting down")
+		return
+	}
+
+	// Deliveries are not aborted if the homeserver gives up on the request.
+	ctx := logging.With(context.WithoutCancel(r.Context()), logging.KeyTxnID, txnID)
+	logger := logging.FromContext(ctx)
+	ctx = otel.GetTextMapPropagator().Extract(ctx, propagation.HeaderCarrier(r.Header))
+	ctx, span := tracing.Tracer().Start(ctx, "transaction", trace.WithSpanKind(trace.SpanKindServer))
+	defer span.End()
+	span.SetAttributes(attribute.String("matrix.txn_id", txnID))
 
 	body, err := io.ReadAll(r.Body)
 	if err != nil {
-		log.Printf("Error reading request body: %v", err)
+		logger.Warn("error reading transaction", "error", err)
 		http.Error(w, "Error reading request body", http.StatusBadRequest)
 		return
 	}
@@ -114,14 +395,40 @@ func (s *AppServer) handleTransaction(w http.ResponseWriter, r *http.Request) {
 
 	var transaction Transaction
 	if err := json.Unmarshal(body, &transaction); err != nil {
-		log.Printf("Error parsing transaction: %v", err)
+		logger.Warn("error parsing transaction", "error", err)
 		http.Error(w, "Error parsing transaction", http.StatusBadRequest)
 		return
 	}
 
-	log.Printf("Processing %d events", len(transaction.Events))
+	if s.crypto != nil {
+		s.crypto.ProcessExtensions(ctx, transaction.Extensions)
+		s.retryUndecrypted(ctx)
+	}
+
+	metrics.Transactions.Inc()
+	span.SetAttributes(attribute.Int("matrix.event_count", len(transaction.Events)))
+	logger.Info("received transaction", "events", len(transaction.Events), "ephemeral", len(transaction.Ephemeral)+len(transaction.UnstableEphemeral))
+	for _, event := range transaction.Events {
+		metrics.Events.WithLabelValues(metrics.EventType(event.Type)).Inc()
+		if event.StateKey == nil {
+			continue
+		}
+		s.current().access.Observe(event.RoomID, event.Type, event.Content)
+		if s.enricher != nil {
+			s.enricher.Observe(event.RoomID, event.Type, *event.StateKey, event.Content)
+		}
+	}
 	for _, event := range transaction.Events {
-		s.processEvent(event)
+		s.processEvent(ctx, event)
+	}
+
+	ephemeral := transaction.Ephemeral
+	if len(ephemeral) == 0 {
+		ephemeral = transaction.UnstableEphemeral
+	}
+	for _, event := range ephemeral {
+		metrics.Events.WithLabelValues(metrics.EventType(event.Type)).Inc()
+		s.processEphemeral(ctx, event)
 	}
 
 	w.Header().Set("Content-Type", "application/json")
@@ -129,45 +436,331 @@ func (s *AppServer) handleTransaction(w http.ResponseWriter, r *http.Request) {
 	_ = json.NewEncoder(w).Encode(map[string]interface{}{})
 }
 
-func (s *AppServer) processEvent(event MatrixEvent) {
-	log.Printf("Processing event: type=%s, room=%s, sender=%s", event.Type, event.RoomID, event.Sender)
+func (s *AppServer) processEvent(ctx context.Context, event MatrixEvent) {
+	ctx = logging.With(ctx, logging.KeyEventID, event.EventID, logging.KeyRoomID, event.RoomID)
+	logger := logging.FromContext(ctx)
+	logger.Debug("processing event", "type", event.Type, "sender", event.Sender)
+
+	if event.Type == "m.room.encrypted" && s.crypto != nil {
+		decrypted, err := s.decryptEvent(event)
+		if errors.Is(err, e2ee.ErrNoSession) {
+			logger.Info("event is waiting for its room key")
+			s.queueUndecrypted(event)
+			return
+		}
+		if err != nil {
+			logger.Warn("error decrypting event", "error", err)
+			return
+		}
+		event = decrypted
+	}
+
+	if event.Type == "m.room.member" {
+		s.handleInvite(ctx, event)
+		return
+	}
 
 	if event.Type != "m.room.message" {
-		log.Printf("Skipping non-message event type: %s", event.Type)
+		logger.Debug("skipping non-message event", "type", event.Type)
 		return
 	}
 
 	body, ok := event.Content["body"].(string)
 	if !ok {
-		log.Printf("Event has no body content")
+		logger.Debug("skipping message without body")
 		return
 	}
 
-	log.Printf("Message body: %s", body)
+	logger.Debug("message received", "sender", event.Sender, logging.Content("body", body))
 
-	// Use router resolver to compute targets (supports JSONata).
-	res, err := router.NewResolver(s.config)
-	if err != nil {
-		log.Printf("Router init error: %v", err)
+	if err := s.current().access.Check(ctx, event.RoomID, event.Sender); err != nil {
+		logger.Debug("dropping event", "error", err)
 		return
 	}
-	targets, err := res.Resolve(event)
+
+	routed := routedEvent{MatrixEvent: event}
+	if s.enricher != nil {
+		eventCtx := s.enricher.Enrich(ctx, event.RoomID, event.Sender)
+		routed.Context = &eventCtx
+	}
+	targets, err := s.resolve(ctx, routed, false)
 	if err != nil {
-		log.Printf("Router resolve error: %v", err)
+		logger.Error("error resolving routes", "error", err)
 		return
 	}
 	if len(targets) == 0 {
-		log.Printf("No routes matched for event %s in room %s", event.EventID, event.RoomID)
+		logger.Debug("no routes matched")
+		return
+	}
+	for _, t := range targets {
+		logger.Info("forwarding event", logging.KeyRoute, t.Name)
+		s.dispatchWebhook(ctx, routed, t)
+	}
+}
+
+// processEphemeral routes a receipt, typing or presence event to the routes
+// that have ephemeral enabled.
+func (s *AppServer) processEphemeral(ctx context.Context, event MatrixEvent) {
+	ctx = logging.With(ctx, logging.KeyRoomID, event.RoomID)
+	logger := logging.FromContext(ctx)
+	if err := s.current().access.Check(ctx, event.RoomID, event.Sender); err != nil {
+		logger.Debug("dropping ephemeral event", "type", event.Type, "error", err)
+		return
+	}
+	routed := routedEvent{MatrixEvent: event}
+	targets, err := s.resolve(ctx, routed, true)
+	if err != nil {
+		logger.Error("error resolving routes", "error", err)
 		return
 	}
 	for _, t := range targets {
-		log.Printf("Forwarding event %s to route '%s' -> %s (%s)", event.EventID, t.Name, t.URL, t.Method)
-		s.dispatchWebhook(event, t)
+		logger.Debug("forwarding ephemeral event", "type", event.Type, logging.KeyRoute, t.Name)
+		s.dispatchWebhook(ctx, routed, t)
+	}
+}
+
+// resolve returns the routes an event is sent to, skipping paused routes
+// and routes whose access policy denies it.
+func (s *AppServer) resolve(ctx context.Context, event routedEvent, ephemeral bool) ([]router.Target, error) {
+	ctx, span := tracing.Tracer().Start(ctx, "route.resolve")
+	defer span.End()
+	span.SetAttributes(
+		attribute.String("matrix.event_id", event.EventID),
+		attribute.String("matrix.event_type", event.Type),
+	)
+
+	live := s.current()
+	if live.resolver == nil {
+		span.RecordError(live.routesErr)
+		return nil, live.routesErr
+	}
+	res := live.resolver.WithLogger(logging.FromContext(ctx)).WithFilter(func(i int, conf config.RouteConfig) bool {
+		if s.routes.skipPaused(conf.Name) {
+			logging.FromContext(ctx).Debug("route is paused", logging.KeyRoute, conf.Name)
+			return false
+		}
+		return live.access.CheckRoute(ctx, i, conf.Name, event.RoomID, event.Sender) == nil
+	})
+	var targets []router.Target
+	var err error
+	if ephemeral {
+		targets, err = res.ResolveEphemeral(event)
+	} else {
+		targets, err = res.Resolve(event)
+	}
+	if err != nil {
+		span.RecordError(err)
+		return nil, err
+	}
+	span.SetAttributes(attribute.Int("route.matches", len(targets)))
+	return targets, nil
+}
+
+// handleInvite accepts invites of the bot to rooms the access policy allows
+// when auto_join is enabled, and rejects invites to rooms it denies.
+func (s *AppServer) handleInvite(ctx context.Context, event MatrixEvent) {
+	botID := matrix.UserID(s.config.Homeserver.SenderLocalpart, s.config.Homeserver.Domain)
+	if event.StateKey == nil || *event.StateKey != botID || event.Content["membership"] != "invite" {
+		return
+	}
+
+	if err := s.current().access.CheckInvite(ctx, event.RoomID, event.Sender, access.InviteAliases(event.Unsigned)); err != nil {
+		logger := logging.FromContext(ctx)
+		logger.Info("rejecting invite", "inviter", event.Sender, "error", err)
+		if err := s.matrixClient.LeaveRoom(ctx, event.RoomID, ""); err != nil {
+			logger.Error("error rejecting invite", "error", err)
+		}
+		return
+	}
+	if !s.current().access.AutoJoin() {
+		logging.FromContext(ctx).Info("invited to room; auto_join is disabled", "inviter", event.Sender)
+		return
+	}
+	if _, err := s.matrixClient.JoinRoom(ctx, event.RoomID, ""); err != nil {
+		logging.FromContext(ctx).Error("error joining room", "error", err)
+		return
+	}
+	logging.FromContext(ctx).Info("joined room after invite", "inviter", event.Sender)
+}
+
+// decryptEvent replaces an m.room.encrypted event's type and content with
+// the decrypted ones.
+func (s *AppServer) decryptEvent(event MatrixEvent) (MatrixEvent, error) {
+	eventType, content, err := s.crypto.Decrypt(event.RoomID, event.EventID, event.Sender, event.Content)
+	if err != nil {
+		return event, err
+	}
+	event.Type = eventType
+	event.Content = content
+	return event, nil
+}
+
+// queueUndecrypted keeps an event until its room key arrives, dropping the
+// oldest event when the queue is full.
+func (s *AppServer) queueUndecrypted(event MatrixEvent) {
+	s.undecryptedMu.Lock()
+	defer s.undecryptedMu.Unlock()
+
+	if len(s.undecrypted) >= maxUndecrypted {
+		var oldest string
+		for id, p := range s.undecrypted {
+			if oldest == "" || p.received.Before(s.undecrypted[oldest].received) {
+				oldest = id
+			}
+		}
+		slog.Warn("dropping event: too many events waiting for room keys", logging.KeyEventID, oldest)
+		delete(s.undecrypted, oldest)
+	}
+	s.undecrypted[event.EventID] = pendingEvent{event: event, received: time.Now()}
+	metrics.UndecryptedEvents.Set(float64(len(s.undecrypted)))
+}
+
+// retryUndecrypted processes queued events whose room keys have arrived and
+// drops those that have waited too long.
+func (s *AppServer) retryUndecrypted(ctx context.Context) {
+	s.undecryptedMu.Lock()
+	var ready []MatrixEvent
+	for id, p := range s.undecrypted {
+		decrypted, err := s.decryptEvent(p.event)
+		switch {
+		case err == nil:
+			ready = append(ready, decrypted)
+			delete(s.undecrypted, id)
+		case !errors.Is(err, e2ee.ErrNoSession):
+			logging.FromContext(ctx).Warn("error decrypting event", logging.KeyEventID, id, "error", err)
+			delete(s.undecrypted, id)
+		case time.Since(p.received) > undecryptedTTL:
+			logging.FromContext(ctx).Warn("giving up on event: room key never arrived", logging.KeyEventID, id)
+			delete(s.undecrypted, id)
+		}
+	}
+	metrics.UndecryptedEvents.Set(float64(len(s.undecrypted)))
+	s.undecryptedMu.Unlock()
+
+	for _, event := range ready {
+		s.processEvent(ctx, event)
+	}
+}
+
+// sweepUndecrypted drops events that have waited too long for their room
+// keys until ctx is done.
+func (s *AppServer) sweepUndecrypted(ctx context.Context) {
+	ticker := time.NewTicker(undecryptedSweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.expireUndecrypted(time.Now())
+		}
+	}
+}
+
+// expireUndecrypted drops the events received more than undecryptedTTL
+// before now.
+func (s *AppServer) expireUndecrypted(now time.Time) {
+	s.undecryptedMu.Lock()
+	defer s.undecryptedMu.Unlock()
+	for id, p := range s.undecrypted {
+		if now.Sub(p.received) > undecryptedTTL {
+			slog.Warn("giving up on event: room key never arrived", logging.KeyEventID, id)
+			delete(s.undecrypted, id)
+		}
+	}
+	metrics.UndecryptedEvents.Set(float64(len(s.undecrypted)))
+}
+
+// saveUndecrypted writes the events waiting for room keys next to the crypto
+// store, or removes the file when there are none.
+func (s *AppServer) saveUndecrypted() error {
+	if s.undecryptedStore == nil {
+		return nil
+	}
+	s.undecryptedMu.Lock()
+	defer s.undecryptedMu.Unlock()
+	if len(s.undecrypted) == 0 {
+		return s.undecryptedStore.Remove()
+	}
+	saved := make([]savedEvent, 0, len(s.undecrypted))
+	for _, p := range s.undecrypted {
+		saved = append(saved, savedEvent{Event: p.event, Received: p.received})
+	}
+	if err := s.undecryptedStore.SaveValue(saved); err != nil {
+		return fmt.Errorf("saving events waiting for room keys: %w", err)
+	}
+	slog.Info("saved events waiting for room keys", "count", len(saved))
+	return nil
+}
+
+// loadUndecrypted restores the events saved by saveUndecrypted, except those
+// received more than undecryptedTTL before now. The file is removed so that
+// a crash does not bring them back a second time.
+func (s *AppServer) loadUndecrypted(now time.Time) error {
+	var saved []savedEvent
+	if err := s.undecryptedStore.LoadValue(&saved); err != nil {
+		return fmt.Errorf("loading events waiting for room keys: %w", err)
+	}
+	restored := 0
+	s.undecryptedMu.Lock()
+	for _, e := range saved {
+		if now.Sub(e.Received) <= undecryptedTTL && len(s.undecrypted) < maxUndecrypted {
+			s.undecrypted[e.Event.EventID] = pendingEvent{event: e.Event, received: e.Received}
+			restored++
+		}
 	}
+	metrics.UndecryptedEvents.Set(float64(len(s.undecrypted)))
+	s.undecryptedMu.Unlock()
+	if len(saved) > 0 {
+		slog.Info("restored events waiting for room keys", "count", restored, "dropped", len(saved)-restored)
+	}
+	return s.undecryptedStore.Remove()
 }
 
 // dispatchWebhook constructs a webhook payload and sends it via the webhook module.
-func (s *AppServer) dispatchWebhook(event MatrixEvent, target router.Target) {
+func (s *AppServer) dispatchWebhook(ctx context.Context, event routedEvent, target router.Target) {
+	s.deliver(ctx, event, target, 1)
+}
+
+// deliver sends an event to a route as the given attempt and records the
+// outcome.
+func (s *AppServer) deliver(ctx context.Context, event routedEvent, target router.Target, attempt int) webhook.Response {
+	payload := webhookPayload(event, target)
+	req := webhook.Request{
+		Route:          target.Name,
+		Attempt:        attempt,
+		URL:            target.URL,
+		Method:         target.Method,
+		Payload:        payload,
+		SharedSecret:   target.SharedSecret.Value(),
+		Signing:        target.Signing,
+		SigningSecrets: config.SecretValues(target.SigningSecrets),
+		Auth:           target.Auth,
+		TLS:            target.TLS,
+	}
+	if event.EventID != "" {
+		// Homeservers retry transactions, so a stable ID lets receivers
+		// drop duplicate deliveries of the same event to the same route.
+		req.MessageID = messageID(event.EventID, target.Name)
+	}
+
+	mediaOpts := media.Options{Mode: target.Media, MaxBytes: target.MediaMaxBytes, MimeTypes: target.MediaMimeTypes}
+	desc, attachments, err := s.media.Forward(ctx, event.Content, mediaOpts)
+	if err != nil {
+		logging.FromContext(ctx).Warn("media not forwarded", logging.KeyRoute, target.Name, "error", err)
+	} else if desc != nil {
+		payload["media"] = desc
+		req.Attachments = attachments
+	}
+
+	resp := s.webhookSender.SendContext(ctx, req)
+	s.recordDelivery(ctx, event, req, resp)
+	return resp
+}
+
+// webhookPayload builds the JSON payload an event is sent to a route with,
+// before any media is added.
+func webhookPayload(event routedEvent, target router.Target) map[string]interface{} {
 	payload := map[string]interface{}{
 		"event_id":   event.EventID,
 		"room_id":    event.RoomID,
@@ -176,6 +769,9 @@ func (s *AppServer) dispatchWebhook(event MatrixEvent, target router.Target) {
 		"content":    event.Content,
 		"event_type": event.Type,
 	}
+	if event.Context != nil {
+		payload["context"] = event.Context
+	}
 
 	// Conditionally include message body based on send_body flag
 	if target.SendBody {
@@ -185,42 +781,303 @@ func (s *AppServer) dispatchWebhook(event MatrixEvent, target router.Target) {
 		}
 	}
 
-	req := webhook.Request{
-		URL:          target.URL,
-		Method:       target.Method,
-		Payload:      payload,
-		SharedSecret: target.SharedSecret,
+	return payload
+}
+
+// recordDelivery adds a delivery attempt to the history and the route's stats.
+func (s *AppServer) recordDelivery(ctx context.Context, event routedEvent, req webhook.Request, resp webhook.Response) {
+	attempt := req.Attempt
+	if attempt == 0 {
+		attempt = 1
+	}
+	rec := history.Record{
+		Time:      time.Now().Add(-resp.Duration),
+		EventID:   event.EventID,
+		RoomID:    event.RoomID,
+		Route:     req.Route,
+		URL:       webhook.RedactURL(req.URL),
+		Attempt:   attempt,
+		Status:    resp.StatusCode,
+		Success:   resp.Error == nil && resp.StatusCode >= 200 && resp.StatusCode < 300,
+		LatencyMS: float64(resp.Duration.Microseconds()) / 1000,
+		Response:  webhook.Snippet(resp.Body),
+	}
+	if resp.Error != nil {
+		rec.Error = resp.Error.Error()
+	}
+	s.routes.record(rec)
+	if err := s.history.Add(rec); err != nil {
+		logging.FromContext(ctx).Error("error recording delivery", "error", err)
 	}
+}
 
-	_ = s.webhookSender.Send(req)
+// messageID derives the webhook-id of an event delivered to a route.
+func messageID(eventID, route string) string {
+	sum := sha256.Sum256([]byte(eventID + "|" + route))
+	return "msg_" + hex.EncodeToString(sum[:16])
 }
 
+// handleRoom creates rooms on demand for aliases matching a configured pattern.
 func (s *AppServer) handleRoom(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	roomAlias := vars["roomAlias"]
 
-	log.Printf("Room query for: %s", roomAlias)
+	slog.Info("room alias query", "alias", roomAlias)
 
-	w.WriteHeader(http.StatusNotFound)
-	_ = json.NewEncoder(w).Encode(map[string]string{
-		"errcode": "M_NOT_FOUND",
-		"error":   fmt.Sprintf("Room alias %s not found", roomAlias),
-	})
+	if err := s.rooms.Provision(r.Context(), roomAlias); err != nil {
+		if errors.Is(err, rooms.ErrUnknownAlias) {
+			writeError(w, http.StatusNotFound, "M_NOT_FOUND", fmt.Sprintf("Room alias %s not found", roomAlias))
+			return
+		}
+		slog.Error("error provisioning room", "alias", roomAlias, "error", err)
+		writeError(w, http.StatusInternalServerError, "M_UNKNOWN", fmt.Sprintf("Could not create room %s", roomAlias))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{})
 }
 
+// handleUser provisions configured ghost users when the homeserver asks about them.
 func (s *AppServer) handleUser(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	userID := vars["userId"]
 
-	log.Printf("User query for: %s", userID)
+	slog.Info("user query", "user_id", userID)
+
+	localpart, ok := s.ghosts.Known(userID)
+	if !ok {
+		writeError(w, http.StatusNotFound, "M_NOT_FOUND", fmt.Sprintf("User %s not found", userID))
+		return
+	}
+
+	if _, err := s.ghosts.Ensure(r.Context(), localpart); err != nil {
+		slog.Error("error provisioning user", "user_id", userID, "error", err)
+		writeError(w, http.StatusInternalServerError, "M_UNKNOWN", fmt.Sprintf("Could not provision user %s", userID))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{})
+}
+
+// handleMedia serves media for signed proxy URLs handed to webhook receivers.
+func (s *AppServer) handleMedia(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	serverName, mediaID := vars["serverName"], vars["mediaId"]
+
+	q := r.URL.Query()
+	expires, errExp := strconv.ParseInt(q.Get("expires"), 10, 64)
+	maxBytes, errMax := strconv.ParseInt(q.Get("max"), 10, 64)
+	types := q.Get("types")
+	if errExp != nil || errMax != nil || !s.mediaSigner.Verify(serverName, mediaID, expires, maxBytes, types, q.Get("sig"), time.Now()) {
+		writeError(w, http.StatusForbidden, "M_FORBIDDEN", "Invalid or expired media URL")
+		return
+	}
+
+	m, err := s.matrixClient.DownloadMedia(r.Context(), serverName, mediaID, maxBytes)
+	if err != nil {
+		slog.Warn("error proxying media", "mxc", "mxc://"+serverName+"/"+mediaID, "error", err)
+		if errors.Is(err, matrix.ErrMediaTooLarge) {
+			writeError(w, http.StatusRequestEntityTooLarge, "M_TOO_LARGE", "Media exceeds size limit")
+			return
+		}
+		writeError(w, http.StatusBadGateway, "M_UNKNOWN", "Error fetching media from homeserver")
+		return
+	}
+
+	contentType := m.ContentType
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	// The URL was signed for the type the event declared; the homeserver
+	// may return something else.
+	if types != "" && !media.MIMEAllowed(contentType, strings.Split(types, ",")) {
+		slog.Warn("refusing proxied media of a type the route does not allow", "mxc", "mxc://"+serverName+"/"+mediaID, "content_type", contentType)
+		writeError(w, http.StatusForbidden, "M_FORBIDDEN", "Media type not allowed")
+		return
+	}
 
-	w.WriteHeader(http.StatusNotFound)
+	// Always a download, never rendered inline under this server's origin
+	params := map[string]string{}
+	if m.Filename != "" {
+		params["filename"] = m.Filename
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(m.Data)))
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", params))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(m.Data)
+}
+
+// handleHook renders an inbound webhook request and posts it into the hook's room.
+func (s *AppServer) handleHook(w http.ResponseWriter, r *http.Request) {
+	hookID := mux.Vars(r)["id"]
+	logger := slog.With("hook", hookID)
+
+	hook, ok := s.current().hooks[hookID]
+	if !ok {
+		writeError(w, http.StatusNotFound, "M_NOT_FOUND", fmt.Sprintf("Hook %s not found", hookID))
+		return
+	}
+	hookCfg := hook.Config()
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, 1024*1024))
+	if err != nil {
+		logger.Warn("error reading hook request", "error", err)
+		writeError(w, http.StatusBadRequest, "M_BAD_JSON", "Error reading request body")
+		return
+	}
+	defer r.Body.Close()
+
+	if err := hook.Verify(r, body); err != nil {
+		logger.Warn("hook request denied", "error", err)
+		writeError(w, http.StatusUnauthorized, "M_FORBIDDEN", "Invalid token or signature")
+		return
+	}
+
+	msg, err := hook.Render(r.Header, body)
+	if err != nil {
+		logger.Warn("error rendering hook message", "error", err)
+		writeError(w, http.StatusBadRequest, "M_BAD_JSON", err.Error())
+		return
+	}
+
+	eventID, err := s.postHookMessage(r, hookCfg, msg)
+	if err != nil {
+		logger.Error("error sending hook message", logging.KeyRoomID, hookCfg.RoomID, "error", err)
+		var denied *access.DeniedError
+		if errors.As(err, &denied) {
+			writeError(w, http.StatusForbidden, "M_FORBIDDEN", "The hook's room is not allowed by the access policy")
+			return
+		}
+		var mErr *matrix.Error
+		if errors.As(err, &mErr) {
+			writeError(w, http.StatusBadGateway, mErr.ErrCode, mErr.Message)
+			return
+		}
+		writeError(w, http.StatusBadGateway, "M_UNKNOWN", "Error sending message to homeserver")
+		return
+	}
+
+	logger.Info("sent hook message", logging.KeyEventID, eventID, logging.KeyRoomID, hookCfg.RoomID)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(w).Encode(map[string]string{"event_id": eventID})
+}
+
+// postHookMessage sends a rendered hook message, editing the earlier message
+// for the same key when the hook has edit_on_resolve enabled.
+func (s *AppServer) postHookMessage(r *http.Request, hook config.HookConfig, msg inbound.Message) (string, error) {
+	senderID, err := s.hookSender(r, hook)
+	if err != nil {
+		return "", err
+	}
+
+	if hook.EditOnResolve && msg.Key != "" {
+		if previous, ok := s.hookTracker.Lookup(hook.ID, msg.Key); ok {
+			eventID, err := s.sendRoomMessage(r.Context(), hook.RoomID, senderID, matrix.EditContent(previous, msg.Content()))
+			if err != nil {
+				return "", err
+			}
+			slog.Info("edited hook message", "hook", hook.ID, logging.KeyEventID, previous, "key", msg.Key)
+			if msg.Resolved {
+				s.hookTracker.Forget(hook.ID, msg.Key)
+			}
+			return eventID, nil
+		}
+	}
+
+	eventID, err := s.sendRoomMessage(r.Context(), hook.RoomID, senderID, msg.Content())
+	if err != nil {
+		return "", err
+	}
+	if hook.EditOnResolve && msg.Key != "" && !msg.Resolved {
+		s.hookTracker.Remember(hook.ID, msg.Key, eventID)
+	}
+	return eventID, nil
+}
+
+// sendRoomMessage sends an m.room.message as senderID (or the bot when empty),
+// encrypting it when encryption is enabled and the room is encrypted. Only
+// the bot has a device, so ghosts cannot post into encrypted rooms.
+func (s *AppServer) sendRoomMessage(ctx context.Context, roomID, senderID string, content map[string]interface{}) (string, error) {
+	if s.crypto == nil {
+		return s.matrixClient.SendMessage(ctx, roomID, senderID, content)
+	}
+	encrypted, err := s.roomEncrypted(ctx, roomID)
+	if err != nil {
+		return "", err
+	}
+	if !encrypted {
+		return s.matrixClient.SendMessage(ctx, roomID, senderID, content)
+	}
+	if senderID != "" {
+		return "", fmt.Errorf("%s cannot send to encrypted room %s: only the bot has a device", senderID, roomID)
+	}
+	encryptedContent, err := s.crypto.Encrypt(ctx, roomID, "m.room.message", content)
+	if err != nil {
+		return "", err
+	}
+	return s.matrixClient.SendEvent(ctx, roomID, "", "m.room.encrypted", encryptedContent)
+}
+
+// roomEncrypted reports whether a room has encryption enabled. Encryption
+// cannot be turned off again, so positive answers are cached.
+func (s *AppServer) roomEncrypted(ctx context.Context, roomID string) (bool, error) {
+	s.encryptedRoomsMu.Lock()
+	known := s.encryptedRooms[roomID]
+	s.encryptedRoomsMu.Unlock()
+	if known {
+		return true, nil
+	}
+
+	_, err := s.matrixClient.GetStateEvent(ctx, roomID, "m.room.encryption", "")
+	var mErr *matrix.Error
+	if errors.As(err, &mErr) && mErr.ErrCode == "M_NOT_FOUND" {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	s.encryptedRoomsMu.Lock()
+	s.encryptedRooms[roomID] = true
+	s.encryptedRoomsMu.Unlock()
+	return true, nil
+}
+
+// hookSender returns the user ID to masquerade as for a hook, or "" for the bot.
+// Ghost senders are registered and joined to the hook's room on first use.
+func (s *AppServer) hookSender(r *http.Request, hook config.HookConfig) (string, error) {
+	if hook.Sender == "" || hook.Sender == s.config.Homeserver.SenderLocalpart {
+		return "", nil
+	}
+	return s.ghosts.EnsureInRoom(r.Context(), hook.Sender, hook.RoomID, s.current().access)
+}
+
+// writeError writes a Matrix-style JSON error response.
+func writeError(w http.ResponseWriter, status int, errcode, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
 	_ = json.NewEncoder(w).Encode(map[string]string{
-		"errcode": "M_NOT_FOUND",
-		"error":   fmt.Sprintf("User %s not found", userID),
+		"errcode": errcode,
+		"error":   message,
 	})
 }
 
+// handleJWKS publishes the public signing keys. Receivers cache them, so a
+// new key should be listed here before it becomes the active key.
+func (s *AppServer) handleJWKS(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/jwk-set+json")
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	w.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(w).Encode(s.signingKeys.JWKS())
+}
+
 func (s *AppServer) handleHealth(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
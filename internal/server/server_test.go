@@ -2,16 +2,56 @@ package server
 
 import (
 	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/x509"
 	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	configpkg "github.com/yamatt/matrix-as-webhook/internal/config"
+	"github.com/yamatt/matrix-as-webhook/internal/e2ee"
+	"github.com/yamatt/matrix-as-webhook/internal/logging"
+	"github.com/yamatt/matrix-as-webhook/internal/matrix"
+	"github.com/yamatt/matrix-as-webhook/internal/signing"
+	"github.com/yamatt/matrix-as-webhook/internal/webhook"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
 )
 
+// loopbackEgress lets webhooks reach the httptest servers, which listen on
+// addresses the default egress policy blocks.
+var loopbackEgress = configpkg.EgressConfig{AllowCIDRs: []string{"127.0.0.0/8"}}
+
+// testASToken authenticates the server to the homeserver, testHSToken the
+// homeserver in tests of the /_matrix/app/v1 API.
+const (
+	testASToken = "test-as-token"
+	testHSToken = "test-hs-token"
+)
+
+// asRequest builds a homeserver request carrying testHSToken.
+func asRequest(method, target string, body io.Reader) *http.Request {
+	req := httptest.NewRequest(method, target, body)
+	req.Header.Set("Authorization", "Bearer "+testHSToken)
+	return req
+}
+
 func TestHandleHealth(t *testing.T) {
-	cfg := configpkg.NewDefault()
+	cfg, _ := configpkg.NewDefault()
 	srv := NewAppServer(cfg)
 
 	req := httptest.NewRequest("GET", "/health", nil)
@@ -33,8 +73,55 @@ func TestHandleHealth(t *testing.T) {
 	}
 }
 
+func TestValidateHSToken(t *testing.T) {
+	send := func(srv *AppServer, query, header string) int {
+		target := "/_matrix/app/v1/transactions/auth"
+		if query != "" {
+			target += "?access_token=" + query
+		}
+		req := httptest.NewRequest("PUT", target, strings.NewReader(`{"events": []}`))
+		if header != "" {
+			req.Header.Set("Authorization", "Bearer "+header)
+		}
+		w := httptest.NewRecorder()
+		srv.Router().ServeHTTP(w, req)
+		return w.Code
+	}
+
+	srv := NewAppServer(&configpkg.Config{ASToken: testASToken, HSToken: testHSToken})
+	if code := send(srv, "", ""); code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 without a token, got %d", code)
+	}
+	if code := send(srv, "wrong", ""); code != http.StatusForbidden {
+		t.Errorf("Expected 403 with a wrong token, got %d", code)
+	}
+	// The AS token is what the server sends, not what it accepts
+	if code := send(srv, testASToken, ""); code != http.StatusForbidden {
+		t.Errorf("Expected 403 with the AS token, got %d", code)
+	}
+	if code := send(srv, testHSToken, ""); code != http.StatusOK {
+		t.Errorf("Expected 200 with the HS token in the query, got %d", code)
+	}
+	if code := send(srv, "", testHSToken); code != http.StatusOK {
+		t.Errorf("Expected 200 with the HS token in the header, got %d", code)
+	}
+
+	// Without a configured token, requests are rejected unless in
+	// insecure development mode
+	open := NewAppServer(&configpkg.Config{ASToken: testASToken})
+	if code := send(open, "", ""); code != http.StatusForbidden {
+		t.Errorf("Expected 403 without a configured token, got %d", code)
+	}
+	open.SetInsecureDev(true)
+	if code := send(open, "", ""); code != http.StatusOK {
+		t.Errorf("Expected 200 in insecure development mode, got %d", code)
+	}
+}
+
 func TestHandleTransaction(t *testing.T) {
-	cfg := configpkg.NewDefault()
+	cfg, _ := configpkg.NewDefault()
+	cfg.ASToken = testASToken
+	cfg.HSToken = testHSToken
 	srv := NewAppServer(cfg)
 
 	transaction := Transaction{
@@ -58,7 +145,7 @@ func TestHandleTransaction(t *testing.T) {
 		t.Fatalf("Failed to marshal transaction: %v", err)
 	}
 
-	req := httptest.NewRequest("PUT", "/_matrix/app/v1/transactions/test123", bytes.NewBuffer(body))
+	req := asRequest("PUT", "/_matrix/app/v1/transactions/test123", bytes.NewBuffer(body))
 	w := httptest.NewRecorder()
 
 	srv.Router().ServeHTTP(w, req)
@@ -68,11 +155,67 @@ func TestHandleTransaction(t *testing.T) {
 	}
 }
 
+func TestHandleTransactionEphemeral(t *testing.T) {
+	var received []map[string]interface{}
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload map[string]interface{}
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			t.Errorf("Failed to decode webhook payload: %v", err)
+		}
+		received = append(received, payload)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer testServer.Close()
+
+	cfg := &configpkg.Config{
+		Egress: loopbackEgress,
+		Routes: []configpkg.RouteConfig{
+			{
+				Name:       "typing",
+				Selector:   "event.type == 'm.typing'",
+				WebhookURL: testServer.URL,
+				Method:     "POST",
+				Ephemeral:  true,
+			},
+			{
+				Name:       "messages",
+				Selector:   "true",
+				WebhookURL: testServer.URL,
+				Method:     "POST",
+			},
+		},
+	}
+	cfg.ASToken = testASToken
+	cfg.HSToken = testHSToken
+	srv := NewAppServer(cfg)
+
+	// Only the unstable field is sent, as older homeservers do.
+	body := `{"events": [], "de.sorunome.msc2409.ephemeral": [
+		{"type": "m.typing", "room_id": "!room:domain.com", "content": {"user_ids": ["@user:domain.com"]}},
+		{"type": "m.receipt", "room_id": "!room:domain.com", "content": {"$event": {"m.read": {"@user:domain.com": {"ts": 1}}}}}
+	]}`
+	req := asRequest("PUT", "/_matrix/app/v1/transactions/ephemeral1", strings.NewReader(body))
+	w := httptest.NewRecorder()
+	srv.Router().ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", w.Code)
+	}
+	if len(received) != 1 {
+		t.Fatalf("Expected 1 webhook call, got %d", len(received))
+	}
+	if received[0]["event_type"] != "m.typing" || received[0]["room_id"] != "!room:domain.com" {
+		t.Errorf("Unexpected payload: %v", received[0])
+	}
+}
+
 func TestHandleRoom(t *testing.T) {
-	cfg := configpkg.NewDefault()
+	cfg, _ := configpkg.NewDefault()
+	cfg.ASToken = testASToken
+	cfg.HSToken = testHSToken
 	srv := NewAppServer(cfg)
 
-	req := httptest.NewRequest("GET", "/_matrix/app/v1/rooms/%23room%3Adomain.com", nil)
+	req := asRequest("GET", "/_matrix/app/v1/rooms/%23room%3Adomain.com", nil)
 	w := httptest.NewRecorder()
 
 	srv.Router().ServeHTTP(w, req)
@@ -92,10 +235,12 @@ func TestHandleRoom(t *testing.T) {
 }
 
 func TestHandleUser(t *testing.T) {
-	cfg := configpkg.NewDefault()
+	cfg, _ := configpkg.NewDefault()
+	cfg.ASToken = testASToken
+	cfg.HSToken = testHSToken
 	srv := NewAppServer(cfg)
 
-	req := httptest.NewRequest("GET", "/_matrix/app/v1/users/%40user%3Adomain.com", nil)
+	req := asRequest("GET", "/_matrix/app/v1/users/%40user%3Adomain.com", nil)
 	w := httptest.NewRecorder()
 
 	srv.Router().ServeHTTP(w, req)
@@ -128,6 +273,7 @@ func TestProcessEventWithWebhook(t *testing.T) {
 	defer testServer.Close()
 
 	cfg := &configpkg.Config{
+		Egress: loopbackEgress,
 		Routes: []configpkg.RouteConfig{
 			{
 				Name:       "match-test",
@@ -152,7 +298,7 @@ func TestProcessEventWithWebhook(t *testing.T) {
 		},
 	}
 
-	srv.processEvent(event)
+	srv.processEvent(context.Background(), event)
 
 	if !webhookCalled {
 		t.Error("Expected webhook to be called")
@@ -171,6 +317,102 @@ func TestProcessEventWithWebhook(t *testing.T) {
 	}
 }
 
+func TestProcessEventStandardSigning(t *testing.T) {
+	secret := "whsec_c2VjcmV0"
+	var ids []string
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if err := webhook.VerifyStandard(r.Header, body, []string{secret}, webhook.DefaultTolerance, time.Now()); err != nil {
+			t.Errorf("Expected a valid Standard Webhooks signature, got %v", err)
+		}
+		ids = append(ids, r.Header.Get("webhook-id"))
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer testServer.Close()
+
+	cfg := &configpkg.Config{
+		Egress: loopbackEgress,
+		Routes: []configpkg.RouteConfig{
+			{
+				Name:           "standard",
+				Selector:       "true",
+				WebhookURL:     testServer.URL,
+				Method:         "POST",
+				Signing:        webhook.SchemeStandard,
+				SigningSecrets: []configpkg.Secret{configpkg.Secret(secret)},
+			},
+		},
+	}
+	srv := NewAppServer(cfg)
+
+	event := MatrixEvent{
+		Type:    "m.room.message",
+		EventID: "$test_event",
+		RoomID:  "!room:domain.com",
+		Sender:  "@user:domain.com",
+		Content: map[string]interface{}{"body": "hello", "msgtype": "m.text"},
+	}
+	// A retried transaction delivers the same event twice.
+	srv.processEvent(context.Background(), event)
+	srv.processEvent(context.Background(), event)
+
+	if len(ids) != 2 || ids[0] == "" || ids[0] != ids[1] {
+		t.Errorf("Expected the same webhook-id for redeliveries, got %v", ids)
+	}
+}
+
+func TestJWKSAndHTTPSignature(t *testing.T) {
+	var signatureInput string
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		signatureInput = r.Header.Get("Signature-Input")
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer testServer.Close()
+
+	_, private, _ := ed25519.GenerateKey(nil)
+	der, _ := x509.MarshalPKCS8PrivateKey(private)
+	keyFile := filepath.Join(t.TempDir(), "signing.pem")
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0o600); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+
+	cfg := &configpkg.Config{
+		Egress: loopbackEgress,
+		Routes: []configpkg.RouteConfig{
+			{Name: "signed", Selector: "true", WebhookURL: testServer.URL, Method: "POST", Signing: webhook.SchemeHTTPSignature},
+		},
+		Signing: configpkg.SigningConfig{Keys: []configpkg.SigningKeyConfig{{ID: "main", PrivateKeyFile: keyFile}}},
+	}
+	srv := NewAppServer(cfg)
+	if err := srv.Start(context.Background()); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+
+	req := httptest.NewRequest("GET", "/.well-known/jwks.json", nil)
+	w := httptest.NewRecorder()
+	srv.Router().ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", w.Code)
+	}
+	var set signing.JWKSet
+	if err := json.NewDecoder(w.Body).Decode(&set); err != nil {
+		t.Fatalf("Failed to decode JWKS: %v", err)
+	}
+	if len(set.Keys) != 1 || set.Keys[0].Kid != "main" || set.Keys[0].Crv != "Ed25519" {
+		t.Errorf("Unexpected JWKS: %+v", set)
+	}
+
+	srv.processEvent(context.Background(), MatrixEvent{
+		Type:    "m.room.message",
+		EventID: "$test_event",
+		RoomID:  "!room:domain.com",
+		Content: map[string]interface{}{"body": "hello", "msgtype": "m.text"},
+	})
+	if !strings.Contains(signatureInput, `keyid="main";alg="ed25519"`) {
+		t.Errorf("Expected the request to be signed with key main, got %q", signatureInput)
+	}
+}
+
 func TestProcessEventSendBodyFalse(t *testing.T) {
 	webhookCalled := false
 	var receivedPayload map[string]interface{}
@@ -186,6 +428,7 @@ func TestProcessEventSendBodyFalse(t *testing.T) {
 
 	sendBodyFalse := false
 	cfg := &configpkg.Config{
+		Egress: loopbackEgress,
 		Routes: []configpkg.RouteConfig{
 			{
 				Name:       "no-body",
@@ -211,7 +454,7 @@ func TestProcessEventSendBodyFalse(t *testing.T) {
 		},
 	}
 
-	srv.processEvent(event)
+	srv.processEvent(context.Background(), event)
 
 	if !webhookCalled {
 		t.Error("Expected webhook to be called")
@@ -247,6 +490,7 @@ func TestProcessEventStopOnMatch(t *testing.T) {
 	defer secondServer.Close()
 
 	cfg := &configpkg.Config{
+		Egress: loopbackEgress,
 		Routes: []configpkg.RouteConfig{
 			{
 				Name:        "stop-route",
@@ -278,7 +522,7 @@ func TestProcessEventStopOnMatch(t *testing.T) {
 		},
 	}
 
-	srv.processEvent(event)
+	srv.processEvent(context.Background(), event)
 
 	if !firstWebhookCalled {
 		t.Error("Expected first webhook to be called")
@@ -299,6 +543,7 @@ func TestProcessEventNoMatch(t *testing.T) {
 	defer testServer.Close()
 
 	cfg := &configpkg.Config{
+		Egress: loopbackEgress,
 		Routes: []configpkg.RouteConfig{
 			{
 				Name:       "no-match",
@@ -323,7 +568,7 @@ func TestProcessEventNoMatch(t *testing.T) {
 		},
 	}
 
-	srv.processEvent(event)
+	srv.processEvent(context.Background(), event)
 
 	if webhookCalled {
 		t.Error("Expected webhook not to be called when pattern doesn't match")
@@ -340,6 +585,7 @@ func TestProcessEventEmptyPattern(t *testing.T) {
 	defer testServer.Close()
 
 	cfg := &configpkg.Config{
+		Egress: loopbackEgress,
 		Routes: []configpkg.RouteConfig{
 			{
 				Name:       "match-all",
@@ -364,9 +610,868 @@ func TestProcessEventEmptyPattern(t *testing.T) {
 		},
 	}
 
-	srv.processEvent(event)
+	srv.processEvent(context.Background(), event)
 
 	if !webhookCalled {
 		t.Error("Expected webhook to be called with empty pattern (matches all)")
 	}
 }
+
+func TestProcessEventAccessPolicy(t *testing.T) {
+	var mu sync.Mutex
+	var called []string
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		called = append(called, r.URL.Path)
+		mu.Unlock()
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer testServer.Close()
+
+	cfg := &configpkg.Config{
+		Egress: loopbackEgress,
+		Access: configpkg.GlobalAccessConfig{AccessConfig: configpkg.AccessConfig{
+			DenyServers: []string{"evil.org"},
+		}},
+		Routes: []configpkg.RouteConfig{
+			{Name: "all", Selector: "true", WebhookURL: testServer.URL + "/all"},
+			{
+				Name:       "ops",
+				Selector:   "true",
+				WebhookURL: testServer.URL + "/ops",
+				Access:     configpkg.AccessConfig{AllowRooms: []string{"!ops:example.org"}},
+			},
+		},
+	}
+	srv := NewAppServer(cfg)
+
+	send := func(roomID, sender string) {
+		srv.processEvent(context.Background(), MatrixEvent{
+			Type:    "m.room.message",
+			EventID: "$" + roomID + sender,
+			RoomID:  roomID,
+			Sender:  sender,
+			Content: map[string]interface{}{"body": "hello", "msgtype": "m.text"},
+		})
+	}
+	send("!ops:example.org", "@alice:example.org")
+	send("!random:example.org", "@alice:example.org")
+	send("!ops:example.org", "@mallory:evil.org")
+
+	want := []string{"/all", "/ops", "/all"}
+	if strings.Join(called, ",") != strings.Join(want, ",") {
+		t.Errorf("Expected deliveries %v, got %v", want, called)
+	}
+	if denied := srv.current().access.Denied(); denied["sender_denied"] != 1 || denied["room_not_allowed"] != 1 {
+		t.Errorf("Unexpected denied counts: %v", denied)
+	}
+}
+
+func TestProcessEventInvite(t *testing.T) {
+	var mu sync.Mutex
+	var requests []string
+	homeserver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests = append(requests, r.URL.Path)
+		mu.Unlock()
+		_ = json.NewEncoder(w).Encode(map[string]string{"room_id": "!ops:example.org"})
+	}))
+	defer homeserver.Close()
+
+	cfg := &configpkg.Config{
+		Homeserver: configpkg.HomeserverConfig{URL: homeserver.URL, Domain: "example.org", SenderLocalpart: "webhook"},
+		Access: configpkg.GlobalAccessConfig{
+			AccessConfig: configpkg.AccessConfig{AllowRooms: []string{"!ops:example.org"}},
+			AutoJoin:     true,
+		},
+	}
+	srv := NewAppServer(cfg)
+
+	invite := func(roomID, stateKey string) {
+		srv.processEvent(context.Background(), MatrixEvent{
+			Type:     "m.room.member",
+			RoomID:   roomID,
+			Sender:   "@alice:example.org",
+			StateKey: &stateKey,
+			Content:  map[string]interface{}{"membership": "invite"},
+		})
+	}
+	invite("!ops:example.org", "@webhook:example.org")
+	invite("!random:example.org", "@webhook:example.org")
+	invite("!random:example.org", "@someone:example.org")
+
+	want := []string{
+		"/_matrix/client/v3/join/!ops:example.org",
+		"/_matrix/client/v3/rooms/!random:example.org/leave",
+	}
+	if strings.Join(requests, ",") != strings.Join(want, ",") {
+		t.Errorf("Expected requests %v, got %v", want, requests)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer testServer.Close()
+
+	cfg := &configpkg.Config{
+		Egress: loopbackEgress,
+		Routes: []configpkg.RouteConfig{
+			{Name: "metrics-test", Selector: "event.content.body == 'metrics'", WebhookURL: testServer.URL},
+		},
+	}
+	cfg.ASToken = testASToken
+	cfg.HSToken = testHSToken
+	srv := NewAppServer(cfg)
+	handler := srv.Router()
+
+	txn := `{"events": [{"type": "m.room.message", "event_id": "$metrics", "room_id": "!room:example.org",
+		"sender": "@alice:example.org", "content": {"body": "metrics", "msgtype": "m.text"}}]}`
+	req := asRequest("PUT", "/_matrix/app/v1/transactions/metrics", strings.NewReader(txn))
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", w.Code)
+	}
+	body := w.Body.String()
+	for _, want := range []string{
+		"as_webhook_transactions_total ",
+		`as_webhook_events_total{type="m.room.message"}`,
+		`as_webhook_selector_matches_total{route="metrics-test"} 1`,
+		`as_webhook_delivery_attempts_total{route="metrics-test",status_class="5xx"} 1`,
+		`as_webhook_delivery_failures_total{route="metrics-test",status_class="5xx"} 1`,
+		`as_webhook_delivery_duration_seconds_count{route="metrics-test",status_class="5xx"} 1`,
+		`as_webhook_deliveries_in_flight{route="metrics-test"} 0`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("Expected metrics to contain %s", want)
+		}
+	}
+	if strings.Contains(body, "!room:example.org") {
+		t.Error("Expected room IDs not to be used as labels")
+	}
+}
+
+func TestTracing(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	prevProvider, prevPropagator := otel.GetTracerProvider(), otel.GetTextMapPropagator()
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	t.Cleanup(func() {
+		otel.SetTracerProvider(prevProvider)
+		otel.SetTextMapPropagator(prevPropagator)
+	})
+
+	var traceparent string
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		traceparent = r.Header.Get("traceparent")
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer testServer.Close()
+
+	cfg := &configpkg.Config{
+		Egress: loopbackEgress,
+		Routes: []configpkg.RouteConfig{{Name: "traced", Selector: "true", WebhookURL: testServer.URL}},
+	}
+	cfg.ASToken = testASToken
+	cfg.HSToken = testHSToken
+	srv := NewAppServer(cfg)
+
+	txn := `{"events": [{"type": "m.room.message", "event_id": "$traced", "room_id": "!room:example.org",
+		"sender": "@alice:example.org", "content": {"body": "hello", "msgtype": "m.text"}}]}`
+	req := asRequest("PUT", "/_matrix/app/v1/transactions/traced", strings.NewReader(txn))
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	srv.Router().ServeHTTP(httptest.NewRecorder(), req)
+
+	spans := map[string]tracetest.SpanStub{}
+	for _, span := range exporter.GetSpans() {
+		spans[span.Name] = span
+	}
+	txnSpan, resolveSpan, sendSpan := spans["transaction"], spans["route.resolve"], spans["webhook.send"]
+	if len(spans) != 3 {
+		t.Fatalf("Expected transaction, route.resolve and webhook.send spans, got %v", exporter.GetSpans().Snapshots())
+	}
+	if txnSpan.SpanContext.TraceID().String() != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Errorf("Expected the transaction to continue the incoming trace, got %s", txnSpan.SpanContext.TraceID())
+	}
+	if resolveSpan.Parent.SpanID() != txnSpan.SpanContext.SpanID() || sendSpan.Parent.SpanID() != txnSpan.SpanContext.SpanID() {
+		t.Error("Expected route.resolve and webhook.send to be children of the transaction span")
+	}
+	want := "00-4bf92f3577b34da6a3ce929d0e0e4736-" + sendSpan.SpanContext.SpanID().String() + "-01"
+	if traceparent != want {
+		t.Errorf("Expected traceparent %s, got %s", want, traceparent)
+	}
+}
+
+func TestLogFields(t *testing.T) {
+	prev := slog.Default()
+	t.Cleanup(func() { slog.SetDefault(prev) })
+	var logs bytes.Buffer
+	if err := logging.Setup(&logs, configpkg.LoggingConfig{Level: "debug", Format: "json"}); err != nil {
+		t.Fatalf("Setup failed: %v", err)
+	}
+
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer testServer.Close()
+
+	cfg := &configpkg.Config{
+		Egress: loopbackEgress,
+		Routes: []configpkg.RouteConfig{{Name: "logged", Selector: "true", WebhookURL: testServer.URL}},
+	}
+	cfg.ASToken = testASToken
+	cfg.HSToken = testHSToken
+	srv := NewAppServer(cfg)
+
+	txn := `{"events": [{"type": "m.room.message", "event_id": "$logged", "room_id": "!room:example.org",
+		"sender": "@alice:example.org", "content": {"body": "very private words", "msgtype": "m.text"}}]}`
+	req := asRequest("PUT", "/_matrix/app/v1/transactions/txn-logged", strings.NewReader(txn))
+	srv.Router().ServeHTTP(httptest.NewRecorder(), req)
+
+	if strings.Contains(logs.String(), "very private words") {
+		t.Error("Expected the message body to be redacted")
+	}
+	var sent map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(logs.String()), "\n") {
+		var record map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &record); err == nil && record["msg"] == "webhook sent" {
+			sent = record
+		}
+	}
+	if sent == nil {
+		t.Fatalf("Expected a 'webhook sent' record, got %s", logs.String())
+	}
+	want := map[string]interface{}{"txn_id": "txn-logged", "event_id": "$logged", "room_id": "!room:example.org", "route": "logged", "attempt": float64(1)}
+	for k, v := range want {
+		if sent[k] != v {
+			t.Errorf("Expected %s=%v, got %v", k, v, sent[k])
+		}
+	}
+}
+
+func TestHandleHook(t *testing.T) {
+	var sentPath, sentUser string
+	var sentContent map[string]interface{}
+
+	var registered, joined bool
+
+	homeserver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/_matrix/client/v3/register":
+			registered = true
+			_ = json.NewEncoder(w).Encode(map[string]string{"user_id": "@webhook_ci:example.org"})
+			return
+		case strings.HasPrefix(r.URL.Path, "/_matrix/client/v3/join/"):
+			joined = r.URL.Query().Get("user_id") == "@webhook_ci:example.org"
+			_ = json.NewEncoder(w).Encode(map[string]string{"room_id": "!ci:example.org"})
+			return
+		}
+		sentPath = r.URL.Path
+		sentUser = r.URL.Query().Get("user_id")
+		if err := json.NewDecoder(r.Body).Decode(&sentContent); err != nil {
+			t.Errorf("Failed to decode message content: %v", err)
+		}
+		_ = json.NewEncoder(w).Encode(map[string]string{"event_id": "$hook_event"})
+	}))
+	defer homeserver.Close()
+
+	cfg := &configpkg.Config{
+		ASToken:    "as-token",
+		Homeserver: configpkg.HomeserverConfig{URL: homeserver.URL, Domain: "example.org", SenderLocalpart: "webhook"},
+		Namespaces: configpkg.NamespacesConfig{
+			Users: []configpkg.NamespaceConfig{{Regex: `@webhook_.*:example\.org`, Exclusive: true}},
+		},
+		Hooks: []configpkg.HookConfig{
+			{
+				ID:       "ci",
+				RoomID:   "!ci:example.org",
+				Sender:   "webhook_ci",
+				Token:    "hook-token",
+				Template: "Build {{ .status }}",
+				MsgType:  "m.notice",
+			},
+		},
+	}
+	srv := NewAppServer(cfg)
+
+	req := httptest.NewRequest("POST", "/hooks/ci", strings.NewReader(`{"status":"passed"}`))
+	req.Header.Set("Authorization", "Bearer hook-token")
+	w := httptest.NewRecorder()
+
+	srv.Router().ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+	if !registered || !joined {
+		t.Errorf("Expected ghost to be registered and joined (registered=%v, joined=%v)", registered, joined)
+	}
+	if !strings.HasPrefix(sentPath, "/_matrix/client/v3/rooms/!ci:example.org/send/m.room.message/") {
+		t.Errorf("Unexpected homeserver path: %s", sentPath)
+	}
+	if sentUser != "@webhook_ci:example.org" {
+		t.Errorf("Expected ghost sender '@webhook_ci:example.org', got '%s'", sentUser)
+	}
+	if sentContent["body"] != "Build passed" {
+		t.Errorf("Expected body 'Build passed', got '%v'", sentContent["body"])
+	}
+
+	var response map[string]string
+	if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if response["event_id"] != "$hook_event" {
+		t.Errorf("Expected event_id '$hook_event', got '%s'", response["event_id"])
+	}
+}
+
+func TestHandleHookUnauthorized(t *testing.T) {
+	cfg := &configpkg.Config{
+		Hooks: []configpkg.HookConfig{{ID: "ci", RoomID: "!ci:example.org", Token: "hook-token"}},
+	}
+	srv := NewAppServer(cfg)
+
+	req := httptest.NewRequest("POST", "/hooks/ci", strings.NewReader(`{}`))
+	req.Header.Set("Authorization", "Bearer wrong")
+	w := httptest.NewRecorder()
+
+	srv.Router().ServeHTTP(w, req)
+
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected status 401, got %d", w.Code)
+	}
+}
+
+func TestStartRefusesInvalidHooks(t *testing.T) {
+	cfg, _ := configpkg.NewDefault()
+	cfg.Hooks = []configpkg.HookConfig{{ID: "open", RoomID: "!ci:example.org"}}
+	if err := NewAppServer(cfg).Start(context.Background()); err == nil || !strings.Contains(err.Error(), "public = true") {
+		t.Errorf("Expected Start to refuse a hook without authentication, got %v", err)
+	}
+}
+
+func TestStartRefusesWithoutMediaKey(t *testing.T) {
+	cfg, _ := configpkg.NewDefault()
+	srv := NewAppServer(cfg)
+	// crypto/rand cannot be made to fail, so the error is set directly
+	srv.mediaKeyErr = errors.New("generating the media signing key: no entropy")
+	if err := srv.Start(context.Background()); err == nil || !strings.Contains(err.Error(), "media signing key") {
+		t.Errorf("Expected Start to refuse to run without a media signing key, got %v", err)
+	}
+}
+
+func TestHandleHookNotFound(t *testing.T) {
+	cfg, _ := configpkg.NewDefault()
+	srv := NewAppServer(cfg)
+
+	req := httptest.NewRequest("POST", "/hooks/missing", strings.NewReader(`{}`))
+	w := httptest.NewRecorder()
+
+	srv.Router().ServeHTTP(w, req)
+
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected status 404, got %d", w.Code)
+	}
+}
+
+func TestHandleHookEditOnResolve(t *testing.T) {
+	var sent []map[string]interface{}
+
+	homeserver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var content map[string]interface{}
+		if err := json.NewDecoder(r.Body).Decode(&content); err != nil {
+			t.Errorf("Failed to decode message content: %v", err)
+		}
+		sent = append(sent, content)
+		_ = json.NewEncoder(w).Encode(map[string]string{"event_id": fmt.Sprintf("$event%d", len(sent))})
+	}))
+	defer homeserver.Close()
+
+	cfg := &configpkg.Config{
+		Homeserver: configpkg.HomeserverConfig{URL: homeserver.URL, Domain: "example.org"},
+		Hooks: []configpkg.HookConfig{
+			{ID: "alerts", RoomID: "!ops:example.org", Format: "alertmanager", EditOnResolve: true, Public: true},
+		},
+	}
+	srv := NewAppServer(cfg)
+
+	for _, status := range []string{"firing", "resolved"} {
+		payload := `{"status":"` + status + `","groupKey":"g1","groupLabels":{"alertname":"Down"},"alerts":[{"status":"` + status + `","labels":{"alertname":"Down"}}]}`
+		req := httptest.NewRequest("POST", "/hooks/alerts", strings.NewReader(payload))
+		w := httptest.NewRecorder()
+		srv.Router().ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected status 200 for %s, got %d: %s", status, w.Code, w.Body.String())
+		}
+	}
+
+	if len(sent) != 2 {
+		t.Fatalf("Expected 2 messages sent, got %d", len(sent))
+	}
+	if _, isEdit := sent[0]["m.relates_to"]; isEdit {
+		t.Error("Expected firing notification to be a new message")
+	}
+	relates, _ := sent[1]["m.relates_to"].(map[string]interface{})
+	if relates["rel_type"] != "m.replace" || relates["event_id"] != "$event1" {
+		t.Errorf("Expected resolved notification to edit $event1, got %v", relates)
+	}
+}
+
+func TestHandleUserKnownGhost(t *testing.T) {
+	registered := false
+	homeserver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/_matrix/client/v3/register" {
+			registered = true
+		}
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{})
+	}))
+	defer homeserver.Close()
+
+	cfg := &configpkg.Config{
+		Homeserver: configpkg.HomeserverConfig{URL: homeserver.URL, Domain: "example.org"},
+		Namespaces: configpkg.NamespacesConfig{
+			Users: []configpkg.NamespaceConfig{{Regex: `@webhook_.*:example\.org`, Exclusive: true}},
+		},
+		Ghosts: []configpkg.GhostConfig{{Localpart: "webhook_ci"}},
+	}
+	cfg.ASToken = testASToken
+	cfg.HSToken = testHSToken
+	srv := NewAppServer(cfg)
+
+	req := asRequest("GET", "/_matrix/app/v1/users/%40webhook_ci%3Aexample.org", nil)
+	w := httptest.NewRecorder()
+	srv.Router().ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+	if !registered {
+		t.Error("Expected ghost to be registered with the homeserver")
+	}
+
+	req = asRequest("GET", "/_matrix/app/v1/users/%40webhook_unknown%3Aexample.org", nil)
+	w = httptest.NewRecorder()
+	srv.Router().ServeHTTP(w, req)
+
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected status 404 for unconfigured ghost, got %d", w.Code)
+	}
+}
+
+func TestHandleRoomCreatesAlias(t *testing.T) {
+	var created map[string]interface{}
+	homeserver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/_matrix/client/v3/createRoom" {
+			_ = json.NewDecoder(r.Body).Decode(&created)
+		}
+		_ = json.NewEncoder(w).Encode(map[string]string{"room_id": "!new:example.org"})
+	}))
+	defer homeserver.Close()
+
+	cfg := &configpkg.Config{
+		Homeserver: configpkg.HomeserverConfig{URL: homeserver.URL, Domain: "example.org"},
+		RoomAliases: []configpkg.RoomAliasConfig{
+			{LocalpartRegex: `^webhook_(?P<name>.+)$`, Name: "Webhook ${name}", Preset: "public_chat"},
+		},
+	}
+	cfg.ASToken = testASToken
+	cfg.HSToken = testHSToken
+	srv := NewAppServer(cfg)
+
+	req := asRequest("GET", "/_matrix/app/v1/rooms/%23webhook_ci%3Aexample.org", nil)
+	w := httptest.NewRecorder()
+	srv.Router().ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+	if created["room_alias_name"] != "webhook_ci" || created["name"] != "Webhook ci" {
+		t.Errorf("Unexpected createRoom request: %v", created)
+	}
+}
+
+func TestProcessEventEnrichedSelector(t *testing.T) {
+	homeserver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/_matrix/client/v3/rooms/!room:domain.com/state/m.room.member/@user:domain.com":
+			_ = json.NewEncoder(w).Encode(map[string]string{"membership": "join", "displayname": "User"})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			_ = json.NewEncoder(w).Encode(map[string]string{"errcode": "M_NOT_FOUND", "error": "not found"})
+		}
+	}))
+	defer homeserver.Close()
+
+	var receivedPayload map[string]interface{}
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewDecoder(r.Body).Decode(&receivedPayload)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer testServer.Close()
+
+	cfg := &configpkg.Config{
+		Egress:     loopbackEgress,
+		Homeserver: configpkg.HomeserverConfig{URL: homeserver.URL, Domain: "domain.com"},
+		Enrichment: configpkg.EnrichmentConfig{Enabled: true},
+		Routes: []configpkg.RouteConfig{
+			{
+				Name:       "support",
+				Selector:   "event.context.room.name == 'Support' && event.context.sender.displayname == 'User'",
+				WebhookURL: testServer.URL,
+				Method:     "POST",
+			},
+		},
+	}
+	cfg.ASToken = testASToken
+	cfg.HSToken = testHSToken
+	srv := NewAppServer(cfg)
+
+	stateKey := ""
+	transaction := Transaction{
+		Events: []MatrixEvent{
+			{
+				Type:     "m.room.name",
+				EventID:  "$name_event",
+				RoomID:   "!room:domain.com",
+				Sender:   "@admin:domain.com",
+				StateKey: &stateKey,
+				Content:  map[string]interface{}{"name": "Support"},
+			},
+			{
+				Type:    "m.room.message",
+				EventID: "$test_event",
+				RoomID:  "!room:domain.com",
+				Sender:  "@user:domain.com",
+				Content: map[string]interface{}{"body": "help", "msgtype": "m.text"},
+			},
+		},
+	}
+	body, _ := json.Marshal(transaction)
+	req := asRequest("PUT", "/_matrix/app/v1/transactions/enrich1", bytes.NewBuffer(body))
+	w := httptest.NewRecorder()
+	srv.Router().ServeHTTP(w, req)
+
+	if receivedPayload == nil {
+		t.Fatal("Expected enriched selector to match and webhook to be called")
+	}
+	eventCtx, _ := receivedPayload["context"].(map[string]interface{})
+	room, _ := eventCtx["room"].(map[string]interface{})
+	if room["name"] != "Support" {
+		t.Errorf("Expected context.room.name 'Support' in payload, got %v", eventCtx)
+	}
+}
+
+func TestProcessEventMediaBase64(t *testing.T) {
+	homeserver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/_matrix/client/v1/media/download/domain.com/abc123" {
+			t.Errorf("Unexpected homeserver path: %s", r.URL.Path)
+		}
+		w.Header().Set("Content-Type", "image/png")
+		_, _ = w.Write([]byte("png-bytes"))
+	}))
+	defer homeserver.Close()
+
+	var receivedPayload map[string]interface{}
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewDecoder(r.Body).Decode(&receivedPayload)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer testServer.Close()
+
+	cfg := &configpkg.Config{
+		Egress:     loopbackEgress,
+		Homeserver: configpkg.HomeserverConfig{URL: homeserver.URL, Domain: "domain.com"},
+		Routes: []configpkg.RouteConfig{
+			{Name: "images", Selector: "true", WebhookURL: testServer.URL, Method: "POST", Media: "base64", MediaMaxBytes: 1024, MediaMimeTypes: []string{"image/*"}},
+		},
+	}
+	srv := NewAppServer(cfg)
+
+	srv.processEvent(context.Background(), MatrixEvent{
+		Type:    "m.room.message",
+		EventID: "$image_event",
+		RoomID:  "!room:domain.com",
+		Sender:  "@user:domain.com",
+		Content: map[string]interface{}{"msgtype": "m.image", "body": "cat.png", "url": "mxc://domain.com/abc123"},
+	})
+
+	mediaDesc, _ := receivedPayload["media"].(map[string]interface{})
+	if mediaDesc["data"] != "cG5nLWJ5dGVz" {
+		t.Errorf("Expected base64 media data in payload, got %v", receivedPayload["media"])
+	}
+}
+
+func TestHandleMediaProxy(t *testing.T) {
+	homeserver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		_, _ = w.Write([]byte("png-bytes"))
+	}))
+	defer homeserver.Close()
+
+	cfg := &configpkg.Config{
+		Homeserver: configpkg.HomeserverConfig{URL: homeserver.URL, Domain: "domain.com"},
+		Media:      configpkg.MediaConfig{PublicURL: "https://as.example.org", SigningKey: "key", ProxyTTL: time.Minute},
+	}
+	srv := NewAppServer(cfg)
+
+	proxyURL := srv.media.ProxyURL("domain.com", "abc123", time.Now().Add(time.Minute).Unix(), 1024, []string{"image/*"})
+	req := httptest.NewRequest("GET", strings.TrimPrefix(proxyURL, "https://as.example.org"), nil)
+	w := httptest.NewRecorder()
+	srv.Router().ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK || w.Body.String() != "png-bytes" {
+		t.Errorf("Expected proxied media, got %d: %s", w.Code, w.Body.String())
+	}
+	if w.Header().Get("Content-Type") != "image/png" {
+		t.Errorf("Expected Content-Type image/png, got %s", w.Header().Get("Content-Type"))
+	}
+	if w.Header().Get("Content-Disposition") != "attachment" || w.Header().Get("X-Content-Type-Options") != "nosniff" {
+		t.Errorf("Expected an attachment with nosniff, got %q and %q", w.Header().Get("Content-Disposition"), w.Header().Get("X-Content-Type-Options"))
+	}
+
+	// A type outside the route's allowlist is refused even with a valid URL
+	proxyURL = srv.media.ProxyURL("domain.com", "abc123", time.Now().Add(time.Minute).Unix(), 1024, []string{"application/pdf"})
+	req = httptest.NewRequest("GET", strings.TrimPrefix(proxyURL, "https://as.example.org"), nil)
+	w = httptest.NewRecorder()
+	srv.Router().ServeHTTP(w, req)
+
+	if w.Code != http.StatusForbidden {
+		t.Errorf("Expected status 403 for a disallowed media type, got %d", w.Code)
+	}
+
+	req = httptest.NewRequest("GET", "/media/domain.com/abc123?expires=9999999999&max=1024&sig=forged", nil)
+	w = httptest.NewRecorder()
+	srv.Router().ServeHTTP(w, req)
+
+	if w.Code != http.StatusForbidden {
+		t.Errorf("Expected status 403 for forged signature, got %d", w.Code)
+	}
+}
+
+// cryptoHomeserver fakes the key and to-device endpoints of a homeserver for
+// a single encrypted room shared by the bot and alice.
+type cryptoHomeserver struct {
+	mu          sync.Mutex
+	deviceKeys  map[string]map[string]json.RawMessage
+	oneTimeKeys map[string]map[string]map[string]json.RawMessage
+	toDevice    map[string][]e2ee.ToDeviceEvent
+	sent        []map[string]interface{}
+	sentTypes   []string
+}
+
+func newCryptoHomeserver(t *testing.T, roomID string, members []string) (*httptest.Server, *cryptoHomeserver) {
+	hs := &cryptoHomeserver{
+		deviceKeys:  make(map[string]map[string]json.RawMessage),
+		oneTimeKeys: make(map[string]map[string]map[string]json.RawMessage),
+		toDevice:    make(map[string][]e2ee.ToDeviceEvent),
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hs.mu.Lock()
+		defer hs.mu.Unlock()
+
+		user := r.URL.Query().Get("user_id")
+		device := r.URL.Query().Get("org.matrix.msc3202.device_id")
+		var body map[string]json.RawMessage
+		_ = json.NewDecoder(r.Body).Decode(&body)
+
+		switch {
+		case r.URL.Path == "/_matrix/client/v3/login":
+			var ident struct {
+				User string `json:"user"`
+			}
+			_ = json.Unmarshal(body["identifier"], &ident)
+			_ = json.NewEncoder(w).Encode(map[string]string{"device_id": "DEVICE_" + strings.ToUpper(ident.User)})
+		case r.URL.Path == "/_matrix/client/v3/keys/upload":
+			if body["device_keys"] != nil {
+				if hs.deviceKeys[user] == nil {
+					hs.deviceKeys[user] = make(map[string]json.RawMessage)
+				}
+				hs.deviceKeys[user][device] = body["device_keys"]
+			}
+			var otks map[string]json.RawMessage
+			_ = json.Unmarshal(body["one_time_keys"], &otks)
+			if hs.oneTimeKeys[user] == nil {
+				hs.oneTimeKeys[user] = make(map[string]map[string]json.RawMessage)
+			}
+			if hs.oneTimeKeys[user][device] == nil {
+				hs.oneTimeKeys[user][device] = make(map[string]json.RawMessage)
+			}
+			for id, k := range otks {
+				hs.oneTimeKeys[user][device][id] = k
+			}
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{"one_time_key_counts": map[string]int{"signed_curve25519": len(hs.oneTimeKeys[user][device])}})
+		case r.URL.Path == "/_matrix/client/v3/keys/query":
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{"device_keys": hs.deviceKeys})
+		case r.URL.Path == "/_matrix/client/v3/keys/claim":
+			var claim map[string]map[string]string
+			_ = json.Unmarshal(body["one_time_keys"], &claim)
+			out := make(map[string]map[string]map[string]json.RawMessage)
+			for u, devices := range claim {
+				out[u] = make(map[string]map[string]json.RawMessage)
+				for d := range devices {
+					for id, k := range hs.oneTimeKeys[u][d] {
+						out[u][d] = map[string]json.RawMessage{id: k}
+						delete(hs.oneTimeKeys[u][d], id)
+						break
+					}
+				}
+			}
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{"one_time_keys": out})
+		case strings.HasPrefix(r.URL.Path, "/_matrix/client/v3/sendToDevice/"):
+			eventType := strings.Split(r.URL.Path, "/")[5]
+			var messages map[string]map[string]json.RawMessage
+			_ = json.Unmarshal(body["messages"], &messages)
+			for to, devices := range messages {
+				for d, content := range devices {
+					hs.toDevice[to] = append(hs.toDevice[to], e2ee.ToDeviceEvent{Type: eventType, Sender: user, Content: content, ToUserID: to, ToDeviceID: d})
+				}
+			}
+			_, _ = w.Write([]byte("{}"))
+		case strings.HasSuffix(r.URL.Path, "/joined_members"):
+			joined := make(map[string]interface{})
+			for _, m := range members {
+				joined[m] = map[string]interface{}{}
+			}
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{"joined": joined})
+		case strings.HasSuffix(r.URL.Path, "/state/m.room.encryption/"):
+			_ = json.NewEncoder(w).Encode(map[string]string{"algorithm": e2ee.AlgorithmMegolm})
+		case r.URL.Path == "/_matrix/client/versions":
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{"versions": []string{"v1.11"}})
+		case strings.HasPrefix(r.URL.Path, "/_matrix/client/v3/rooms/"+roomID+"/send/"):
+			var content map[string]interface{}
+			raw, _ := json.Marshal(body)
+			_ = json.Unmarshal(raw, &content)
+			hs.sent = append(hs.sent, content)
+			hs.sentTypes = append(hs.sentTypes, strings.Split(r.URL.Path, "/")[7])
+			_ = json.NewEncoder(w).Encode(map[string]string{"event_id": fmt.Sprintf("$sent%d", len(hs.sent))})
+		default:
+			t.Errorf("Unexpected homeserver request: %s %s", r.Method, r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	return server, hs
+}
+
+// drain returns the to-device events queued for userID.
+func (hs *cryptoHomeserver) drain(userID string) []e2ee.ToDeviceEvent {
+	hs.mu.Lock()
+	defer hs.mu.Unlock()
+	events := hs.toDevice[userID]
+	delete(hs.toDevice, userID)
+	return events
+}
+
+func TestEncryptedRoom(t *testing.T) {
+	const roomID = "!secret:domain.com"
+	server, hs := newCryptoHomeserver(t, roomID, []string{"@webhook:domain.com", "@alice:domain.com"})
+	defer server.Close()
+	dir := t.TempDir()
+
+	var receivedPayload map[string]interface{}
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewDecoder(r.Body).Decode(&receivedPayload)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer receiver.Close()
+
+	cfg := &configpkg.Config{
+		Egress:     loopbackEgress,
+		Homeserver: configpkg.HomeserverConfig{URL: server.URL, Domain: "domain.com"},
+		Encryption: configpkg.EncryptionConfig{Enabled: true, StorePath: filepath.Join(dir, "bot.json")},
+		Routes:     []configpkg.RouteConfig{{Name: "deploy", Selector: `event.content.body == "!deploy"`, WebhookURL: receiver.URL}},
+		Hooks:      []configpkg.HookConfig{{ID: "ci", RoomID: roomID, Public: true, Template: "Deployed {{ .version }}"}},
+	}
+	configpkg.ApplyDefaults(cfg)
+	cfg.ASToken = testASToken
+	cfg.HSToken = testHSToken
+	srv := NewAppServer(cfg)
+	if err := srv.Start(context.Background()); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+
+	alice := e2ee.NewMachine(matrix.NewClient(server.URL, "", time.Second), e2ee.NewStore(filepath.Join(dir, "alice.json"), ""), "@alice:domain.com", "alice", "")
+	if err := alice.Start(context.Background()); err != nil {
+		t.Fatalf("Alice Start failed: %v", err)
+	}
+	encrypted, err := alice.Encrypt(context.Background(), roomID, "m.room.message", map[string]interface{}{"msgtype": "m.text", "body": "!deploy"})
+	if err != nil {
+		t.Fatalf("Encrypt failed: %v", err)
+	}
+
+	// The event arrives before its room key and waits for it.
+	transaction := func(txn map[string]interface{}) {
+		body, _ := json.Marshal(txn)
+		req := asRequest("PUT", "/_matrix/app/v1/transactions/"+fmt.Sprint(time.Now().UnixNano()), bytes.NewReader(body))
+		w := httptest.NewRecorder()
+		srv.Router().ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Transaction failed: %d", w.Code)
+		}
+	}
+	transaction(map[string]interface{}{"events": []map[string]interface{}{{
+		"type": "m.room.encrypted", "event_id": "$enc", "room_id": roomID, "sender": "@alice:domain.com", "content": encrypted,
+	}}})
+	if receivedPayload != nil {
+		t.Fatalf("Expected no webhook before the room key arrives, got %v", receivedPayload)
+	}
+
+	transaction(map[string]interface{}{"events": []interface{}{}, "de.sorunome.msc2409.to_device": hs.drain("@webhook:domain.com")})
+	if receivedPayload == nil {
+		t.Fatal("Expected the queued event to be routed once its room key arrived")
+	}
+	if receivedPayload["event_type"] != "m.room.message" || receivedPayload["message"] != "!deploy" {
+		t.Errorf("Expected decrypted message in payload, got %v", receivedPayload)
+	}
+
+	// Messages posted by hooks into the room are encrypted for its members.
+	req := httptest.NewRequest("POST", "/hooks/ci", strings.NewReader(`{"version":"1.2.3"}`))
+	w := httptest.NewRecorder()
+	srv.Router().ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+	if len(hs.sent) != 1 || hs.sentTypes[0] != "m.room.encrypted" {
+		t.Fatalf("Expected one m.room.encrypted event, got %v", hs.sentTypes)
+	}
+	alice.ProcessExtensions(context.Background(), e2ee.Extensions{ToDevice: hs.drain("@alice:domain.com")})
+	_, content, err := alice.Decrypt(roomID, "$sent1", "@webhook:domain.com", hs.sent[0])
+	if err != nil {
+		t.Fatalf("Alice could not decrypt the hook message: %v", err)
+	}
+	if content["body"] != "Deployed 1.2.3" {
+		t.Errorf("Expected body 'Deployed 1.2.3', got %v", content["body"])
+	}
+}
+
+func TestUndecryptedEventsSurviveRestart(t *testing.T) {
+	cfg, _ := configpkg.NewDefault()
+	cfg.Encryption = configpkg.EncryptionConfig{Enabled: true, StorePath: filepath.Join(t.TempDir(), "crypto-store.json"), PickleKey: "pickle"}
+	srv := NewAppServer(cfg)
+	srv.queueUndecrypted(MatrixEvent{EventID: "$waiting", RoomID: "!room:domain.com", Type: "m.room.encrypted"})
+	srv.undecrypted["$stale"] = pendingEvent{event: MatrixEvent{EventID: "$stale"}, received: time.Now().Add(-undecryptedTTL - time.Minute)}
+	if err := srv.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	if _, err := os.Stat(cfg.Encryption.StorePath + ".pending"); err != nil {
+		t.Fatalf("Expected the waiting events to be saved next to the crypto store: %v", err)
+	}
+
+	restarted := NewAppServer(cfg)
+	if err := restarted.loadUndecrypted(time.Now()); err != nil {
+		t.Fatalf("loadUndecrypted failed: %v", err)
+	}
+	if p, ok := restarted.undecrypted["$waiting"]; !ok || p.event.RoomID != "!room:domain.com" {
+		t.Errorf("Expected the waiting event to be restored, got %+v", restarted.undecrypted)
+	}
+	if _, ok := restarted.undecrypted["$stale"]; ok {
+		t.Error("Expected an expired event to be dropped on restore")
+	}
+	if _, err := os.Stat(cfg.Encryption.StorePath + ".pending"); !os.IsNotExist(err) {
+		t.Errorf("Expected the saved events to be removed once restored, got %v", err)
+	}
+}
@@ -0,0 +1,213 @@
+// Package signing signs outgoing webhook requests with asymmetric keys and
+// publishes the public halves as a JSON Web Key Set.
+package signing
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/yamatt/matrix-as-webhook/internal/config"
+)
+
+// Key is a private signing key and its ID.
+type Key struct {
+	ID     string
+	signer crypto.Signer
+}
+
+// Keyring holds every configured key; the active one signs requests.
+type Keyring struct {
+	keys   []*Key
+	active *Key
+}
+
+// JWK is the public half of a key as a JSON Web Key.
+type JWK struct {
+	Kty string `json:"kty"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y,omitempty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+}
+
+// JWKSet is the document served on the JWKS endpoint.
+type JWKSet struct {
+	Keys []JWK `json:"keys"`
+}
+
+var b64 = base64.RawURLEncoding
+
+// LoadKeyring reads the configured private keys. It returns nil when no keys
+// are configured.
+func LoadKeyring(cfg config.SigningConfig) (*Keyring, error) {
+	if len(cfg.Keys) == 0 {
+		return nil, nil
+	}
+	k := &Keyring{}
+	for _, kc := range cfg.Keys {
+		data, err := os.ReadFile(kc.PrivateKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("signing: %w", err)
+		}
+		key, err := ParsePrivateKey(kc.ID, data)
+		if err != nil {
+			return nil, fmt.Errorf("signing: %s: %w", kc.PrivateKeyFile, err)
+		}
+		for _, other := range k.keys {
+			if other.ID == key.ID {
+				return nil, fmt.Errorf("signing: duplicate key ID %q", key.ID)
+			}
+		}
+		k.keys = append(k.keys, key)
+	}
+
+	k.active = k.keys[0]
+	if cfg.ActiveKey != "" {
+		k.active = nil
+		for _, key := range k.keys {
+			if key.ID == cfg.ActiveKey {
+				k.active = key
+			}
+		}
+		if k.active == nil {
+			return nil, fmt.Errorf("signing: active_key %q is not configured", cfg.ActiveKey)
+		}
+	}
+	return k, nil
+}
+
+// NewKeyring returns a keyring signing with the first of keys.
+func NewKeyring(keys ...*Key) *Keyring {
+	return &Keyring{keys: keys, active: keys[0]}
+}
+
+// ParsePrivateKey parses a PEM PKCS#8 Ed25519 or ECDSA P-256 private key. An
+// empty id is replaced by the key's JWK thumbprint.
+func ParsePrivateKey(id string, data []byte) (*Key, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM block found")
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	return NewKey(id, parsed)
+}
+
+// NewKey wraps an ed25519.PrivateKey or P-256 *ecdsa.PrivateKey.
+func NewKey(id string, private interface{}) (*Key, error) {
+	var signer crypto.Signer
+	switch p := private.(type) {
+	case ed25519.PrivateKey:
+		signer = p
+	case *ecdsa.PrivateKey:
+		if p.Curve != elliptic.P256() {
+			return nil, errors.New("only the P-256 curve is supported")
+		}
+		signer = p
+	default:
+		return nil, fmt.Errorf("unsupported key type %T", private)
+	}
+	key := &Key{ID: id, signer: signer}
+	if key.ID == "" {
+		key.ID = key.thumbprint()
+	}
+	return key, nil
+}
+
+// JWKS returns the public keys of every configured key.
+func (k *Keyring) JWKS() JWKSet {
+	set := JWKSet{Keys: []JWK{}}
+	if k == nil {
+		return set
+	}
+	for _, key := range k.keys {
+		set.Keys = append(set.Keys, key.JWK())
+	}
+	return set
+}
+
+// Active returns the key that signs requests.
+func (k *Keyring) Active() *Key {
+	return k.active
+}
+
+// JWK returns the public key as a JSON Web Key.
+func (k *Key) JWK() JWK {
+	switch pub := k.signer.Public().(type) {
+	case ed25519.PublicKey:
+		return JWK{Kty: "OKP", Crv: "Ed25519", X: b64.EncodeToString(pub), Kid: k.ID, Alg: "EdDSA", Use: "sig"}
+	case *ecdsa.PublicKey:
+		x, y := make([]byte, 32), make([]byte, 32)
+		pub.X.FillBytes(x)
+		pub.Y.FillBytes(y)
+		return JWK{Kty: "EC", Crv: "P-256", X: b64.EncodeToString(x), Y: b64.EncodeToString(y), Kid: k.ID, Alg: "ES256", Use: "sig"}
+	}
+	return JWK{}
+}
+
+// thumbprint computes the RFC 7638 JWK thumbprint: the SHA-256 of the
+// required members in lexicographic order.
+func (k *Key) thumbprint() string {
+	jwk := k.JWK()
+	var members interface{}
+	if jwk.Kty == "OKP" {
+		members = struct {
+			Crv string `json:"crv"`
+			Kty string `json:"kty"`
+			X   string `json:"x"`
+		}{jwk.Crv, jwk.Kty, jwk.X}
+	} else {
+		members = struct {
+			Crv string `json:"crv"`
+			Kty string `json:"kty"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		}{jwk.Crv, jwk.Kty, jwk.X, jwk.Y}
+	}
+	raw, _ := json.Marshal(members)
+	sum := sha256.Sum256(raw)
+	return b64.EncodeToString(sum[:])
+}
+
+// sign signs message with the key. ECDSA signatures are the fixed-size r||s
+// form both RFC 9421 and JWS use, not ASN.1.
+func (k *Key) sign(message []byte) ([]byte, error) {
+	switch p := k.signer.(type) {
+	case ed25519.PrivateKey:
+		return ed25519.Sign(p, message), nil
+	case *ecdsa.PrivateKey:
+		digest := sha256.Sum256(message)
+		r, s, err := ecdsa.Sign(rand.Reader, p, digest[:])
+		if err != nil {
+			return nil, err
+		}
+		sig := make([]byte, 64)
+		r.FillBytes(sig[:32])
+		s.FillBytes(sig[32:])
+		return sig, nil
+	}
+	return nil, errors.New("signing: unsupported key")
+}
+
+// httpAlg is the RFC 9421 algorithm name of the key.
+func (k *Key) httpAlg() string {
+	if _, ok := k.signer.(ed25519.PrivateKey); ok {
+		return "ed25519"
+	}
+	return "ecdsa-p256-sha256"
+}
@@ -0,0 +1,195 @@
+package signing
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/yamatt/matrix-as-webhook/internal/config"
+)
+
+// verify checks sig over message with the public key published in jwk.
+func verify(t *testing.T, jwk JWK, message, sig []byte) bool {
+	t.Helper()
+	x, _ := b64.DecodeString(jwk.X)
+	switch jwk.Kty {
+	case "OKP":
+		return ed25519.Verify(ed25519.PublicKey(x), message, sig)
+	case "EC":
+		y, _ := b64.DecodeString(jwk.Y)
+		pub := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		digest := sha256.Sum256(message)
+		return len(sig) == 64 && ecdsa.Verify(pub, digest[:], new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:]))
+	}
+	t.Fatalf("Unexpected key type %s", jwk.Kty)
+	return false
+}
+
+func testKeys(t *testing.T) []*Key {
+	t.Helper()
+	_, edPriv, _ := ed25519.GenerateKey(rand.Reader)
+	ecPriv, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	ed, err := NewKey("ed", edPriv)
+	if err != nil {
+		t.Fatalf("NewKey failed: %v", err)
+	}
+	ec, err := NewKey("", ecPriv)
+	if err != nil {
+		t.Fatalf("NewKey failed: %v", err)
+	}
+	return []*Key{ed, ec}
+}
+
+func TestKeyring_SignRequest(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	body := []byte(`{"event_id":"$1"}`)
+
+	for _, key := range testKeys(t) {
+		req, _ := http.NewRequest("POST", "https://receiver.example.org/hook?x=1", bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		if err := NewKeyring(key).SignRequest(req, body, now); err != nil {
+			t.Fatalf("SignRequest failed: %v", err)
+		}
+
+		digest := sha256.Sum256(body)
+		if want := "sha-256=:" + base64.StdEncoding.EncodeToString(digest[:]) + ":"; req.Header.Get("Content-Digest") != want {
+			t.Errorf("Expected Content-Digest %s, got %s", want, req.Header.Get("Content-Digest"))
+		}
+		input := req.Header.Get("Signature-Input")
+		wantParams := `("@method" "@target-uri" "content-type" "content-digest");created=1700000000;keyid="` + key.ID + `";alg="` + key.httpAlg() + `"`
+		if input != "sig1="+wantParams {
+			t.Errorf("Unexpected Signature-Input: %s", input)
+		}
+
+		// Rebuild the signature base the way a receiver would.
+		base := strings.Join([]string{
+			`"@method": POST`,
+			`"@target-uri": https://receiver.example.org/hook?x=1`,
+			`"content-type": application/json`,
+			`"content-digest": ` + req.Header.Get("Content-Digest"),
+			`"@signature-params": ` + wantParams,
+		}, "\n")
+		value := strings.TrimSuffix(strings.TrimPrefix(req.Header.Get("Signature"), "sig1=:"), ":")
+		sig, _ := base64.StdEncoding.DecodeString(value)
+		if !verify(t, key.JWK(), []byte(base), sig) {
+			t.Errorf("Expected %s signature to verify", key.httpAlg())
+		}
+		if verify(t, key.JWK(), []byte(strings.Replace(base, "POST", "PUT", 1)), sig) {
+			t.Error("Expected signature over a different method to fail")
+		}
+	}
+}
+
+func TestKeyring_SignJWS(t *testing.T) {
+	body := []byte(`{"event_id":"$1"}`)
+	for _, key := range testKeys(t) {
+		jws, err := NewKeyring(key).SignJWS(body, time.Unix(1700000000, 0))
+		if err != nil {
+			t.Fatalf("SignJWS failed: %v", err)
+		}
+		parts := strings.Split(jws, ".")
+		if len(parts) != 3 || parts[1] != "" {
+			t.Fatalf("Expected a detached JWS, got %s", jws)
+		}
+
+		raw, _ := b64.DecodeString(parts[0])
+		var header map[string]interface{}
+		if err := json.Unmarshal(raw, &header); err != nil {
+			t.Fatalf("Bad protected header: %v", err)
+		}
+		if header["kid"] != key.ID || header["alg"] != key.JWK().Alg || header["iat"] != float64(1700000000) {
+			t.Errorf("Unexpected protected header: %v", header)
+		}
+
+		sig, _ := b64.DecodeString(parts[2])
+		if !verify(t, key.JWK(), []byte(parts[0]+"."+b64.EncodeToString(body)), sig) {
+			t.Errorf("Expected %s JWS to verify", header["alg"])
+		}
+	}
+}
+
+func TestKey_Thumbprint(t *testing.T) {
+	// Example key and thumbprint from RFC 8037 appendix A.
+	seed, _ := b64.DecodeString("nWGxne_9WmC6hEr0kuwsxERJxWl7MmkZcDusAxyuf2A")
+	key, err := NewKey("", ed25519.NewKeyFromSeed(seed))
+	if err != nil {
+		t.Fatalf("NewKey failed: %v", err)
+	}
+	if jwk := key.JWK(); jwk.X != "11qYAYKxCrfVS_7TyWQHOg7hcvPapiMlrwIaaPcHURo" {
+		t.Errorf("Unexpected public key: %s", jwk.X)
+	}
+	if key.ID != "kPrK_qmxVWaYVA9wwBF6Iuo3vVzz7TxHCTwXBygrS4k" {
+		t.Errorf("Unexpected thumbprint: %s", key.ID)
+	}
+}
+
+func writeKey(t *testing.T, dir, name string, private interface{}) string {
+	t.Helper()
+	der, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		t.Fatalf("MarshalPKCS8PrivateKey failed: %v", err)
+	}
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0o600); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+	return path
+}
+
+func TestLoadKeyring(t *testing.T) {
+	dir := t.TempDir()
+	_, edPriv, _ := ed25519.GenerateKey(rand.Reader)
+	ecPriv, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	cfg := config.SigningConfig{
+		Keys: []config.SigningKeyConfig{
+			{ID: "2026-01", PrivateKeyFile: writeKey(t, dir, "old.pem", edPriv)},
+			{ID: "2026-10", PrivateKeyFile: writeKey(t, dir, "new.pem", ecPriv)},
+		},
+	}
+
+	keys, err := LoadKeyring(cfg)
+	if err != nil {
+		t.Fatalf("LoadKeyring failed: %v", err)
+	}
+	if keys.Active().ID != "2026-01" {
+		t.Errorf("Expected the first key to be active, got %s", keys.Active().ID)
+	}
+	set := keys.JWKS()
+	if len(set.Keys) != 2 || set.Keys[0].Alg != "EdDSA" || set.Keys[1].Alg != "ES256" {
+		t.Errorf("Unexpected JWKS: %+v", set)
+	}
+
+	cfg.ActiveKey = "2026-10"
+	if keys, err = LoadKeyring(cfg); err != nil || keys.Active().ID != "2026-10" {
+		t.Errorf("Expected active_key to select the new key, got %v", err)
+	}
+
+	cfg.ActiveKey = "missing"
+	if _, err := LoadKeyring(cfg); err == nil {
+		t.Error("Expected an unknown active_key to fail")
+	}
+
+	p384, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	cfg = config.SigningConfig{Keys: []config.SigningKeyConfig{{PrivateKeyFile: writeKey(t, dir, "p384.pem", p384)}}}
+	if _, err := LoadKeyring(cfg); err == nil {
+		t.Error("Expected a P-384 key to be rejected")
+	}
+
+	if keys, err := LoadKeyring(config.SigningConfig{}); keys != nil || err != nil {
+		t.Errorf("Expected no keyring without keys, got %v, %v", keys, err)
+	}
+}
@@ -0,0 +1,80 @@
+// Package tlsreload keeps values built from TLS files, such as certificates,
+// keys and CA bundles, up to date with the files on disk.
+package tlsreload
+
+import (
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// Reloader holds a value loaded from files and loads it again when the
+// files' modification times change. If the changed files do not load, the
+// previous value is kept and the error logged; the load is retried once
+// the files change again rather than on every use.
+type Reloader[T any] struct {
+	paths []string
+	load  func() (T, error)
+
+	mu       sync.Mutex
+	value    T
+	loaded   bool
+	modTimes []time.Time
+}
+
+// New creates a Reloader that builds its value with load from paths. Empty
+// paths are ignored.
+func New[T any](load func() (T, error), paths ...string) *Reloader[T] {
+	return &Reloader[T]{paths: paths, load: load}
+}
+
+// Get returns the value, loading it first if it has not been loaded or a
+// file changed. reloaded reports whether an earlier value was replaced. An
+// error is returned only if there is no earlier value to fall back to.
+func (r *Reloader[T]) Get() (value T, reloaded bool, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	modTimes := r.fileModTimes()
+	if r.loaded && sameTimes(r.modTimes, modTimes) {
+		return r.value, false, nil
+	}
+	v, err := r.load()
+	if err != nil {
+		if !r.loaded {
+			return value, false, err
+		}
+		slog.Error("keeping previous TLS files, reload failed", "files", r.paths, "error", err)
+		r.modTimes = modTimes
+		return r.value, false, nil
+	}
+	reloaded = r.loaded
+	if reloaded {
+		slog.Info("reloaded TLS files", "files", r.paths)
+	}
+	r.value, r.loaded, r.modTimes = v, true, modTimes
+	return v, reloaded, nil
+}
+
+func (r *Reloader[T]) fileModTimes() []time.Time {
+	times := make([]time.Time, len(r.paths))
+	for i, path := range r.paths {
+		if path == "" {
+			continue
+		}
+		if info, err := os.Stat(path); err == nil {
+			times[i] = info.ModTime()
+		}
+	}
+	return times
+}
+
+func sameTimes(a, b []time.Time) bool {
+	for i := range a {
+		if !a[i].Equal(b[i]) {
+			return false
+		}
+	}
+	return true
+}
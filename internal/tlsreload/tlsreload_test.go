@@ -0,0 +1,81 @@
+package tlsreload
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeFile writes data to path and sets its modification time.
+func writeFile(t *testing.T, path, data string, modTime time.Time) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+	if err := os.Chtimes(path, modTime, modTime); err != nil {
+		t.Fatalf("Chtimes failed: %v", err)
+	}
+}
+
+func TestReloader(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "value")
+	start := time.Now().Add(-time.Hour)
+	writeFile(t, path, "first", start)
+
+	loads := 0
+	r := New(func() (string, error) {
+		loads++
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return "", err
+		}
+		if string(data) == "broken" {
+			return "", errors.New("broken file")
+		}
+		return string(data), nil
+	}, path, "")
+
+	value, reloaded, err := r.Get()
+	if err != nil || value != "first" || reloaded {
+		t.Fatalf("Expected first load to return 'first', got %q, %v, %v", value, reloaded, err)
+	}
+	if _, _, _ = r.Get(); loads != 1 {
+		t.Errorf("Expected unchanged files not to be loaded again, got %d loads", loads)
+	}
+
+	writeFile(t, path, "second", start.Add(time.Minute))
+	value, reloaded, err = r.Get()
+	if err != nil || value != "second" || !reloaded {
+		t.Errorf("Expected changed file to reload 'second', got %q, %v, %v", value, reloaded, err)
+	}
+
+	writeFile(t, path, "broken", start.Add(2*time.Minute))
+	value, reloaded, err = r.Get()
+	if err != nil || value != "second" || reloaded {
+		t.Errorf("Expected broken file to keep 'second', got %q, %v, %v", value, reloaded, err)
+	}
+	before := loads
+	if _, _, _ = r.Get(); loads != before {
+		t.Errorf("Expected broken file not to be retried until it changes, got %d loads", loads-before)
+	}
+
+	writeFile(t, path, "third", start.Add(3*time.Minute))
+	if value, reloaded, _ = r.Get(); value != "third" || !reloaded {
+		t.Errorf("Expected fixed file to reload 'third', got %q, %v", value, reloaded)
+	}
+}
+
+func TestReloaderInitialError(t *testing.T) {
+	r := New(func() (int, error) {
+		return 0, errors.New("no files")
+	}, filepath.Join(t.TempDir(), "missing"))
+
+	if _, _, err := r.Get(); err == nil {
+		t.Error("Expected an error without an earlier value")
+	}
+	if _, _, err := r.Get(); err == nil {
+		t.Error("Expected the load to be retried while there is no value")
+	}
+}
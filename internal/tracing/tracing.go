@@ -0,0 +1,111 @@
+// Package tracing sets up OpenTelemetry tracing.
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/yamatt/matrix-as-webhook/internal/config"
+)
+
+// Exporters for TracingConfig.Exporter.
+const (
+	ExporterOTLPHTTP = "otlp-http"
+	ExporterOTLPGRPC = "otlp-grpc"
+	ExporterStdout   = "stdout"
+)
+
+const instrumentationName = "github.com/yamatt/matrix-as-webhook"
+
+// Tracer returns the tracer spans of this module are started with.
+func Tracer() trace.Tracer {
+	return otel.Tracer(instrumentationName)
+}
+
+// Setup installs the global tracer provider and the W3C trace context
+// propagator. The returned function flushes and stops the exporter. With no
+// exporter configured, spans are not recorded but incoming trace context is
+// still passed on to webhook receivers.
+func Setup(ctx context.Context, conf config.TracingConfig) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	if conf.Exporter == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	exporter, err := newExporter(ctx, conf)
+	if err != nil {
+		return nil, err
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(conf.SampleRatio))),
+		sdktrace.WithResource(newResource(conf.ServiceName)),
+	)
+	otel.SetTracerProvider(provider)
+	return provider.Shutdown, nil
+}
+
+func newExporter(ctx context.Context, conf config.TracingConfig) (sdktrace.SpanExporter, error) {
+	switch conf.Exporter {
+	case ExporterOTLPHTTP:
+		var opts []otlptracehttp.Option
+		if len(conf.Headers) > 0 {
+			opts = append(opts, otlptracehttp.WithHeaders(headers(conf)))
+		}
+		if conf.Endpoint != "" {
+			opts = append(opts, otlptracehttp.WithEndpointURL(conf.Endpoint))
+		}
+		if conf.Insecure {
+			opts = append(opts, otlptracehttp.WithInsecure())
+		}
+		return otlptracehttp.New(ctx, opts...)
+	case ExporterOTLPGRPC:
+		var opts []otlptracegrpc.Option
+		if len(conf.Headers) > 0 {
+			opts = append(opts, otlptracegrpc.WithHeaders(headers(conf)))
+		}
+		if conf.Endpoint != "" {
+			opts = append(opts, otlptracegrpc.WithEndpointURL(conf.Endpoint))
+		}
+		if conf.Insecure {
+			opts = append(opts, otlptracegrpc.WithInsecure())
+		}
+		return otlptracegrpc.New(ctx, opts...)
+	case ExporterStdout:
+		return stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+	default:
+		return nil, fmt.Errorf("tracing: unknown exporter %q", conf.Exporter)
+	}
+}
+
+func headers(conf config.TracingConfig) map[string]string {
+	out := make(map[string]string, len(conf.Headers))
+	for k, v := range conf.Headers {
+		out[k] = v.Value()
+	}
+	return out
+}
+
+// newResource describes this process; OTEL_RESOURCE_ATTRIBUTES and
+// OTEL_SERVICE_NAME still apply on top of it.
+func newResource(serviceName string) *resource.Resource {
+	res, err := resource.Merge(
+		resource.NewSchemaless(attribute.String("service.name", serviceName)),
+		resource.Environment(),
+	)
+	if err != nil {
+		return resource.Default()
+	}
+	return res
+}
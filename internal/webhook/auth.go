@@ -0,0 +1,149 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/yamatt/matrix-as-webhook/internal/config"
+)
+
+const (
+	// tokenRefreshMargin is how long before expiry a cached OAuth2 token is
+	// replaced, so that it does not expire in flight.
+	tokenRefreshMargin = time.Minute
+	// defaultTokenLifetime is assumed when a token response has no expires_in.
+	defaultTokenLifetime = 5 * time.Minute
+)
+
+// tokenCache holds OAuth2 access tokens per token endpoint, client and scope.
+// mu only guards the map; each entry has its own lock, held while its token
+// is fetched, so that deliveries needing the same token wait for one request
+// and the others are not held up.
+type tokenCache struct {
+	mu     sync.Mutex
+	tokens map[string]*cachedToken
+}
+
+type cachedToken struct {
+	// lock is held by whoever reads or fetches the token. It is a channel
+	// so that waiting for it can be cancelled.
+	lock    chan struct{}
+	value   string
+	expires time.Time
+}
+
+// entry returns the cache entry for key, adding an empty one if needed.
+func (c *tokenCache) entry(key string) *cachedToken {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t, ok := c.tokens[key]
+	if !ok {
+		t = &cachedToken{lock: make(chan struct{}, 1)}
+		c.tokens[key] = t
+	}
+	return t
+}
+
+// authorize adds the route's credentials to httpReq.
+func (s *Sender) authorize(httpReq *http.Request, auth config.AuthConfig) error {
+	switch auth.Type {
+	case "":
+	case "bearer":
+		httpReq.Header.Set("Authorization", "Bearer "+auth.Token.Value())
+	case "basic":
+		httpReq.SetBasicAuth(auth.Username, auth.Password.Value())
+	case "api_key":
+		httpReq.Header.Set(auth.Header, auth.Key.Value())
+	case "oauth2":
+		token, err := s.oauth2Token(httpReq.Context(), auth)
+		if err != nil {
+			return err
+		}
+		httpReq.Header.Set("Authorization", "Bearer "+token)
+	default:
+		return fmt.Errorf("webhook: unknown auth type %q", auth.Type)
+	}
+	return nil
+}
+
+func tokenKey(auth config.AuthConfig) string {
+	return auth.TokenURL + "|" + auth.ClientID + "|" + strings.Join(auth.Scopes, " ") + "|" + auth.Audience
+}
+
+// oauth2Token returns a cached access token, fetching a new one with the
+// client credentials grant (RFC 6749 section 4.4) when it is missing or
+// about to expire. Only one token request is made at a time for each key.
+func (s *Sender) oauth2Token(ctx context.Context, auth config.AuthConfig) (string, error) {
+	t := s.tokens.entry(tokenKey(auth))
+	select {
+	case t.lock <- struct{}{}:
+	case <-ctx.Done():
+		return "", fmt.Errorf("webhook: waiting for token: %w", ctx.Err())
+	}
+	defer func() { <-t.lock }()
+
+	if t.value != "" && s.now().Add(tokenRefreshMargin).Before(t.expires) {
+		return t.value, nil
+	}
+
+	form := url.Values{"grant_type": {"client_credentials"}}
+	if len(auth.Scopes) > 0 {
+		form.Set("scope", strings.Join(auth.Scopes, " "))
+	}
+	if auth.Audience != "" {
+		form.Set("audience", auth.Audience)
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", auth.TokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", fmt.Errorf("webhook: token request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(url.QueryEscape(auth.ClientID), url.QueryEscape(auth.ClientSecret.Value()))
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("webhook: token request: %w", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1024*1024))
+	if err != nil {
+		return "", fmt.Errorf("webhook: token response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("webhook: token endpoint returned %d: %s", resp.StatusCode, body)
+	}
+
+	var token struct {
+		AccessToken string `json:"access_token"`
+		TokenType   string `json:"token_type"`
+		ExpiresIn   int64  `json:"expires_in"`
+	}
+	if err := json.Unmarshal(body, &token); err != nil || token.AccessToken == "" {
+		return "", fmt.Errorf("webhook: token endpoint returned no access_token")
+	}
+	if token.TokenType != "" && !strings.EqualFold(token.TokenType, "bearer") {
+		return "", fmt.Errorf("webhook: unsupported token type %q", token.TokenType)
+	}
+	lifetime := defaultTokenLifetime
+	if token.ExpiresIn > 0 {
+		lifetime = time.Duration(token.ExpiresIn) * time.Second
+	}
+	t.value, t.expires = token.AccessToken, s.now().Add(lifetime)
+	return token.AccessToken, nil
+}
+
+// forgetToken drops the cached token after the receiver rejected it, so the
+// next request fetches a new one.
+func (s *Sender) forgetToken(auth config.AuthConfig) {
+	s.tokens.mu.Lock()
+	defer s.tokens.mu.Unlock()
+	delete(s.tokens.tokens, tokenKey(auth))
+}
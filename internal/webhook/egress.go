@@ -0,0 +1,217 @@
+package webhook
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/yamatt/matrix-as-webhook/internal/config"
+)
+
+// ErrBlockedDestination is returned when a webhook would connect to an
+// address the egress policy does not allow.
+var ErrBlockedDestination = errors.New("webhook: destination blocked by egress policy")
+
+// blockedPrefixes are the ranges webhooks may not reach unless allowed:
+// addresses on this host, private networks and cloud metadata services.
+var blockedPrefixes = mustPrefixes(
+	"0.0.0.0/8",      // "this" network
+	"10.0.0.0/8",     // private
+	"100.64.0.0/10",  // carrier-grade NAT, including 100.100.100.200 metadata
+	"127.0.0.0/8",    // loopback
+	"169.254.0.0/16", // link-local, including 169.254.169.254 metadata
+	"172.16.0.0/12",  // private
+	"192.0.0.0/24",   // IETF protocol assignments
+	"192.168.0.0/16", // private
+	"198.18.0.0/15",  // benchmarking
+	"224.0.0.0/4",    // multicast
+	"240.0.0.0/4",    // reserved and broadcast
+	"::/128",         // unspecified
+	"::1/128",        // loopback
+	"64:ff9b::/96",   // NAT64, which maps onto IPv4 ranges above
+	"fc00::/7",       // unique local, including fd00:ec2::254 metadata
+	"fe80::/10",      // link-local
+	"ff00::/8",       // multicast
+	"2001:db8::/32",  // documentation
+)
+
+func mustPrefixes(cidrs ...string) []netip.Prefix {
+	out := make([]netip.Prefix, len(cidrs))
+	for i, c := range cidrs {
+		out[i] = netip.MustParsePrefix(c)
+	}
+	return out
+}
+
+// EgressPolicy decides which addresses webhook requests may connect to. It
+// is enforced when dialling, after DNS resolution, so a host name cannot be
+// re-pointed at a blocked address between check and connect.
+type EgressPolicy struct {
+	allowCIDRs   []netip.Prefix
+	allowHosts   []string
+	maxRedirects int
+	proxy        *url.URL // nil to connect directly
+}
+
+// NewEgressPolicy builds a policy from the configuration, ignoring invalid
+// CIDRs and proxy URLs with a log message.
+func NewEgressPolicy(conf config.EgressConfig) *EgressPolicy {
+	p := &EgressPolicy{maxRedirects: conf.MaxRedirects}
+	if p.maxRedirects == 0 {
+		p.maxRedirects = config.DefaultMaxRedirects
+	}
+	if conf.Proxy != "" {
+		proxy, err := ParseProxy(conf.Proxy)
+		if err != nil {
+			slog.Warn("ignoring invalid egress proxy", "error", err)
+		}
+		p.proxy = proxy
+	}
+	for _, c := range conf.AllowCIDRs {
+		prefix, err := netip.ParsePrefix(c)
+		if err != nil {
+			slog.Warn("ignoring invalid egress CIDR", "cidr", c, "error", err)
+			continue
+		}
+		p.allowCIDRs = append(p.allowCIDRs, prefix.Masked())
+	}
+	for _, h := range conf.AllowHosts {
+		p.allowHosts = append(p.allowHosts, strings.ToLower(strings.TrimSuffix(h, ".")))
+	}
+	return p
+}
+
+// ParseProxy parses the [egress] proxy URL.
+func ParseProxy(raw string) (*url.URL, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, fmt.Errorf("egress proxy: %w", err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("egress proxy: %s is not an http or https URL", u.Redacted())
+	}
+	return u, nil
+}
+
+// hostAllowed reports whether host is on the host allowlist.
+func (p *EgressPolicy) hostAllowed(host string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, allowed := range p.allowHosts {
+		if suffix, ok := strings.CutPrefix(allowed, "*."); ok {
+			if strings.HasSuffix(host, "."+suffix) {
+				return true
+			}
+		} else if host == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// addrAllowed reports whether ip may be connected to.
+func (p *EgressPolicy) addrAllowed(ip netip.Addr) bool {
+	ip = ip.Unmap()
+	for _, prefix := range p.allowCIDRs {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+	for _, prefix := range blockedPrefixes {
+		if prefix.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// control runs on every connection attempt with the resolved address.
+func (p *EgressPolicy) control(_, address string, _ syscall.RawConn) error {
+	addrPort, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrBlockedDestination, address)
+	}
+	if !p.addrAllowed(addrPort.Addr()) {
+		return fmt.Errorf("%w: %s", ErrBlockedDestination, addrPort.Addr())
+	}
+	return nil
+}
+
+// dialContext dials addr, checking every resolved address unless the host
+// name is explicitly allowed.
+func (p *EgressPolicy) dialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	d := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if !p.hostAllowed(host) {
+		d.Control = p.control
+	}
+	return d.DialContext(ctx, network, addr)
+}
+
+// checkTarget resolves a request's host and checks its addresses, for
+// requests sent through the proxy, where the dialler only sees the proxy's
+// address. The proxy may resolve the name differently, so this is weaker
+// than the check when dialling directly.
+func (p *EgressPolicy) checkTarget(ctx context.Context, host string) error {
+	if p.hostAllowed(host) {
+		return nil
+	}
+	addrs, err := net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+	if err != nil {
+		return fmt.Errorf("%w: resolving %s: %v", ErrBlockedDestination, host, err)
+	}
+	for _, addr := range addrs {
+		if !p.addrAllowed(addr) {
+			return fmt.Errorf("%w: %s", ErrBlockedDestination, addr.Unmap())
+		}
+	}
+	return nil
+}
+
+// proxyFor returns the proxy for a request after checking its target; it
+// is called again for every redirect hop.
+func (p *EgressPolicy) proxyFor(req *http.Request) (*url.URL, error) {
+	if err := p.checkTarget(req.Context(), req.URL.Hostname()); err != nil {
+		return nil, err
+	}
+	return p.proxy, nil
+}
+
+// checkRedirect limits redirects and refuses non-HTTP schemes. Each hop is
+// dialled through the same policy, so a redirect to a blocked address fails
+// when it connects.
+func (p *EgressPolicy) checkRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) > p.maxRedirects {
+		return fmt.Errorf("webhook: stopped after %d redirects", p.maxRedirects)
+	}
+	if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+		return fmt.Errorf("%w: redirect to %s", ErrBlockedDestination, req.URL.Scheme)
+	}
+	slog.Debug("following webhook redirect", "url", req.URL.Redacted())
+	return nil
+}
+
+// newTransport returns an HTTP transport that dials through the policy.
+// Proxies from the environment are not used, since the policy would then
+// only see the proxy's address. The configured proxy is dialled through the
+// policy like any other address, so an internal proxy must be allowed, and
+// the targets sent through it are checked before each request.
+func (p *EgressPolicy) newTransport() *http.Transport {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.Proxy = nil
+	if p.proxy != nil {
+		t.Proxy = p.proxyFor
+	}
+	t.DialContext = p.dialContext
+	return t
+}
@@ -0,0 +1,103 @@
+package webhook
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"sync"
+
+	"github.com/yamatt/matrix-as-webhook/internal/config"
+	"github.com/yamatt/matrix-as-webhook/internal/tlsreload"
+)
+
+// tlsClients holds an HTTP client per distinct route TLS configuration.
+type tlsClients struct {
+	mu      sync.Mutex
+	clients map[config.TLSConfig]*tlsClient
+}
+
+// tlsClient is a client built from a TLS configuration, which is reloaded
+// when its files change.
+type tlsClient struct {
+	files  *tlsreload.Reloader[*tls.Config]
+	client *http.Client
+}
+
+var tlsVersions = map[string]uint16{
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// clientFor returns the HTTP client for a route's TLS settings. Clients are
+// rebuilt when a certificate, key or CA file changes; if the new files do not
+// load, the previous client keeps being used.
+func (s *Sender) clientFor(conf config.TLSConfig) (*http.Client, error) {
+	if conf == (config.TLSConfig{}) {
+		return s.client, nil
+	}
+
+	s.tlsClients.mu.Lock()
+	defer s.tlsClients.mu.Unlock()
+
+	c := s.tlsClients.clients[conf]
+	if c == nil {
+		c = &tlsClient{files: tlsreload.New(func() (*tls.Config, error) {
+			return buildTLSConfig(conf)
+		}, conf.CertFile, conf.KeyFile, conf.CAFile)}
+	}
+	tlsConf, reloaded, err := c.files.Get()
+	if err != nil {
+		return nil, err
+	}
+	if c.client == nil || reloaded {
+		if c.client != nil {
+			c.client.CloseIdleConnections()
+		}
+		c.client = s.newClient(tlsConf)
+		s.tlsClients.clients[conf] = c
+	}
+	return c.client, nil
+}
+
+// buildTLSConfig loads the files of a route's TLS settings.
+func buildTLSConfig(conf config.TLSConfig) (*tls.Config, error) {
+	tlsConf := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		ServerName:         conf.ServerName,
+		InsecureSkipVerify: conf.InsecureSkipVerify,
+	}
+	if conf.MinVersion != "" {
+		v, ok := tlsVersions[conf.MinVersion]
+		if !ok {
+			return nil, fmt.Errorf("webhook: unsupported TLS min_version %q", conf.MinVersion)
+		}
+		tlsConf.MinVersion = v
+	}
+	if conf.InsecureSkipVerify {
+		slog.Warn("TLS certificate verification is disabled for a route")
+	}
+
+	if conf.CertFile != "" || conf.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(conf.CertFile, conf.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("webhook: client certificate: %w", err)
+		}
+		tlsConf.Certificates = []tls.Certificate{cert}
+	}
+	if conf.CAFile != "" {
+		pem, err := os.ReadFile(conf.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("webhook: CA bundle: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("webhook: CA bundle contains no certificates")
+		}
+		tlsConf.RootCAs = pool
+	}
+	return tlsConf, nil
+}
@@ -0,0 +1,178 @@
+package webhook
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/yamatt/matrix-as-webhook/internal/config"
+)
+
+// testCA issues certificates for TLS tests.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("CreateCertificate failed: %v", err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return &testCA{cert: cert, key: key, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+// issue returns a PEM certificate and key for commonName, valid for 127.0.0.1.
+func (ca *testCA) issue(t *testing.T, commonName string, usage x509.ExtKeyUsage) ([]byte, []byte) {
+	t.Helper()
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		DNSNames:     []string{"receiver.internal"},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatalf("CreateCertificate failed: %v", err)
+	}
+	keyDER, _ := x509.MarshalPKCS8PrivateKey(key)
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})
+}
+
+func writeFile(t *testing.T, path string, data []byte, modTime time.Time) {
+	t.Helper()
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+	if err := os.Chtimes(path, modTime, modTime); err != nil {
+		t.Fatalf("Chtimes failed: %v", err)
+	}
+}
+
+// newMTLSServer starts a server that requires a client certificate issued
+// by ca and records the client's common name.
+func newMTLSServer(t *testing.T, ca *testCA, clientCN *string) *httptest.Server {
+	t.Helper()
+	certPEM, keyPEM := ca.issue(t, "receiver", x509.ExtKeyUsageServerAuth)
+	serverCert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatalf("X509KeyPair failed: %v", err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*clientCN = r.TLS.PeerCertificates[0].Subject.CommonName
+		w.WriteHeader(http.StatusOK)
+	}))
+	srv.TLS = &tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    pool,
+	}
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestSend_MutualTLS(t *testing.T) {
+	ca := newTestCA(t)
+	var clientCN string
+	srv := newMTLSServer(t, ca, &clientCN)
+
+	dir := t.TempDir()
+	conf := config.TLSConfig{
+		CertFile:   filepath.Join(dir, "client.pem"),
+		KeyFile:    filepath.Join(dir, "client-key.pem"),
+		CAFile:     filepath.Join(dir, "ca.pem"),
+		ServerName: "receiver.internal",
+		MinVersion: "1.3",
+	}
+	past := time.Now().Add(-time.Minute)
+	certPEM, keyPEM := ca.issue(t, "client-1", x509.ExtKeyUsageClientAuth)
+	writeFile(t, conf.CertFile, certPEM, past)
+	writeFile(t, conf.KeyFile, keyPEM, past)
+	writeFile(t, conf.CAFile, ca.pem, past)
+
+	sender := newTestSender()
+	if resp := sender.Send(Request{URL: srv.URL, Payload: map[string]interface{}{}}); resp.Error == nil {
+		t.Error("Expected a request without the private CA to fail")
+	}
+
+	req := Request{URL: srv.URL, Payload: map[string]interface{}{}, TLS: conf}
+	if resp := sender.Send(req); resp.Error != nil || clientCN != "client-1" {
+		t.Fatalf("Expected client-1 to authenticate, got %q, %v", clientCN, resp.Error)
+	}
+
+	// A renewed certificate is picked up without a restart.
+	certPEM, keyPEM = ca.issue(t, "client-2", x509.ExtKeyUsageClientAuth)
+	writeFile(t, conf.CertFile, certPEM, time.Now())
+	writeFile(t, conf.KeyFile, keyPEM, time.Now())
+	if resp := sender.Send(req); resp.Error != nil || clientCN != "client-2" {
+		t.Errorf("Expected the reloaded client-2 certificate, got %q, %v", clientCN, resp.Error)
+	}
+
+	// A broken file keeps the previous certificate in use.
+	writeFile(t, conf.KeyFile, []byte("not a key"), time.Now().Add(time.Minute))
+	if resp := sender.Send(req); resp.Error != nil || clientCN != "client-2" {
+		t.Errorf("Expected the previous certificate after a failed reload, got %q, %v", clientCN, resp.Error)
+	}
+}
+
+func TestSend_TLSSettingsErrors(t *testing.T) {
+	sender := newTestSender()
+	for _, conf := range []config.TLSConfig{
+		{MinVersion: "1.1"},
+		{CAFile: filepath.Join(t.TempDir(), "missing.pem")},
+		{CertFile: filepath.Join(t.TempDir(), "missing.pem"), KeyFile: "missing-key.pem"},
+	} {
+		if resp := sender.Send(Request{URL: "https://127.0.0.1:1", Payload: map[string]interface{}{}, TLS: conf}); resp.Error == nil {
+			t.Errorf("Expected TLS settings %+v to fail", conf)
+		}
+	}
+}
+
+func TestSend_InsecureSkipVerify(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	sender := newTestSender()
+	resp := sender.Send(Request{URL: srv.URL, Payload: map[string]interface{}{}, TLS: config.TLSConfig{InsecureSkipVerify: true}})
+	if resp.Error != nil || resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected the self-signed server to be accepted, got %d, %v", resp.StatusCode, resp.Error)
+	}
+}
@@ -2,19 +2,110 @@ package webhook
 
 import (
 	"bytes"
+	"context"
 	"crypto/hmac"
 	"crypto/sha256"
+	"crypto/tls"
 	"encoding/hex"
 	"encoding/json"
+	"fmt"
 	"io"
-	"log"
+	"mime"
+	"mime/multipart"
 	"net/http"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"sync"
 	"time"
+
+	"github.com/yamatt/matrix-as-webhook/internal/config"
+	"github.com/yamatt/matrix-as-webhook/internal/logging"
+	"github.com/yamatt/matrix-as-webhook/internal/metrics"
+	"github.com/yamatt/matrix-as-webhook/internal/signing"
+	"github.com/yamatt/matrix-as-webhook/internal/tracing"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Signing schemes for outgoing requests.
+const (
+	// SchemeLegacy signs the body alone into X-Webhook-Signature.
+	SchemeLegacy = "legacy"
+	// SchemeStandard follows the Standard Webhooks spec
+	// (https://www.standardwebhooks.com): webhook-id, webhook-timestamp and
+	// webhook-signature headers over "id.timestamp.body".
+	SchemeStandard = "standard"
+	// SchemeHTTPSignature signs with an asymmetric key per HTTP Message
+	// Signatures (RFC 9421).
+	SchemeHTTPSignature = "http-signature"
+	// SchemeJWS sends a detached JWS of the body in X-Webhook-JWS.
+	SchemeJWS = "jws"
 )
 
 // Sender handles HTTP dispatch to webhook endpoints.
 type Sender struct {
-	client *http.Client
+	client     *http.Client
+	now        func() time.Time
+	keys       *signing.Keyring // nil unless asymmetric signing keys are configured
+	egress     *EgressPolicy
+	tokens     tokenCache
+	tlsClients tlsClients
+	loads      routeLoads
+}
+
+// Load is what a sender has done and is doing for a route.
+type Load struct {
+	// InFlight is the number of requests waiting for a response
+	InFlight int `json:"in_flight"`
+	// Retries counts the requests sent since startup that were not the
+	// first attempt at their message
+	Retries uint64 `json:"retries"`
+}
+
+// routeLoads holds the Load of each route, keyed by route name.
+type routeLoads struct {
+	mu     sync.Mutex
+	routes map[string]*Load
+}
+
+// begin counts a request to a route until the returned function is called.
+func (l *routeLoads) begin(route string, attempt int) func() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.routes == nil {
+		l.routes = make(map[string]*Load)
+	}
+	load, ok := l.routes[route]
+	if !ok {
+		load = &Load{}
+		l.routes[route] = load
+	}
+	load.InFlight++
+	metrics.DeliveriesInFlight.WithLabelValues(route).Inc()
+	if attempt > 1 {
+		load.Retries++
+		metrics.DeliveryRetries.WithLabelValues(route).Inc()
+	}
+	return func() {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		load.InFlight--
+		metrics.DeliveriesInFlight.WithLabelValues(route).Dec()
+	}
+}
+
+// Load returns what the sender has done and is doing for a route.
+func (s *Sender) Load(route string) Load {
+	s.loads.mu.Lock()
+	defer s.loads.mu.Unlock()
+	if load, ok := s.loads.routes[route]; ok {
+		return *load
+	}
+	return Load{}
 }
 
 // NewSender creates a new webhook sender with a configured HTTP client.
@@ -22,17 +113,68 @@ func NewSender(timeout time.Duration) *Sender {
 	if timeout == 0 {
 		timeout = 30 * time.Second
 	}
-	return &Sender{
+	s := &Sender{
 		client: &http.Client{Timeout: timeout},
+		now:    time.Now,
+		tokens: tokenCache{tokens: make(map[string]*cachedToken)},
 	}
+	s.SetEgressPolicy(NewEgressPolicy(config.EgressConfig{}))
+	return s
+}
+
+// SetEgressPolicy replaces the policy deciding which addresses requests may
+// connect to. By default internal and metadata addresses are blocked.
+func (s *Sender) SetEgressPolicy(policy *EgressPolicy) {
+	s.egress = policy
+	s.client = s.newClient(nil)
+	s.tlsClients = tlsClients{clients: make(map[config.TLSConfig]*tlsClient)}
+}
+
+// newClient returns an HTTP client that dials through the egress policy.
+func (s *Sender) newClient(tlsConf *tls.Config) *http.Client {
+	transport := s.egress.newTransport()
+	if tlsConf != nil {
+		transport.TLSClientConfig = tlsConf
+	}
+	return &http.Client{Timeout: s.client.Timeout, Transport: transport, CheckRedirect: s.egress.checkRedirect}
+}
+
+// SetKeyring sets the keys requests with SchemeHTTPSignature or SchemeJWS
+// are signed with.
+func (s *Sender) SetKeyring(keys *signing.Keyring) {
+	s.keys = keys
 }
 
 // Request represents a webhook request to be sent.
 type Request struct {
+	// Route is the name of the route the request is for, used in logs and metrics
+	Route string
+	// Attempt numbers deliveries of the same message, starting at 1
+	Attempt      int
 	URL          string
 	Method       string
 	Payload      map[string]interface{}
-	SharedSecret string // Optional shared secret for HMAC-SHA256 signing
+	SharedSecret string       // Optional shared secret for HMAC-SHA256 signing
+	Attachments  []Attachment // Optional files; when present the request is multipart/form-data
+	// Signing selects SchemeLegacy (default), SchemeStandard,
+	// SchemeHTTPSignature or SchemeJWS
+	Signing string
+	// SigningSecrets are the "whsec_" secrets used by SchemeStandard
+	SigningSecrets []string
+	// MessageID is sent as webhook-id with SchemeStandard; random if empty
+	MessageID string
+	// Auth holds the credentials presented to the receiver
+	Auth config.AuthConfig
+	// TLS holds client certificates and trusted CAs for the receiver
+	TLS config.TLSConfig
+}
+
+// Attachment is a file sent alongside the JSON payload in a multipart request.
+type Attachment struct {
+	FieldName   string
+	Filename    string
+	ContentType string
+	Data        []byte
 }
 
 // Response represents the result of sending a webhook.
@@ -40,58 +182,237 @@ type Response struct {
 	StatusCode int
 	Error      error
 	Body       []byte
+	// Duration is how long the attempt took
+	Duration time.Duration
 }
 
 // Send dispatches a webhook request and returns the response.
 func (s *Sender) Send(req Request) Response {
+	return s.SendContext(context.Background(), req)
+}
+
+// SendContext is like Send, recording the attempt as a span under ctx and
+// passing the trace context to the receiver in a traceparent header.
+func (s *Sender) SendContext(ctx context.Context, req Request) Response {
+	if req.Attempt == 0 {
+		req.Attempt = 1
+	}
+	ctx, span := tracing.Tracer().Start(ctx, "webhook.send", trace.WithSpanKind(trace.SpanKindClient))
+	defer span.End()
+	span.SetAttributes(attribute.String("webhook.route", req.Route), attribute.Int("webhook.attempt", req.Attempt))
+	ctx = logging.With(ctx, logging.KeyRoute, req.Route, logging.KeyAttempt, req.Attempt)
+	defer s.loads.begin(req.Route, req.Attempt)()
+
+	start := time.Now()
+	resp := s.send(ctx, req)
+	resp.Duration = time.Since(start)
+	observe(req.Route, resp, resp.Duration)
+
+	if resp.StatusCode != 0 {
+		span.SetAttributes(attribute.Int("http.response.status_code", resp.StatusCode))
+	}
+	if resp.Error != nil {
+		span.RecordError(resp.Error)
+		span.SetStatus(codes.Error, resp.Error.Error())
+	} else if resp.StatusCode >= 400 {
+		span.SetStatus(codes.Error, http.StatusText(resp.StatusCode))
+	}
+	return resp
+}
+
+// observe records the outcome of a request in the delivery metrics.
+func observe(route string, resp Response, took time.Duration) {
+	class := metrics.StatusClass(resp.StatusCode)
+	metrics.DeliveryAttempts.WithLabelValues(route, class).Inc()
+	metrics.DeliveryDuration.WithLabelValues(route, class).Observe(took.Seconds())
+	if resp.Error == nil && resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		metrics.DeliverySuccesses.WithLabelValues(route).Inc()
+	} else {
+		metrics.DeliveryFailures.WithLabelValues(route, class).Inc()
+	}
+}
+
+func (s *Sender) send(ctx context.Context, req Request) Response {
 	if req.Method == "" {
 		req.Method = "POST"
 	}
-
-	log.Printf("Webhook: sending to %s with method %s", req.URL, req.Method)
+	logger := logging.FromContext(ctx)
+	logger.Debug("sending webhook", "url", RedactURL(req.URL), "method", req.Method)
 
 	payloadBytes, err := json.Marshal(req.Payload)
 	if err != nil {
-		log.Printf("Webhook: error marshaling payload: %v", err)
+		logger.Error("error marshaling webhook payload", "error", err)
 		return Response{Error: err}
 	}
 
-	httpReq, err := http.NewRequest(req.Method, req.URL, bytes.NewBuffer(payloadBytes))
+	body, contentType := payloadBytes, "application/json"
+	if len(req.Attachments) > 0 {
+		body, contentType, err = encodeMultipart(payloadBytes, req.Attachments)
+		if err != nil {
+			logger.Error("error encoding attachments", "error", err)
+			return Response{Error: err}
+		}
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, req.Method, req.URL, bytes.NewBuffer(body))
 	if err != nil {
-		log.Printf("Webhook: error creating request: %v", err)
+		logger.Error("error creating webhook request", "error", err)
+		return Response{Error: err}
+	}
+	httpReq.Header.Set("Content-Type", contentType)
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(httpReq.Header))
+	trace.SpanFromContext(ctx).SetAttributes(
+		attribute.String("http.request.method", req.Method),
+		attribute.String("server.address", httpReq.URL.Hostname()),
+	)
+
+	if err := s.sign(httpReq, req, body); err != nil {
+		logger.Error("error signing webhook request", "error", err)
+		return Response{Error: err}
+	}
+
+	if err := s.authorize(httpReq, req.Auth); err != nil {
+		logger.Error("error authorizing webhook request", "error", err)
 		return Response{Error: err}
 	}
-	httpReq.Header.Set("Content-Type", "application/json")
 
-	// Add signature header if shared secret is provided
-	if req.SharedSecret != "" {
-		signature := generateSignature(payloadBytes, req.SharedSecret)
-		httpReq.Header.Set("X-Webhook-Signature", signature)
-		log.Printf("Webhook: added signature header to request")
+	client, err := s.clientFor(req.TLS)
+	if err != nil {
+		logger.Error("error loading TLS settings", "error", err)
+		return Response{Error: err}
 	}
 
-	resp, err := s.client.Do(httpReq)
+	resp, err := client.Do(httpReq)
 	if err != nil {
-		log.Printf("Webhook: error sending to %s: %v", req.URL, err)
+		logger.Warn("webhook request failed", "url", RedactURL(req.URL), "error", err)
 		return Response{Error: err}
 	}
 	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusUnauthorized && req.Auth.Type == "oauth2" {
+		s.forgetToken(req.Auth)
+	}
 
 	respBody, err := io.ReadAll(io.LimitReader(resp.Body, 1024*1024))
 	if err != nil {
-		log.Printf("Webhook: error reading response: %v", err)
+		logger.Warn("error reading webhook response", "error", err)
 		return Response{StatusCode: resp.StatusCode, Error: err}
 	}
 
-	log.Printf("Webhook: sent to %s, status: %d", req.URL, resp.StatusCode)
-
 	if resp.StatusCode >= 400 {
-		log.Printf("Webhook: error response from %s: %s", req.URL, string(respBody))
+		logger.Warn("webhook rejected", "url", RedactURL(req.URL), "status", resp.StatusCode, "response", Snippet(respBody))
+	} else {
+		logger.Info("webhook sent", "url", RedactURL(req.URL), "status", resp.StatusCode)
 	}
 
 	return Response{StatusCode: resp.StatusCode, Body: respBody}
 }
 
+// RedactURL hides the password and query of a URL, which may hold credentials.
+func RedactURL(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "<invalid URL>"
+	}
+	if u.RawQuery != "" {
+		u.RawQuery = "redacted"
+	}
+	return u.Redacted()
+}
+
+// Snippet returns the start of a response body for logs and the history.
+func Snippet(body []byte) string {
+	const max = 512
+	if len(body) > max {
+		return string(body[:max]) + "..."
+	}
+	return string(body)
+}
+
+// sign adds the signature headers of the request's signing scheme.
+func (s *Sender) sign(httpReq *http.Request, req Request, body []byte) error {
+	switch req.Signing {
+	case "", SchemeLegacy:
+		// Add signature header if shared secret is provided
+		if req.SharedSecret != "" {
+			signature := generateSignature(body, req.SharedSecret)
+			httpReq.Header.Set("X-Webhook-Signature", signature)
+		}
+	case SchemeStandard:
+		id := req.MessageID
+		if id == "" {
+			id = newMessageID()
+		}
+		timestamp := s.now().Unix()
+		signature, err := signStandard(id, timestamp, body, req.SigningSecrets)
+		if err != nil {
+			return err
+		}
+		httpReq.Header.Set("webhook-id", id)
+		httpReq.Header.Set("webhook-timestamp", strconv.FormatInt(timestamp, 10))
+		httpReq.Header.Set("webhook-signature", signature)
+	case SchemeHTTPSignature, SchemeJWS:
+		if s.keys == nil {
+			return fmt.Errorf("webhook: %s signing needs keys in [signing]", req.Signing)
+		}
+		if req.Signing == SchemeJWS {
+			jws, err := s.keys.SignJWS(body, s.now())
+			if err != nil {
+				return err
+			}
+			httpReq.Header.Set("X-Webhook-JWS", jws)
+			return nil
+		}
+		return s.keys.SignRequest(httpReq, body, s.now())
+	default:
+		return fmt.Errorf("webhook: unknown signing scheme %q", req.Signing)
+	}
+	return nil
+}
+
+// encodeMultipart builds a multipart/form-data body with the JSON payload in
+// a "payload" part followed by one part per attachment.
+func encodeMultipart(payload []byte, attachments []Attachment) ([]byte, string, error) {
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+
+	header := textproto.MIMEHeader{}
+	header.Set("Content-Disposition", `form-data; name="payload"`)
+	header.Set("Content-Type", "application/json")
+	part, err := mw.CreatePart(header)
+	if err != nil {
+		return nil, "", err
+	}
+	if _, err := part.Write(payload); err != nil {
+		return nil, "", err
+	}
+
+	for _, a := range attachments {
+		field := a.FieldName
+		if field == "" {
+			field = "file"
+		}
+		contentType := a.ContentType
+		if contentType == "" {
+			contentType = "application/octet-stream"
+		}
+		header := textproto.MIMEHeader{}
+		header.Set("Content-Disposition", mime.FormatMediaType("form-data", map[string]string{"name": field, "filename": a.Filename}))
+		header.Set("Content-Type", contentType)
+		part, err := mw.CreatePart(header)
+		if err != nil {
+			return nil, "", err
+		}
+		if _, err := part.Write(a.Data); err != nil {
+			return nil, "", err
+		}
+	}
+
+	if err := mw.Close(); err != nil {
+		return nil, "", err
+	}
+	return buf.Bytes(), mw.FormDataContentType(), nil
+}
+
 // generateSignature creates an HMAC-SHA256 signature of the payload.
 // The signature is hex-encoded and prefixed with "sha256=" for clarity.
 func generateSignature(payload []byte, sharedSecret string) string {
@@ -100,3 +421,10 @@ func generateSignature(payload []byte, sharedSecret string) string {
 	signature := hex.EncodeToString(h.Sum(nil))
 	return "sha256=" + signature
 }
+
+// VerifySignature reports whether signature is a valid "sha256=" HMAC of payload
+// under sharedSecret, using a constant-time comparison.
+func VerifySignature(payload []byte, sharedSecret, signature string) bool {
+	expected := generateSignature(payload, sharedSecret)
+	return hmac.Equal([]byte(signature), []byte(expected))
+}
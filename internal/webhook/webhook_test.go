@@ -1,15 +1,36 @@
 package webhook
 
 import (
+	"bytes"
+	"context"
 	"crypto/hmac"
 	"crypto/sha256"
+	"encoding/base64"
 	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
+
+	"github.com/yamatt/matrix-as-webhook/internal/config"
 )
 
+// newTestSender returns a sender allowed to reach the loopback test servers.
+func newTestSender() *Sender {
+	sender := NewSender(5 * time.Second)
+	sender.SetEgressPolicy(NewEgressPolicy(config.EgressConfig{AllowCIDRs: []string{"127.0.0.0/8"}}))
+	return sender
+}
+
 func TestSend_Success(t *testing.T) {
 	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != "POST" {
@@ -22,7 +43,7 @@ func TestSend_Success(t *testing.T) {
 	}))
 	defer testServer.Close()
 
-	sender := NewSender(5 * time.Second)
+	sender := newTestSender()
 	req := Request{
 		URL:    testServer.URL,
 		Method: "POST",
@@ -49,7 +70,7 @@ func TestSend_DefaultMethod(t *testing.T) {
 	}))
 	defer testServer.Close()
 
-	sender := NewSender(5 * time.Second)
+	sender := newTestSender()
 	req := Request{
 		URL:     testServer.URL,
 		Payload: map[string]interface{}{"test": "data"},
@@ -74,7 +95,7 @@ func TestSend_WithSignature(t *testing.T) {
 	}))
 	defer testServer.Close()
 
-	sender := NewSender(5 * time.Second)
+	sender := newTestSender()
 	req := Request{
 		URL:          testServer.URL,
 		Method:       "POST",
@@ -135,7 +156,7 @@ func TestSend_NoSignatureWithoutSecret(t *testing.T) {
 	}))
 	defer testServer.Close()
 
-	sender := NewSender(5 * time.Second)
+	sender := newTestSender()
 	req := Request{
 		URL:     testServer.URL,
 		Method:  "POST",
@@ -159,7 +180,7 @@ func TestSend_ErrorResponse(t *testing.T) {
 	}))
 	defer testServer.Close()
 
-	sender := NewSender(5 * time.Second)
+	sender := newTestSender()
 	req := Request{
 		URL:     testServer.URL,
 		Method:  "POST",
@@ -179,7 +200,7 @@ func TestSend_ErrorResponse(t *testing.T) {
 }
 
 func TestSend_InvalidURL(t *testing.T) {
-	sender := NewSender(5 * time.Second)
+	sender := newTestSender()
 	req := Request{
 		URL:     "http://invalid-nonexistent-domain.test:99999",
 		Method:  "POST",
@@ -201,7 +222,7 @@ func TestSend_CustomHTTPMethod(t *testing.T) {
 	}))
 	defer testServer.Close()
 
-	sender := NewSender(5 * time.Second)
+	sender := newTestSender()
 	req := Request{
 		URL:     testServer.URL,
 		Method:  "PUT",
@@ -213,3 +234,513 @@ func TestSend_CustomHTTPMethod(t *testing.T) {
 		t.Fatalf("Unexpected error: %v", resp.Error)
 	}
 }
+
+func TestVerifySignature(t *testing.T) {
+	payload := []byte(`{"test":"data"}`)
+	sig := generateSignature(payload, "secret")
+
+	if !VerifySignature(payload, "secret", sig) {
+		t.Error("Expected signature to verify")
+	}
+	if VerifySignature(payload, "other", sig) {
+		t.Error("Expected signature with wrong secret to fail")
+	}
+	if VerifySignature([]byte(`{"test":"tampered"}`), "secret", sig) {
+		t.Error("Expected signature over different payload to fail")
+	}
+}
+
+func TestSend_WithAttachments(t *testing.T) {
+	var payload, file string
+	var fileType, signature string
+	var rawBody []byte
+
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rawBody, _ = io.ReadAll(r.Body)
+		signature = r.Header.Get("X-Webhook-Signature")
+		r.Body = io.NopCloser(bytes.NewReader(rawBody))
+		if err := r.ParseMultipartForm(1 << 20); err != nil {
+			t.Errorf("Expected multipart body: %v", err)
+			return
+		}
+		payload = r.FormValue("payload")
+		f, header, err := r.FormFile("file")
+		if err != nil {
+			t.Errorf("Expected file part: %v", err)
+			return
+		}
+		data, _ := io.ReadAll(f)
+		file = string(data)
+		fileType = header.Header.Get("Content-Type")
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer testServer.Close()
+
+	sender := newTestSender()
+	resp := sender.Send(Request{
+		URL:          testServer.URL,
+		Payload:      map[string]interface{}{"test": "data"},
+		SharedSecret: "secret",
+		Attachments:  []Attachment{{FieldName: "file", Filename: "cat.png", ContentType: "image/png", Data: []byte("png-bytes")}},
+	})
+	if resp.Error != nil {
+		t.Fatalf("Unexpected error: %v", resp.Error)
+	}
+
+	if payload != `{"test":"data"}` {
+		t.Errorf("Expected JSON payload part, got %q", payload)
+	}
+	if file != "png-bytes" || fileType != "image/png" {
+		t.Errorf("Unexpected file part %q (%s)", file, fileType)
+	}
+	if !VerifySignature(rawBody, "secret", signature) {
+		t.Error("Expected signature over the full multipart body")
+	}
+}
+
+func TestSignStandard_SpecVector(t *testing.T) {
+	// Example from the Standard Webhooks specification.
+	sig, err := signStandard("msg_p5jXN8AQM9LWM0D4loKWxJek", 1614265330, []byte(`{"test": 2432232314}`), []string{"whsec_MfKQ9r8GKYqrTwjUPD8ILPZIo2LaLaSw"})
+	if err != nil {
+		t.Fatalf("signStandard failed: %v", err)
+	}
+	if sig != "v1,g0hM9SsE+OTPJTGt/tmIKtSyZlE3uFJELVlNIOLJ1OE=" {
+		t.Errorf("Unexpected signature: %s", sig)
+	}
+}
+
+func TestSend_StandardSignature(t *testing.T) {
+	oldSecret := "whsec_" + base64.StdEncoding.EncodeToString([]byte("old secret"))
+	newSecret := "whsec_" + base64.StdEncoding.EncodeToString([]byte("new secret"))
+	var header http.Header
+	var body []byte
+
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header = r.Header.Clone()
+		body, _ = io.ReadAll(r.Body)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer testServer.Close()
+
+	sender := newTestSender()
+	resp := sender.Send(Request{
+		URL:            testServer.URL,
+		Payload:        map[string]interface{}{"test": "data"},
+		SharedSecret:   "ignored",
+		Signing:        SchemeStandard,
+		SigningSecrets: []string{newSecret, oldSecret},
+		MessageID:      "msg_1",
+	})
+	if resp.Error != nil {
+		t.Fatalf("Unexpected error: %v", resp.Error)
+	}
+
+	if header.Get("webhook-id") != "msg_1" {
+		t.Errorf("Expected webhook-id msg_1, got %q", header.Get("webhook-id"))
+	}
+	if header.Get("X-Webhook-Signature") != "" {
+		t.Error("Expected no legacy signature with standard signing")
+	}
+	if n := len(strings.Fields(header.Get("webhook-signature"))); n != 2 {
+		t.Errorf("Expected one signature per secret, got %d", n)
+	}
+	// A receiver that only knows either secret accepts the request.
+	for _, secret := range []string{oldSecret, newSecret} {
+		if err := VerifyStandard(header, body, []string{secret}, DefaultTolerance, time.Now()); err != nil {
+			t.Errorf("Expected signature to verify, got %v", err)
+		}
+	}
+}
+
+func TestVerifyStandard(t *testing.T) {
+	secret := "whsec_" + base64.StdEncoding.EncodeToString([]byte("secret"))
+	body := []byte(`{"test":"data"}`)
+	now := time.Unix(1700000000, 0)
+	sig, _ := signStandard("msg_1", now.Unix(), body, []string{secret})
+	header := http.Header{}
+	header.Set("webhook-id", "msg_1")
+	header.Set("webhook-timestamp", strconv.FormatInt(now.Unix(), 10))
+	header.Set("webhook-signature", sig)
+
+	if err := VerifyStandard(header, body, []string{secret}, DefaultTolerance, now.Add(time.Minute)); err != nil {
+		t.Errorf("Expected signature to verify, got %v", err)
+	}
+	if err := VerifyStandard(header, body, []string{secret}, DefaultTolerance, now.Add(10*time.Minute)); !errors.Is(err, ErrTimestampOutOfRange) {
+		t.Errorf("Expected ErrTimestampOutOfRange for a replayed request, got %v", err)
+	}
+	if err := VerifyStandard(header, []byte(`{"test":"tampered"}`), []string{secret}, DefaultTolerance, now); !errors.Is(err, ErrInvalidSignature) {
+		t.Errorf("Expected ErrInvalidSignature for a tampered body, got %v", err)
+	}
+
+	// The timestamp is signed, so it cannot be moved forward.
+	header.Set("webhook-timestamp", strconv.FormatInt(now.Add(time.Hour).Unix(), 10))
+	if err := VerifyStandard(header, body, []string{secret}, DefaultTolerance, now.Add(time.Hour)); !errors.Is(err, ErrInvalidSignature) {
+		t.Errorf("Expected ErrInvalidSignature for a changed timestamp, got %v", err)
+	}
+}
+
+func TestSend_StandardSignatureBadSecret(t *testing.T) {
+	sender := newTestSender()
+	resp := sender.Send(Request{
+		URL:            "http://127.0.0.1:1",
+		Payload:        map[string]interface{}{"test": "data"},
+		Signing:        SchemeStandard,
+		SigningSecrets: []string{"whsec_not base64!"},
+	})
+	if resp.Error == nil {
+		t.Error("Expected an error for an invalid secret")
+	}
+}
+
+func TestSend_AsymmetricSigningWithoutKeys(t *testing.T) {
+	sender := newTestSender()
+	for _, scheme := range []string{SchemeHTTPSignature, SchemeJWS} {
+		resp := sender.Send(Request{URL: "http://127.0.0.1:1", Payload: map[string]interface{}{}, Signing: scheme})
+		if resp.Error == nil || !strings.Contains(resp.Error.Error(), "[signing]") {
+			t.Errorf("Expected %s without keys to fail, got %v", scheme, resp.Error)
+		}
+	}
+}
+
+func TestSend_StaticAuth(t *testing.T) {
+	var header http.Header
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header = r.Header.Clone()
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer testServer.Close()
+
+	sender := newTestSender()
+	tests := []struct {
+		auth   config.AuthConfig
+		header string
+		want   string
+	}{
+		{config.AuthConfig{Type: "bearer", Token: "abc"}, "Authorization", "Bearer abc"},
+		{config.AuthConfig{Type: "basic", Username: "user", Password: "pass"}, "Authorization", "Basic dXNlcjpwYXNz"},
+		{config.AuthConfig{Type: "api_key", Header: "X-API-Key", Key: "k"}, "X-API-Key", "k"},
+	}
+	for _, tt := range tests {
+		resp := sender.Send(Request{URL: testServer.URL, Payload: map[string]interface{}{}, Auth: tt.auth})
+		if resp.Error != nil {
+			t.Fatalf("Unexpected error: %v", resp.Error)
+		}
+		if got := header.Get(tt.header); got != tt.want {
+			t.Errorf("%s: expected %s %q, got %q", tt.auth.Type, tt.header, tt.want, got)
+		}
+	}
+
+	resp := sender.Send(Request{URL: testServer.URL, Payload: map[string]interface{}{}, Auth: config.AuthConfig{Type: "digest"}})
+	if resp.Error == nil {
+		t.Error("Expected an unknown auth type to fail")
+	}
+}
+
+func TestSend_OAuth2ClientCredentials(t *testing.T) {
+	tokenRequests := 0
+	tokenServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tokenRequests++
+		if id, secret, ok := r.BasicAuth(); !ok || id != "client" || secret != "s3cret" {
+			t.Errorf("Expected client credentials in basic auth, got %q/%q", id, secret)
+		}
+		if r.FormValue("grant_type") != "client_credentials" || r.FormValue("scope") != "hooks:write hooks:read" {
+			t.Errorf("Unexpected token request: %v", r.Form)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"access_token": "token-%d", "token_type": "Bearer", "expires_in": 120}`, tokenRequests)
+	}))
+	defer tokenServer.Close()
+
+	var authorization string
+	status := http.StatusOK
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorization = r.Header.Get("Authorization")
+		w.WriteHeader(status)
+	}))
+	defer testServer.Close()
+
+	now := time.Unix(1700000000, 0)
+	sender := newTestSender()
+	sender.now = func() time.Time { return now }
+	req := Request{
+		URL:     testServer.URL,
+		Payload: map[string]interface{}{},
+		Auth: config.AuthConfig{
+			Type:         "oauth2",
+			TokenURL:     tokenServer.URL,
+			ClientID:     "client",
+			ClientSecret: "s3cret",
+			Scopes:       []string{"hooks:write", "hooks:read"},
+		},
+	}
+
+	sender.Send(req)
+	sender.Send(req)
+	if tokenRequests != 1 || authorization != "Bearer token-1" {
+		t.Errorf("Expected the token to be cached, got %d token requests and %q", tokenRequests, authorization)
+	}
+
+	// Within a minute of expiry the token is refreshed before use.
+	now = now.Add(70 * time.Second)
+	sender.Send(req)
+	if tokenRequests != 2 || authorization != "Bearer token-2" {
+		t.Errorf("Expected the token to be refreshed, got %d token requests and %q", tokenRequests, authorization)
+	}
+
+	// A rejected token is dropped so the next request fetches a new one.
+	status = http.StatusUnauthorized
+	sender.Send(req)
+	status = http.StatusOK
+	sender.Send(req)
+	if tokenRequests != 3 || authorization != "Bearer token-3" {
+		t.Errorf("Expected a new token after a 401, got %d token requests and %q", tokenRequests, authorization)
+	}
+}
+
+func TestSend_OAuth2ConcurrentTokenFetch(t *testing.T) {
+	var requests sync.Map // token requests by client ID
+	fetching := make(chan struct{}, 1)
+	release := make(chan struct{})
+	tokenServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, _, _ := r.BasicAuth()
+		n, _ := requests.LoadOrStore(id, new(atomic.Int32))
+		n.(*atomic.Int32).Add(1)
+		if id == "slow" {
+			fetching <- struct{}{}
+			<-release
+		}
+		fmt.Fprintf(w, `{"access_token": "token-%s"}`, id)
+	}))
+	defer tokenServer.Close()
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer testServer.Close()
+
+	sender := newTestSender()
+	request := func(client string) Request {
+		return Request{
+			URL:     testServer.URL,
+			Payload: map[string]interface{}{},
+			Auth:    config.AuthConfig{Type: "oauth2", TokenURL: tokenServer.URL, ClientID: client},
+		}
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if resp := sender.Send(request("slow")); resp.Error != nil {
+				t.Errorf("Expected the delivery to succeed, got %v", resp.Error)
+			}
+		}()
+	}
+	<-fetching
+
+	// Another token is fetched while the first is still being fetched...
+	if resp := sender.Send(request("fast")); resp.Error != nil {
+		t.Errorf("Expected a different token not to wait, got %v", resp.Error)
+	}
+	// ...and a delivery waiting for the first one gives up with its context.
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if resp := sender.SendContext(ctx, request("slow")); !errors.Is(resp.Error, context.DeadlineExceeded) {
+		t.Errorf("Expected the wait for the token to be cancelled, got %v", resp.Error)
+	}
+
+	close(release)
+	wg.Wait()
+	if n, _ := requests.Load("slow"); n.(*atomic.Int32).Load() != 1 {
+		t.Errorf("Expected one token request for concurrent deliveries, got %d", n.(*atomic.Int32).Load())
+	}
+}
+
+func TestSend_OAuth2TokenError(t *testing.T) {
+	tokenServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte(`{"error": "invalid_client"}`))
+	}))
+	defer tokenServer.Close()
+
+	receiverCalled := false
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		receiverCalled = true
+	}))
+	defer testServer.Close()
+
+	sender := newTestSender()
+	resp := sender.Send(Request{
+		URL:     testServer.URL,
+		Payload: map[string]interface{}{},
+		Auth:    config.AuthConfig{Type: "oauth2", TokenURL: tokenServer.URL, ClientID: "client"},
+	})
+	if resp.Error == nil || !strings.Contains(resp.Error.Error(), "invalid_client") {
+		t.Errorf("Expected the token error to be reported, got %v", resp.Error)
+	}
+	if receiverCalled {
+		t.Error("Expected no request without a token")
+	}
+}
+
+func TestSend_EgressPolicyBlocksInternalAddresses(t *testing.T) {
+	called := false
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+	}))
+	defer testServer.Close()
+	port := testServer.Listener.Addr().(*net.TCPAddr).Port
+
+	sender := NewSender(5 * time.Second)
+	for _, url := range []string{
+		testServer.URL,
+		fmt.Sprintf("http://localhost:%d/", port), // checked after DNS resolution
+		fmt.Sprintf("http://[::ffff:127.0.0.1]:%d/", port),
+		"http://169.254.169.254/latest/meta-data/",
+		"http://10.0.0.1/",
+	} {
+		resp := sender.Send(Request{URL: url, Payload: map[string]interface{}{}})
+		if !errors.Is(resp.Error, ErrBlockedDestination) {
+			t.Errorf("Expected %s to be blocked, got %v", url, resp.Error)
+		}
+	}
+	if called {
+		t.Error("Expected no request to reach the loopback server")
+	}
+
+	sender.SetEgressPolicy(NewEgressPolicy(config.EgressConfig{AllowHosts: []string{"localhost"}}))
+	if resp := sender.Send(Request{URL: fmt.Sprintf("http://localhost:%d/", port), Payload: map[string]interface{}{}}); resp.Error != nil || !called {
+		t.Errorf("Expected an allowed host to be reached, got %v", resp.Error)
+	}
+	if resp := sender.Send(Request{URL: testServer.URL, Payload: map[string]interface{}{}}); !errors.Is(resp.Error, ErrBlockedDestination) {
+		t.Errorf("Expected the host allowlist not to allow the bare address, got %v", resp.Error)
+	}
+}
+
+func TestSend_EgressPolicyRechecksRedirects(t *testing.T) {
+	internalCalled := false
+	internal := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		internalCalled = true
+	}))
+	defer internal.Close()
+	internalPort := internal.Listener.Addr().(*net.TCPAddr).Port
+
+	hops := 0
+	redirector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hops++
+		switch r.URL.Path {
+		case "/internal":
+			// 127.0.0.2 is loopback too, but outside the allowlist below.
+			http.Redirect(w, r, fmt.Sprintf("http://127.0.0.2:%d/", internalPort), http.StatusFound)
+		case "/loop":
+			http.Redirect(w, r, "/loop", http.StatusFound)
+		default:
+			w.WriteHeader(http.StatusOK)
+		}
+	}))
+	defer redirector.Close()
+
+	sender := NewSender(5 * time.Second)
+	sender.SetEgressPolicy(NewEgressPolicy(config.EgressConfig{AllowCIDRs: []string{"127.0.0.1/32"}, MaxRedirects: 2}))
+
+	if resp := sender.Send(Request{URL: redirector.URL + "/internal", Payload: map[string]interface{}{}}); !errors.Is(resp.Error, ErrBlockedDestination) {
+		t.Errorf("Expected the redirect hop to be blocked, got %v", resp.Error)
+	}
+	if internalCalled {
+		t.Error("Expected the redirect target not to be reached")
+	}
+
+	hops = 0
+	if resp := sender.Send(Request{URL: redirector.URL + "/loop", Payload: map[string]interface{}{}}); resp.Error == nil || hops != 3 {
+		t.Errorf("Expected to stop after 2 redirects, got %d requests and %v", hops, resp.Error)
+	}
+}
+
+func TestSend_EgressProxy(t *testing.T) {
+	var proxied []string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// A forward proxy receives the absolute URL of the target
+		proxied = append(proxied, r.URL.String())
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer proxy.Close()
+
+	sender := NewSender(5 * time.Second)
+	sender.SetEgressPolicy(NewEgressPolicy(config.EgressConfig{Proxy: proxy.URL}))
+	if resp := sender.Send(Request{URL: "http://203.0.113.5/hook", Payload: map[string]interface{}{}}); !errors.Is(resp.Error, ErrBlockedDestination) {
+		t.Errorf("Expected a proxy on a blocked address to be refused, got %v", resp.Error)
+	}
+
+	// The proxy's address must be allowed like any other
+	sender.SetEgressPolicy(NewEgressPolicy(config.EgressConfig{Proxy: proxy.URL, AllowCIDRs: []string{"127.0.0.1/32"}}))
+	if resp := sender.Send(Request{URL: "http://203.0.113.5/hook", Payload: map[string]interface{}{}}); resp.Error != nil {
+		t.Fatalf("Expected the request to go through the proxy, got %v", resp.Error)
+	}
+	if len(proxied) != 1 || proxied[0] != "http://203.0.113.5/hook" {
+		t.Errorf("Expected the proxy to receive the webhook, got %v", proxied)
+	}
+
+	// Targets are still checked before they are handed to the proxy
+	if resp := sender.Send(Request{URL: "http://10.0.0.1/hook", Payload: map[string]interface{}{}}); !errors.Is(resp.Error, ErrBlockedDestination) {
+		t.Errorf("Expected an internal target to be blocked behind the proxy, got %v", resp.Error)
+	}
+	if len(proxied) != 1 {
+		t.Errorf("Expected the blocked target not to reach the proxy, got %v", proxied)
+	}
+
+	if _, err := ParseProxy("socks5://proxy.example.org:1080"); err == nil {
+		t.Error("Expected an error for a proxy that is not http or https")
+	}
+}
+
+func TestEgressPolicy_AddrAllowed(t *testing.T) {
+	policy := NewEgressPolicy(config.EgressConfig{AllowCIDRs: []string{"10.1.0.0/16", "not a cidr"}, AllowHosts: []string{"*.svc.cluster.local"}})
+	tests := []struct {
+		addr    string
+		allowed bool
+	}{
+		{"93.184.216.34", true},
+		{"2606:2800:220:1::1", true},
+		{"10.1.2.3", true},
+		{"10.2.0.1", false},
+		{"192.168.1.1", false},
+		{"100.100.100.200", false},
+		{"fd00:ec2::254", false},
+		{"::ffff:169.254.169.254", false},
+		{"::1", false},
+	}
+	for _, tt := range tests {
+		if got := policy.addrAllowed(netip.MustParseAddr(tt.addr)); got != tt.allowed {
+			t.Errorf("addrAllowed(%s) = %v, expected %v", tt.addr, got, tt.allowed)
+		}
+	}
+	if !policy.hostAllowed("hooks.team.svc.cluster.local") || policy.hostAllowed("svc.cluster.local.evil.com") {
+		t.Error("Unexpected host allowlist matching")
+	}
+}
+
+func TestSend_Load(t *testing.T) {
+	release := make(chan struct{})
+	received := make(chan struct{}, 2)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- struct{}{}
+		<-release
+	}))
+	defer server.Close()
+
+	sender := newTestSender()
+	done := make(chan struct{})
+	go func() {
+		sender.Send(Request{Route: "slow", URL: server.URL, Attempt: 2})
+		close(done)
+	}()
+	<-received
+	if load := sender.Load("slow"); load.InFlight != 1 || load.Retries != 1 {
+		t.Errorf("Expected one retry in flight, got %+v", load)
+	}
+	close(release)
+	<-done
+
+	sender.Send(Request{Route: "slow", URL: server.URL})
+	if load := sender.Load("slow"); load.InFlight != 0 || load.Retries != 1 {
+		t.Errorf("Expected nothing in flight and the first attempt not counted as a retry, got %+v", load)
+	}
+}